@@ -58,6 +58,12 @@ module.exports = {
                 },
                 {
                     path: 'release-artifacts/flowfuse-device-installer-darwin-arm64'
+                },
+                {
+                    path: 'release-artifacts/installer-manifest.json'
+                },
+                {
+                    path: 'release-artifacts/installer-manifest.json.sig'
                 }
             ]
         }]
@@ -0,0 +1,408 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/credentials"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
+	"github.com/flowfuse/device-agent-installer/pkg/service"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+)
+
+// legacyServiceName is the service name of installations that predate
+// per-port services, including the hand-written units of the manual
+// installation instructions.
+const legacyServiceName = "flowfuse-device-agent"
+
+// legacyDefaultPort is the port the Device Agent listens on without --port.
+const legacyDefaultPort = 1880
+
+// Patterns picking the settings of a legacy installation out of its service
+// definition, a systemd unit or an init script
+var (
+	legacyDirRE  = regexp.MustCompile(`(?:--dir[= ]|-d )["']?([^\s"']+)`)
+	legacyPortRE = regexp.MustCompile(`(?:--port[= ]|-p )["']?(\d+)`)
+	legacyUserRE = regexp.MustCompile(`(?m)^\s*(?:User|USER|command_user)=["']?([^\s"']+)`)
+	legacyCARE   = regexp.MustCompile(`NODE_EXTRA_CA_CERTS=[\\"']*([^\s"'\\]+)`)
+)
+
+// legacyInstallation describes a Device Agent that was not installed by this
+// installer.
+type legacyInstallation struct {
+	// ServiceInstalled is set if the legacy service exists
+	ServiceInstalled bool
+	// Dir is the Device Agent directory holding device.yml and the project data
+	Dir string
+	// User is the account the service runs as, empty if not set
+	User string
+	// Port is the port the Device Agent listens on
+	Port int
+	// CACertPath is the CA bundle passed in NODE_EXTRA_CA_CERTS, if any
+	CACertPath string
+	// AgentVersion is the installed Device Agent version, empty if unknown
+	AgentVersion string
+}
+
+// Adopt moves a Device Agent that was installed without this installer, e.g.
+// with a global npm install and a hand-written service, under the installer's
+// management, so that it can be updated with --update-agent and --update-nodejs.
+// It performs the following steps:
+// 1. Detects the legacy installation from its service definition and device.yml
+// 2. Copies the Device Agent directory to the working directory if they differ
+// 3. Installs Node.js and the Device Agent (the installed version unless one is given) into the working directory
+// 4. Replaces the legacy service with an installer-managed one, restarting the
+// legacy service if the new one does not start (an adoption in place gives the
+// directory back to its original owner first)
+// 5. Saves the installer configuration
+//
+// device.yml and the project data are kept; the global npm package and a
+// copied Device Agent directory are left in place.
+//
+// Parameters:
+//   - nodeVersion: The version of Node.js to install
+//   - agentVersion: The Device Agent version to install; empty for the installed version
+//   - customWorkDir: Optional custom working directory path. If empty, uses default path.
+//   - port: The port the Device Agent listens on; 0 for the port of the legacy installation
+//   - caCertPaths: CA bundle files (PEM); empty to keep the bundle of the legacy service
+//   - keepAccount: Whether to keep running as the account of the legacy service, unless it is root
+//
+// Returns:
+//   - error: An error if no legacy installation is found or a step fails
+func Adopt(nodeVersion, agentVersion, customWorkDir string, port int, caCertPaths []string, keepAccount bool) error {
+	logger.LogFunctionEntry("Adopt", map[string]interface{}{
+		"nodeVersion":   nodeVersion,
+		"agentVersion":  agentVersion,
+		"customWorkDir": customWorkDir,
+		"port":          port,
+		"caCertPaths":   caCertPaths,
+		"keepAccount":   keepAccount,
+	})
+
+	if runtime.GOOS != "linux" {
+		err := fmt.Errorf("adopting an installation is only supported on Linux")
+		logger.Error("%v", err)
+		logger.LogFunctionExit("Adopt", nil, err)
+		return err
+	}
+	if err := utils.CheckPermissions(); err != nil {
+		logger.LogFunctionExit("Adopt", nil, err)
+		return fmt.Errorf("permission check failed: %w", err)
+	}
+
+	workDir, err := utils.GetWorkingDirectory(customWorkDir)
+	if err != nil {
+		logger.Error("Failed to get working directory: %v", err)
+		logger.LogFunctionExit("Adopt", nil, err)
+		return fmt.Errorf("failed to get working directory: %w", err)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "installer.conf")); err == nil {
+		err := fmt.Errorf("the installation in %s is already managed by the installer", workDir)
+		logger.Error("%v", err)
+		logger.LogFunctionExit("Adopt", nil, err)
+		return err
+	}
+
+	legacy, err := detectLegacyInstallation(workDir)
+	if err != nil {
+		logger.Error("%v", err)
+		logger.LogFunctionExit("Adopt", nil, err)
+		return err
+	}
+	if port == 0 {
+		port = legacy.Port
+	}
+	if agentVersion == "" {
+		agentVersion = legacy.AgentVersion
+	}
+	if agentVersion == "" {
+		agentVersion = "latest"
+	}
+	if len(caCertPaths) == 0 && legacy.CACertPath != "" {
+		caCertPaths = []string{legacy.CACertPath}
+	}
+	if keepAccount && legacy.User != "" && legacy.User != "root" {
+		utils.ServiceUsername = legacy.User
+		utils.UseExistingAccount = true
+	}
+	if err := credentials.Validate(credentials.Encryption, service.IsSystemd()); err != nil {
+		logger.Error("%v", err)
+		logger.LogFunctionExit("Adopt", nil, err)
+		return err
+	}
+	serviceName := fmt.Sprintf("flowfuse-device-agent-%d", port)
+	if service.IsInstalled(serviceName) {
+		err := fmt.Errorf("service %s already exists, choose another port with --port", serviceName)
+		logger.Error("%v", err)
+		logger.LogFunctionExit("Adopt", nil, err)
+		return err
+	}
+
+	logger.Info("Found a FlowFuse Device Agent installed without the installer:")
+	if legacy.ServiceInstalled {
+		logger.Info("  Service:           %s", legacyServiceName)
+	}
+	logger.Info("  Directory:         %s", legacy.Dir)
+	logger.Info("  Port:              %d", legacy.Port)
+	if legacy.AgentVersion != "" {
+		logger.Info("  Device Agent:      %s", legacy.AgentVersion)
+	}
+	logger.Info("It will be moved to %s, run by service %s as %s, with Device Agent %s and Node.js %s.", workDir, serviceName, utils.ServiceUsername, agentVersion, nodeVersion)
+	logger.Info("device.yml and the project data are kept.\n")
+	if !utils.PromptYesNo("Do you want to adopt this installation?", false) {
+		logger.Info("Adoption cancelled by user")
+		logger.LogFunctionExit("Adopt", "cancelled", nil)
+		return nil
+	}
+
+	// Adopting in place hands the legacy files to the service account; their
+	// owner gets them back if the legacy service has to be started again
+	originalOwner := ""
+	if legacy.Dir == workDir {
+		output, err := exec.Command("stat", "-c", "%u:%g", workDir).Output()
+		if err != nil {
+			logger.Error("Failed to read the owner of %s: %v", workDir, err)
+			logger.LogFunctionExit("Adopt", nil, err)
+			return fmt.Errorf("failed to read the owner of %s: %w", workDir, err)
+		}
+		originalOwner = strings.TrimSpace(string(output))
+	}
+
+	if legacy.ServiceInstalled {
+		logger.Info("Stopping service %s...", legacyServiceName)
+		if err := service.Stop(legacyServiceName); err != nil {
+			logger.Error("Service stop failed: %v", err)
+			logger.LogFunctionExit("Adopt", nil, err)
+			return fmt.Errorf("service stop failed: %w", err)
+		}
+	}
+	// Until the new service runs, a failure leaves the legacy service running
+	restartLegacy := func() {
+		if originalOwner != "" {
+			if output, err := exec.Command("sudo", "chown", "-R", originalOwner, workDir).CombinedOutput(); err != nil {
+				logger.Error("Failed to restore the ownership of %s: %v\nOutput: %s", workDir, err, output)
+			}
+		}
+		if legacy.ServiceInstalled {
+			if err := service.Start(legacyServiceName); err != nil {
+				logger.Error("Failed to restart service %s: %v", legacyServiceName, err)
+			}
+		}
+	}
+	fail := func(err error) error {
+		restartLegacy()
+		logger.LogFunctionExit("Adopt", nil, err)
+		return err
+	}
+
+	// Creates the service user as well
+	if _, err := utils.CreateWorkingDirectory(workDir); err != nil {
+		logger.Error("Failed to create working directory: %v", err)
+		return fail(fmt.Errorf("failed to create working directory: %w", err))
+	}
+	if err := utils.ReconcileServiceGroups(utils.ServiceUsername, nil); err != nil {
+		logger.Error("Failed to update service account groups: %v", err)
+		return fail(fmt.Errorf("failed to update service account groups: %w", err))
+	}
+	if legacy.Dir != workDir {
+		logger.Info("Copying %s to %s...", legacy.Dir, workDir)
+		if output, err := exec.Command("sudo", "cp", "-a", legacy.Dir+"/.", workDir).CombinedOutput(); err != nil {
+			return fail(fmt.Errorf("failed to copy %s: %w\nOutput: %s", legacy.Dir, err, output))
+		}
+	}
+	if output, err := exec.Command("sudo", "chown", "-R", utils.ServiceOwner(), workDir).CombinedOutput(); err != nil {
+		return fail(fmt.Errorf("failed to set ownership of %s: %w\nOutput: %s", workDir, err, output))
+	}
+
+	caCertDest, err := utils.InstallCACertificate(caCertPaths, workDir)
+	if err != nil {
+		logger.Error("Failed to install CA certificate: %v", err)
+		return fail(fmt.Errorf("failed to install CA certificate: %w", err))
+	}
+	if caCertDest != "" {
+		os.Setenv("NODE_EXTRA_CA_CERTS", caCertDest)
+	}
+
+	nodeVersion, err = nodejs.CheckDeviceAgentCompatibility(agentVersion, nodeVersion, nodejs.AutoSelectVersion)
+	if err != nil {
+		return fail(fmt.Errorf("compatibility check failed: %w", err))
+	}
+	if err := nodejs.CheckNodeRelease(nodeVersion); err != nil {
+		return fail(fmt.Errorf("node.js release check failed: %w", err))
+	}
+	logger.Info("Installing Node.js %s and the Device Agent into %s...", nodeVersion, workDir)
+	if err := nodejs.EnsureNodeJs(nodeVersion, workDir, false); err != nil {
+		logger.Error("Node.js setup failed: %v", err)
+		return fail(fmt.Errorf("node.js setup failed: %w", err))
+	}
+	if err := nodejs.InstallDeviceAgent(agentVersion, workDir, false); err != nil {
+		logger.Error("Device Agent package installation failed: %v", err)
+		return fail(fmt.Errorf("device agent installation failed: %w", err))
+	}
+	if err := nodejs.InstallExtraPackages(nodejs.ExtraPackages, workDir); err != nil {
+		logger.Error("Extra package installation failed: %v", err)
+		return fail(fmt.Errorf("extra package installation failed: %w", err))
+	}
+	if agentVersion == "latest" {
+		if agentVersion, err = nodejs.GetLatestDeviceAgentVersion(workDir); err != nil {
+			return fail(fmt.Errorf("failed to get latest device agent version: %w", err))
+		}
+	}
+
+	logger.Info("Replacing service %s with %s...", legacyServiceName, serviceName)
+	if err := service.Install(serviceName, workDir, port, caCertDest); err != nil {
+		logger.Error("Service setup failed: %v", err)
+		return fail(fmt.Errorf("service setup failed: %w", err))
+	}
+	if err := credentials.Protect(workDir, serviceName); err != nil {
+		logger.Error("Securing the device credentials failed: %v", err)
+		service.Uninstall(serviceName)
+		return fail(fmt.Errorf("securing the device credentials failed: %w", err))
+	}
+	if err := service.Start(serviceName); err != nil {
+		logger.Error("Service start failed: %v", err)
+		if rmErr := service.Uninstall(serviceName); rmErr != nil {
+			logger.Error("Failed to remove service %s: %v", serviceName, rmErr)
+		}
+		return fail(fmt.Errorf("service start failed, %s was restarted: %w", legacyServiceName, err))
+	}
+	if legacy.ServiceInstalled {
+		if err := service.Uninstall(legacyServiceName); err != nil {
+			logger.Error("Failed to remove service %s: %v", legacyServiceName, err)
+		}
+	}
+
+	cfg := &config.InstallerConfig{
+		ServiceUsername:      utils.ServiceUsername,
+		ServiceUID:           utils.ServiceUID,
+		ServiceGID:           utils.ServiceGID,
+		ServiceHome:          utils.ServiceHome,
+		ServiceGroups:        utils.ServiceGroups,
+		ExistingAccount:      utils.UseExistingAccount,
+		ServiceName:          serviceName,
+		NodeVersion:          nodeVersion,
+		AgentVersion:         agentVersion,
+		Port:                 port,
+		NodeExtraCACerts:     caCertDest,
+		CacheDir:             cache.Dir,
+		NpmRegistry:          nodejs.Registry,
+		ExtraPackages:        nodejs.ExtraPackages,
+		CredentialEncryption: credentials.Encryption,
+		AgentArgs:            service.AgentArgs,
+		Environment:          service.Environment,
+	}
+	if err := config.SaveConfig(cfg, workDir); err != nil {
+		logger.Error("Could not save configuration: %v", err)
+		logger.LogFunctionExit("Adopt", nil, err)
+		return fmt.Errorf("could not save configuration: %w", err)
+	}
+
+	logger.Info("The Device Agent in %s is now managed by the installer as service %s.", workDir, serviceName)
+	if legacy.Dir != workDir {
+		logger.Info("The original files in %s were kept; remove them once the Device Agent runs as expected.", legacy.Dir)
+	}
+	if globalAgentPackage() != "" {
+		logger.Info("The global npm package is no longer used; remove it with: sudo npm uninstall -g @flowfuse/device-agent")
+	}
+	logger.LogFunctionExit("Adopt", "success", nil)
+	return nil
+}
+
+// detectLegacyInstallation finds a Device Agent that runs as the legacy
+// service, or whose device.yml is in the working directory.
+//
+// Parameters:
+//   - workDir: The working directory the installation is adopted into
+//
+// Returns:
+//   - *legacyInstallation: The detected installation
+//   - error: An error if there is no device.yml to adopt
+func detectLegacyInstallation(workDir string) (*legacyInstallation, error) {
+	legacy := &legacyInstallation{Dir: workDir, Port: legacyDefaultPort}
+
+	if service.IsInstalled(legacyServiceName) {
+		legacy.ServiceInstalled = true
+		files, err := service.ExportDefinition(legacyServiceName, workDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the definition of service %s: %w", legacyServiceName, err)
+		}
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var definition strings.Builder
+		for _, name := range names {
+			definition.Write(files[name])
+		}
+		parseLegacyDefinition(definition.String(), legacy)
+	}
+
+	if _, err := os.Stat(filepath.Join(legacy.Dir, "device.yml")); err != nil {
+		return nil, fmt.Errorf("no Device Agent installation found: %s has no device.yml", legacy.Dir)
+	}
+
+	// An agent installed by an early installer lives in the directory; a
+	// manual installation used a global npm install
+	for _, packageFile := range []string{
+		filepath.Join(legacy.Dir, nodejs.NodeDir, "lib", "node_modules", "@flowfuse", "device-agent", "package.json"),
+		globalAgentPackage(),
+	} {
+		if packageFile == "" {
+			continue
+		}
+		var pkg struct {
+			Version string `json:"version"`
+		}
+		if data, err := os.ReadFile(packageFile); err == nil && json.Unmarshal(data, &pkg) == nil && pkg.Version != "" {
+			legacy.AgentVersion = pkg.Version
+			break
+		}
+	}
+	logger.Debug("Legacy installation: %+v", legacy)
+	return legacy, nil
+}
+
+// parseLegacyDefinition reads the Device Agent directory, port, account and
+// CA bundle from a service definition into legacy.
+func parseLegacyDefinition(definition string, legacy *legacyInstallation) {
+	if m := legacyDirRE.FindStringSubmatch(definition); m != nil {
+		legacy.Dir = m[1]
+	}
+	if m := legacyPortRE.FindStringSubmatch(definition); m != nil {
+		if port, err := strconv.Atoi(m[1]); err == nil {
+			legacy.Port = port
+		}
+	}
+	if m := legacyUserRE.FindStringSubmatch(definition); m != nil {
+		legacy.User = m[1]
+	}
+	if m := legacyCARE.FindStringSubmatch(definition); m != nil {
+		legacy.CACertPath = m[1]
+	}
+}
+
+// globalAgentPackage returns the package.json of a Device Agent installed
+// with "npm install -g" using the system's npm, or "" if there is none.
+func globalAgentPackage() string {
+	output, err := exec.Command("npm", "root", "-g").Output()
+	if err != nil {
+		return ""
+	}
+	packageFile := filepath.Join(strings.TrimSpace(string(output)), "@flowfuse", "device-agent", "package.json")
+	if _, err := os.Stat(packageFile); err != nil {
+		return ""
+	}
+	return packageFile
+}
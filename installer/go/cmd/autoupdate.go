@@ -0,0 +1,339 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/autoupdate"
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/credentials"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
+	"github.com/flowfuse/device-agent-installer/pkg/service"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+	"github.com/flowfuse/device-agent-installer/pkg/validate"
+)
+
+const (
+	// healthCheckPeriod is how long the service has to keep running after a
+	// scheduled update for the update to be kept
+	healthCheckPeriod = 60 * time.Second
+	// healthCheckInterval is how often the service is checked in that period
+	healthCheckInterval = 5 * time.Second
+)
+
+// EnableAutoUpdate schedules daily Device Agent updates for an installation.
+// It performs the following steps:
+// 1. Validates the policy; the pinned channel defaults to the installed version
+// 2. Copies the running installer to a root-owned location (see autoupdate.InstallerPath)
+// 3. Installs a job starting "--run-auto-update" at the beginning of the maintenance window
+// 4. Records the policy in the installer configuration
+//
+// Parameters:
+//   - customWorkDir: Optional custom working directory path. If empty, uses default path.
+//   - policy: The update policy
+//
+// Returns:
+//   - error: An error if no installation is found, the policy is invalid or the job cannot be installed
+func EnableAutoUpdate(customWorkDir string, policy config.AutoUpdatePolicy) error {
+	logger.LogFunctionEntry("EnableAutoUpdate", map[string]interface{}{
+		"customWorkDir": customWorkDir,
+		"channel":       policy.Channel,
+		"version":       policy.Version,
+		"window":        policy.Window,
+		"jitterMinutes": policy.JitterMinutes,
+	})
+
+	workDir, cfg, serviceName, err := loadAutoUpdateInstallation(customWorkDir)
+	if err != nil {
+		logger.LogFunctionExit("EnableAutoUpdate", nil, err)
+		return err
+	}
+	if !service.IsInstalled(serviceName) {
+		err := fmt.Errorf("FlowFuse Device Agent is not installed on this system")
+		logger.LogFunctionExit("EnableAutoUpdate", nil, err)
+		return err
+	}
+
+	if policy.Channel == config.AutoUpdateChannelPinned && (policy.Version == "" || policy.Version == "latest") {
+		policy.Version = cfg.AgentVersion
+	}
+	if err := autoupdate.ValidatePolicy(&policy); err != nil {
+		logger.LogFunctionExit("EnableAutoUpdate", nil, err)
+		return err
+	}
+	window, _ := autoupdate.ParseWindow(policy.Window)
+	policy.Window = window.String()
+
+	if err := utils.CheckPermissions(); err != nil {
+		logger.LogFunctionExit("EnableAutoUpdate", nil, err)
+		return fmt.Errorf("permission check failed: %w", err)
+	}
+
+	installerPath, err := autoupdate.InstallInstaller()
+	if err != nil {
+		logger.Error("Failed to install the installer for scheduled updates: %v", err)
+		logger.LogFunctionExit("EnableAutoUpdate", nil, err)
+		return err
+	}
+
+	hour, minute := window.StartClock()
+	job := service.UpdateJob{
+		ServiceName: serviceName,
+		Args:        []string{installerPath, "--run-auto-update", "--dir", workDir, "--no-update-check"},
+		Hour:        hour,
+		Minute:      minute,
+	}
+	logger.Info("Scheduling automatic updates of the FlowFuse Device Agent...")
+	if err := service.InstallUpdateJob(job); err != nil {
+		logger.Error("Failed to schedule automatic updates: %v", err)
+		logger.LogFunctionExit("EnableAutoUpdate", nil, err)
+		return fmt.Errorf("failed to schedule automatic updates: %w", err)
+	}
+
+	cfg.AutoUpdate = &policy
+	if err := config.SaveConfig(cfg, workDir); err != nil {
+		logger.Error("Failed to save configuration: %v", err)
+		logger.LogFunctionExit("EnableAutoUpdate", nil, err)
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+
+	logger.Info("Automatic updates enabled: %s", describeAutoUpdatePolicy(&policy))
+	logger.LogFunctionExit("EnableAutoUpdate", "success", nil)
+	return nil
+}
+
+// DisableAutoUpdate removes the scheduled update job of an installation and
+// its policy. The result of the last scheduled update is kept.
+//
+// Parameters:
+//   - customWorkDir: Optional custom working directory path. If empty, uses default path.
+//
+// Returns:
+//   - error: An error if no installation is found or the job cannot be removed
+func DisableAutoUpdate(customWorkDir string) error {
+	logger.LogFunctionEntry("DisableAutoUpdate", map[string]interface{}{
+		"customWorkDir": customWorkDir,
+	})
+
+	workDir, cfg, serviceName, err := loadAutoUpdateInstallation(customWorkDir)
+	if err != nil {
+		logger.LogFunctionExit("DisableAutoUpdate", nil, err)
+		return err
+	}
+	if err := utils.CheckPermissions(); err != nil {
+		logger.LogFunctionExit("DisableAutoUpdate", nil, err)
+		return fmt.Errorf("permission check failed: %w", err)
+	}
+
+	if err := service.UninstallUpdateJob(serviceName); err != nil {
+		logger.Error("Failed to remove the scheduled update job: %v", err)
+		logger.LogFunctionExit("DisableAutoUpdate", nil, err)
+		return fmt.Errorf("failed to remove the scheduled update job: %w", err)
+	}
+
+	cfg.AutoUpdate = nil
+	if err := config.SaveConfig(cfg, workDir); err != nil {
+		logger.Error("Failed to save configuration: %v", err)
+		logger.LogFunctionExit("DisableAutoUpdate", nil, err)
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+
+	logger.Info("Automatic updates disabled")
+	logger.LogFunctionExit("DisableAutoUpdate", "success", nil)
+	return nil
+}
+
+// RunAutoUpdate is run by the scheduled job. It updates the Device Agent
+// according to the recorded policy and records the outcome.
+// It performs the following steps:
+// 1. Skips the run if it started outside the maintenance window
+// 2. Waits a random delay (see autoupdate.Jitter)
+// 3. Selects the version from the channel and updates with the --update-agent flow
+// 4. Checks that the service keeps running, and otherwise reinstalls the previous version
+//
+// Parameters:
+//   - customWorkDir: Optional custom working directory path. If empty, uses default path.
+//
+// Returns:
+//   - error: An error if automatic updates are not enabled, or the update failed or was rolled back
+func RunAutoUpdate(customWorkDir string) error {
+	logger.LogFunctionEntry("RunAutoUpdate", map[string]interface{}{
+		"customWorkDir": customWorkDir,
+	})
+
+	workDir, cfg, serviceName, err := loadAutoUpdateInstallation(customWorkDir)
+	if err != nil {
+		logger.LogFunctionExit("RunAutoUpdate", nil, err)
+		return err
+	}
+	policy := cfg.AutoUpdate
+	if policy == nil {
+		err := fmt.Errorf("automatic updates are not enabled for %s, use --enable-auto-update", workDir)
+		logger.LogFunctionExit("RunAutoUpdate", nil, err)
+		return err
+	}
+	window, err := autoupdate.ParseWindow(policy.Window)
+	if err != nil {
+		logger.LogFunctionExit("RunAutoUpdate", nil, err)
+		return err
+	}
+	if cfg.ServiceUsername != "" {
+		utils.ServiceUsername = cfg.ServiceUsername
+	}
+	applyServiceAccountConfig(cfg)
+	credentials.Encryption = cfg.CredentialEncryption
+
+	remaining := window.Remaining(time.Now())
+	if remaining == 0 {
+		logger.Info("Outside the maintenance window %s, skipping the update", window)
+		recordAutoUpdate(workDir, config.AutoUpdateResult{
+			Result:  config.AutoUpdateSkipped,
+			Message: fmt.Sprintf("started outside the maintenance window %s", window),
+		})
+		logger.LogFunctionExit("RunAutoUpdate", "skipped", nil)
+		return nil
+	}
+	if delay := autoupdate.Jitter(policy, remaining); delay > 0 {
+		logger.Info("Waiting %s before updating...", delay.Round(time.Second))
+		time.Sleep(delay)
+	}
+
+	previous := cfg.AgentVersion
+	target, err := nodejs.ResolveDeviceAgentVersion(autoupdate.VersionRange(policy, previous))
+	if err != nil {
+		logger.Error("Failed to select the Device Agent version: %v", err)
+		recordAutoUpdate(workDir, config.AutoUpdateResult{
+			Result:      config.AutoUpdateFailed,
+			FromVersion: previous,
+			Message:     err.Error(),
+		})
+		logger.LogFunctionExit("RunAutoUpdate", nil, err)
+		return fmt.Errorf("failed to select the Device Agent version: %w", err)
+	}
+	if target == previous {
+		logger.Info("Device Agent %s is up to date (%s channel)", previous, policy.Channel)
+		recordAutoUpdate(workDir, config.AutoUpdateResult{
+			Result:      config.AutoUpdateUpToDate,
+			FromVersion: previous,
+			ToVersion:   target,
+		})
+		logger.LogFunctionExit("RunAutoUpdate", "up to date", nil)
+		return nil
+	}
+
+	logger.Info("Updating the FlowFuse Device Agent from %s to %s...", previous, target)
+	updateErr := Update(target, cfg.NodeVersion, workDir, true, false)
+	if updateErr == nil {
+		updateErr = checkServiceHealth(serviceName)
+	}
+	if updateErr == nil {
+		recordAutoUpdate(workDir, config.AutoUpdateResult{
+			Result:      config.AutoUpdateUpdated,
+			FromVersion: previous,
+			ToVersion:   target,
+		})
+		logger.LogFunctionExit("RunAutoUpdate", "updated", nil)
+		return nil
+	}
+
+	logger.Error("Update to %s failed: %v", target, updateErr)
+	logger.Info("Rolling back to Device Agent %s...", previous)
+	rollbackErr := Update(previous, cfg.NodeVersion, workDir, true, false)
+	if rollbackErr == nil {
+		rollbackErr = checkServiceHealth(serviceName)
+	}
+	if rollbackErr != nil {
+		logger.Error("Rollback to %s failed: %v", previous, rollbackErr)
+		err := fmt.Errorf("update to %s failed: %v; rollback to %s failed: %w", target, updateErr, previous, rollbackErr)
+		recordAutoUpdate(workDir, config.AutoUpdateResult{
+			Result:      config.AutoUpdateFailed,
+			FromVersion: previous,
+			ToVersion:   target,
+			Message:     err.Error(),
+		})
+		logger.LogFunctionExit("RunAutoUpdate", nil, err)
+		return err
+	}
+
+	recordAutoUpdate(workDir, config.AutoUpdateResult{
+		Result:      config.AutoUpdateRolledBack,
+		FromVersion: previous,
+		ToVersion:   target,
+		Message:     updateErr.Error(),
+	})
+	err = fmt.Errorf("update to %s failed and was rolled back to %s: %w", target, previous, updateErr)
+	logger.LogFunctionExit("RunAutoUpdate", nil, err)
+	return err
+}
+
+// loadAutoUpdateInstallation returns the absolute working directory,
+// configuration and service name of an installation.
+func loadAutoUpdateInstallation(customWorkDir string) (string, *config.InstallerConfig, string, error) {
+	workDir, err := utils.GetWorkingDirectory(customWorkDir)
+	if err != nil {
+		logger.Error("Failed to get working directory: %v", err)
+		return "", nil, "", fmt.Errorf("failed to get working directory: %w", err)
+	}
+	// The scheduled job runs from a different directory
+	if workDir, err = filepath.Abs(workDir); err != nil {
+		return "", nil, "", fmt.Errorf("failed to get working directory: %w", err)
+	}
+	if err := validate.ValidateUninstallDirectory(workDir); err != nil {
+		logger.Error("No installation found: %v", err)
+		return "", nil, "", fmt.Errorf("no installation found: %w", err)
+	}
+
+	cfg, err := config.LoadConfig(workDir)
+	if err != nil {
+		logger.Error("Could not load configuration: %v", err)
+		return "", nil, "", fmt.Errorf("could not load configuration: %w", err)
+	}
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "flowfuse-device-agent"
+	}
+	return workDir, cfg, serviceName, nil
+}
+
+// checkServiceHealth checks that the service keeps running for
+// healthCheckPeriod. A service that crashes and is restarted by the service
+// manager is caught while it is down.
+func checkServiceHealth(serviceName string) error {
+	logger.Info("Checking that the FlowFuse Device Agent keeps running...")
+	deadline := time.Now().Add(healthCheckPeriod)
+	for {
+		if !service.IsRunning(serviceName) {
+			return fmt.Errorf("the service %s is not running after the update", serviceName)
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(healthCheckInterval)
+	}
+}
+
+// recordAutoUpdate stores the outcome of a scheduled update in the installer
+// configuration. Failures are logged only.
+func recordAutoUpdate(workDir string, result config.AutoUpdateResult) {
+	result.Time = time.Now()
+	cfg, err := config.LoadConfig(workDir)
+	if err != nil {
+		logger.Error("Could not record the update result: %v", err)
+		return
+	}
+	cfg.LastAutoUpdate = &result
+	if err := config.SaveConfig(cfg, workDir); err != nil {
+		logger.Error("Could not record the update result: %v", err)
+	}
+}
+
+// describeAutoUpdatePolicy summarises a policy for the user.
+func describeAutoUpdatePolicy(policy *config.AutoUpdatePolicy) string {
+	channel := policy.Channel + " channel"
+	if policy.Channel == config.AutoUpdateChannelPinned {
+		channel = fmt.Sprintf("pinned to %s", policy.Version)
+	}
+	return fmt.Sprintf("%s, daily window %s (local time), up to %d minute(s) jitter", channel, policy.Window, policy.JitterMinutes)
+}
@@ -0,0 +1,416 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/credentials"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
+	"github.com/flowfuse/device-agent-installer/pkg/service"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+	"github.com/flowfuse/device-agent-installer/pkg/validate"
+)
+
+// backupMetadataDir is the directory inside a backup archive holding the
+// manifest and the service definition. Everything else is working directory
+// content.
+const backupMetadataDir = ".flowfuse-backup"
+
+// backupFormatVersion is increased when the archive layout changes.
+const backupFormatVersion = 1
+
+// backupExcludes are working directory entries not worth backing up: the
+// Node.js runtimes (with the agent package) and NSSM are reinstalled on
+// restore, and npm caches are rebuilt on demand.
+var backupExcludes = []string{"./" + nodejs.NodeDir, "./" + nodejs.StagedNodeDir, "./" + nodejs.PreviousNodeDir, "./nssm", ".npm-cache"}
+
+// backupManifest describes a backup archive.
+type backupManifest struct {
+	Version      int                    `json:"version"`
+	Created      time.Time              `json:"created"`
+	Hostname     string                 `json:"hostname"`
+	OS           string                 `json:"os"`
+	Arch         string                 `json:"arch"`
+	WorkDir      string                 `json:"workDir"`
+	Config       config.InstallerConfig `json:"config"`
+	ServiceFiles []string               `json:"serviceFiles,omitempty"`
+}
+
+// Backup writes the full agent state of an installation to a .tar.gz archive:
+// the working directory (device.yml, installer.conf, CA bundle and Node-RED
+// project data) without the Node.js runtime and caches, a manifest with the
+// installer configuration, and the generated service definition.
+// The service is stopped while the archive is written so the project files are
+// consistent, and started again afterwards.
+//
+// Parameters:
+//   - archivePath: The archive file to create
+//   - customWorkDir: Optional custom working directory path. If empty, uses default path.
+//
+// Returns:
+//   - error: An error if the installation cannot be found or the archive cannot be written
+func Backup(archivePath, customWorkDir string) error {
+	logger.LogFunctionEntry("Backup", map[string]interface{}{
+		"archivePath":   archivePath,
+		"customWorkDir": customWorkDir,
+	})
+
+	workDir, err := utils.GetWorkingDirectory(customWorkDir)
+	if err != nil {
+		logger.Error("Failed to get working directory: %v", err)
+		logger.LogFunctionExit("Backup", nil, err)
+		return fmt.Errorf("failed to get working directory: %w", err)
+	}
+	if err := validate.ValidateUninstallDirectory(workDir); err != nil {
+		logger.Error("Backup failed: %v", err)
+		logger.LogFunctionExit("Backup", nil, err)
+		return fmt.Errorf("no installation found: %w", err)
+	}
+
+	if err := utils.CheckPermissions(); err != nil {
+		logger.LogFunctionExit("Backup", nil, err)
+		return fmt.Errorf("permission check failed: %w", err)
+	}
+
+	cfg, err := config.LoadConfig(workDir)
+	if err != nil {
+		logger.Error("Could not load configuration: %v", err)
+		logger.LogFunctionExit("Backup", nil, err)
+		return fmt.Errorf("could not load configuration: %w", err)
+	}
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "flowfuse-device-agent"
+	}
+
+	archivePath, err = filepath.Abs(archivePath)
+	if err != nil {
+		return fmt.Errorf("invalid archive path: %w", err)
+	}
+
+	// Stage the manifest and service definition next to the working directory content
+	stagingDir, err := os.MkdirTemp("", "flowfuse-backup-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+	metadataDir := filepath.Join(stagingDir, backupMetadataDir)
+	if err := os.MkdirAll(filepath.Join(metadataDir, "service"), 0755); err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	manifest := backupManifest{
+		Version:  backupFormatVersion,
+		Created:  time.Now().UTC(),
+		Hostname: hostname,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		WorkDir:  workDir,
+		Config:   *cfg,
+	}
+
+	if files, err := service.ExportDefinition(serviceName, workDir); err != nil {
+		logger.Info("Warning: Could not read the service definition: %v", err)
+	} else {
+		for name, data := range files {
+			if err := os.WriteFile(filepath.Join(metadataDir, "service", name), data, 0644); err != nil {
+				return fmt.Errorf("failed to stage service definition: %w", err)
+			}
+			manifest.ServiceFiles = append(manifest.ServiceFiles, name)
+		}
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal backup manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(metadataDir, "manifest.json"), manifestData, 0644); err != nil {
+		return fmt.Errorf("failed to write backup manifest: %w", err)
+	}
+
+	// Only a running service is stopped, and started again afterwards
+	serviceWasStopped := false
+	if service.IsInstalled(serviceName) && service.IsRunning(serviceName) {
+		if err := service.Stop(serviceName); err != nil {
+			logger.Error("Service stop failed: %v", err)
+			logger.LogFunctionExit("Backup", nil, err)
+			return fmt.Errorf("service stop failed: %w", err)
+		}
+		serviceWasStopped = true
+	}
+
+	logger.Info("Backing up %s to %s...", workDir, archivePath)
+	// The archive holds the device credentials; create it readable by its owner only
+	if file, err := os.OpenFile(archivePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err == nil {
+		file.Close()
+		_ = os.Chmod(archivePath, 0600)
+	}
+	args := []string{"-czf", archivePath}
+	for _, exclude := range backupExcludes {
+		args = append(args, "--exclude="+exclude)
+	}
+	args = append(args, "-C", workDir, ".", "-C", stagingDir, backupMetadataDir)
+	tarCmd := newTarCmd(args...)
+	logger.Debug("Backup command: %s", tarCmd.String())
+	output, tarErr := tarCmd.CombinedOutput()
+
+	if serviceWasStopped {
+		if err := service.Start(serviceName); err != nil {
+			logger.Error("Service start failed: %v", err)
+		}
+	}
+
+	if tarErr != nil {
+		logger.Error("Backup failed: %v\nOutput: %s", tarErr, output)
+		logger.LogFunctionExit("Backup", nil, tarErr)
+		return fmt.Errorf("failed to create backup archive: %w\nOutput: %s", tarErr, output)
+	}
+
+	// Hand the archive to the invoking user so it can be copied off the device
+	if runtime.GOOS != "windows" {
+		chmodCmd := exec.Command("sudo", "chmod", "600", archivePath)
+		if output, err := chmodCmd.CombinedOutput(); err != nil {
+			logger.Error("Failed to restrict permissions of %s: %v\nOutput: %s", archivePath, err, output)
+			logger.LogFunctionExit("Backup", nil, err)
+			return fmt.Errorf("failed to restrict permissions of %s: %w", archivePath, err)
+		}
+		chownCmd := exec.Command("sudo", "chown", strconv.Itoa(os.Getuid())+":"+strconv.Itoa(os.Getgid()), archivePath)
+		if output, err := chownCmd.CombinedOutput(); err != nil {
+			logger.Info("Warning: Could not set ownership of %s: %s\nOutput: %s", archivePath, err, output)
+		}
+	}
+
+	logger.Info("Backup written to %s", archivePath)
+	logger.LogFunctionExit("Backup", "success", nil)
+	return nil
+}
+
+// Restore recreates an installation from an archive written by Backup: it
+// recreates the service user, reinstalls the recorded Node.js, Device Agent and
+// extra package versions, puts the working directory content back with the
+// correct ownership, and registers and starts the service.
+//
+// Parameters:
+//   - archivePath: The backup archive to restore
+//   - customWorkDir: Optional working directory to restore into. If empty, the
+//     directory recorded in the backup is used.
+//
+// Returns:
+//   - error: An error if the archive is invalid, an installation already exists
+//     in the target directory, or any restore step fails
+func Restore(archivePath, customWorkDir string) error {
+	logger.LogFunctionEntry("Restore", map[string]interface{}{
+		"archivePath":   archivePath,
+		"customWorkDir": customWorkDir,
+	})
+
+	archivePath, err := filepath.Abs(archivePath)
+	if err != nil {
+		return fmt.Errorf("invalid archive path: %w", err)
+	}
+
+	manifest, err := readBackupManifest(archivePath)
+	if err != nil {
+		logger.Error("Invalid backup archive: %v", err)
+		logger.LogFunctionExit("Restore", nil, err)
+		return fmt.Errorf("invalid backup archive: %w", err)
+	}
+	if manifest.OS != runtime.GOOS {
+		err := fmt.Errorf("backup was created on %s and cannot be restored on %s", manifest.OS, runtime.GOOS)
+		logger.Error("%v", err)
+		logger.LogFunctionExit("Restore", nil, err)
+		return err
+	}
+	cfg := manifest.Config
+	logger.Info("Restoring backup of %s created %s (Device Agent %s, Node.js %s)",
+		manifest.Hostname, manifest.Created.Local().Format("2006-01-02 15:04"), cfg.AgentVersion, cfg.NodeVersion)
+
+	if customWorkDir == "" {
+		customWorkDir = manifest.WorkDir
+	}
+	if validate.ValidateUninstallDirectory(customWorkDir) == nil {
+		err := fmt.Errorf("an installation already exists in %s, uninstall it first or restore with --dir", customWorkDir)
+		logger.Error("%v", err)
+		logger.LogFunctionExit("Restore", nil, err)
+		return err
+	}
+
+	if err := utils.CheckPermissions(); err != nil {
+		logger.LogFunctionExit("Restore", nil, err)
+		return fmt.Errorf("permission check failed: %w", err)
+	}
+
+	if cfg.ServiceUsername != "" {
+		utils.ServiceUsername = cfg.ServiceUsername
+	}
+	applyServiceAccountConfig(&cfg)
+	applyLaunchConfig(&cfg)
+	cfg.ServiceUID, cfg.ServiceGID, cfg.ServiceHome, cfg.ServiceGroups = utils.ServiceUID, utils.ServiceGID, utils.ServiceHome, utils.ServiceGroups
+	cfg.ExistingAccount = utils.UseExistingAccount
+	credentials.Encryption = cfg.CredentialEncryption
+	// Staged runtimes are not part of a backup
+	cfg.StagedUpdate = nil
+	if cfg.Port == 0 {
+		cfg.Port = utils.DefaultPort
+	}
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = fmt.Sprintf("flowfuse-device-agent-%d", cfg.Port)
+		cfg.ServiceName = serviceName
+	}
+	if cache.Dir == "" {
+		cache.Dir = cfg.CacheDir
+	}
+	if nodejs.Registry == "" {
+		nodejs.Registry = cfg.NpmRegistry
+	}
+
+	// Creates the service user as well
+	workDir, err := utils.CreateWorkingDirectory(customWorkDir)
+	if err != nil {
+		logger.Error("Failed to create working directory: %v", err)
+		logger.LogFunctionExit("Restore", nil, err)
+		return fmt.Errorf("failed to create working directory: %w", err)
+	}
+	if err := utils.ReconcileServiceGroups(utils.ServiceUsername, nil); err != nil {
+		logger.Error("Failed to update service account groups: %v", err)
+		logger.LogFunctionExit("Restore", nil, err)
+		return fmt.Errorf("failed to update service account groups: %w", err)
+	}
+
+	// Put the data back before installing Node.js, so the recorded packages
+	// land next to the restored Node-RED project. installer.conf is written
+	// from the manifest once the runtime is installed: it records a Node.js
+	// version that is not there yet, as node/ is not part of the backup.
+	logger.Info("Restoring data to %s...", workDir)
+	tarCmd := newTarCmd("-xzf", archivePath, "-C", workDir, "--exclude="+backupMetadataDir, "--exclude=./installer.conf")
+	logger.Debug("Restore command: %s", tarCmd.String())
+	if output, err := tarCmd.CombinedOutput(); err != nil {
+		logger.Error("Failed to extract backup: %v\nOutput: %s", err, output)
+		logger.LogFunctionExit("Restore", nil, err)
+		return fmt.Errorf("failed to extract backup: %w\nOutput: %s", err, output)
+	}
+	if runtime.GOOS != "windows" {
+		chownCmd := exec.Command("sudo", "chown", "-R", utils.ServiceUsername, workDir)
+		if output, err := chownCmd.CombinedOutput(); err != nil {
+			logger.LogFunctionExit("Restore", nil, err)
+			return fmt.Errorf("failed to set ownership of restored data: %w\nOutput: %s", err, output)
+		}
+	}
+
+	// The CA bundle lives in the working directory, which may have moved
+	if cfg.NodeExtraCACerts != "" {
+		if rel, err := filepath.Rel(manifest.WorkDir, cfg.NodeExtraCACerts); err == nil && !strings.HasPrefix(rel, "..") {
+			cfg.NodeExtraCACerts = filepath.Join(workDir, rel)
+		}
+		os.Setenv("NODE_EXTRA_CA_CERTS", cfg.NodeExtraCACerts)
+	}
+
+	logger.Info("Installing Node.js %s...", cfg.NodeVersion)
+	if err := nodejs.EnsureNodeJs(cfg.NodeVersion, workDir, false); err != nil {
+		logger.Error("Node.js setup failed: %v", err)
+		logger.LogFunctionExit("Restore", nil, err)
+		return fmt.Errorf("node.js setup failed: %w", err)
+	}
+	if err := nodejs.InstallDeviceAgent(cfg.AgentVersion, workDir, false); err != nil {
+		logger.Error("Device Agent package installation failed: %v", err)
+		logger.LogFunctionExit("Restore", nil, err)
+		return fmt.Errorf("device agent installation failed: %w", err)
+	}
+	if err := nodejs.InstallExtraPackages(cfg.ExtraPackages, workDir); err != nil {
+		logger.Error("Extra package installation failed: %v", err)
+		logger.LogFunctionExit("Restore", nil, err)
+		return fmt.Errorf("extra package installation failed: %w", err)
+	}
+
+	if err := config.SaveConfig(&cfg, workDir); err != nil {
+		logger.Error("Could not save configuration: %v", err)
+	}
+
+	logger.Info("Registering FlowFuse Device Agent service...")
+	if service.IsInstalled(serviceName) {
+		if err := service.Uninstall(serviceName); err != nil {
+			logger.LogFunctionExit("Restore", nil, err)
+			return fmt.Errorf("service removal failed: %w", err)
+		}
+	}
+	if err := service.Install(serviceName, workDir, cfg.Port, cfg.NodeExtraCACerts); err != nil {
+		logger.Error("Service setup failed: %v", err)
+		logger.LogFunctionExit("Restore", nil, err)
+		return fmt.Errorf("service setup failed: %w", err)
+	}
+
+	// Re-apply the device.yml permissions; encrypted credentials are restored
+	// as they were and still need their key on this machine
+	if err := credentials.Protect(workDir, serviceName); err != nil {
+		logger.Error("Securing the device credentials failed: %v", err)
+		logger.LogFunctionExit("Restore", nil, err)
+		return fmt.Errorf("securing the device credentials failed: %w", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(workDir, "device.yml")); err == nil {
+		if err := service.Start(serviceName); err != nil {
+			logger.Error("Service start failed: %v", err)
+			logger.LogFunctionExit("Restore", nil, err)
+			return fmt.Errorf("service start failed: %w", err)
+		}
+	} else {
+		logger.Info("The backup has no device.yml, the service was not started")
+	}
+
+	logger.Info("FlowFuse Device Agent restored to %s", workDir)
+	logger.LogFunctionExit("Restore", "success", nil)
+	return nil
+}
+
+// readBackupManifest extracts and parses the manifest of a backup archive.
+func readBackupManifest(archivePath string) (*backupManifest, error) {
+	if _, err := os.Stat(archivePath); err != nil {
+		return nil, err
+	}
+	tempDir, err := os.MkdirTemp("", "flowfuse-restore-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	member := backupMetadataDir + "/manifest.json"
+	extractCmd := exec.Command("tar", "-xzf", archivePath, "-C", tempDir, member)
+	if output, err := extractCmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("no backup manifest found: %w\nOutput: %s", err, output)
+	}
+
+	data, err := os.ReadFile(filepath.Join(tempDir, backupMetadataDir, "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup manifest: %w", err)
+	}
+	var manifest backupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse backup manifest: %w", err)
+	}
+	if manifest.Version > backupFormatVersion {
+		return nil, fmt.Errorf("backup format %d is newer than this installer supports (%d)", manifest.Version, backupFormatVersion)
+	}
+	return &manifest, nil
+}
+
+// newTarCmd returns a tar command, run with sudo on Linux and macOS so files
+// owned by the service user can be read and written. Windows 10 and later ship
+// bsdtar as tar.exe.
+func newTarCmd(args ...string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("tar", args...)
+	}
+	return exec.Command("sudo", append([]string{"tar"}, args...)...)
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/flowfuse/device-agent-installer/pkg/certs"
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/credentials"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/service"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+	"github.com/flowfuse/device-agent-installer/pkg/validate"
+)
+
+// RotateCA replaces the CA bundle of an installed Device Agent and restarts
+// the service so the new bundle is picked up.
+// It performs the following steps:
+// 1. Loads the configuration of the installation
+// 2. Validates the new bundle files and writes the combined bundle (see utils.InstallCACertificate)
+// 3. Registers the service again if it did not use a CA bundle before, otherwise restarts it
+// 4. Records the bundle in the installer configuration
+//
+// Parameters:
+//   - customWorkDir: Optional custom working directory path. If empty, uses default path.
+//   - caCertPaths: The new CA bundle files (PEM)
+//
+// Returns:
+//   - error: An error if no installation is found, a bundle is invalid, or the service cannot be restarted
+func RotateCA(customWorkDir string, caCertPaths []string) error {
+	logger.LogFunctionEntry("RotateCA", map[string]interface{}{
+		"customWorkDir": customWorkDir,
+		"caCertPaths":   caCertPaths,
+		"systemStore":   certs.SystemStore,
+	})
+
+	if len(caCertPaths) == 0 && !certs.SystemStore {
+		err := fmt.Errorf("no CA bundle given, use --ca-cert and/or --ca-system-store with --rotate-ca")
+		logger.LogFunctionExit("RotateCA", nil, err)
+		return err
+	}
+
+	workDir, err := utils.GetWorkingDirectory(customWorkDir)
+	if err != nil {
+		logger.Error("Failed to get working directory: %v", err)
+		logger.LogFunctionExit("RotateCA", nil, err)
+		return fmt.Errorf("failed to get working directory: %w", err)
+	}
+	if err := validate.ValidateUninstallDirectory(workDir); err != nil {
+		logger.Error("CA rotation failed: %v", err)
+		logger.LogFunctionExit("RotateCA", nil, err)
+		return fmt.Errorf("no installation found: %w", err)
+	}
+
+	if err := utils.CheckPermissions(); err != nil {
+		logger.LogFunctionExit("RotateCA", nil, err)
+		return fmt.Errorf("permission check failed: %w", err)
+	}
+
+	cfg, err := config.LoadConfig(workDir)
+	if err != nil {
+		logger.Error("Could not load configuration: %v", err)
+		logger.LogFunctionExit("RotateCA", nil, err)
+		return fmt.Errorf("could not load configuration: %w", err)
+	}
+	if cfg.ServiceUsername != "" {
+		utils.ServiceUsername = cfg.ServiceUsername
+	}
+	applyServiceAccountConfig(cfg)
+	applyLaunchConfig(cfg)
+	credentials.Encryption = cfg.CredentialEncryption
+	if cfg.Port == 0 {
+		cfg.Port = utils.DefaultPort
+	}
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "flowfuse-device-agent"
+	}
+
+	logger.Info("Replacing the CA bundle of the FlowFuse Device Agent in %s...", workDir)
+	caCertDest, err := utils.InstallCACertificate(caCertPaths, workDir)
+	if err != nil {
+		logger.Error("Failed to install CA certificate: %v", err)
+		logger.LogFunctionExit("RotateCA", nil, err)
+		return fmt.Errorf("failed to install CA certificate: %w", err)
+	}
+
+	// The service definition carries NODE_EXTRA_CA_CERTS; it only has to be
+	// written again if the bundle path changed, otherwise a restart is enough
+	switch {
+	case caCertDest != cfg.NodeExtraCACerts || !service.IsInstalled(serviceName):
+		logger.Info("Configuring FlowFuse Device Agent to use the new CA bundle...")
+		if err := registerService(serviceName, workDir, cfg.Port, caCertDest); err != nil {
+			logger.Error("Service setup failed: %v", err)
+			logger.LogFunctionExit("RotateCA", nil, err)
+			return err
+		}
+	case service.IsRunning(serviceName):
+		logger.Info("Restarting FlowFuse Device Agent service...")
+		if err := service.Stop(serviceName); err != nil {
+			logger.Error("Service stop failed: %v", err)
+			logger.LogFunctionExit("RotateCA", nil, err)
+			return fmt.Errorf("service stop failed: %w", err)
+		}
+		if err := service.Start(serviceName); err != nil {
+			logger.Error("Service start failed: %v", err)
+			logger.LogFunctionExit("RotateCA", nil, err)
+			return fmt.Errorf("service start failed: %w", err)
+		}
+	default:
+		logger.Info("The service is not running, the new CA bundle is used on its next start")
+	}
+
+	cfg.NodeExtraCACerts = caCertDest
+	if err := config.SaveConfig(cfg, workDir); err != nil {
+		logger.Error("Failed to save configuration: %v", err)
+		logger.LogFunctionExit("RotateCA", nil, err)
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+
+	logger.Info("CA bundle replaced: %s", caCertDest)
+	logger.LogFunctionExit("RotateCA", "success", nil)
+	return nil
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
+	"github.com/flowfuse/device-agent-installer/pkg/download"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+)
+
+// CacheList prints the contents of the shared artifact cache: every cached
+// artifact with its checksum, size and last use, followed by the disk usage of
+// the per-user npm caches.
+//
+// Returns:
+//   - error: Always nil; an empty or missing cache is reported, not treated as a failure
+func CacheList() error {
+	logger.LogFunctionEntry("CacheList", map[string]interface{}{
+		"cacheDir": cache.Root(),
+	})
+
+	logger.Info("Cache directory: %s", cache.Root())
+
+	entries := cache.List()
+	var total int64
+	if len(entries) == 0 {
+		logger.Info("No cached artifacts")
+	} else {
+		logger.Info("Cached artifacts:")
+		for _, entry := range entries {
+			logger.Info("  %s  %10s  last used %s  %s", entry.SHA256[:12], download.FormatBytes(entry.Size), entry.LastUsed.Local().Format("2006-01-02 15:04"), entry.Name)
+			total += entry.Size
+		}
+	}
+
+	npmUsage := cache.NpmUsage()
+	users := make([]string, 0, len(npmUsage))
+	for user := range npmUsage {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		logger.Info("npm cache (%s): %s", user, download.FormatBytes(npmUsage[user]))
+		total += npmUsage[user]
+	}
+
+	logger.Info("Total: %s", download.FormatBytes(total))
+
+	logger.LogFunctionExit("CacheList", "success", nil)
+	return nil
+}
+
+// CachePrune removes cached artifacts that have not been used by any install,
+// update or rollback for cache.PruneAge. The npm caches are left alone since
+// npm verifies and garbage-collects them itself.
+//
+// Returns:
+//   - error: An error if the cache could not be pruned
+func CachePrune() error {
+	logger.LogFunctionEntry("CachePrune", map[string]interface{}{
+		"cacheDir": cache.Root(),
+		"maxAge":   cache.PruneAge.String(),
+	})
+
+	removed, freed, err := cache.Prune(cache.PruneAge)
+	for _, entry := range removed {
+		logger.Info("Removed %s (%s)", entry.Name, download.FormatBytes(entry.Size))
+	}
+	if err != nil {
+		logger.Error("Cache prune failed: %v", err)
+		logger.LogFunctionExit("CachePrune", nil, err)
+		return fmt.Errorf("cache prune failed: %w", err)
+	}
+
+	logger.Info("Cache pruned: %d artifact(s) removed, %s freed", len(removed), download.FormatBytes(freed))
+
+	logger.LogFunctionExit("CachePrune", "success", nil)
+	return nil
+}
@@ -0,0 +1,274 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
+	"github.com/flowfuse/device-agent-installer/pkg/service"
+	"github.com/flowfuse/device-agent-installer/pkg/style"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+	"github.com/flowfuse/device-agent-installer/pkg/validate"
+)
+
+// defaultFlowFuseURL is the FlowFuse instance the Device Agent connects to
+// when no URL is given.
+const defaultFlowFuseURL = "https://app.flowfuse.com"
+
+// Output formats of Check
+const (
+	CheckFormatText = "text"
+	CheckFormatJSON = "json"
+)
+
+// ErrNotReady is returned by Check when a check failed, or with
+// nodejs.Strict when a check warned. Any other error means the checks could
+// not be run.
+var ErrNotReady = errors.New("the system is not ready for the installation")
+
+// checkReport is the JSON output of Check.
+type checkReport struct {
+	// Ready is set if no check failed (and, with --strict, none warned)
+	Ready   bool                   `json:"ready"`
+	OS      string                 `json:"os"`
+	Arch    string                 `json:"arch"`
+	WorkDir string                 `json:"workDir"`
+	Summary map[string]int         `json:"summary"`
+	Checks  []validate.CheckResult `json:"checks"`
+	// Error is set if the checks could not be run
+	Error string `json:"error,omitempty"`
+}
+
+// Check runs every system requirement check of an installation and reports
+// all results together, without installing or changing anything: privileges,
+// disk space, the port, an existing installation, system libraries, the C
+// library against the Node.js build, memory against the Node.js heap, the
+// reachability of the FlowFuse instance, the Node.js distribution and the npm
+// registry, the clock, a read-only or noexec working directory and the
+// SELinux/AppArmor mode.
+//
+// Parameters:
+//   - customWorkDir: Optional custom working directory path. If empty, uses default path.
+//   - url: The FlowFuse URL; empty for the default instance
+//   - nodeVersion: The Node.js version to install
+//   - port: The TCP port of the Device Agent
+//   - caCertPaths: CA bundle files (PEM) trusted by the reachability checks
+//   - format: CheckFormatText for a list of results, CheckFormatJSON for a report on standard output
+//
+// Returns:
+//   - error: ErrNotReady if a check failed, or with nodejs.Strict if a check
+//     warned; another error if the checks could not be run, reported in the
+//     error field of the JSON report
+func Check(customWorkDir, url, nodeVersion string, port int, caCertPaths []string, format string) error {
+	logger.LogFunctionEntry("Check", map[string]interface{}{
+		"customWorkDir": customWorkDir,
+		"url":           url,
+		"nodeVersion":   nodeVersion,
+		"port":          port,
+		"caCertPaths":   caCertPaths,
+		"format":        format,
+	})
+
+	workDir, err := utils.GetWorkingDirectory(customWorkDir)
+	if err != nil {
+		logger.Error("Failed to get working directory: %v", err)
+		logger.LogFunctionExit("Check", nil, err)
+		err = fmt.Errorf("failed to get working directory: %w", err)
+		printCheckError(format, "", err)
+		return err
+	}
+	if url == "" {
+		url = defaultFlowFuseURL
+	}
+
+	// The downloads trust the bundle named by NODE_EXTRA_CA_CERTS; combine
+	// the given files into a temporary one instead of installing it
+	if len(caCertPaths) > 0 {
+		bundle, err := checkCABundle(caCertPaths)
+		if err != nil {
+			logger.Error("Failed to read CA certificate: %v", err)
+			logger.LogFunctionExit("Check", nil, err)
+			err = fmt.Errorf("failed to read CA certificate: %w", err)
+			printCheckError(format, workDir, err)
+			return err
+		}
+		defer os.Remove(bundle)
+		previous, hadPrevious := os.LookupEnv("NODE_EXTRA_CA_CERTS")
+		os.Setenv("NODE_EXTRA_CA_CERTS", bundle)
+		defer func() {
+			if hadPrevious {
+				os.Setenv("NODE_EXTRA_CA_CERTS", previous)
+			} else {
+				os.Unsetenv("NODE_EXTRA_CA_CERTS")
+			}
+		}()
+	}
+
+	if format != CheckFormatJSON {
+		logger.Info("Checking whether this system is ready for the FlowFuse Device Agent in %s...", workDir)
+		logger.Info("")
+	}
+
+	results := []validate.CheckResult{
+		validate.CheckPrivileges(),
+		validate.CheckDiskSpace(customWorkDir),
+	}
+	results = append(results, validate.CheckFilesystem(workDir)...)
+	results = append(results,
+		validate.CheckPort(port),
+		validate.CheckExistingInstallation(customWorkDir),
+		validate.CheckLibraries(),
+		validate.CheckCLibrary(nodeVersion),
+		validate.CheckMemory(validate.HeapMB(service.Environment)),
+	)
+
+	endpoints := []validate.EndpointResult{
+		validate.CheckEndpoint("FlowFuse", url),
+		checkDistribution(),
+		validate.CheckEndpoint("npm registry", nodejs.RegistryURL()+"/"),
+	}
+	for _, endpoint := range endpoints {
+		results = append(results, endpoint.CheckResult)
+	}
+	results = append(results,
+		validate.CheckClockSkew(endpoints),
+		validate.CheckSecurityModule(),
+	)
+
+	summary := map[string]int{validate.CheckPass: 0, validate.CheckWarn: 0, validate.CheckFail: 0, validate.CheckSkip: 0}
+	for _, res := range results {
+		summary[res.Status]++
+		logger.Debug("Check %s: %s: %s", res.Name, res.Status, res.Message)
+	}
+	ready := summary[validate.CheckFail] == 0 && (!nodejs.Strict || summary[validate.CheckWarn] == 0)
+
+	if format == CheckFormatJSON {
+		data, err := json.MarshalIndent(checkReport{
+			Ready:   ready,
+			OS:      runtime.GOOS,
+			Arch:    runtime.GOARCH,
+			WorkDir: workDir,
+			Summary: summary,
+			Checks:  results,
+		}, "", "  ")
+		if err != nil {
+			logger.LogFunctionExit("Check", nil, err)
+			return fmt.Errorf("failed to encode the report: %w", err)
+		}
+		fmt.Println(string(data))
+	} else {
+		for _, res := range results {
+			logger.Info("%s %s: %s", checkLabel(res.Status), res.Name, res.Message)
+			if res.Hint != "" && (res.Status == validate.CheckFail || res.Status == validate.CheckWarn) {
+				logger.Info("       %s", res.Hint)
+			}
+		}
+		logger.Info("")
+	}
+
+	if !ready {
+		err := fmt.Errorf("%w: %d check(s) failed, %d warning(s)", ErrNotReady, summary[validate.CheckFail], summary[validate.CheckWarn])
+		if format != CheckFormatJSON {
+			logger.Info("%s %v", style.Yellow("Warning:"), err)
+		}
+		logger.LogFunctionExit("Check", nil, err)
+		return err
+	}
+
+	if format != CheckFormatJSON {
+		if summary[validate.CheckWarn] > 0 {
+			logger.Info("The system is ready for the installation, with %d warning(s)", summary[validate.CheckWarn])
+		} else {
+			logger.Info("The system is ready for the installation")
+		}
+	}
+	logger.LogFunctionExit("Check", "success", nil)
+	return nil
+}
+
+// printCheckError prints the JSON report of checks that could not be run, so
+// that standard output carries a report in any case. The text format reports
+// the error through the log.
+//
+// Parameters:
+//   - format: The report format
+//   - workDir: The working directory, if known
+//   - err: The error that stopped the checks
+func printCheckError(format, workDir string, err error) {
+	if format != CheckFormatJSON {
+		return
+	}
+	data, jsonErr := json.MarshalIndent(checkReport{
+		OS:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+		WorkDir: workDir,
+		Summary: map[string]int{},
+		Checks:  []validate.CheckResult{},
+		Error:   err.Error(),
+	}, "", "  ")
+	if jsonErr != nil {
+		logger.Debug("Failed to encode the error report: %v", jsonErr)
+		return
+	}
+	fmt.Println(string(data))
+}
+
+// checkCABundle writes the given CA bundle files into one temporary file.
+func checkCABundle(paths []string) (string, error) {
+	file, err := os.CreateTemp("", "flowfuse-check-ca-*.pem")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			os.Remove(file.Name())
+			return "", err
+		}
+		if _, err := fmt.Fprintf(file, "%s\n", data); err != nil {
+			os.Remove(file.Name())
+			return "", err
+		}
+	}
+	return file.Name(), nil
+}
+
+// checkDistribution checks the Node.js distribution sites in the order the
+// installer downloads from them. An unreachable mirror only warns if an
+// official site can be reached, as the downloads fall back to it.
+func checkDistribution() validate.EndpointResult {
+	var failed []string
+	var last validate.EndpointResult
+	for _, base := range nodejs.DistBaseURLs() {
+		last = validate.CheckEndpoint("Node.js distribution", base+"/index.json")
+		if last.Status != validate.CheckFail {
+			if len(failed) > 0 && nodejs.MirrorURL != "" {
+				last.Status = validate.CheckWarn
+				last.Message = fmt.Sprintf("%s; %s not reachable", last.Message, strings.Join(failed, ", "))
+				last.Hint = "Check --nodejs-mirror ($NODEJS_ORG_MIRROR)"
+			}
+			return last
+		}
+		failed = append(failed, base)
+	}
+	return last
+}
+
+// checkLabel returns the styled label of a check status.
+func checkLabel(status string) string {
+	switch status {
+	case validate.CheckPass:
+		return style.Green("[ OK ]")
+	case validate.CheckWarn:
+		return style.Yellow("[WARN]")
+	case validate.CheckFail:
+		return style.Red("[FAIL]")
+	}
+	return "[SKIP]"
+}
@@ -0,0 +1,459 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/certs"
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
+	"github.com/flowfuse/device-agent-installer/pkg/service"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+	"github.com/flowfuse/device-agent-installer/pkg/validate"
+
+	"gopkg.in/yaml.v3"
+)
+
+// diagnosticsDir is the top-level directory inside a diagnostics archive.
+const diagnosticsDir = "flowfuse-diagnostics"
+
+// diagnosticsFormatVersion is increased when the archive layout changes.
+const diagnosticsFormatVersion = 1
+
+const (
+	// diagnosticsJournalLines is the number of journal lines collected with systemd
+	diagnosticsJournalLines = 5000
+	// diagnosticsMaxLogBytes is the size of the tail kept of each log file
+	diagnosticsMaxLogBytes = 2 * 1024 * 1024
+	// diagnosticsInstallerLogs is the number of recent installer logs collected per location
+	diagnosticsInstallerLogs = 5
+)
+
+// secretKeyRE matches device.yml keys whose values are secrets, e.g. token,
+// provisioningToken, credentialSecret or brokerPassword.
+var secretKeyRE = regexp.MustCompile(`(?i)(token|secret|password|passwd|otc)$`)
+
+// diagnosticsManifest describes a diagnostics archive.
+type diagnosticsManifest struct {
+	Version          int                     `json:"version"`
+	Created          time.Time               `json:"created"`
+	InstallerVersion string                  `json:"installerVersion"`
+	Hostname         string                  `json:"hostname"`
+	OS               string                  `json:"os"`
+	Arch             string                  `json:"arch"`
+	Alpine           bool                    `json:"alpine,omitempty"`
+	InitSystem       string                  `json:"initSystem,omitempty"`
+	WorkDir          string                  `json:"workDir"`
+	Installed        bool                    `json:"installed"`
+	ServiceName      string                  `json:"serviceName"`
+	ServiceInstalled bool                    `json:"serviceInstalled"`
+	Config           *config.InstallerConfig `json:"config,omitempty"`
+	NodeVersion      string                  `json:"nodeVersion,omitempty"`
+	NpmVersion       string                  `json:"npmVersion,omitempty"`
+	DiskSpace        []diagnosticsDiskSpace  `json:"diskSpace"`
+	Port             diagnosticsPort         `json:"port"`
+	CABundle         *diagnosticsCABundle    `json:"caBundle,omitempty"`
+	Files            []string                `json:"files"`
+	Errors           []string                `json:"errors,omitempty"`
+}
+
+// diagnosticsDiskSpace is the free space of a location used by the installer.
+type diagnosticsDiskSpace struct {
+	Label     string `json:"label"`
+	Path      string `json:"path"`
+	FreeBytes uint64 `json:"freeBytes"`
+}
+
+// diagnosticsPort is the state of the Device Agent port.
+type diagnosticsPort struct {
+	Port  int  `json:"port"`
+	InUse bool `json:"inUse"`
+}
+
+// diagnosticsCABundle identifies the CA bundle given to the Device Agent.
+type diagnosticsCABundle struct {
+	Path         string                     `json:"path"`
+	SHA256       string                     `json:"sha256,omitempty"`
+	Certificates []diagnosticsCACertificate `json:"certificates,omitempty"`
+}
+
+// diagnosticsCACertificate identifies one certificate of the CA bundle.
+type diagnosticsCACertificate struct {
+	Subject  string    `json:"subject"`
+	NotAfter time.Time `json:"notAfter"`
+	SHA256   string    `json:"sha256"`
+}
+
+// diagnosticsCollector stages the files of a diagnostics archive.
+type diagnosticsCollector struct {
+	stagingDir string
+	manifest   *diagnosticsManifest
+}
+
+// CollectDiagnostics writes a support bundle for the installation to a .tar.gz
+// archive: installer.conf, device.yml with its secrets redacted, the service
+// definition, status and logs for the detected init system, recent installer
+// logs and a manifest with the OS details, Node.js and npm versions, free disk
+// space, port state and the CA bundle fingerprint.
+// It also works for a failed or partial installation and collects whatever
+// exists; problems reading a part are recorded in the manifest. Every text file
+// is passed through the log redaction before it is written.
+//
+// Parameters:
+//   - archivePath: The archive file to create
+//   - customWorkDir: Optional custom working directory path. If empty, uses default path.
+//   - installerVersion: The installer version recorded in the manifest
+//
+// Returns:
+//   - error: An error if the archive cannot be written
+func CollectDiagnostics(archivePath, customWorkDir, installerVersion string) error {
+	logger.LogFunctionEntry("CollectDiagnostics", map[string]interface{}{
+		"archivePath":   archivePath,
+		"customWorkDir": customWorkDir,
+	})
+
+	workDir, err := utils.GetWorkingDirectory(customWorkDir)
+	if err != nil {
+		logger.Error("Failed to get working directory: %v", err)
+		logger.LogFunctionExit("CollectDiagnostics", nil, err)
+		return fmt.Errorf("failed to get working directory: %w", err)
+	}
+
+	if err := utils.CheckPermissions(); err != nil {
+		logger.LogFunctionExit("CollectDiagnostics", nil, err)
+		return fmt.Errorf("permission check failed: %w", err)
+	}
+
+	archivePath, err = filepath.Abs(archivePath)
+	if err != nil {
+		return fmt.Errorf("invalid archive path: %w", err)
+	}
+
+	stagingDir, err := os.MkdirTemp("", "flowfuse-diagnostics-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	_, statErr := os.Stat(workDir)
+	hostname, _ := os.Hostname()
+	operatingSystem, architecture := utils.GetOSDetails()
+	manifest := &diagnosticsManifest{
+		Version:          diagnosticsFormatVersion,
+		Created:          time.Now().UTC(),
+		InstallerVersion: installerVersion,
+		Hostname:         hostname,
+		OS:               operatingSystem,
+		Arch:             architecture,
+		WorkDir:          workDir,
+		Installed:        statErr == nil && validate.ValidateUninstallDirectory(workDir) == nil,
+	}
+	c := &diagnosticsCollector{stagingDir: filepath.Join(stagingDir, diagnosticsDir), manifest: manifest}
+
+	if manifest.Installed {
+		logger.Info("Collecting diagnostics for %s...", workDir)
+	} else {
+		logger.Info("No installation found in %s, collecting system information only...", workDir)
+	}
+
+	// Configuration
+	cfg := &config.InstallerConfig{}
+	if _, err := os.Stat(filepath.Join(workDir, "installer.conf")); err == nil {
+		if cfg, err = config.LoadConfig(workDir); err != nil {
+			c.recordError("installer.conf: %v", err)
+			cfg = &config.InstallerConfig{}
+		} else {
+			manifest.Config = cfg
+			service.RegisterEnvironmentSecrets(cfg.Environment)
+		}
+		c.addFile("config/installer.conf", filepath.Join(workDir, "installer.conf"), 0)
+	}
+	c.addDeviceConfiguration(workDir)
+
+	manifest.ServiceName = cfg.ServiceName
+	if manifest.ServiceName == "" {
+		manifest.ServiceName = "flowfuse-device-agent"
+	}
+	manifest.ServiceInstalled = service.IsInstalled(manifest.ServiceName)
+
+	// System
+	if runtime.GOOS == "linux" {
+		manifest.Alpine = utils.IsAlpine()
+		manifest.InitSystem = service.DetectTarget().Init
+		c.addFile("system/os-release", "/etc/os-release", 0)
+	}
+	if nodeVersion, npmVersion, err := nodejs.GetRuntimeVersions(workDir); err != nil {
+		c.recordError("node.js: %v", err)
+	} else {
+		manifest.NodeVersion, manifest.NpmVersion = nodeVersion, npmVersion
+	}
+	c.checkDiskSpace(workDir)
+	c.checkPort(cfg.Port)
+	if cfg.NodeExtraCACerts != "" {
+		c.inspectCABundle(cfg.NodeExtraCACerts)
+	}
+
+	// Service
+	if files, err := service.ExportDefinition(manifest.ServiceName, workDir); err != nil {
+		c.recordError("service definition: %v", err)
+	} else {
+		for name, data := range files {
+			c.writeFile("service/"+name, data)
+		}
+	}
+	for name, data := range service.Diagnostics(manifest.ServiceName, diagnosticsJournalLines) {
+		c.writeFile("service/"+name, data)
+	}
+
+	// Logs
+	for _, path := range agentLogFiles(workDir, manifest.ServiceName) {
+		c.addFile("logs/agent/"+filepath.Base(path), path, diagnosticsMaxLogBytes)
+	}
+	for _, path := range installerLogFiles(workDir) {
+		c.addFile("logs/installer/"+filepath.Base(path), path, diagnosticsMaxLogBytes)
+	}
+
+	sort.Strings(manifest.Files)
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal diagnostics manifest: %w", err)
+	}
+	c.writeFile("manifest.json", manifestData)
+
+	tarCmd := exec.Command("tar", "-czf", archivePath, "-C", stagingDir, diagnosticsDir)
+	logger.Debug("Diagnostics archive command: %s", tarCmd.String())
+	if output, err := tarCmd.CombinedOutput(); err != nil {
+		logger.Error("Failed to write diagnostics archive: %v\nOutput: %s", err, output)
+		logger.LogFunctionExit("CollectDiagnostics", nil, err)
+		return fmt.Errorf("failed to create diagnostics archive: %w\nOutput: %s", err, output)
+	}
+
+	for _, problem := range manifest.Errors {
+		logger.Debug("Diagnostics: %s", problem)
+	}
+	logger.Info("Diagnostics written to %s", archivePath)
+	logger.Info("Secrets were redacted, please review the archive before sharing it.")
+	logger.LogFunctionExit("CollectDiagnostics", "success", nil)
+	return nil
+}
+
+// recordError notes a part of the bundle that could not be collected.
+func (c *diagnosticsCollector) recordError(format string, v ...interface{}) {
+	c.manifest.Errors = append(c.manifest.Errors, logger.Redact(fmt.Sprintf(format, v...)))
+}
+
+// writeFile redacts data and writes it to name inside the bundle.
+func (c *diagnosticsCollector) writeFile(name string, data []byte) {
+	path := filepath.Join(c.stagingDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		c.recordError("%s: %v", name, err)
+		return
+	}
+	if err := os.WriteFile(path, []byte(logger.Redact(string(data))), 0600); err != nil {
+		c.recordError("%s: %v", name, err)
+		return
+	}
+	if name != "manifest.json" {
+		c.manifest.Files = append(c.manifest.Files, name)
+	}
+}
+
+// addFile copies a file into the bundle, keeping only the last maxBytes bytes
+// when maxBytes is positive.
+func (c *diagnosticsCollector) addFile(name, path string, maxBytes int) {
+	data, err := utils.ReadPrivilegedFile(path)
+	if err != nil {
+		c.recordError("%s: %v", path, err)
+		return
+	}
+	if maxBytes > 0 && len(data) > maxBytes {
+		data = append([]byte(fmt.Sprintf("[truncated to the last %d bytes]\n", maxBytes)), data[len(data)-maxBytes:]...)
+	}
+	c.writeFile(name, data)
+}
+
+// addDeviceConfiguration adds device.yml with the values of all secret keys
+// replaced. Encrypted credential files are listed in the manifest only.
+func (c *diagnosticsCollector) addDeviceConfiguration(workDir string) {
+	path := filepath.Join(workDir, "device.yml")
+	if _, err := os.Stat(path); err != nil {
+		c.recordError("device.yml: %v", err)
+		return
+	}
+	if problem, err := utils.CheckDeviceConfigurationPermissions(path); err == nil && problem != "" {
+		c.recordError("%s", problem)
+	}
+	data, err := utils.ReadPrivilegedFile(path)
+	if err != nil {
+		c.recordError("device.yml: %v", err)
+		return
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		c.recordError("device.yml is not valid YAML, only known secret fields were redacted: %v", err)
+		c.writeFile("config/device.yml", data)
+		return
+	}
+	redactYAMLSecrets(&doc)
+	redacted, err := yaml.Marshal(&doc)
+	if err != nil {
+		c.recordError("device.yml: %v", err)
+		return
+	}
+	c.writeFile("config/device.yml", redacted)
+}
+
+// redactYAMLSecrets replaces the values of secret keys anywhere in node.
+func redactYAMLSecrets(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if secretKeyRE.MatchString(key.Value) && value.Kind == yaml.ScalarNode {
+				value.Value = "[REDACTED]"
+				value.Tag = "!!str"
+				value.Style = 0
+				continue
+			}
+			redactYAMLSecrets(value)
+		}
+		return
+	}
+	for _, child := range node.Content {
+		redactYAMLSecrets(child)
+	}
+}
+
+// checkDiskSpace records the free space of the working and temporary directories.
+func (c *diagnosticsCollector) checkDiskSpace(workDir string) {
+	for _, location := range []struct{ label, path string }{
+		{"install directory", workDir},
+		{"temporary directory", os.TempDir()},
+	} {
+		_, free, err := utils.HasEnoughDiskSpace(location.path, 0)
+		if err != nil {
+			c.recordError("disk space of %s: %v", location.path, err)
+			continue
+		}
+		c.manifest.DiskSpace = append(c.manifest.DiskSpace, diagnosticsDiskSpace{
+			Label:     location.label,
+			Path:      location.path,
+			FreeBytes: free,
+		})
+	}
+}
+
+// checkPort records whether the Device Agent port is in use, which is expected
+// while the service is running.
+func (c *diagnosticsCollector) checkPort(port int) {
+	if port == 0 {
+		port = utils.DefaultPort
+	}
+	c.manifest.Port.Port = port
+	c.manifest.Port.InUse = validate.CheckUnusedPort(port) != nil
+}
+
+// inspectCABundle records the fingerprint of the CA bundle and of each
+// certificate in it.
+func (c *diagnosticsCollector) inspectCABundle(path string) {
+	bundle := &diagnosticsCABundle{Path: path}
+	c.manifest.CABundle = bundle
+	data, err := utils.ReadPrivilegedFile(path)
+	if err != nil {
+		c.recordError("CA bundle: %v", err)
+		return
+	}
+	sum := sha256.Sum256(data)
+	bundle.SHA256 = hex.EncodeToString(sum[:])
+
+	certificates, err := certs.Parse(data)
+	if err != nil {
+		c.recordError("CA bundle: %v", err)
+		return
+	}
+	for _, cert := range certificates {
+		bundle.Certificates = append(bundle.Certificates, diagnosticsCACertificate{
+			Subject:  cert.Subject.String(),
+			NotAfter: cert.NotAfter,
+			SHA256:   certs.Fingerprint(cert),
+		})
+	}
+}
+
+// agentLogFiles returns the Device Agent log files written by the service
+// outside the journal: the SysVinit log in /var/log, the OpenRC and launchd
+// logs in <workDir>/logs and the NSSM logs in the working directory.
+func agentLogFiles(workDir, serviceName string) []string {
+	files := service.LogFiles(serviceName)
+	for _, pattern := range []string{filepath.Join(workDir, "logs", "*.log"), filepath.Join(workDir, "*.log")} {
+		matches, _ := filepath.Glob(pattern)
+		files = append(files, matches...)
+	}
+	return files
+}
+
+// installerLogFiles returns the most recent installer logs kept with the
+// installation and in the temporary directory, including the current one.
+func installerLogFiles(workDir string) []string {
+	var files []string
+	installerLogDir := filepath.Join(workDir, "logs", "installer")
+	var names []string
+	if runtime.GOOS == "windows" {
+		entries, _ := os.ReadDir(installerLogDir)
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+	} else if output, err := exec.Command("sudo", "ls", "-1", installerLogDir).Output(); err == nil {
+		names = strings.Fields(string(output))
+	}
+	files = append(files, recentInstallerLogs(installerLogDir, names)...)
+
+	matches, _ := filepath.Glob(filepath.Join(os.TempDir(), logger.LogFilePrefix+"*.log"))
+	names = nil
+	for _, match := range matches {
+		names = append(names, filepath.Base(match))
+	}
+	files = append(files, recentInstallerLogs(os.TempDir(), names)...)
+
+	if current := logger.GetLogFilePath(); current != "" {
+		found := false
+		for _, file := range files {
+			found = found || file == current
+		}
+		if !found {
+			files = append(files, current)
+		}
+	}
+	return files
+}
+
+// recentInstallerLogs returns the newest installer logs among names in dir.
+// Timestamped names sort chronologically.
+func recentInstallerLogs(dir string, names []string) []string {
+	var logs []string
+	for _, name := range names {
+		if strings.HasPrefix(name, logger.LogFilePrefix) && strings.HasSuffix(name, ".log") {
+			logs = append(logs, name)
+		}
+	}
+	sort.Strings(logs)
+	if len(logs) > diagnosticsInstallerLogs {
+		logs = logs[len(logs)-diagnosticsInstallerLogs:]
+	}
+	var paths []string
+	for _, name := range logs {
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	return paths
+}
@@ -0,0 +1,370 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
+	"github.com/flowfuse/device-agent-installer/pkg/certs"
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/credentials"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
+	"github.com/flowfuse/device-agent-installer/pkg/service"
+	"github.com/flowfuse/device-agent-installer/pkg/style"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+	"github.com/flowfuse/device-agent-installer/pkg/validate"
+)
+
+// doctorFinding is the outcome of a doctor check.
+type doctorFinding struct {
+	// problem describes what is wrong; empty if the check passed
+	problem string
+	// fix repairs the problem; nil if it cannot be repaired automatically
+	fix func() error
+	// hint tells the user how to resolve a problem that is not repaired
+	hint string
+}
+
+// doctorCheck is a single check run by Doctor.
+type doctorCheck struct {
+	name string
+	run  func() doctorFinding
+}
+
+// doctor holds the installation examined by Doctor.
+type doctor struct {
+	workDir     string
+	serviceName string
+	cfg         *config.InstallerConfig
+}
+
+// Doctor checks an installation for common breakages and prints a result for
+// each check: a missing or partial Node.js runtime or Device Agent package, a
+// service definition that does not point at the bundled Node.js, working
+// directory ownership that drifted from the service user, a missing log
+// rotation configuration on macOS, a port taken by another process, a missing
+// CA bundle, low disk space and missing system libraries.
+// With fix set, the safe remediations are applied and the check is repeated.
+//
+// Parameters:
+//   - customWorkDir: Optional custom working directory path. If empty, uses default path.
+//   - fix: Whether to repair the problems that can be repaired automatically
+//
+// Returns:
+//   - error: An error if no installation is found, or if problems remain
+func Doctor(customWorkDir string, fix bool) error {
+	logger.LogFunctionEntry("Doctor", map[string]interface{}{
+		"customWorkDir": customWorkDir,
+		"fix":           fix,
+	})
+
+	workDir, err := utils.GetWorkingDirectory(customWorkDir)
+	if err != nil {
+		logger.Error("Failed to get working directory: %v", err)
+		logger.LogFunctionExit("Doctor", nil, err)
+		return fmt.Errorf("failed to get working directory: %w", err)
+	}
+	if err := validate.ValidateUninstallDirectory(workDir); err != nil {
+		logger.Error("Doctor failed: %v", err)
+		logger.LogFunctionExit("Doctor", nil, err)
+		return fmt.Errorf("no installation found: %w", err)
+	}
+
+	if err := utils.CheckPermissions(); err != nil {
+		logger.LogFunctionExit("Doctor", nil, err)
+		return fmt.Errorf("permission check failed: %w", err)
+	}
+
+	cfg, err := config.LoadConfig(workDir)
+	if err != nil {
+		logger.Error("Could not load configuration: %v", err)
+		logger.LogFunctionExit("Doctor", nil, err)
+		return fmt.Errorf("could not load configuration: %w", err)
+	}
+	if cfg.ServiceUsername != "" {
+		utils.ServiceUsername = cfg.ServiceUsername
+	}
+	applyServiceAccountConfig(cfg)
+	applyLaunchConfig(cfg)
+	credentials.Encryption = cfg.CredentialEncryption
+	if cache.Dir == "" {
+		cache.Dir = cfg.CacheDir
+	}
+	if cfg.Port == 0 {
+		cfg.Port = utils.DefaultPort
+	}
+	d := &doctor{workDir: workDir, serviceName: cfg.ServiceName, cfg: cfg}
+	if d.serviceName == "" {
+		d.serviceName = "flowfuse-device-agent"
+	}
+
+	logger.Info("Checking the FlowFuse Device Agent installation in %s...", workDir)
+	logger.Info("")
+	remaining := 0
+	for _, check := range d.checks() {
+		finding := check.run()
+		if finding.problem == "" {
+			logger.Info("%s %s", style.Green("[ OK ]"), check.name)
+			continue
+		}
+		logger.Info("%s %s: %s", style.Red("[FAIL]"), check.name, finding.problem)
+
+		if finding.fix != nil && fix {
+			if err := finding.fix(); err != nil {
+				logger.Error("       Repair failed: %v", err)
+			} else if again := check.run(); again.problem != "" {
+				logger.Info("       Repair did not resolve the problem: %s", again.problem)
+			} else {
+				logger.Info("%s %s", style.Green("[FIXED]"), check.name)
+				continue
+			}
+		} else if finding.fix != nil {
+			logger.Info("       Run with --doctor --fix to repair it")
+		}
+		if finding.hint != "" {
+			logger.Info("       %s", finding.hint)
+		}
+		remaining++
+	}
+	logger.Info("")
+
+	if remaining > 0 {
+		err := fmt.Errorf("%d problem(s) found", remaining)
+		logger.Info("%s %v", style.Yellow("Warning:"), err)
+		logger.LogFunctionExit("Doctor", nil, err)
+		return err
+	}
+	logger.Info("No problems found")
+	logger.LogFunctionExit("Doctor", "success", nil)
+	return nil
+}
+
+// checks returns the checks for the current operating system. Checks whose
+// repair depends on an earlier one come later, e.g. reinstalling Node.js
+// removes the Device Agent package.
+func (d *doctor) checks() []doctorCheck {
+	checks := []doctorCheck{
+		{"Node.js runtime", d.checkNodeRuntime},
+		{"Device Agent executable", d.checkDeviceAgent},
+		{"Service definition", d.checkServiceDefinition},
+	}
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		checks = append(checks, doctorCheck{"Working directory ownership", d.checkOwnership})
+	}
+	if runtime.GOOS == "darwin" {
+		checks = append(checks, doctorCheck{"Log rotation", d.checkNewsyslog})
+	}
+	checks = append(checks,
+		doctorCheck{"Port", d.checkPort},
+		doctorCheck{"CA bundle", d.checkCABundle},
+		doctorCheck{"Disk space", d.checkDiskSpace},
+	)
+	if runtime.GOOS == "linux" {
+		checks = append(checks, doctorCheck{"System libraries", d.checkLibraries})
+	}
+	return checks
+}
+
+// checkNodeRuntime checks that the bundled Node.js runs.
+func (d *doctor) checkNodeRuntime() doctorFinding {
+	nodeVersion, _, err := nodejs.GetRuntimeVersions(d.workDir)
+	if err == nil {
+		logger.Debug("Bundled Node.js: %s", nodeVersion)
+		return doctorFinding{}
+	}
+	finding := doctorFinding{problem: err.Error()}
+	if d.cfg.NodeVersion != "" {
+		finding.fix = func() error {
+			return nodejs.ReinstallNodeJs(d.cfg.NodeVersion, d.workDir)
+		}
+	} else {
+		finding.hint = "Run the installer with --update-nodejs to install Node.js"
+	}
+	return finding
+}
+
+// checkDeviceAgent checks that npm installed the flowfuse-device-agent
+// executable, which is missing after a partial npm install.
+func (d *doctor) checkDeviceAgent() doctorFinding {
+	agentPath := nodejs.GetDeviceAgentPath(d.workDir)
+	if _, err := os.Stat(agentPath); err == nil {
+		return doctorFinding{}
+	}
+	version := d.cfg.AgentVersion
+	if version == "" {
+		version = "latest"
+	}
+	return doctorFinding{
+		problem: fmt.Sprintf("%s is missing, the Device Agent package is incomplete", agentPath),
+		fix: func() error {
+			if err := nodejs.InstallDeviceAgent(version, d.workDir, false); err != nil {
+				return err
+			}
+			return nodejs.InstallExtraPackages(d.cfg.ExtraPackages, d.workDir)
+		},
+	}
+}
+
+// checkServiceDefinition checks that the service is registered and runs the
+// bundled Node.js, not a directory left over from an older installation.
+func (d *doctor) checkServiceDefinition() doctorFinding {
+	if !service.IsInstalled(d.serviceName) {
+		return doctorFinding{
+			problem: fmt.Sprintf("service %s is not registered", d.serviceName),
+			fix:     d.reinstallService,
+		}
+	}
+
+	files, err := service.ExportDefinition(d.serviceName, d.workDir)
+	if err != nil {
+		return doctorFinding{problem: fmt.Sprintf("could not read the service definition: %v", err)}
+	}
+	var definition strings.Builder
+	for _, data := range files {
+		definition.Write(data)
+	}
+	nodeBinDir := filepath.Dir(nodejs.GetDeviceAgentPath(d.workDir))
+	if strings.Contains(definition.String(), nodeBinDir) {
+		return doctorFinding{}
+	}
+	return doctorFinding{
+		problem: fmt.Sprintf("the service definition does not use the bundled Node.js in %s", nodeBinDir),
+		fix:     d.reinstallService,
+	}
+}
+
+// reinstallService registers the service again from the recorded
+// configuration and starts it if the device is configured.
+func (d *doctor) reinstallService() error {
+	return registerService(d.serviceName, d.workDir, d.cfg.Port, d.cfg.NodeExtraCACerts)
+}
+
+// checkOwnership checks that the working directory content is owned by the
+// service user. The installer logs are skipped; they are kept private to root.
+func (d *doctor) checkOwnership() doctorFinding {
+	paths, err := d.findForeignFiles()
+	if err != nil {
+		return doctorFinding{problem: fmt.Sprintf("could not check ownership: %v", err)}
+	}
+	if len(paths) == 0 {
+		return doctorFinding{}
+	}
+	return doctorFinding{
+		problem: fmt.Sprintf("%d path(s) are not owned by %s, e.g. %s", len(paths), utils.ServiceUsername, paths[0]),
+		fix: func() error {
+			owner := utils.ServiceOwner()
+			if runtime.GOOS == "darwin" {
+				owner = utils.ServiceUsername
+			}
+			chownCmd := exec.Command("sudo", d.ownershipFindArgs("-exec", "chown", "-h", owner, "{}", "+")...)
+			logger.Debug("Ownership repair command: %s", chownCmd.String())
+			if output, err := chownCmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to set ownership: %w\nOutput: %s", err, output)
+			}
+			return nil
+		},
+	}
+}
+
+// findForeignFiles lists the paths in the working directory not owned by the
+// service user.
+func (d *doctor) findForeignFiles() ([]string, error) {
+	var stderr strings.Builder
+	findCmd := exec.Command("sudo", d.ownershipFindArgs("-print")...)
+	findCmd.Stderr = &stderr
+	output, err := findCmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var paths []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, nil
+}
+
+// ownershipFindArgs returns a find command line that applies action to the
+// paths in the working directory not owned by the service user.
+func (d *doctor) ownershipFindArgs(action ...string) []string {
+	args := []string{"find", d.workDir,
+		"-path", filepath.Join(d.workDir, "logs", "installer"), "-prune", "-o",
+		"!", "-user", utils.ServiceUsername}
+	return append(args, action...)
+}
+
+// checkNewsyslog checks that the log rotation configuration exists on macOS.
+func (d *doctor) checkNewsyslog() doctorFinding {
+	confPath := service.NewsyslogConfigPath(d.serviceName)
+	if _, err := os.Stat(confPath); err == nil {
+		return doctorFinding{}
+	}
+	return doctorFinding{
+		problem: fmt.Sprintf("%s is missing, the service logs are not rotated", confPath),
+		fix: func() error {
+			return service.RestoreNewsyslogConfig(d.serviceName, d.workDir)
+		},
+	}
+}
+
+// checkPort checks that the port is free or used by the service itself.
+func (d *doctor) checkPort() doctorFinding {
+	if validate.CheckUnusedPort(d.cfg.Port) == nil || service.IsRunning(d.serviceName) {
+		return doctorFinding{}
+	}
+	return doctorFinding{
+		problem: fmt.Sprintf("port %d is in use by another process while the service is not running", d.cfg.Port),
+		hint:    "Stop the other process, or reinstall the Device Agent on a free port with --port",
+	}
+}
+
+// checkCABundle checks that the CA bundle recorded in installer.conf exists,
+// is a valid PEM bundle and holds no expired or soon expiring certificates.
+func (d *doctor) checkCABundle() doctorFinding {
+	if d.cfg.NodeExtraCACerts == "" {
+		return doctorFinding{}
+	}
+	if _, err := os.Stat(d.cfg.NodeExtraCACerts); err != nil {
+		return doctorFinding{
+			problem: fmt.Sprintf("%s recorded in installer.conf does not exist", d.cfg.NodeExtraCACerts),
+			hint:    "Run the installer with --rotate-ca --ca-cert <bundle> to install the CA bundle",
+		}
+	}
+	certificates, err := certs.ReadFile(d.cfg.NodeExtraCACerts)
+	if err != nil {
+		return doctorFinding{
+			problem: err.Error(),
+			hint:    "Run the installer with --rotate-ca --ca-cert <bundle> to replace the CA bundle",
+		}
+	}
+	if warnings := certs.ExpiryWarnings(certificates, time.Now()); len(warnings) > 0 {
+		return doctorFinding{
+			problem: strings.Join(warnings, "; "),
+			hint:    "Run the installer with --rotate-ca --ca-cert <bundle> to replace the CA bundle",
+		}
+	}
+	return doctorFinding{}
+}
+
+// checkDiskSpace checks the free space needed for updates.
+func (d *doctor) checkDiskSpace() doctorFinding {
+	if err := validate.CheckFreeDiskSpace(d.workDir, validate.MinFreeDiskBytes); err != nil {
+		return doctorFinding{problem: err.Error(), hint: "Free up disk space before updating"}
+	}
+	return doctorFinding{}
+}
+
+// checkLibraries checks for the system libraries Node.js needs.
+func (d *doctor) checkLibraries() doctorFinding {
+	if err := validate.CheckLibstdcExists(); err != nil {
+		return doctorFinding{problem: err.Error(), hint: "Install libstdc++ with the system package manager"}
+	}
+	return doctorFinding{}
+}
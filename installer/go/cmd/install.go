@@ -3,14 +3,21 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
 	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/credentials"
+	"github.com/flowfuse/device-agent-installer/pkg/download"
 	"github.com/flowfuse/device-agent-installer/pkg/logger"
 	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
 	"github.com/flowfuse/device-agent-installer/pkg/service"
+	"github.com/flowfuse/device-agent-installer/pkg/style"
 	"github.com/flowfuse/device-agent-installer/pkg/utils"
 	"github.com/flowfuse/device-agent-installer/pkg/validate"
+	"gopkg.in/yaml.v3"
 )
 
 // Install performs the complete installation of the FlowFuse Device Agent.
@@ -36,29 +43,50 @@ import (
 //   - customWorkDir: Optional custom working directory path. If empty, uses default path.
 //   - update: Whether this is an update operation
 //   - port: The TCP port number the device agent will use
+//   - caCertPaths: CA bundle files (PEM) the Device Agent should trust
 //
 // Returns:
 //   - error: An error object if any step of the installation fails, nil otherwise
 //
 // The function logs detailed information about each step of the process.
-func Install(nodeVersion, agentVersion, url, otc, customWorkDir string, update bool, port int, caCertPath string) error {
+func Install(nodeVersion, agentVersion, url, otc, customWorkDir string, update bool, port int, caCertPaths []string) error {
 	logger.LogFunctionEntry("Install", map[string]interface{}{
 		"nodeVersion":   nodeVersion,
 		"agentVersion":  agentVersion,
 		"url":           url,
-		"otc":           otc,
+		"otcProvided":   otc != "",
 		"customWorkDir": customWorkDir,
 		"port":          port,
 	})
 
 	serviceName := fmt.Sprintf("flowfuse-device-agent-%d", port)
 
+	// The configuration of a previous install (the defaults if there is none).
+	// It is read before the pre-check, as a fresh installation removes
+	// installer.conf but keeps the scheduled job of an automatic update policy.
+	prev, err := config.LoadConfig(customWorkDir)
+	if err != nil {
+		logger.Debug("Ignoring the configuration of the previous installation: %v", err)
+		prev = &config.InstallerConfig{}
+	}
+
 	// Run pre-install validation
 	logger.Debug("Running pre-check...")
 	if err := validate.PreInstall(customWorkDir, port); err != nil {
 		logger.LogFunctionExit("Install", nil, err)
 		return fmt.Errorf("pre-check failed: %w", err)
 	}
+	// A fresh installation chosen in the pre-check removed the configuration
+	if configPath, err := config.GetConfigPath(customWorkDir); err == nil {
+		if _, err := os.Stat(configPath); os.IsNotExist(err) {
+			prev = &config.InstallerConfig{AutoUpdate: prev.AutoUpdate, LastAutoUpdate: prev.LastAutoUpdate}
+		}
+	}
+
+	// Keep the service account settings of a previous install unless overridden
+	previousGroups := prev.ServiceGroups
+	applyServiceAccountConfig(prev)
+	applyLaunchConfig(prev)
 
 	// Create working directory
 	logger.Debug("Creating working directory...")
@@ -70,20 +98,27 @@ func Install(nodeVersion, agentVersion, url, otc, customWorkDir string, update b
 	}
 	logger.Debug("Working directory created at: %s", workDir)
 
+	if err := utils.ReconcileServiceGroups(utils.ServiceUsername, previousGroups); err != nil {
+		logger.Error("Failed to update service account groups: %v", err)
+		logger.LogFunctionExit("Install", nil, err)
+		return fmt.Errorf("failed to update service account groups: %w", err)
+	}
+
 	// Resolve and install the custom CA bundle (if any) before Node.js/npm/OTC steps,
 	// so both the setup commands and the long-running service trust it.
-	// Precedence: --ca-cert flag, then NODE_EXTRA_CA_CERTS env, then the value stored
+	// Precedence: --ca-cert flags, then NODE_EXTRA_CA_CERTS env, then the value stored
 	// from a previous install (so a bare reinstall keeps CA trust without re-passing it).
-	caSrc := caCertPath
-	if caSrc == "" {
-		caSrc = os.Getenv("NODE_EXTRA_CA_CERTS")
-	}
-	if caSrc == "" {
-		if prev, cfgErr := config.LoadConfig(workDir); cfgErr == nil {
-			caSrc = prev.NodeExtraCACerts
+	// The system trust store is added with --ca-system-store.
+	caSrcs := caCertPaths
+	if len(caSrcs) == 0 {
+		if env := os.Getenv("NODE_EXTRA_CA_CERTS"); env != "" {
+			caSrcs = []string{env}
 		}
 	}
-	caCertDest, err := utils.InstallCACertificate(caSrc, workDir)
+	if len(caSrcs) == 0 && prev.NodeExtraCACerts != "" {
+		caSrcs = []string{prev.NodeExtraCACerts}
+	}
+	caCertDest, err := utils.InstallCACertificate(caSrcs, workDir)
 	if err != nil {
 		logger.Error("Failed to install CA certificate: %v", err)
 		logger.LogFunctionExit("Install", nil, err)
@@ -94,6 +129,56 @@ func Install(nodeVersion, agentVersion, url, otc, customWorkDir string, update b
 		logger.Debug("Using custom CA certificate bundle: %s", caCertDest)
 	}
 
+	// Reuse the artifact cache and npm registry chosen by a previous install
+	// unless --cache-dir or --npm-registry overrides them.
+	if cache.Dir == "" {
+		cache.Dir = prev.CacheDir
+	}
+	if nodejs.Registry == "" {
+		nodejs.Registry = prev.NpmRegistry
+	}
+	logger.Debug("Using artifact cache: %s", cache.Root())
+
+	// Keep encrypting the credentials with the key source of a previous install
+	// unless --encrypt-credentials selects one
+	if credentials.Encryption == "" {
+		credentials.Encryption = prev.CredentialEncryption
+	}
+	if err := credentials.Validate(credentials.Encryption, runtime.GOOS == "linux" && service.IsSystemd()); err != nil {
+		logger.Error("%v", err)
+		logger.LogFunctionExit("Install", nil, err)
+		return err
+	}
+
+	// Check the connection to the FlowFuse platform with the CA bundle and proxy
+	// settings before anything is downloaded, so a network problem is reported
+	// here instead of as a failure of the Device Agent's configuration
+	if err := verifyConnectivity(url, otc, workDir); err != nil {
+		logger.Error("Connection check failed: %v", err)
+		logger.LogFunctionExit("Install", nil, err)
+		return fmt.Errorf("connection check failed: %w", err)
+	}
+
+	// Make sure the requested Device Agent supports the Node.js version
+	nodeVersion, err = nodejs.CheckDeviceAgentCompatibility(agentVersion, nodeVersion, nodejs.AutoSelectVersion)
+	if err != nil {
+		logger.LogFunctionExit("Install", nil, err)
+		return fmt.Errorf("compatibility check failed: %w", err)
+	}
+
+	// Warn about (or with --strict, refuse) an end-of-life or insecure Node.js version
+	if err := nodejs.CheckNodeRelease(nodeVersion); err != nil {
+		logger.LogFunctionExit("Install", nil, err)
+		return fmt.Errorf("node.js release check failed: %w", err)
+	}
+
+	// A staged update would replace the versions installed now when applied
+	if err := discardStagedUpdate(workDir); err != nil {
+		logger.Error("Discarding the staged update failed: %v", err)
+		logger.LogFunctionExit("Install", nil, err)
+		return fmt.Errorf("discarding the staged update failed: %w", err)
+	}
+
 	// Check/install Node.js
 	logger.Info("Checking Node.js installation...")
 	if err := nodejs.EnsureNodeJs(nodeVersion, workDir, false); err != nil {
@@ -111,6 +196,14 @@ func Install(nodeVersion, agentVersion, url, otc, customWorkDir string, update b
 	}
 	logger.Debug("Device Agent installation successful")
 
+	// Install extra npm packages and Node-RED nodes, keeping those pinned by a previous install
+	extraPackages := nodejs.MergePackages(prev.ExtraPackages, nodejs.ExtraPackages)
+	if err := nodejs.InstallExtraPackages(extraPackages, workDir); err != nil {
+		logger.Error("Extra package installation failed: %v", err)
+		logger.LogFunctionExit("Install", nil, err)
+		return fmt.Errorf("extra package installation failed: %w", err)
+	}
+
 	// Configure the device agent
 	logger.Info("Configuring FlowFuse Device Agent...")
 	installMode, autoStartService, err := nodejs.ConfigureDeviceAgent(url, otc, workDir, port)
@@ -139,6 +232,14 @@ func Install(nodeVersion, agentVersion, url, otc, customWorkDir string, update b
 
 	logger.Debug("Service setup successful")
 
+	// Restrict device.yml to the service user and encrypt its credentials if requested; this
+	// runs after the service is registered so a virtual service account exists
+	if err := credentials.Protect(workDir, serviceName); err != nil {
+		logger.Error("Securing the device credentials failed: %v", err)
+		logger.LogFunctionExit("Install", nil, err)
+		return fmt.Errorf("securing the device credentials failed: %w", err)
+	}
+
 	// Start the service if auto-start is enabled for this installation mode
 	if autoStartService {
 		if err := service.Start(serviceName); err != nil {
@@ -158,13 +259,26 @@ func Install(nodeVersion, agentVersion, url, otc, customWorkDir string, update b
 		}
 	}
 	cfg := &config.InstallerConfig{
-		ServiceUsername:  utils.ServiceUsername,
-		ServiceName:      serviceName,
-		NodeVersion:      nodeVersion,
-		AgentVersion:     agentVersion,
-		Port:             port,
-		NodeExtraCACerts: caCertDest,
+		ServiceUsername:      utils.ServiceUsername,
+		ServiceUID:           utils.ServiceUID,
+		ServiceGID:           utils.ServiceGID,
+		ServiceHome:          utils.ServiceHome,
+		ServiceGroups:        utils.ServiceGroups,
+		ExistingAccount:      utils.UseExistingAccount,
+		ServiceName:          serviceName,
+		NodeVersion:          nodeVersion,
+		AgentVersion:         agentVersion,
+		Port:                 port,
+		NodeExtraCACerts:     caCertDest,
+		CacheDir:             cache.Dir,
+		NpmRegistry:          nodejs.Registry,
+		ExtraPackages:        extraPackages,
+		CredentialEncryption: credentials.Encryption,
+		AgentArgs:            service.AgentArgs,
+		Environment:          service.Environment,
 	}
+	cfg.AutoUpdate = prev.AutoUpdate
+	cfg.LastAutoUpdate = prev.LastAutoUpdate
 	logger.Debug("Saving configuration: %+v", cfg)
 	if err := config.SaveConfig(cfg, workDir); err != nil {
 		logger.Error("Could not save configuration: %v", err)
@@ -175,23 +289,118 @@ func Install(nodeVersion, agentVersion, url, otc, customWorkDir string, update b
 	return nil
 }
 
+// applyServiceAccountConfig fills the service account settings that were not
+// given on the command line from a previous installation's configuration.
+//
+// Parameters:
+//   - cfg: The previous installer configuration
+func applyServiceAccountConfig(cfg *config.InstallerConfig) {
+	if utils.ServiceUID == 0 {
+		utils.ServiceUID = cfg.ServiceUID
+	}
+	if utils.ServiceGID == 0 {
+		utils.ServiceGID = cfg.ServiceGID
+	}
+	if utils.ServiceHome == "" {
+		utils.ServiceHome = cfg.ServiceHome
+	}
+	if utils.ServiceGroups == nil {
+		utils.ServiceGroups = cfg.ServiceGroups
+	}
+	if cfg.ExistingAccount {
+		utils.UseExistingAccount = true
+	}
+}
+
+// applyLaunchConfig keeps the extra Device Agent arguments and environment
+// variables of an installation unless --agent-arg or --env replace them, and
+// records the values in effect in cfg.
+//
+// Parameters:
+//   - cfg: The configuration of the installation
+func applyLaunchConfig(cfg *config.InstallerConfig) {
+	if service.AgentArgs == nil {
+		service.AgentArgs = cfg.AgentArgs
+	}
+	if service.Environment == nil {
+		service.Environment = cfg.Environment
+	}
+	cfg.AgentArgs, cfg.Environment = service.AgentArgs, service.Environment
+	service.RegisterEnvironmentSecrets(cfg.Environment)
+}
+
+// registerService registers the service again with the given settings and
+// starts it if the device is configured.
+//
+// Parameters:
+//   - serviceName: The name of the service
+//   - workDir: The working directory of the installation
+//   - port: The TCP port number the device agent uses
+//   - caCertPath: The CA bundle the Device Agent trusts, or "" for none
+//
+// Returns:
+//   - error: An error if the service could not be removed, registered or started
+func registerService(serviceName, workDir string, port int, caCertPath string) error {
+	if service.IsInstalled(serviceName) {
+		if err := service.Uninstall(serviceName); err != nil {
+			return fmt.Errorf("service removal failed: %w", err)
+		}
+	}
+	if err := service.Install(serviceName, workDir, port, caCertPath); err != nil {
+		return fmt.Errorf("service setup failed: %w", err)
+	}
+	if err := credentials.Protect(workDir, serviceName); err != nil {
+		return fmt.Errorf("securing the device credentials failed: %w", err)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "device.yml")); err != nil {
+		logger.Info("device.yml not found, the service was not started")
+		return nil
+	}
+	return service.Start(serviceName)
+}
+
+// UninstallOptions selects what Uninstall keeps or additionally removes.
+type UninstallOptions struct {
+	// KeepConfig keeps the device identity: device.yml, installer.conf and the CA bundle
+	KeepConfig bool
+	// KeepData keeps the Node-RED user directory with the project files
+	KeepData bool
+	// Purge also removes the artifact and npm caches, log files outside the
+	// working directory and the service user, without prompting
+	Purge bool
+}
+
 // Uninstall removes the FlowFuse Device Agent from the system.
 // It performs the following steps:
 // 1. Verifies if the device agent is currently installed
 // 2. Removes the device agent service
 // 3. Uninstalls the device agent package
-// 4. Removes the working directory
+// 4. Removes the working directory, except for the entries kept by the options
 // 5. Removes the service account that was used to run the agent
+// 6. With Purge, removes caches and external log files without asking
+// 7. Prints a summary of what was removed and what was kept
+//
+// The artifact cache and the service account are shared by the instances on
+// other ports, and are kept while another Device Agent service exists.
 //
 // The function uses configuration settings if available, or falls back to
 // default values when the configuration cannot be loaded.
 //
+// Parameters:
+//   - customWorkDir: Optional custom working directory path. If empty, uses default path.
+//   - opts: What to keep or additionally remove
+//
 // Returns an error if any step in the uninstallation process fails.
-func Uninstall(customWorkDir string) error {
+func Uninstall(customWorkDir string, opts UninstallOptions) error {
 	logger.LogFunctionEntry("Uninstall", map[string]interface{}{
 		"customWorkDir": customWorkDir,
+		"keepConfig":    opts.KeepConfig,
+		"keepData":      opts.KeepData,
+		"purge":         opts.Purge,
 	})
 
+	var removed, kept []string
+
 	// Get the working directory first to show it in the confirmation prompt
 	logger.Debug("Getting working directory...")
 	workDir, err := utils.GetWorkingDirectory(customWorkDir)
@@ -213,7 +422,8 @@ func Uninstall(customWorkDir string) error {
 	// Show confirmation prompt with the directory path
 	logger.Info("This will uninstall the FlowFuse Device Agent from: %s\n", workDir)
 
-	confirmed := utils.PromptYesNo("Do you want to proceed with the removal?", false)
+	// --purge asks for nothing
+	confirmed := opts.Purge || utils.PromptYesNo("Do you want to proceed with the removal?", false)
 	if !confirmed {
 		logger.Info("Uninstall cancelled by user")
 		logger.LogFunctionExit("Uninstall", "cancelled", nil)
@@ -251,10 +461,21 @@ func Uninstall(customWorkDir string) error {
 			return fmt.Errorf("service removal failed: %w", err)
 		}
 		logger.Debug("Service successfully removed")
+		removed = append(removed, fmt.Sprintf("service %s", serviceName))
 	} else {
 		logger.Info("FlowFuse Device Agent service is not installed on this system, skipping service removal")
 	}
 
+	if service.IsUpdateJobInstalled(serviceName) {
+		logger.Info("Removing the scheduled update job...")
+		if err := service.UninstallUpdateJob(serviceName); err != nil {
+			logger.Error("Scheduled update job removal failed: %v", err)
+			logger.LogFunctionExit("Uninstall", nil, err)
+			return fmt.Errorf("scheduled update job removal failed: %w", err)
+		}
+		removed = append(removed, fmt.Sprintf("scheduled update job %s", service.UpdateJobName(serviceName)))
+	}
+
 	// Get the working directory
 	logger.Debug("Getting working directory...")
 	workDir, err = utils.GetWorkingDirectory(customWorkDir)
@@ -273,6 +494,7 @@ func Uninstall(customWorkDir string) error {
 		return fmt.Errorf("device agent removal failed: %w", err)
 	}
 	logger.Debug("Device agent package successfully removed")
+	removed = append(removed, "Device Agent package")
 
 	// Load saved configuration to get the system username
 	logger.Debug("Loading saved configuration...")
@@ -289,17 +511,93 @@ func Uninstall(customWorkDir string) error {
 	}
 
 	// Remove contents of the working directory
+	var preserve []string
+	if opts.KeepConfig {
+		preserve = append(preserve, "device.yml", "installer.conf", "ca-certificates.pem")
+		for _, mode := range []string{credentials.ModeSystemdCreds, credentials.ModeKeyFile, credentials.ModeDPAPI} {
+			preserve = append(preserve, filepath.Base(credentials.EncryptedConfigPath(workDir, mode)))
+		}
+		preserve = append(preserve, "decrypt-credentials.js", "start-device-agent.ps1")
+	}
+	if opts.KeepData {
+		preserve = append(preserve, nodejs.NodeREDUserDir, nodejs.NodeREDNodesDir)
+	}
+	for _, name := range preserve {
+		if _, err := os.Stat(filepath.Join(workDir, name)); err == nil {
+			kept = append(kept, filepath.Join(workDir, name))
+		}
+	}
 	logger.Info("Removing working directory...")
-	if err := utils.RemoveWorkingDirectory(workDir); err != nil {
+	if err := utils.RemoveWorkingDirectory(workDir, preserve...); err != nil {
 		logger.Error("Failed to remove working directory content: %v", err)
 		logger.LogFunctionExit("Uninstall", nil, err)
 		return fmt.Errorf("failed to remove working directory content: %w", err)
 	}
+	if len(kept) == 0 && opts.Purge {
+		if err := utils.RemoveDirectory(workDir); err != nil {
+			logger.Error("Failed to remove working directory: %v", err)
+		}
+		removed = append(removed, fmt.Sprintf("working directory %s", workDir))
+	} else {
+		removed = append(removed, fmt.Sprintf("contents of %s", workDir))
+	}
 	logger.Debug("Working directory successfully removed")
 
-	// Confirm service account removal
-	confirmUseraccountRemoval := utils.ConfirmUserRemoval(savedUsername)
-	if confirmUseraccountRemoval {
+	// Record that the configuration was kept on purpose, so that installing
+	// again reuses it without asking
+	if opts.KeepConfig && cfg != nil {
+		cfg.KeptByUninstall = true
+		if err := config.SaveConfig(cfg, workDir); err != nil {
+			logger.Error("Could not save configuration: %v", err)
+		}
+	}
+
+	// The key of keyfile-encrypted credentials lives outside the working directory
+	if !opts.KeepConfig && credentials.RemoveKeyFile(serviceName) {
+		removed = append(removed, credentials.KeyFilePath(serviceName))
+	}
+
+	// The cache and the service account are shared with the Device Agent
+	// instances on other ports, and are only removed with the last one
+	otherServices := service.OtherServices(serviceName)
+	if len(otherServices) > 0 {
+		logger.Debug("Other FlowFuse Device Agent services: %v", otherServices)
+	}
+
+	// With --purge, remove what lives outside the working directory as well
+	if opts.Purge {
+		for _, logFile := range service.LogFiles(serviceName) {
+			if err := utils.RemoveDirectory(logFile); err != nil {
+				logger.Error("Failed to remove log file %s: %v", logFile, err)
+				continue
+			}
+			removed = append(removed, logFile)
+		}
+
+		if cfg != nil && cache.Dir == "" {
+			cache.Dir = cfg.CacheDir
+		}
+		if len(otherServices) > 0 {
+			kept = append(kept, fmt.Sprintf("cache %s (used by %s)", cache.Root(), strings.Join(otherServices, ", ")))
+		} else if freed, err := cache.Purge(); err != nil {
+			logger.Error("Failed to remove cache %s: %v", cache.Root(), err)
+		} else if freed > 0 {
+			removed = append(removed, fmt.Sprintf("cache %s (%s)", cache.Root(), download.FormatBytes(freed)))
+		}
+	}
+
+	// An existing account was not created by the installer and is never removed,
+	// also when only --use-existing-account says so (e.g. installer.conf is gone)
+	existingAccount := (cfg != nil && cfg.ExistingAccount) || utils.UseExistingAccount
+
+	// Confirm service account removal (not asked when purging)
+	if existingAccount {
+		logger.Debug("Service account %s existed before installation, not removing it", savedUsername)
+		kept = append(kept, fmt.Sprintf("service account %s (existing account)", savedUsername))
+	} else if len(otherServices) > 0 {
+		logger.Debug("Other services may run as %s, not removing it", savedUsername)
+		kept = append(kept, fmt.Sprintf("service account %s (used by %s)", savedUsername, strings.Join(otherServices, ", ")))
+	} else if opts.Purge || utils.ConfirmUserRemoval(savedUsername) {
 		// Remove service account
 		logger.Info("Removing service account...")
 		if err := utils.RemoveServiceUser(savedUsername); err != nil {
@@ -320,10 +618,28 @@ func Uninstall(customWorkDir string) error {
 			}
 		} else {
 			logger.Debug("Service account successfully removed")
+			removed = append(removed, fmt.Sprintf("service account %s", savedUsername))
 		}
+	} else {
+		kept = append(kept, fmt.Sprintf("service account %s", savedUsername))
 	}
 
 	logger.Info("FlowFuse Device Agent has been uninstalled!")
+	logger.Info("")
+	logger.Info("Removed:")
+	for _, item := range removed {
+		logger.Info("  - %s", item)
+	}
+	if len(kept) > 0 {
+		logger.Info("Kept:")
+		for _, item := range kept {
+			logger.Info("  - %s", item)
+		}
+	}
+	if opts.KeepConfig {
+		logger.Info("")
+		logger.Info("Installing again into %s will reuse the kept device configuration.", workDir)
+	}
 
 	logger.LogFunctionExit("Uninstall", "success", nil)
 	return nil
@@ -382,6 +698,12 @@ func Update(agentVersion, nodeVersion, customWorkDir string, updateAgent, update
 		default:
 			serviceName = s
 		}
+		if cache.Dir == "" {
+			cache.Dir = cfg.CacheDir
+		}
+		if nodejs.Registry == "" {
+			nodejs.Registry = cfg.NpmRegistry
+		}
 	}
 
 	// Check if the device agent is installed
@@ -431,9 +753,50 @@ func Update(agentVersion, nodeVersion, customWorkDir string, updateAgent, update
 		}
 	}
 
-	// Stop the service temporarily for the update (if we're updating anything)
-	serviceWasStopped := false
+	// Check the Node.js version the agent will run on after this update
+	checkNodeVersion := nodeVersion
+	if !nodeUpdateNeeded && cfg != nil && cfg.NodeVersion != "" {
+		checkNodeVersion = cfg.NodeVersion
+	}
+	if err := nodejs.CheckNodeRelease(checkNodeVersion); err != nil {
+		logger.LogFunctionExit("Update", nil, err)
+		return fmt.Errorf("node.js release check failed: %w", err)
+	}
+
+	// Make sure the Device Agent that will be installed supports that Node.js version
 	if nodeUpdateNeeded || agentUpdateNeeded {
+		checkAgentVersion := agentVersion
+		if !agentUpdateNeeded && cfg != nil {
+			checkAgentVersion = cfg.AgentVersion
+		}
+		if _, err := nodejs.CheckDeviceAgentCompatibility(checkAgentVersion, checkNodeVersion, false); err != nil {
+			logger.LogFunctionExit("Update", nil, err)
+			return fmt.Errorf("compatibility check failed: %w", err)
+		}
+	}
+
+	// With --update-agent the extra packages are reconciled too; newly requested
+	// ones need a restart to be picked up
+	reconcilePackages := updateAgent || nodeUpdateNeeded
+	var extraPackages []config.NpmPackage
+	if cfg != nil {
+		extraPackages = nodejs.MergePackages(cfg.ExtraPackages, nodejs.ExtraPackages)
+	}
+	installPackages := reconcilePackages && len(extraPackages) > 0
+
+	// A staged update would replace the versions installed now when applied
+	if reconcilePackages {
+		if err := discardStagedUpdate(workDir); err != nil {
+			logger.Error("Discarding the staged update failed: %v", err)
+			logger.LogFunctionExit("Update", nil, err)
+			return fmt.Errorf("discarding the staged update failed: %w", err)
+		}
+	}
+
+	// Stop the service temporarily for the update (if we're updating anything,
+	// including the saved extra packages that are reinstalled)
+	serviceWasStopped := false
+	if nodeUpdateNeeded || agentUpdateNeeded || installPackages {
 		if err := service.Stop(serviceName); err != nil {
 			logger.Error("Service stop failed: %v", err)
 			logger.LogFunctionExit("Update", nil, err)
@@ -447,6 +810,17 @@ func Update(agentVersion, nodeVersion, customWorkDir string, updateAgent, update
 	if nodeUpdateNeeded {
 		if err := nodejs.UpdateNodeJs(nodeVersion, workDir); err != nil {
 			logger.Error("Node.js update failed: %v", err)
+			// Roll back to the previous Node.js version (from the artifact cache) and
+			// reinstall the Device Agent package, which was removed with the old runtime
+			if cfg != nil && cfg.NodeVersion != "" && cfg.NodeVersion != nodeVersion {
+				if rbErr := nodejs.RestoreNodeJs(cfg.NodeVersion, workDir); rbErr != nil {
+					logger.Error("Node.js rollback failed: %v", rbErr)
+				} else if rbErr := nodejs.InstallDeviceAgent(cfg.AgentVersion, workDir, false); rbErr != nil {
+					logger.Error("Device Agent reinstall after rollback failed: %v", rbErr)
+				} else if rbErr := nodejs.InstallExtraPackages(cfg.ExtraPackages, workDir); rbErr != nil {
+					logger.Error("Extra package reinstall after rollback failed: %v", rbErr)
+				}
+			}
 			// Try to start the service even if Node.js update failed
 			if serviceWasStopped {
 				logger.Debug("Starting FlowFuse Device Agent service after Node.js update failure")
@@ -518,6 +892,25 @@ func Update(agentVersion, nodeVersion, customWorkDir string, updateAgent, update
 		logger.Debug("Device Agent update successful")
 	}
 
+	if installPackages {
+		if err := nodejs.InstallExtraPackages(extraPackages, workDir); err != nil {
+			logger.Error("Extra package installation failed: %v", err)
+			if serviceWasStopped {
+				if startErr := service.Start(serviceName); startErr != nil {
+					logger.Error("Failed to restart service after extra package installation failure: %v", startErr)
+				}
+			}
+			logger.LogFunctionExit("Update", nil, err)
+			return fmt.Errorf("extra package installation failed: %w", err)
+		}
+		if latest, err := config.LoadConfig(customWorkDir); err == nil {
+			latest.ExtraPackages = extraPackages
+			if err := config.SaveConfig(latest, customWorkDir); err != nil {
+				logger.Error("Failed to update extra packages in configuration: %v", err)
+			}
+		}
+	}
+
 	if serviceWasStopped {
 		if err := service.Start(serviceName); err != nil {
 			logger.Error("Service start failed: %v", err)
@@ -541,3 +934,97 @@ func Update(agentVersion, nodeVersion, customWorkDir string, updateAgent, update
 	logger.LogFunctionExit("Update", "success", nil)
 	return nil
 }
+
+// verifyConnectivity checks the connection to the FlowFuse platform before the
+// Device Agent is configured, and reports the TLS chain and HTTP status.
+// Without a device.yml the one-time code is exchanged with the platform during
+// the installation, so a failure that retrying does not fix (an invalid URL, a
+// host name that does not resolve, or TLS; see validate.IsConfigurationError)
+// stops it; other failures, such as a server error or a timeout, only warn.
+// With a device.yml that is kept or supplied (provisioning), its platform and
+// MQTT broker are checked; the Device Agent connects to them once the service
+// runs and keeps retrying, so failures only warn. validate.SkipConnectivityCheck
+// skips the check.
+//
+// Parameters:
+//   - url: The FlowFuse URL given on the command line
+//   - otc: The one-time code, if any
+//   - workDir: The working directory
+//
+// Returns:
+//   - error: An actionable error if the platform the one-time code is used with cannot be reached
+func verifyConnectivity(url, otc, workDir string) error {
+	if validate.SkipConnectivityCheck {
+		logger.Debug("Skipping the connection check (--skip-connectivity-check)")
+		return nil
+	}
+
+	var device utils.DeviceConfig
+	supplied := false
+	path := filepath.Join(workDir, "device.yml")
+	if _, err := os.Stat(path); err == nil {
+		data, err := utils.ReadPrivilegedFile(path)
+		if err == nil {
+			err = yaml.Unmarshal(data, &device)
+		}
+		if err != nil {
+			logger.Debug("Skipping the connection check of %s: %v", path, err)
+			return nil
+		}
+		supplied = true
+	} else if nodejs.ProvisioningConfig != "" {
+		if err := yaml.Unmarshal([]byte(nodejs.ProvisioningConfig), &device); err == nil {
+			supplied = true
+		}
+	}
+
+	if supplied {
+		if device.ForgeURL != "" {
+			conn, err := validate.VerifyPlatform(device.ForgeURL)
+			reportConnection("FlowFuse platform", conn, err)
+		}
+		if device.BrokerURL != "" {
+			conn, err := validate.VerifyBroker(device.BrokerURL)
+			reportConnection("MQTT broker", conn, err)
+		}
+		return nil
+	}
+
+	if url == "" {
+		if otc == "" {
+			// The Device Agent asks for the platform
+			return nil
+		}
+		url = defaultFlowFuseURL
+	}
+	conn, err := validate.VerifyPlatform(url)
+	if err != nil && otc != "" && validate.IsConfigurationError(err) {
+		for _, line := range conn.Describe() {
+			logger.Info("  %s", line)
+		}
+		return fmt.Errorf("%w (use --skip-connectivity-check to install anyway)", err)
+	}
+	reportConnection("FlowFuse platform", conn, err)
+	return nil
+}
+
+// reportConnection logs the outcome of a connection check; a failure is
+// logged as a warning.
+//
+// Parameters:
+//   - name: What was connected to, e.g. "MQTT broker"
+//   - conn: The details of the connection
+//   - err: The error of the connection check, if any
+func reportConnection(name string, conn *validate.Connection, err error) {
+	if err == nil {
+		logger.Info("Connected to the %s at %s", name, conn.URL)
+	}
+	for _, line := range conn.Describe() {
+		logger.Info("  %s", line)
+	}
+	if err != nil {
+		logger.Info("%s could not connect to the %s at %s: %v", style.Yellow("Warning:"), name, conn.URL, err)
+	} else if conn.Warning != "" {
+		logger.Info("%s %s", style.Yellow("Warning:"), conn.Warning)
+	}
+}
@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
+	"github.com/flowfuse/device-agent-installer/pkg/certs"
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/credentials"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
+	"github.com/flowfuse/device-agent-installer/pkg/service"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+)
+
+// renderManifestName is the file describing a render directory.
+const renderManifestName = "manifest.json"
+
+// renderManifest lists the files in a render directory and where the
+// installer would write them.
+type renderManifest struct {
+	Target      string               `json:"target"`
+	ServiceName string               `json:"serviceName"`
+	WorkDir     string               `json:"workDir"`
+	Port        int                  `json:"port"`
+	Files       []renderManifestFile `json:"files"`
+}
+
+// renderManifestFile describes one rendered file.
+type renderManifestFile struct {
+	Name string `json:"name"`
+	Path string `json:"path,omitempty"`
+	Mode string `json:"mode,omitempty"`
+}
+
+// Render writes the files an installation with the given options would put on
+// a system, without installing anything: the service definition for the
+// target operating system and init system, the CA bundle, and a preview of
+// installer.conf. A manifest.json lists where each file would be written.
+// The Device Agent version is recorded as given, "latest" is not resolved.
+//
+// Parameters:
+//   - outputDir: The directory to write the files to; created if missing
+//   - targetOS: The operating system to render for; empty for this system
+//   - initSystem: The Linux init system (systemd, sysvinit or openrc); empty for
+//     the one of this system, or systemd when rendering for another system
+//   - nodeVersion: The Node.js version to record
+//   - agentVersion: The Device Agent version to record
+//   - customWorkDir: Optional working directory on the target. If empty, uses the target's default path.
+//   - port: The port the Device Agent listens on
+//   - caCertPaths: CA bundles to combine into the installed bundle
+//
+// Returns:
+//   - error: An error if the target or options are not supported, or a file cannot be written
+func Render(outputDir, targetOS, initSystem, nodeVersion, agentVersion, customWorkDir string, port int, caCertPaths []string) error {
+	logger.LogFunctionEntry("Render", map[string]interface{}{
+		"outputDir":     outputDir,
+		"targetOS":      targetOS,
+		"initSystem":    initSystem,
+		"nodeVersion":   nodeVersion,
+		"agentVersion":  agentVersion,
+		"customWorkDir": customWorkDir,
+		"port":          port,
+		"caCertPaths":   caCertPaths,
+	})
+
+	target := service.Target{OS: targetOS, Init: initSystem}
+	if targetOS == "" || targetOS == runtime.GOOS {
+		detected := service.DetectTarget()
+		target.OS = detected.OS
+		if target.Init == "" {
+			target.Init = detected.Init
+		}
+	}
+	if target.OS == "linux" && target.Init == "" {
+		target.Init = service.InitSystemd
+	}
+	if err := target.Validate(); err != nil {
+		logger.Error("%v", err)
+		logger.LogFunctionExit("Render", nil, err)
+		return err
+	}
+	if err := credentials.ValidateFor(credentials.Encryption, target.OS, target.Init == service.InitSystemd); err != nil {
+		logger.Error("%v", err)
+		logger.LogFunctionExit("Render", nil, err)
+		return err
+	}
+
+	workDir := customWorkDir
+	if workDir == "" {
+		var err error
+		if workDir, err = utils.DefaultWorkingDirectoryFor(target.OS); err != nil {
+			logger.Error("%v", err)
+			logger.LogFunctionExit("Render", nil, err)
+			return err
+		}
+	}
+	serviceName := fmt.Sprintf("flowfuse-device-agent-%d", port)
+
+	var caBundle []byte
+	caCertDest := ""
+	if len(caCertPaths) > 0 || certs.SystemStore {
+		var err error
+		if caBundle, err = certs.Build(caCertPaths, certs.SystemStore); err != nil {
+			logger.Error("Invalid CA certificate: %v", err)
+			logger.LogFunctionExit("Render", nil, err)
+			return fmt.Errorf("invalid CA certificate: %w", err)
+		}
+		caCertDest = target.Join(workDir, "ca-certificates.pem")
+	}
+
+	files, err := service.Render(target, serviceName, workDir, port, caCertDest)
+	if err != nil {
+		logger.Error("%v", err)
+		logger.LogFunctionExit("Render", nil, err)
+		return err
+	}
+	if caBundle != nil {
+		files = append(files, service.RenderedFile{Name: "ca-certificates.pem", Path: caCertDest, Content: caBundle})
+	}
+
+	cfg := &config.InstallerConfig{
+		ServiceUsername:      utils.ServiceUsername,
+		ServiceUID:           utils.ServiceUID,
+		ServiceGID:           utils.ServiceGID,
+		ServiceHome:          utils.ServiceHome,
+		ServiceGroups:        utils.ServiceGroups,
+		ExistingAccount:      utils.UseExistingAccount,
+		ServiceName:          serviceName,
+		NodeVersion:          nodeVersion,
+		AgentVersion:         agentVersion,
+		Port:                 port,
+		NodeExtraCACerts:     caCertDest,
+		CacheDir:             cache.Dir,
+		NpmRegistry:          nodejs.Registry,
+		ExtraPackages:        nodejs.ExtraPackages,
+		CredentialEncryption: credentials.Encryption,
+		AgentArgs:            service.AgentArgs,
+		Environment:          service.Environment,
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		logger.Error("Failed to marshal config: %v", err)
+		logger.LogFunctionExit("Render", nil, err)
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+	files = append(files, service.RenderedFile{Name: "installer.conf", Path: target.Join(workDir, "installer.conf"), Mode: "644", Content: data})
+
+	manifest := renderManifest{Target: target.String(), ServiceName: serviceName, WorkDir: workDir, Port: port}
+	for _, file := range files {
+		manifest.Files = append(manifest.Files, renderManifestFile{Name: file.Name, Path: file.Path, Mode: file.Mode})
+	}
+	data, err = json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		logger.Error("Failed to marshal manifest: %v", err)
+		logger.LogFunctionExit("Render", nil, err)
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	files = append(files, service.RenderedFile{Name: renderManifestName, Content: append(data, '\n')})
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		logger.Error("Failed to create %s: %v", outputDir, err)
+		logger.LogFunctionExit("Render", nil, err)
+		return fmt.Errorf("failed to create %s: %w", outputDir, err)
+	}
+	for _, file := range files {
+		if err := os.WriteFile(filepath.Join(outputDir, file.Name), file.Content, 0644); err != nil {
+			logger.Error("Failed to write %s: %v", file.Name, err)
+			logger.LogFunctionExit("Render", nil, err)
+			return fmt.Errorf("failed to write %s: %w", file.Name, err)
+		}
+	}
+
+	logger.Info("Rendered the %s installation to %s:", target, outputDir)
+	for _, file := range manifest.Files {
+		if file.Path != "" {
+			logger.Info("  %s -> %s", file.Name, file.Path)
+		} else {
+			logger.Info("  %s", file.Name)
+		}
+	}
+	logger.LogFunctionExit("Render", "success", nil)
+	return nil
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/selfupdate"
+)
+
+// SelfUpdate replaces the running installer with the latest release.
+// It performs the following steps:
+// 1. Downloads the release manifest and verifies its signature
+// 2. Compares the release with the running version
+// 3. Downloads the binary of the running platform, verifies its checksum and atomically replaces the executable
+//
+// Installed Device Agents are not touched; use --update-agent and
+// --update-nodejs with the new installer to update them.
+//
+// Parameters:
+//   - currentVersion: The version of the running installer
+//
+// Returns:
+//   - error: An error if the manifest cannot be verified or the executable cannot be replaced
+func SelfUpdate(currentVersion string) error {
+	logger.LogFunctionEntry("SelfUpdate", map[string]interface{}{
+		"currentVersion": currentVersion,
+		"manifestURL":    selfupdate.ManifestURL,
+	})
+
+	logger.Info("Checking for a newer installer release...")
+	manifest, manifestURL, err := selfupdate.FetchManifest()
+	if err != nil {
+		logger.Error("Failed to check for a newer installer release: %v", err)
+		logger.LogFunctionExit("SelfUpdate", nil, err)
+		return fmt.Errorf("failed to check for a newer installer release: %w", err)
+	}
+
+	if !selfupdate.IsNewer(manifest.Version, currentVersion) {
+		logger.Info("The installer is up to date (version %s, latest release %s)", currentVersion, manifest.Version)
+		logger.LogFunctionExit("SelfUpdate", "up to date", nil)
+		return nil
+	}
+
+	logger.Info("Updating the installer from %s to %s...", currentVersion, manifest.Version)
+	exePath, err := selfupdate.Apply(manifest, manifestURL)
+	if err != nil {
+		logger.Error("Installer update failed: %v", err)
+		logger.LogFunctionExit("SelfUpdate", nil, err)
+		return fmt.Errorf("installer update failed: %w", err)
+	}
+
+	logger.Info("Installer updated to %s: %s", manifest.Version, exePath)
+	logger.LogFunctionExit("SelfUpdate", "success", nil)
+	return nil
+}
@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/credentials"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
+	"github.com/flowfuse/device-agent-installer/pkg/service"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+	"github.com/flowfuse/device-agent-installer/pkg/validate"
+)
+
+// StageUpdate prepares an update of Node.js and/or the Device Agent while the
+// service keeps running, so that applying it later (see ApplyStaged) only
+// needs a restart.
+// It performs the following steps:
+// 1. Determines the versions to stage; components not selected keep their installed version
+// 2. Checks the Node.js release and the compatibility of the two versions
+// 3. Installs the complete runtime next to the one in use (see nodejs.StageRuntime)
+// 4. Records the staged versions in the installer configuration
+//
+// Parameters:
+//   - agentVersion: The Device Agent version to stage ("latest" or x.y.z)
+//   - nodeVersion: The Node.js version to stage
+//   - customWorkDir: Optional custom working directory path. If empty, uses default path.
+//   - updateAgent: Whether to stage agentVersion
+//   - updateNode: Whether to stage nodeVersion
+//
+// Returns:
+//   - error: An error if no installation is found, a check fails or the runtime cannot be installed
+func StageUpdate(agentVersion, nodeVersion, customWorkDir string, updateAgent, updateNode bool) error {
+	logger.LogFunctionEntry("StageUpdate", map[string]interface{}{
+		"agentVersion":  agentVersion,
+		"nodeVersion":   nodeVersion,
+		"customWorkDir": customWorkDir,
+		"updateAgent":   updateAgent,
+		"updateNode":    updateNode,
+	})
+
+	workDir, cfg, serviceName, err := loadStagedInstallation(customWorkDir)
+	if err != nil {
+		logger.LogFunctionExit("StageUpdate", nil, err)
+		return err
+	}
+	if !service.IsInstalled(serviceName) {
+		err := fmt.Errorf("FlowFuse Device Agent is not installed on this system")
+		logger.LogFunctionExit("StageUpdate", nil, err)
+		return err
+	}
+
+	targetNode := cfg.NodeVersion
+	if updateNode {
+		targetNode = nodeVersion
+	}
+	targetAgent := cfg.AgentVersion
+	if updateAgent {
+		targetAgent = agentVersion
+		if targetAgent == "latest" {
+			if targetAgent, err = nodejs.GetLatestDeviceAgentVersion(workDir); err != nil {
+				logger.LogFunctionExit("StageUpdate", nil, err)
+				return err
+			}
+		}
+	}
+	if targetNode == cfg.NodeVersion && targetAgent == cfg.AgentVersion && len(nodejs.ExtraPackages) == 0 {
+		logger.Info("Node.js %s and Device Agent %s are already installed, nothing to stage", targetNode, targetAgent)
+		logger.LogFunctionExit("StageUpdate", "up to date", nil)
+		return nil
+	}
+
+	if err := nodejs.CheckNodeRelease(targetNode); err != nil {
+		logger.LogFunctionExit("StageUpdate", nil, err)
+		return fmt.Errorf("node.js release check failed: %w", err)
+	}
+	if _, err := nodejs.CheckDeviceAgentCompatibility(targetAgent, targetNode, false); err != nil {
+		logger.LogFunctionExit("StageUpdate", nil, err)
+		return fmt.Errorf("compatibility check failed: %w", err)
+	}
+
+	packages := nodejs.MergePackages(cfg.ExtraPackages, nodejs.ExtraPackages)
+	logger.Info("Staging Node.js %s and Device Agent %s, the service keeps running...", targetNode, targetAgent)
+	if err := nodejs.StageRuntime(targetNode, targetAgent, workDir, packages); err != nil {
+		logger.Error("Staging the update failed: %v", err)
+		logger.LogFunctionExit("StageUpdate", nil, err)
+		return fmt.Errorf("staging the update failed: %w", err)
+	}
+
+	cfg.StagedUpdate = &config.StagedUpdate{
+		Time:          time.Now(),
+		NodeVersion:   targetNode,
+		AgentVersion:  targetAgent,
+		ExtraPackages: packages,
+	}
+	if err := config.SaveConfig(cfg, workDir); err != nil {
+		logger.Error("Failed to save configuration: %v", err)
+		logger.LogFunctionExit("StageUpdate", nil, err)
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+
+	logger.Info("Update staged. Apply it with --apply-staged, which only restarts the service.")
+	logger.LogFunctionExit("StageUpdate", "success", nil)
+	return nil
+}
+
+// ApplyStaged switches an installation to the runtime prepared with
+// StageUpdate. It performs the following steps:
+// 1. Stops the service
+// 2. Swaps the staged runtime with the one in use (see nodejs.SwitchToStagedRuntime)
+// 3. Starts the service; if it does not start, the previous runtime is restored and started
+// 4. Records the new versions in the installer configuration
+//
+// Parameters:
+//   - customWorkDir: Optional custom working directory path. If empty, uses default path.
+//
+// Returns:
+//   - error: An error if nothing is staged, or the staged runtime could not be switched to
+func ApplyStaged(customWorkDir string) error {
+	logger.LogFunctionEntry("ApplyStaged", map[string]interface{}{
+		"customWorkDir": customWorkDir,
+	})
+
+	workDir, cfg, serviceName, err := loadStagedInstallation(customWorkDir)
+	if err != nil {
+		logger.LogFunctionExit("ApplyStaged", nil, err)
+		return err
+	}
+	staged := cfg.StagedUpdate
+	if staged == nil || !nodejs.IsRuntimeStaged(workDir) {
+		err := fmt.Errorf("no staged update found in %s, use --stage-update first", workDir)
+		logger.LogFunctionExit("ApplyStaged", nil, err)
+		return err
+	}
+	if !service.IsInstalled(serviceName) {
+		err := fmt.Errorf("FlowFuse Device Agent is not installed on this system")
+		logger.LogFunctionExit("ApplyStaged", nil, err)
+		return err
+	}
+
+	logger.Info("Applying the staged update: Node.js %s, Device Agent %s", staged.NodeVersion, staged.AgentVersion)
+	if err := service.Stop(serviceName); err != nil {
+		logger.Error("Service stop failed: %v", err)
+		logger.LogFunctionExit("ApplyStaged", nil, err)
+		return fmt.Errorf("service stop failed: %w", err)
+	}
+
+	if err := nodejs.SwitchToStagedRuntime(workDir); err != nil {
+		logger.Error("Switching to the staged runtime failed: %v", err)
+		if startErr := service.Start(serviceName); startErr != nil {
+			logger.Error("Failed to restart service: %v", startErr)
+		}
+		logger.LogFunctionExit("ApplyStaged", nil, err)
+		return fmt.Errorf("switching to the staged runtime failed: %w", err)
+	}
+
+	if err := service.Start(serviceName); err != nil {
+		logger.Error("Service start with the staged runtime failed: %v", err)
+		logger.Info("Rolling back to Node.js %s and Device Agent %s...", cfg.NodeVersion, cfg.AgentVersion)
+		if rbErr := nodejs.RestorePreviousRuntime(workDir); rbErr != nil {
+			logger.Error("Rollback failed: %v", rbErr)
+		} else if startErr := service.Start(serviceName); startErr != nil {
+			logger.Error("Failed to restart service after rollback: %v", startErr)
+		}
+		cfg.StagedUpdate = nil
+		if saveErr := config.SaveConfig(cfg, workDir); saveErr != nil {
+			logger.Error("Failed to save configuration: %v", saveErr)
+		}
+		logger.LogFunctionExit("ApplyStaged", nil, err)
+		return fmt.Errorf("service start with the staged runtime failed, rolled back: %w", err)
+	}
+
+	cfg.NodeVersion = staged.NodeVersion
+	cfg.AgentVersion = staged.AgentVersion
+	cfg.ExtraPackages = staged.ExtraPackages
+	cfg.StagedUpdate = nil
+	if err := config.SaveConfig(cfg, workDir); err != nil {
+		logger.Error("Failed to save configuration: %v", err)
+		logger.LogFunctionExit("ApplyStaged", nil, err)
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+	if err := nodejs.RemovePreviousRuntime(workDir); err != nil {
+		logger.Error("Failed to remove the previous runtime: %v", err)
+	}
+
+	logger.Info("Staged update applied: Node.js %s, Device Agent %s", staged.NodeVersion, staged.AgentVersion)
+	logger.LogFunctionExit("ApplyStaged", "success", nil)
+	return nil
+}
+
+// discardStagedUpdate removes an update prepared with StageUpdate. An update
+// or reinstall calls it before changing the runtime, as applying the staged
+// update afterwards would replace the versions it installs.
+//
+// Parameters:
+//   - workDir: The working directory of the installation
+//
+// Returns:
+//   - error: An error if the staged runtime cannot be removed or the configuration cannot be saved
+func discardStagedUpdate(workDir string) error {
+	cfg, err := config.LoadConfig(workDir)
+	if err != nil {
+		cfg = nil
+	}
+	if !nodejs.IsRuntimeStaged(workDir) && (cfg == nil || cfg.StagedUpdate == nil) {
+		return nil
+	}
+	if cfg != nil && cfg.StagedUpdate != nil {
+		logger.Info("Discarding the staged update to Node.js %s and Device Agent %s", cfg.StagedUpdate.NodeVersion, cfg.StagedUpdate.AgentVersion)
+	}
+	if err := nodejs.DiscardStagedRuntime(workDir); err != nil {
+		return fmt.Errorf("failed to remove the staged runtime: %w", err)
+	}
+	if cfg != nil && cfg.StagedUpdate != nil {
+		cfg.StagedUpdate = nil
+		if err := config.SaveConfig(cfg, workDir); err != nil {
+			return fmt.Errorf("failed to save configuration: %w", err)
+		}
+	}
+	return nil
+}
+
+// loadStagedInstallation returns the working directory, configuration and
+// service name of an installation, and applies its service account and cache
+// settings.
+func loadStagedInstallation(customWorkDir string) (string, *config.InstallerConfig, string, error) {
+	workDir, err := utils.GetWorkingDirectory(customWorkDir)
+	if err != nil {
+		logger.Error("Failed to get working directory: %v", err)
+		return "", nil, "", fmt.Errorf("failed to get working directory: %w", err)
+	}
+	if err := validate.ValidateUninstallDirectory(workDir); err != nil {
+		logger.Error("No installation found: %v", err)
+		return "", nil, "", fmt.Errorf("no installation found: %w", err)
+	}
+	if err := utils.CheckPermissions(); err != nil {
+		return "", nil, "", fmt.Errorf("permission check failed: %w", err)
+	}
+
+	cfg, err := config.LoadConfig(workDir)
+	if err != nil {
+		logger.Error("Could not load configuration: %v", err)
+		return "", nil, "", fmt.Errorf("could not load configuration: %w", err)
+	}
+	if cfg.ServiceUsername != "" {
+		utils.ServiceUsername = cfg.ServiceUsername
+	}
+	applyServiceAccountConfig(cfg)
+	credentials.Encryption = cfg.CredentialEncryption
+	if cache.Dir == "" {
+		cache.Dir = cfg.CacheDir
+	}
+	if nodejs.Registry == "" {
+		nodejs.Registry = cfg.NpmRegistry
+	}
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "flowfuse-device-agent"
+	}
+	return workDir, cfg, serviceName, nil
+}
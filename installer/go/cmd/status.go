@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
+	"github.com/flowfuse/device-agent-installer/pkg/certs"
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/credentials"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
+	"github.com/flowfuse/device-agent-installer/pkg/service"
+	"github.com/flowfuse/device-agent-installer/pkg/style"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+	"github.com/flowfuse/device-agent-installer/pkg/validate"
+)
+
+// Status reports the state of a FlowFuse Device Agent installation: the
+// installed versions, the service, and any release advisories for the
+// installed Node.js version.
+//
+// Parameters:
+//   - customWorkDir: Optional custom working directory path. If empty, uses default path.
+//
+// Returns:
+//   - error: An error if no installation is found, or if Node.js has release
+//     advisories and --strict is set
+func Status(customWorkDir string) error {
+	logger.LogFunctionEntry("Status", map[string]interface{}{
+		"customWorkDir": customWorkDir,
+	})
+
+	workDir, err := utils.GetWorkingDirectory(customWorkDir)
+	if err != nil {
+		logger.Error("Failed to get working directory: %v", err)
+		logger.LogFunctionExit("Status", nil, err)
+		return fmt.Errorf("failed to get working directory: %w", err)
+	}
+
+	if err := validate.ValidateUninstallDirectory(workDir); err != nil {
+		logger.Error("Status check failed: %v", err)
+		logger.LogFunctionExit("Status", nil, err)
+		return fmt.Errorf("no installation found: %w", err)
+	}
+
+	cfg, err := config.LoadConfig(workDir)
+	if err != nil {
+		logger.Error("Could not load configuration: %v", err)
+		logger.LogFunctionExit("Status", nil, err)
+		return fmt.Errorf("could not load configuration: %w", err)
+	}
+	if cache.Dir == "" {
+		cache.Dir = cfg.CacheDir
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "flowfuse-device-agent"
+	}
+	serviceState := style.Red("not installed")
+	if service.IsInstalled(serviceName) {
+		serviceState = style.Green("installed")
+	}
+
+	logger.Info("Installation directory: %s", workDir)
+	logger.Info("Service:                %s (%s)", serviceName, serviceState)
+	logger.Info("Service user:           %s", cfg.ServiceUsername)
+	logger.Info("Port:                   %d", cfg.Port)
+	logger.Info("Device Agent version:   %s", cfg.AgentVersion)
+	logger.Info("Node.js version:        %s", cfg.NodeVersion)
+	logger.Info("Artifact cache:         %s", cache.Root())
+	encryption := cfg.CredentialEncryption
+	if encryption == "" {
+		encryption = "none"
+	}
+	logger.Info("Credential encryption:  %s", encryption)
+	if len(cfg.AgentArgs) > 0 {
+		logger.Info("Agent arguments:        %s", strings.Join(cfg.AgentArgs, " "))
+	}
+	if len(cfg.Environment) > 0 {
+		// Only the names, values may hold secrets
+		names := make([]string, len(cfg.Environment))
+		for i, spec := range cfg.Environment {
+			names[i], _, _ = strings.Cut(spec, "=")
+		}
+		logger.Info("Service environment:    %s", strings.Join(names, ", "))
+	}
+	var warnings []string
+	if cfg.NodeExtraCACerts != "" {
+		certificates, err := certs.ReadFile(cfg.NodeExtraCACerts)
+		if err != nil {
+			logger.Info("CA bundle:              %s (%s)", cfg.NodeExtraCACerts, style.Red("invalid"))
+			warnings = append(warnings, err.Error())
+		} else {
+			logger.Info("CA bundle:              %s (%d certificate(s))", cfg.NodeExtraCACerts, len(certificates))
+			warnings = certs.ExpiryWarnings(certificates, time.Now())
+		}
+	}
+	if cfg.AutoUpdate != nil {
+		logger.Info("Automatic updates:      %s", describeAutoUpdatePolicy(cfg.AutoUpdate))
+		if !service.IsUpdateJobInstalled(serviceName) {
+			warnings = append(warnings, "the scheduled update job is missing, run --enable-auto-update again")
+		}
+	} else {
+		logger.Info("Automatic updates:      disabled")
+	}
+	if last := cfg.LastAutoUpdate; last != nil {
+		logger.Info("Last automatic update:  %s", describeAutoUpdateResult(last))
+	}
+	if staged := cfg.StagedUpdate; staged != nil {
+		logger.Info("Staged update:          Node.js %s, Device Agent %s (staged %s, apply with --apply-staged)",
+			staged.NodeVersion, staged.AgentVersion, staged.Time.Local().Format("2006-01-02 15:04"))
+		if !nodejs.IsRuntimeStaged(workDir) {
+			warnings = append(warnings, "the staged runtime is missing, run --stage-update again")
+		}
+	}
+	for _, warning := range warnings {
+		logger.Info("%s %s", style.Yellow("Warning:"), warning)
+	}
+
+	for _, problem := range credentials.CheckPermissions(workDir, serviceName) {
+		logger.Info("%s %s", style.Yellow("Warning:"), problem)
+	}
+
+	if cfg.NodeVersion != "" {
+		if err := nodejs.CheckNodeRelease(cfg.NodeVersion); err != nil {
+			logger.LogFunctionExit("Status", nil, err)
+			return err
+		}
+	}
+
+	logger.LogFunctionExit("Status", "success", nil)
+	return nil
+}
+
+// describeAutoUpdateResult summarises the outcome of a scheduled update.
+func describeAutoUpdateResult(result *config.AutoUpdateResult) string {
+	outcome := result.Result
+	switch result.Result {
+	case config.AutoUpdateUpdated, config.AutoUpdateUpToDate:
+		outcome = style.Green(outcome)
+	case config.AutoUpdateSkipped:
+		outcome = style.Yellow(outcome)
+	default:
+		outcome = style.Red(outcome)
+	}
+	summary := fmt.Sprintf("%s, %s", result.Time.Local().Format("2006-01-02 15:04"), outcome)
+	switch {
+	case result.ToVersion != "" && result.ToVersion != result.FromVersion:
+		summary += fmt.Sprintf(" (%s to %s)", result.FromVersion, result.ToVersion)
+	case result.FromVersion != "":
+		summary += fmt.Sprintf(" (%s)", result.FromVersion)
+	}
+	if result.Message != "" {
+		summary += ": " + result.Message
+	}
+	return summary
+}
@@ -0,0 +1,11 @@
+// Package e2e holds the end-to-end tests of the installer flows described in
+// installer/TESTING.md.
+//
+// The tests run the install, update and uninstall commands in-process against
+// a scratch filesystem root (utils.RootDir), a local HTTP server standing in
+// for the Node.js distribution site and the npm registry, and stub commands
+// for sudo, the init systems, the account tools, npm and the Device Agent.
+// They only run on Linux and need no privileges or network access:
+//
+//	go test ./e2e/
+package e2e
@@ -0,0 +1,555 @@
+//go:build linux
+
+package e2e
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
+	"github.com/flowfuse/device-agent-installer/pkg/certs"
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/credentials"
+	"github.com/flowfuse/device-agent-installer/pkg/download"
+	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
+	"github.com/flowfuse/device-agent-installer/pkg/service"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+	"github.com/flowfuse/device-agent-installer/pkg/validate"
+)
+
+const (
+	// testNodeVersion is the Node.js version installed by default
+	testNodeVersion = "22.23.0"
+	// testNodeUpdateVersion is the newer Node.js version served for updates
+	testNodeUpdateVersion = "22.24.0"
+	// testAgentVersion is the latest Device Agent version in the fake registry
+	testAgentVersion = "3.6.1"
+	// testOTC is the one-time code passed to the Device Agent
+	testOTC = "fake-one-time-code"
+	// serviceUser is the service account created by the installer
+	serviceUser = "flowfuse"
+)
+
+// testAgentVersions are the Device Agent versions in the fake registry,
+// including a prerelease newer than the latest release.
+var testAgentVersions = []string{"3.5.2", "3.6.0", testAgentVersion, "3.7.0-beta.1"}
+
+// initSystem is the Linux init system emulated by a harness.
+type initSystem string
+
+const (
+	systemd  initSystem = "systemd"
+	sysVInit initSystem = "sysvinit"
+	openRC   initSystem = "openrc"
+)
+
+// initSystems are the init systems every scenario runs against.
+var initSystems = []initSystem{systemd, sysVInit, openRC}
+
+// harness is a scratch Linux system the installer commands run against:
+//   - root is the filesystem root (utils.RootDir) holding the service
+//     definitions, working directories and the artifact cache
+//   - bin holds stub commands and links to the few real tools the installer
+//     needs, and is the only PATH entry
+//   - every stub appends its command line to cmdLog
+//   - server stands in for the Node.js distribution site, the npm registry
+//     and the FlowFuse platform, whose URL is url
+//   - broker accepts the MQTT connections to the brokerURL the Device Agent
+//     stub writes to device.yml
+type harness struct {
+	t      *testing.T
+	init   initSystem
+	root   string
+	bin    string
+	cmdLog string
+	server *httptest.Server
+	url    string
+	broker net.Listener
+}
+
+// realTools are linked into the stub directory; everything else the
+// installer runs is a stub.
+var realTools = []string{
+	"basename", "cat", "chmod", "cp", "dirname", "env", "false", "find", "grep",
+	"gzip", "head", "ln", "ls", "mkdir", "mv", "rm", "rmdir", "sed", "sh",
+	"sort", "stat", "tail", "tar", "test", "touch", "tr", "true",
+}
+
+// newHarness prepares a scratch system with the given init system and points
+// the installer's package settings at it.
+func newHarness(t *testing.T, init initSystem) *harness {
+	t.Helper()
+	if err := validate.CheckLibstdcExists(); err != nil {
+		t.Skipf("the installer requires libstdc++ on the host: %v", err)
+	}
+
+	h := &harness{
+		t:    t,
+		init: init,
+		root: t.TempDir(),
+		bin:  t.TempDir(),
+	}
+	h.cmdLog = filepath.Join(h.root, ".stub", "commands.log")
+	for _, dir := range []string{".stub/users", ".stub/groups", ".stub/running", "etc/init.d"} {
+		h.mkdir(dir)
+	}
+	if init == systemd {
+		h.mkdir("etc/systemd/system")
+		h.mkdir("run/systemd/system")
+	}
+
+	for _, tool := range realTools {
+		if path, err := exec.LookPath(tool); err == nil {
+			if err := os.Symlink(path, filepath.Join(h.bin, tool)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for name, script := range stubCommands(init) {
+		h.writeExecutable(filepath.Join(h.bin, name), script)
+	}
+	h.writeExecutable(h.path(".stub", "flowfuse-device-agent"), agentStub)
+
+	h.server = httptest.NewServer(h.handler())
+	t.Cleanup(h.server.Close)
+	h.url = h.server.URL
+	broker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	go func() {
+		for {
+			conn, err := broker.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	h.broker = broker
+
+	t.Setenv("PATH", h.bin)
+	t.Setenv("TMPDIR", t.TempDir())
+	t.Setenv("FF_ROOT", h.root)
+	t.Setenv("FF_CMDLOG", h.cmdLog)
+	t.Setenv("FF_AGENT_LATEST", testAgentVersion)
+	t.Setenv("FF_BROKER_URL", "mqtt://"+broker.Addr().String())
+	t.Setenv("NODE_EXTRA_CA_CERTS", "")
+	t.Setenv("FLOWFUSE_OTC", "")
+	// Fail fast on anything that would leave the machine; the local server
+	// is reached directly
+	t.Setenv("HTTP_PROXY", "http://127.0.0.1:9")
+	t.Setenv("HTTPS_PROXY", "http://127.0.0.1:9")
+
+	utils.RootDir = h.root
+	utils.ServiceUsername = serviceUser
+	utils.DefaultPort = 1880
+	utils.ServiceUID, utils.ServiceGID, utils.ServiceHome, utils.ServiceGroups = 0, 0, "", nil
+	utils.UseExistingAccount = false
+	nodejs.MirrorURL = h.server.URL + "/dist"
+	nodejs.ExtraPackages = nil
+	nodejs.Registry = h.server.URL + "/registry"
+	nodejs.ProvisioningConfig = ""
+	nodejs.Strict = false
+	nodejs.AutoSelectVersion = false
+	download.Offline = false
+	cache.Dir = filepath.Join(h.root, "var", "cache", "flowfuse-installer")
+	credentials.Encryption = ""
+	service.AgentArgs, service.Environment = nil, nil
+	certs.SystemStore = false
+	t.Cleanup(func() {
+		utils.RootDir = ""
+		cache.Dir = ""
+		nodejs.MirrorURL = ""
+	})
+
+	stdin := os.Stdin
+	t.Cleanup(func() { os.Stdin = stdin })
+	h.answer()
+	return h
+}
+
+// path returns an absolute path below the scratch root.
+func (h *harness) path(elem ...string) string {
+	return filepath.Join(append([]string{h.root}, elem...)...)
+}
+
+// mkdir creates a directory below the scratch root.
+func (h *harness) mkdir(dir string) {
+	h.t.Helper()
+	if err := os.MkdirAll(h.path(dir), 0755); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// writeExecutable writes a shell script.
+func (h *harness) writeExecutable(path, script string) {
+	h.t.Helper()
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// answer replaces standard input with the given prompt answers, one per line.
+// Prompts without an answer read end-of-file.
+func (h *harness) answer(lines ...string) {
+	h.t.Helper()
+	path := filepath.Join(h.t.TempDir(), "stdin")
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		h.t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	h.t.Cleanup(func() { file.Close() })
+	os.Stdin = file
+}
+
+// commands returns the command lines the stubs recorded, in order.
+func (h *harness) commands() []string {
+	h.t.Helper()
+	data, err := os.ReadFile(h.cmdLog)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+}
+
+// resetCommands forgets the recorded commands.
+func (h *harness) resetCommands() {
+	h.t.Helper()
+	if err := os.RemoveAll(h.cmdLog); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// definitionPath returns where the service definition of serviceName is
+// generated for the emulated init system.
+func (h *harness) definitionPath(serviceName string) string {
+	if h.init == systemd {
+		return h.path("etc", "systemd", "system", serviceName+".service")
+	}
+	return h.path("etc", "init.d", serviceName)
+}
+
+// definition returns the generated service definition of serviceName.
+func (h *harness) definition(serviceName string) string {
+	h.t.Helper()
+	data, err := os.ReadFile(h.definitionPath(serviceName))
+	if err != nil {
+		h.t.Fatalf("service definition of %s: %v", serviceName, err)
+	}
+	return string(data)
+}
+
+// updateJob returns the scheduled update job of serviceName: the timer and
+// unit on systemd, otherwise the /etc/cron.d entry and root's crontab.
+func (h *harness) updateJob(serviceName string) string {
+	var paths []string
+	switch h.init {
+	case systemd:
+		paths = []string{
+			h.path("etc", "systemd", "system", serviceName+"-update.timer"),
+			h.path("etc", "systemd", "system", serviceName+"-update.service"),
+		}
+	default:
+		paths = []string{h.path("etc", "cron.d", serviceName+"-update"), h.path("etc", "crontabs", "root")}
+	}
+	var job strings.Builder
+	for _, path := range paths {
+		if data, err := os.ReadFile(path); err == nil {
+			job.Write(data)
+		}
+	}
+	return job.String()
+}
+
+// running reports whether the stub init system considers serviceName started.
+func (h *harness) running(serviceName string) bool {
+	_, err := os.Stat(h.path(".stub", "running", serviceName))
+	return err == nil
+}
+
+// config loads installer.conf of the installation in workDir.
+func (h *harness) config(workDir string) *config.InstallerConfig {
+	h.t.Helper()
+	cfg, err := config.LoadConfig(workDir)
+	if err != nil {
+		h.t.Fatalf("installer.conf: %v", err)
+	}
+	return cfg
+}
+
+// Commands the emulated init system runs for a service.
+
+func (h *harness) enableCommands(serviceName string) []string {
+	switch h.init {
+	case systemd:
+		return []string{"systemctl daemon-reload", "systemctl enable " + serviceName}
+	case sysVInit:
+		return []string{"update-rc.d " + serviceName + " defaults"}
+	default:
+		return []string{"rc-update add " + serviceName}
+	}
+}
+
+func (h *harness) disableCommand(serviceName string) string {
+	switch h.init {
+	case systemd:
+		return "systemctl disable " + serviceName
+	case sysVInit:
+		return "update-rc.d " + serviceName + " remove"
+	default:
+		return "rc-update del " + serviceName
+	}
+}
+
+func (h *harness) startCommand(serviceName string) string {
+	return h.controlCommand(serviceName, "start")
+}
+
+func (h *harness) stopCommand(serviceName string) string {
+	return h.controlCommand(serviceName, "stop")
+}
+
+func (h *harness) controlCommand(serviceName, action string) string {
+	switch h.init {
+	case systemd:
+		return "systemctl " + action + " " + serviceName
+	case sysVInit:
+		return "service " + serviceName + " " + action
+	default:
+		return "rc-service " + serviceName + " " + action
+	}
+}
+
+// assertSequence checks that the recorded commands contain each of want, in
+// that order; other commands may come in between.
+func (h *harness) assertSequence(want ...string) {
+	h.t.Helper()
+	got := h.commands()
+	i := 0
+	for _, command := range got {
+		if i < len(want) && command == want[i] {
+			i++
+		}
+	}
+	if i < len(want) {
+		h.t.Errorf("command %q not run in the expected order; commands run:\n  %s", want[i], strings.Join(got, "\n  "))
+	}
+}
+
+// assertNotRun checks that no recorded command starts with prefix.
+func (h *harness) assertNotRun(prefix string) {
+	h.t.Helper()
+	for _, command := range h.commands() {
+		if strings.HasPrefix(command, prefix) {
+			h.t.Errorf("unexpected command %q", command)
+		}
+	}
+}
+
+// assertRun checks that a command starting with prefix and containing arg
+// was recorded.
+func (h *harness) assertRun(prefix, arg string) {
+	h.t.Helper()
+	got := h.commands()
+	for _, command := range got {
+		if strings.HasPrefix(command, prefix) && strings.Contains(command, arg) {
+			return
+		}
+	}
+	h.t.Errorf("no %q command with %q run; commands run:\n  %s", prefix, arg, strings.Join(got, "\n  "))
+}
+
+// count returns how many recorded commands equal command.
+func (h *harness) count(command string) int {
+	n := 0
+	for _, c := range h.commands() {
+		if c == command {
+			n++
+		}
+	}
+	return n
+}
+
+// assertContains checks that text contains each of want.
+func assertContains(t *testing.T, what, text string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		if !strings.Contains(text, w) {
+			t.Errorf("%s does not contain %q:\n%s", what, w, text)
+		}
+	}
+}
+
+// assertExists checks whether path exists.
+func assertExists(t *testing.T, path string, exists bool) {
+	t.Helper()
+	_, err := os.Stat(path)
+	switch {
+	case exists && err != nil:
+		t.Errorf("%s should exist: %v", path, err)
+	case !exists && err == nil:
+		t.Errorf("%s should not exist", path)
+	}
+}
+
+// assertEmpty checks that the working directory dir was emptied; the
+// directory itself is kept.
+func (h *harness) assertEmpty(dir string) {
+	h.t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		h.t.Fatal(err)
+	}
+	for _, entry := range entries {
+		h.t.Errorf("%s was not removed", filepath.Join(dir, entry.Name()))
+	}
+}
+
+// freePort returns a TCP port no process listens on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// handler serves the Node.js distribution site below /dist and the npm
+// registry metadata of the Device Agent below /registry (the package
+// document, and a version manifest per version or dist-tag).
+func (h *harness) handler() http.Handler {
+	archives := map[string][]byte{}
+	var index []map[string]interface{}
+	for _, version := range []string{testNodeUpdateVersion, testNodeVersion} {
+		archives[version] = nodeArchive(h.t, version)
+		index = append(index, map[string]interface{}{"version": "v" + version, "date": "2026-01-01", "security": false, "lts": "Jod"})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/settings", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"platform": "test"})
+	})
+	mux.HandleFunc("/dist/index.json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(index)
+	})
+	mux.HandleFunc("/dist/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/dist/"), "/")
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		version := strings.TrimPrefix(parts[0], "v")
+		archive, ok := archives[version]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		name := nodeArchiveName(version)
+		switch parts[1] {
+		case "SHASUMS256.txt":
+			sum := sha256.Sum256(archive)
+			fmt.Fprintf(w, "%s  %s\n", hex.EncodeToString(sum[:]), name)
+		case name:
+			w.Write(archive)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("/registry/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/registry/@flowfuse/device-agent" {
+			versions := map[string]interface{}{}
+			for _, version := range testAgentVersions {
+				versions[version] = map[string]string{"version": version}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"name":      "@flowfuse/device-agent",
+				"dist-tags": map[string]string{"latest": testAgentVersion},
+				"versions":  versions,
+			})
+			return
+		}
+		version := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		if version == "latest" {
+			version = testAgentVersion
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name":    "@flowfuse/device-agent",
+			"version": version,
+			"engines": map[string]string{"node": ">=18"},
+		})
+	})
+	return mux
+}
+
+// nodeArchiveName returns the name of the Node.js archive the installer
+// downloads on this machine.
+func nodeArchiveName(version string) string {
+	arch := map[string]string{"amd64": "x64", "386": "x86", "arm64": "arm64", "arm": "armv7l"}[runtime.GOARCH]
+	if utils.IsAlpine() {
+		arch += "-musl"
+	}
+	return fmt.Sprintf("node-v%s-linux-%s.tar.gz", version, arch)
+}
+
+// nodeArchive builds a Node.js distribution archive holding stub node and npm
+// executables.
+func nodeArchive(t *testing.T, version string) []byte {
+	t.Helper()
+	rootDir := strings.TrimSuffix(nodeArchiveName(version), ".tar.gz")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	files := map[string]string{
+		"bin/node": nodeStub(version),
+		"bin/npm":  npmStub,
+	}
+	for _, dir := range []string{"", "bin/"} {
+		if err := tw.WriteHeader(&tar.Header{Name: rootDir + "/" + dir, Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, script := range files {
+		content := "#!/bin/sh\n" + script
+		if err := tw.WriteHeader(&tar.Header{Name: rootDir + "/" + name, Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
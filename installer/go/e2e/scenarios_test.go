@@ -0,0 +1,1151 @@
+//go:build linux
+
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/cmd"
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
+	"github.com/flowfuse/device-agent-installer/pkg/service"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+	"github.com/flowfuse/device-agent-installer/pkg/validate"
+)
+
+// The scenarios follow the sections of installer/TESTING.md and run once per
+// Linux init system. Scenario B (interactive install) and the macOS and
+// Windows checks remain manual.
+
+// updateGolden rewrites the golden files of TestRender instead of comparing
+// against them: go test ./e2e/ -run TestRender -update
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// serviceName returns the per-port service name of an installation.
+func serviceName(port int) string {
+	return fmt.Sprintf("flowfuse-device-agent-%d", port)
+}
+
+// forEachInit runs a scenario against every emulated init system.
+func forEachInit(t *testing.T, scenario func(t *testing.T, h *harness)) {
+	for _, init := range initSystems {
+		t.Run(string(init), func(t *testing.T) {
+			scenario(t, newHarness(t, init))
+		})
+	}
+}
+
+// install runs an OTC install into dir on port and fails the test on error.
+func (h *harness) install(dir string, port int) {
+	h.t.Helper()
+	if err := cmd.Install(testNodeVersion, "latest", h.url, testOTC, dir, false, port, nil); err != nil {
+		h.t.Fatalf("install failed: %v", err)
+	}
+}
+
+// assertInstalled checks the service definition, installer.conf and service
+// state of an installation in dir on port.
+func (h *harness) assertInstalled(dir string, port int) {
+	h.t.Helper()
+	name := serviceName(port)
+	definition := h.definition(name)
+	assertContains(h.t, "service definition", definition,
+		fmt.Sprintf("--dir %s", dir), fmt.Sprintf("--port %d", port))
+	switch h.init {
+	case systemd:
+		assertContains(h.t, "systemd unit", definition, "User="+serviceUser, "Restart=on-failure")
+	case sysVInit:
+		assertContains(h.t, "init script", definition, fmt.Sprintf(`DAEMON_ARGS="--dir %s --port %d"`, dir, port))
+	case openRC:
+		assertContains(h.t, "OpenRC script", definition, "#!/sbin/openrc-run", fmt.Sprintf("--dir %s --port %d", dir, port))
+	}
+
+	cfg := h.config(dir)
+	if cfg.ServiceName != name || cfg.Port != port {
+		h.t.Errorf("installer.conf records service %q on port %d, want %q on port %d", cfg.ServiceName, cfg.Port, name, port)
+	}
+	if cfg.NodeVersion != testNodeVersion || cfg.AgentVersion != testAgentVersion {
+		h.t.Errorf("installer.conf records Node.js %q and agent %q, want %q and %q", cfg.NodeVersion, cfg.AgentVersion, testNodeVersion, testAgentVersion)
+	}
+	if cfg.ServiceUsername != serviceUser {
+		h.t.Errorf("installer.conf records service user %q, want %q", cfg.ServiceUsername, serviceUser)
+	}
+	assertExists(h.t, filepath.Join(dir, "device.yml"), true)
+	assertExists(h.t, filepath.Join(dir, "node", "bin", "node"), true)
+	assertExists(h.t, filepath.Join(dir, "node", "bin", "flowfuse-device-agent"), true)
+	if !h.running(name) {
+		h.t.Errorf("service %s is not running", name)
+	}
+}
+
+// A. Happy path – OTC only (defaults)
+func TestHappyPath(t *testing.T) {
+	forEachInit(t, func(t *testing.T, h *harness) {
+		port := freePort(t)
+		h.install("", port)
+
+		dir := h.path("opt", "flowfuse-device")
+		h.assertInstalled(dir, port)
+		name := serviceName(port)
+		h.assertSequence(append([]string{
+			"adduser --system --shell /sbin/nologin --home /home/flowfuse " + serviceUser,
+			fmt.Sprintf("flowfuse-device-agent --otc-no-start --installer-mode -o %s -u %s --dir %s --port %d", testOTC, h.url, dir, port),
+		}, append(h.enableCommands(name), h.startCommand(name))...)...)
+	})
+}
+
+// C. Custom installation directory
+func TestCustomDirectory(t *testing.T) {
+	forEachInit(t, func(t *testing.T, h *harness) {
+		port := freePort(t)
+		dir := h.path("srv", "flowfuse agent")
+		h.install(dir, port)
+
+		h.assertInstalled(dir, port)
+		assertExists(t, h.path("opt", "flowfuse-device"), false)
+		assertExists(t, filepath.Join(dir, "installer.conf"), true)
+	})
+}
+
+// D. Custom port (per-port services)
+func TestCustomPort(t *testing.T) {
+	forEachInit(t, func(t *testing.T, h *harness) {
+		port := freePort(t)
+		dir := h.path("opt", "ff")
+		h.install(dir, port)
+
+		h.assertInstalled(dir, port)
+		data, err := os.ReadFile(filepath.Join(dir, "installer.conf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertContains(t, "installer.conf", string(data), fmt.Sprintf(`"port": %d`, port))
+		assertExists(t, h.definitionPath("flowfuse-device-agent"), false)
+	})
+}
+
+// E. Multiple instances
+func TestMultipleInstances(t *testing.T) {
+	forEachInit(t, func(t *testing.T, h *harness) {
+		first, second := freePort(t), freePort(t)
+		for first == second {
+			second = freePort(t)
+		}
+		firstDir, secondDir := h.path("opt", "ff-a"), h.path("opt", "ff-b")
+		h.install(firstDir, first)
+		h.resetCommands()
+		h.install(secondDir, second)
+
+		h.assertInstalled(firstDir, first)
+		h.assertInstalled(secondDir, second)
+		// The second instance reuses the service account and leaves the
+		// first one alone
+		h.assertNotRun("adduser")
+		h.assertNotRun(h.stopCommand(serviceName(first)))
+
+		// --purge asks for nothing, and keeps the cache and the service
+		// account while the other instance uses them
+		h.resetCommands()
+		if err := cmd.Uninstall(firstDir, cmd.UninstallOptions{Purge: true}); err != nil {
+			t.Fatalf("uninstall failed: %v", err)
+		}
+		assertExists(t, firstDir, false)
+		assertExists(t, cache.Dir, true)
+		h.assertNotRun("userdel")
+		if !h.running(serviceName(second)) {
+			t.Errorf("service %s is not running after removing the other instance", serviceName(second))
+		}
+
+		// ... and removes them with the last instance
+		if err := cmd.Uninstall(secondDir, cmd.UninstallOptions{Purge: true}); err != nil {
+			t.Fatalf("uninstall failed: %v", err)
+		}
+		assertExists(t, cache.Dir, false)
+		h.assertRun("userdel", serviceUser)
+	})
+}
+
+// F. Idempotent reinstall
+func TestReinstall(t *testing.T) {
+	forEachInit(t, func(t *testing.T, h *harness) {
+		port := freePort(t)
+		dir := h.path("opt", "ff")
+		h.install(dir, port)
+		h.resetCommands()
+
+		// Replace the existing configuration with the new one-time code
+		h.answer("2")
+		h.install(dir, port)
+
+		h.assertInstalled(dir, port)
+		name := serviceName(port)
+		h.assertSequence(h.stopCommand(name), h.startCommand(name))
+		if n := h.count(h.startCommand(name)); n != 1 {
+			t.Errorf("service started %d times, want once", n)
+		}
+	})
+}
+
+// G, H and I. Updates of the Device Agent, Node.js or both
+func TestUpdate(t *testing.T) {
+	const agentVersion = "3.7.0"
+	cases := []struct {
+		name          string
+		agentVersion  string
+		nodeVersion   string
+		updateAgent   bool
+		updateNode    bool
+		wantAgent     string
+		wantNode      string
+		wantInstalled []string
+	}{
+		{
+			name:        "agent",
+			updateAgent: true, agentVersion: agentVersion,
+			wantAgent: agentVersion, wantNode: testNodeVersion,
+			wantInstalled: []string{"@flowfuse/device-agent@" + agentVersion},
+		},
+		{
+			name:       "nodejs",
+			updateNode: true, nodeVersion: testNodeUpdateVersion,
+			wantAgent: testAgentVersion, wantNode: testNodeUpdateVersion,
+			// The agent is reinstalled to rebuild it against the new runtime
+			wantInstalled: []string{"@flowfuse/device-agent@" + testAgentVersion},
+		},
+		{
+			name:        "both",
+			updateAgent: true, agentVersion: agentVersion,
+			updateNode: true, nodeVersion: testNodeUpdateVersion,
+			wantAgent: agentVersion, wantNode: testNodeUpdateVersion,
+			wantInstalled: []string{"@flowfuse/device-agent@" + agentVersion},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			forEachInit(t, func(t *testing.T, h *harness) {
+				port := freePort(t)
+				dir := h.path("opt", "ff")
+				registry := nodejs.Registry
+				h.install(dir, port)
+				h.resetCommands()
+
+				// Run without --npm-registry: the registry of the installation is kept
+				nodejs.Registry = ""
+				if err := cmd.Update(tc.agentVersion, tc.nodeVersion, dir, tc.updateAgent, tc.updateNode); err != nil {
+					t.Fatalf("update failed: %v", err)
+				}
+
+				name := serviceName(port)
+				h.assertSequence(h.stopCommand(name), h.startCommand(name))
+				if n := h.count(h.stopCommand(name)); n != 1 {
+					t.Errorf("service stopped %d times, want a single stop/start cycle", n)
+				}
+				if !h.running(name) {
+					t.Errorf("service %s is not running after the update", name)
+				}
+				cfg := h.config(dir)
+				if cfg.AgentVersion != tc.wantAgent || cfg.NodeVersion != tc.wantNode {
+					t.Errorf("installer.conf records agent %q and Node.js %q, want %q and %q", cfg.AgentVersion, cfg.NodeVersion, tc.wantAgent, tc.wantNode)
+				}
+				out, err := exec.Command(filepath.Join(dir, "node", "bin", "node"), "--version").Output()
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertContains(t, "node --version", string(out), "v"+tc.wantNode)
+				assertExists(t, filepath.Join(dir, "node", "bin", "flowfuse-device-agent"), true)
+				for _, spec := range tc.wantInstalled {
+					h.assertRun("npm", spec)
+				}
+				h.assertRun("npm", "--registry "+registry)
+				if cfg.NpmRegistry != registry {
+					t.Errorf("installer.conf records the npm registry %q, want %q", cfg.NpmRegistry, registry)
+				}
+			})
+		})
+	}
+}
+
+// J. Uninstall
+func TestUninstall(t *testing.T) {
+	forEachInit(t, func(t *testing.T, h *harness) {
+		port := freePort(t)
+		dir := h.path("opt", "ff")
+		h.install(dir, port)
+		h.resetCommands()
+
+		// Confirm the uninstall and the removal of the service account
+		h.answer("y", "y")
+		if err := cmd.Uninstall(dir, cmd.UninstallOptions{}); err != nil {
+			t.Fatalf("uninstall failed: %v", err)
+		}
+
+		name := serviceName(port)
+		h.assertSequence(h.stopCommand(name), h.disableCommand(name), "userdel -r "+serviceUser)
+		assertExists(t, h.definitionPath(name), false)
+		h.assertEmpty(dir)
+		if h.running(name) {
+			t.Errorf("service %s is still running", name)
+		}
+	})
+}
+
+// J. Uninstall with --use-existing-account never removes the account, even
+// when installer.conf does not record it
+func TestUninstallExistingAccount(t *testing.T) {
+	forEachInit(t, func(t *testing.T, h *harness) {
+		port := freePort(t)
+		dir := h.path("opt", "ff")
+		h.install(dir, port)
+		h.resetCommands()
+
+		utils.UseExistingAccount = true
+		if err := cmd.Uninstall(dir, cmd.UninstallOptions{Purge: true}); err != nil {
+			t.Fatalf("uninstall failed: %v", err)
+		}
+		h.assertNotRun("userdel")
+	})
+}
+
+// J. Uninstall keeping the configuration: only configuration kept with
+// --keep-config is reused without asking
+func TestUninstallKeepConfig(t *testing.T) {
+	forEachInit(t, func(t *testing.T, h *harness) {
+		port := freePort(t)
+		dir := h.path("opt", "ff")
+		h.install(dir, port)
+
+		h.answer("y", "n")
+		if err := cmd.Uninstall(dir, cmd.UninstallOptions{KeepConfig: true}); err != nil {
+			t.Fatalf("uninstall failed: %v", err)
+		}
+		assertExists(t, filepath.Join(dir, "device.yml"), true)
+		if !h.config(dir).KeptByUninstall {
+			t.Fatal("installer.conf does not record that the configuration was kept")
+		}
+
+		// Reinstalling reuses it without a prompt, which would fail on the empty stdin
+		h.answer()
+		h.install(dir, port)
+		if h.config(dir).KeptByUninstall {
+			t.Error("installer.conf still records the kept configuration after installing")
+		}
+		if !h.running(serviceName(port)) {
+			t.Errorf("service %s is not running", serviceName(port))
+		}
+
+		// Configuration left behind otherwise is not reused silently
+		h.answer("y", "n")
+		if err := cmd.Uninstall(dir, cmd.UninstallOptions{KeepConfig: true}); err != nil {
+			t.Fatalf("uninstall failed: %v", err)
+		}
+		cfg := h.config(dir)
+		cfg.KeptByUninstall = false
+		if err := config.SaveConfig(cfg, dir); err != nil {
+			t.Fatal(err)
+		}
+		h.answer()
+		err := cmd.Install(testNodeVersion, "latest", h.url, testOTC, dir, false, port, nil)
+		if err == nil || !strings.Contains(err.Error(), "user choice") {
+			t.Errorf("install over leftover configuration returned %v, want the prompt to be asked", err)
+		}
+	})
+}
+
+// K. Legacy fallback: an installation made before per-port service names has
+// a service called flowfuse-device-agent and no service name or port in
+// installer.conf.
+func TestLegacyService(t *testing.T) {
+	const legacyName = "flowfuse-device-agent"
+	legacyInstall := func(t *testing.T, h *harness) string {
+		port := freePort(t)
+		dir := h.path("opt", "flowfuse-device")
+		h.install("", port)
+		name := serviceName(port)
+		if err := os.Rename(h.definitionPath(name), h.definitionPath(legacyName)); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(h.path(".stub", "running", name), h.path(".stub", "running", legacyName)); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "installer.conf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		legacy := []byte(fmt.Sprintf(`{"serviceUsername": %q, "agentVersion": %q, "nodeVersion": %q}`, serviceUser, testAgentVersion, testNodeVersion))
+		if len(data) == 0 {
+			t.Fatal("installer.conf is empty")
+		}
+		if err := os.WriteFile(filepath.Join(dir, "installer.conf"), legacy, 0644); err != nil {
+			t.Fatal(err)
+		}
+		h.resetCommands()
+		return dir
+	}
+
+	t.Run("update", func(t *testing.T) {
+		forEachInit(t, func(t *testing.T, h *harness) {
+			dir := legacyInstall(t, h)
+			if err := cmd.Update("3.7.0", "", dir, true, false); err != nil {
+				t.Fatalf("update failed: %v", err)
+			}
+			h.assertSequence(h.stopCommand(legacyName), h.startCommand(legacyName))
+			if !h.running(legacyName) {
+				t.Errorf("service %s is not running after the update", legacyName)
+			}
+			if cfg := h.config(dir); cfg.AgentVersion != "3.7.0" {
+				t.Errorf("installer.conf records agent %q, want 3.7.0", cfg.AgentVersion)
+			}
+		})
+	})
+
+	t.Run("uninstall", func(t *testing.T) {
+		forEachInit(t, func(t *testing.T, h *harness) {
+			dir := legacyInstall(t, h)
+			h.answer("y", "y")
+			if err := cmd.Uninstall("", cmd.UninstallOptions{}); err != nil {
+				t.Fatalf("uninstall failed: %v", err)
+			}
+			h.assertSequence(h.stopCommand(legacyName), h.disableCommand(legacyName))
+			assertExists(t, h.definitionPath(legacyName), false)
+			h.assertEmpty(dir)
+		})
+	})
+}
+
+// L. Help and version output
+func TestHelpAndVersion(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go tool is not on PATH")
+	}
+	binary := filepath.Join(t.TempDir(), "flowfuse-device-agent-installer")
+	build := exec.Command(goTool, "build", "-ldflags", "-X main.instVersion=0.0.0-e2e", "-o", binary, "..")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building the installer failed: %v\n%s", err, out)
+	}
+
+	help, err := exec.Command(binary, "--help").CombinedOutput()
+	if err != nil {
+		t.Fatalf("--help failed: %v\n%s", err, help)
+	}
+	assertContains(t, "--help output", string(help), "Usage:", "--port", "--dir", "--otc", "--uninstall")
+
+	version, err := exec.Command(binary, "--version").CombinedOutput()
+	if err != nil {
+		t.Fatalf("--version failed: %v\n%s", err, version)
+	}
+	assertContains(t, "--version output", string(version), "FlowFuse Device Agent Installer Version: 0.0.0-e2e")
+}
+
+// M. Automatic updates
+func TestAutoUpdate(t *testing.T) {
+	forEachInit(t, func(t *testing.T, h *harness) {
+		port := freePort(t)
+		dir := h.path("opt", "ff")
+		h.install(dir, port)
+		name := serviceName(port)
+		// Without systemd the job goes to /etc/cron.d (e.g. Debian), or to
+		// root's crontab read by BusyBox crond (Alpine)
+		switch h.init {
+		case sysVInit:
+			h.mkdir("etc/cron.d")
+		case openRC:
+			h.mkdir("etc/crontabs")
+		}
+
+		now := time.Now()
+		window := func(from, to time.Duration) string {
+			return now.Add(from).Format("15:04") + "-" + now.Add(to).Format("15:04")
+		}
+		enable := func(window string) {
+			t.Helper()
+			policy := config.AutoUpdatePolicy{Channel: config.AutoUpdateChannelMinor, Window: window}
+			if err := cmd.EnableAutoUpdate(dir, policy); err != nil {
+				t.Fatalf("enable auto update failed: %v", err)
+			}
+		}
+		run := func(want string) {
+			t.Helper()
+			h.resetCommands()
+			if err := cmd.RunAutoUpdate(dir); err != nil {
+				t.Fatalf("scheduled update failed: %v", err)
+			}
+			last := h.config(dir).LastAutoUpdate
+			if last == nil || last.Result != want {
+				t.Fatalf("installer.conf records the scheduled update %+v, want %s", last, want)
+			}
+			h.assertNotRun(h.stopCommand(name))
+		}
+
+		open := window(-time.Hour, time.Hour)
+		enable(open)
+		installer := h.path("usr", "local", "lib", "flowfuse-device-installer", "flowfuse-device-installer")
+		assertExists(t, installer, true)
+		start := now.Add(-time.Hour)
+		schedule := fmt.Sprintf("%d %d * * *", start.Minute(), start.Hour())
+		if h.init == systemd {
+			schedule = "OnCalendar=*-*-* " + start.Format("15:04") + ":00"
+			h.assertRun("systemctl", "enable "+name+"-update.timer")
+		}
+		assertContains(t, "update job", h.updateJob(name), schedule, installer, "--run-auto-update", dir)
+		if cfg := h.config(dir); cfg.AutoUpdate == nil || cfg.AutoUpdate.Window != open {
+			t.Errorf("installer.conf records the update policy %+v, want window %s", cfg.AutoUpdate, open)
+		}
+
+		// The minor channel stays on the latest release, not the newer prerelease
+		run(config.AutoUpdateUpToDate)
+
+		// A run that starts outside the window does nothing
+		enable(window(2*time.Hour, 3*time.Hour))
+		run(config.AutoUpdateSkipped)
+
+		// A reinstall keeps the policy of the scheduled job
+		h.answer("2")
+		h.install(dir, port)
+		if cfg := h.config(dir); cfg.AutoUpdate == nil || cfg.LastAutoUpdate == nil || cfg.LastAutoUpdate.Result != config.AutoUpdateSkipped {
+			t.Errorf("installer.conf records the update policy %+v and last update %+v after a reinstall, want both kept", cfg.AutoUpdate, cfg.LastAutoUpdate)
+		}
+		assertContains(t, "update job", h.updateJob(name), "--run-auto-update", dir)
+
+		if err := cmd.DisableAutoUpdate(dir); err != nil {
+			t.Fatalf("disable auto update failed: %v", err)
+		}
+		if job := h.updateJob(name); strings.Contains(job, name) {
+			t.Errorf("update job still scheduled:\n%s", job)
+		}
+		if cfg := h.config(dir); cfg.AutoUpdate != nil || cfg.LastAutoUpdate == nil {
+			t.Errorf("installer.conf records policy %+v and last update %+v, want no policy and the last update", cfg.AutoUpdate, cfg.LastAutoUpdate)
+		}
+
+		// Uninstall removes the job too
+		enable(open)
+		h.answer("y", "y")
+		if err := cmd.Uninstall(dir, cmd.UninstallOptions{}); err != nil {
+			t.Fatalf("uninstall failed: %v", err)
+		}
+		if job := h.updateJob(name); strings.Contains(job, name) {
+			t.Errorf("update job still scheduled after uninstall:\n%s", job)
+		}
+	})
+}
+
+// N. Staged update
+func TestStagedUpdate(t *testing.T) {
+	const agentVersion = "3.7.0"
+	forEachInit(t, func(t *testing.T, h *harness) {
+		port := freePort(t)
+		dir := h.path("opt", "ff")
+		h.install(dir, port)
+		name := serviceName(port)
+		h.resetCommands()
+		node, err := nodejs.ParsePackageSpec("node-red-contrib-example@1.2.3", config.PackageTargetNodeRED)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodejs.ExtraPackages = []config.NpmPackage{node}
+
+		// Staging leaves the service, its runtime and its Node-RED nodes alone
+		if err := cmd.StageUpdate(agentVersion, testNodeUpdateVersion, dir, true, true); err != nil {
+			t.Fatalf("stage update failed: %v", err)
+		}
+		h.assertNotRun(h.stopCommand(name))
+		if !h.running(name) {
+			t.Errorf("service %s is not running after staging", name)
+		}
+		h.assertRun("npm", "@flowfuse/device-agent@"+agentVersion)
+		h.assertRun("npm", filepath.Join(dir, "node.staged", nodejs.NodeREDNodesDir))
+		assertExists(t, filepath.Join(dir, "node.staged", "bin", "flowfuse-device-agent"), true)
+		cfg := h.config(dir)
+		if cfg.AgentVersion != testAgentVersion || cfg.NodeVersion != testNodeVersion {
+			t.Errorf("installer.conf records agent %q and Node.js %q before applying, want %q and %q", cfg.AgentVersion, cfg.NodeVersion, testAgentVersion, testNodeVersion)
+		}
+		if s := cfg.StagedUpdate; s == nil || s.AgentVersion != agentVersion || s.NodeVersion != testNodeUpdateVersion {
+			t.Fatalf("installer.conf records the staged update %+v, want agent %s and Node.js %s", s, agentVersion, testNodeUpdateVersion)
+		}
+
+		// Applying only restarts the service
+		h.resetCommands()
+		if err := cmd.ApplyStaged(dir); err != nil {
+			t.Fatalf("apply staged failed: %v", err)
+		}
+		h.assertSequence(h.stopCommand(name), h.startCommand(name))
+		h.assertNotRun("npm")
+		if !h.running(name) {
+			t.Errorf("service %s is not running after applying", name)
+		}
+		cfg = h.config(dir)
+		if cfg.AgentVersion != agentVersion || cfg.NodeVersion != testNodeUpdateVersion || cfg.StagedUpdate != nil {
+			t.Errorf("installer.conf records agent %q, Node.js %q and staged update %+v, want %q, %q and none", cfg.AgentVersion, cfg.NodeVersion, cfg.StagedUpdate, agentVersion, testNodeUpdateVersion)
+		}
+		out, err := exec.Command(filepath.Join(dir, "node", "bin", "node"), "--version").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertContains(t, "node --version", string(out), "v"+testNodeUpdateVersion)
+		assertExists(t, filepath.Join(dir, "node.staged"), false)
+		assertExists(t, filepath.Join(dir, "node.previous"), false)
+
+		assertExists(t, filepath.Join(dir, nodejs.NodeREDNodesDir, "node_modules", "node-red-contrib-example", "package.json"), true)
+		assertExists(t, filepath.Join(dir, "node", nodejs.NodeREDNodesDir), false)
+
+		// Nothing is left to apply
+		if err := cmd.ApplyStaged(dir); err == nil {
+			t.Error("applying twice succeeded, want an error")
+		}
+
+		// An update discards a staged update, which would otherwise undo it
+		nodejs.ExtraPackages = nil
+		if err := cmd.StageUpdate(testAgentVersion, testNodeUpdateVersion, dir, true, false); err != nil {
+			t.Fatalf("stage update failed: %v", err)
+		}
+		h.resetCommands()
+		if err := cmd.Update(agentVersion, testNodeUpdateVersion, dir, true, false); err != nil {
+			t.Fatalf("update failed: %v", err)
+		}
+		// The agent is up to date, but the saved Node-RED node is reinstalled,
+		// so the service is stopped for it
+		h.assertRun("npm", "node-red-contrib-example@1.2.3")
+		if h.count(h.stopCommand(name)) != 1 {
+			t.Errorf("service %s was not stopped while its packages were reinstalled; commands run:\n  %s", name, strings.Join(h.commands(), "\n  "))
+		}
+		assertExists(t, filepath.Join(dir, "node.staged"), false)
+		if cfg := h.config(dir); cfg.StagedUpdate != nil {
+			t.Errorf("installer.conf records the staged update %+v after an update, want none", cfg.StagedUpdate)
+		}
+		if err := cmd.ApplyStaged(dir); err == nil {
+			t.Error("applying a discarded update succeeded, want an error")
+		}
+	})
+}
+
+// launchArgs and launchEnvironment are extra Device Agent arguments and
+// environment variables with characters every service definition format
+// needs to escape.
+var (
+	launchArgs        = []string{"--interval=120", "it's a \"label\" with 50% of $HOME", `C:\path\`}
+	launchEnvironment = []string{"TZ=Europe/Berlin", "FF_NOTE=it's \"quoted\", 50% & $HOME <here>"}
+)
+
+// O. Rendered service definitions
+func TestRender(t *testing.T) {
+	targets := []struct {
+		name, os, init string
+		launch         bool
+	}{
+		{"linux-systemd", "linux", "systemd", false},
+		{"linux-sysvinit", "linux", "sysvinit", false},
+		{"linux-openrc", "linux", "openrc", false},
+		{"darwin", "darwin", "", false},
+		{"windows", "windows", "", false},
+		// Extra agent arguments and environment variables that need escaping
+		{"linux-systemd-launch", "linux", "systemd", true},
+		{"linux-sysvinit-launch", "linux", "sysvinit", true},
+		{"linux-openrc-launch", "linux", "openrc", true},
+		{"darwin-launch", "darwin", "", true},
+		{"windows-launch", "windows", "", true},
+	}
+	for _, target := range targets {
+		t.Run(target.name, func(t *testing.T) {
+			h := newHarness(t, systemd)
+			// installer.conf records the cache and the npm registry only when
+			// they are chosen
+			cache.Dir = ""
+			nodejs.Registry = ""
+			if target.launch {
+				service.AgentArgs = launchArgs
+				service.Environment = launchEnvironment
+			}
+			out := t.TempDir()
+			if err := cmd.Render(out, target.os, target.init, testNodeVersion, testAgentVersion, "", 1880, nil); err != nil {
+				t.Fatalf("render failed: %v", err)
+			}
+			if commands := h.commands(); len(commands) > 0 {
+				t.Errorf("render ran commands: %v", commands)
+			}
+
+			golden := filepath.Join("testdata", "render", target.name)
+			if *updateGolden {
+				if err := os.RemoveAll(golden); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.CopyFS(golden, os.DirFS(out)); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			compareDirs(t, golden, out)
+		})
+	}
+}
+
+// compareDirs checks that dir holds the same files as the golden directory.
+func compareDirs(t *testing.T, golden, dir string) {
+	t.Helper()
+	want, err := os.ReadDir(golden)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create the golden files)", err)
+	}
+	got, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Errorf("rendered %d files, want %d", len(got), len(want))
+	}
+	for _, entry := range want {
+		wantData, err := os.ReadFile(filepath.Join(golden, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotData, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Errorf("%s was not rendered", entry.Name())
+			continue
+		}
+		if !bytes.Equal(gotData, wantData) {
+			t.Errorf("%s differs from %s:\n%s", entry.Name(), filepath.Join(golden, entry.Name()), gotData)
+		}
+	}
+}
+
+// P. Adopting a manual installation: a global npm install run by a
+// hand-written flowfuse-device-agent service with its own directory
+func TestAdopt(t *testing.T) {
+	const legacyName = "flowfuse-device-agent"
+	forEachInit(t, func(t *testing.T, h *harness) {
+		port := freePort(t)
+		src := h.path("home", "pi", ".flowfuse")
+		dir := h.path("opt", "flowfuse-device")
+		h.mkdir(filepath.Join("home", "pi", ".flowfuse", "project"))
+		for name, content := range map[string]string{
+			"device.yml":                           "deviceId: legacy\ntoken: secret\n",
+			filepath.Join("project", "flows.json"): "[]\n",
+		} {
+			if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		execStart := fmt.Sprintf("/usr/bin/flowfuse-device-agent --dir %s --port %d", src, port)
+		definition := fmt.Sprintf("#!/bin/sh\n# Hand-written\nexec %s\n", execStart)
+		if h.init == systemd {
+			definition = fmt.Sprintf("[Unit]\nDescription=FlowFuse Device Agent\n\n[Service]\nExecStart=%s\nRestart=always\n\n[Install]\nWantedBy=multi-user.target\n", execStart)
+		}
+		if err := os.WriteFile(h.definitionPath(legacyName), []byte(definition), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(h.path(".stub", "running", legacyName), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// A failed adoption in place gives the files back to their owner and
+		// starts the legacy service again
+		h.answer("y")
+		if err := cmd.Adopt("1.0.0", "", src, 0, nil, true); err == nil {
+			t.Fatal("adopting with an unsupported Node.js version succeeded, want an error")
+		}
+		h.assertSequence(fmt.Sprintf("chown -R %d:%d %s", os.Getuid(), os.Getgid(), src), h.startCommand(legacyName))
+		if !h.running(legacyName) {
+			t.Errorf("service %s is not running after the failed adoption", legacyName)
+		}
+		assertExists(t, filepath.Join(src, "installer.conf"), false)
+
+		h.answer("y")
+		if err := cmd.Adopt(testNodeVersion, "", "", 0, nil, true); err != nil {
+			t.Fatalf("adopt failed: %v", err)
+		}
+		h.assertInstalled(dir, port)
+		assertExists(t, h.definitionPath(legacyName), false)
+		if h.running(legacyName) {
+			t.Errorf("service %s is still running", legacyName)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "device.yml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertContains(t, "device.yml", string(data), "deviceId: legacy")
+		assertExists(t, filepath.Join(dir, "project", "flows.json"), true)
+		assertExists(t, filepath.Join(src, "device.yml"), true)
+
+		// Once managed, the installation is updated like any other
+		if err := cmd.Update("3.7.0", "", dir, true, false); err != nil {
+			t.Fatalf("update failed: %v", err)
+		}
+		if cfg := h.config(dir); cfg.AgentVersion != "3.7.0" {
+			t.Errorf("installer.conf records agent %q, want 3.7.0", cfg.AgentVersion)
+		}
+		if err := cmd.Adopt(testNodeVersion, "", "", 0, nil, true); err == nil {
+			t.Error("adopting a managed installation succeeded, want an error")
+		}
+	})
+}
+
+// Q. Extra agent arguments and environment variables are written into the
+// service definition and kept by updates and reinstalls
+func TestLaunchSettings(t *testing.T) {
+	forEachInit(t, func(t *testing.T, h *harness) {
+		port := freePort(t)
+		dir := h.path("opt", "ff")
+		name := serviceName(port)
+		// --agent-arg --interval=120 --env TZ=Europe/Berlin; a fresh install
+		// asks nothing, so any prompt fails on the empty stdin
+		service.AgentArgs = []string{"--interval=120"}
+		service.Environment = []string{"TZ=Europe/Berlin"}
+		h.answer()
+		h.install(dir, port)
+		if !h.running(name) {
+			t.Errorf("service %s is not running", name)
+		}
+		assertContains(t, "service definition", h.definition(name), "--interval=120", "TZ", "Europe/Berlin")
+
+		// A later run without --agent-arg and --env keeps them
+		service.AgentArgs, service.Environment = nil, nil
+		h.answer()
+		if err := cmd.Update("3.7.0", "", dir, true, false); err != nil {
+			t.Fatalf("update failed: %v", err)
+		}
+		// Keep the existing configuration
+		h.answer("1")
+		h.install(dir, port)
+		assertContains(t, "service definition", h.definition(name), "--interval=120", "TZ", "Europe/Berlin")
+		cfg := h.config(dir)
+		if strings.Join(cfg.AgentArgs, " ") != "--interval=120" || strings.Join(cfg.Environment, " ") != "TZ=Europe/Berlin" {
+			t.Errorf("installer.conf records arguments %q and environment %q", cfg.AgentArgs, cfg.Environment)
+		}
+
+		// An empty --agent-arg and --env remove them
+		service.AgentArgs, service.Environment = []string{}, []string{}
+		// Keep the existing configuration
+		h.answer("1")
+		h.install(dir, port)
+		if definition := h.definition(name); strings.Contains(definition, "--interval") || strings.Contains(definition, "Europe/Berlin") {
+			t.Errorf("service definition still has the removed settings:\n%s", definition)
+		}
+		if cfg := h.config(dir); cfg.AgentArgs != nil || cfg.Environment != nil {
+			t.Errorf("installer.conf records arguments %q and environment %q, want none", cfg.AgentArgs, cfg.Environment)
+		}
+	})
+}
+
+// R. System requirement check: every probe is reported, in text or as a
+// JSON report, and nothing is installed
+func TestCheck(t *testing.T) {
+	h := newHarness(t, systemd)
+	port := freePort(t)
+	dir := h.path("opt", "ff")
+	h.mkdir("proc")
+	h.mkdir(filepath.Join("sys", "fs", "selinux"))
+	system := func(meminfo, glibc, selinux string) {
+		t.Helper()
+		if err := os.WriteFile(h.path("proc", "meminfo"), []byte(meminfo), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(h.path("sys", "fs", "selinux", "enforce"), []byte(selinux), 0644); err != nil {
+			t.Fatal(err)
+		}
+		h.writeExecutable(filepath.Join(h.bin, "getconf"), fmt.Sprintf("#!/bin/sh\necho glibc %s\n", glibc))
+	}
+	check := func() (map[string]string, bool, error) {
+		t.Helper()
+		var err error
+		output := captureStdout(t, func() {
+			err = cmd.Check(dir, h.server.URL, testNodeVersion, port, nil, cmd.CheckFormatJSON)
+		})
+		var report struct {
+			Ready  bool `json:"ready"`
+			Checks []struct {
+				Name   string `json:"name"`
+				Status string `json:"status"`
+			} `json:"checks"`
+		}
+		if jsonErr := json.Unmarshal([]byte(output), &report); jsonErr != nil {
+			t.Fatalf("standard output is not a JSON report: %v\n%s", jsonErr, output)
+		}
+		statuses := map[string]string{}
+		for _, check := range report.Checks {
+			statuses[check.Name] = check.Status
+		}
+		return statuses, report.Ready, err
+	}
+	assertStatuses := func(statuses map[string]string, want map[string]string) {
+		t.Helper()
+		for name, status := range want {
+			if statuses[name] != status {
+				t.Errorf("check %q is %q, want %q (all: %v)", name, statuses[name], status, statuses)
+			}
+		}
+	}
+
+	// A system that meets the requirements
+	system("MemTotal:        4096000 kB\nMemAvailable:    3072000 kB\n", "2.36", "0\n")
+	statuses, ready, err := check()
+	if err != nil || !ready {
+		t.Errorf("check of a ready system returned ready=%v, %v (%v)", ready, err, statuses)
+	}
+	assertStatuses(statuses, map[string]string{
+		"C library":            "pass",
+		"Memory":               "pass",
+		"FlowFuse":             "pass",
+		"Node.js distribution": "pass",
+		"npm registry":         "pass",
+		"Clock":                "pass",
+		"Security module":      "pass",
+		"Port":                 "pass",
+	})
+
+	// Every problem is reported together, not just the first
+	system("MemTotal:        262144 kB\nMemAvailable:    131072 kB\n", "2.17", "1\n")
+	h.mkdir(filepath.Join("opt", "ff"))
+	if err := os.WriteFile(filepath.Join(dir, "installer.conf"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	statuses, ready, err = check()
+	if err == nil || ready {
+		t.Errorf("check of a failing system returned ready=%v, %v", ready, err)
+	}
+	assertStatuses(statuses, map[string]string{
+		"C library":             "fail",
+		"Memory":                "fail",
+		"Security module":       "warn",
+		"Existing installation": "warn",
+		"npm registry":          "pass",
+	})
+
+	// Warnings pass, unless --strict
+	system("MemTotal:        4096000 kB\nMemAvailable:    3072000 kB\n", "2.36", "1\n")
+	if _, ready, err = check(); err != nil || !ready {
+		t.Errorf("check with warnings returned ready=%v, %v", ready, err)
+	}
+	nodejs.Strict = true
+	if _, ready, err = check(); !errors.Is(err, cmd.ErrNotReady) || ready {
+		t.Errorf("strict check with warnings returned ready=%v, %v", ready, err)
+	}
+
+	// Checks that cannot be run still print a report, with the error
+	var checkErr error
+	output := captureStdout(t, func() {
+		checkErr = cmd.Check(dir, h.server.URL, testNodeVersion, port, []string{h.path("missing-ca.pem")}, cmd.CheckFormatJSON)
+	})
+	if checkErr == nil || errors.Is(checkErr, cmd.ErrNotReady) {
+		t.Errorf("check with a missing CA certificate returned %v, want an error other than not ready", checkErr)
+	}
+	var report struct {
+		Ready bool   `json:"ready"`
+		Error string `json:"error"`
+	}
+	if jsonErr := json.Unmarshal([]byte(output), &report); jsonErr != nil {
+		t.Fatalf("standard output is not a JSON report: %v\n%s", jsonErr, output)
+	}
+	if report.Ready || !strings.Contains(report.Error, "CA certificate") {
+		t.Errorf("report of a check that could not run is %+v", report)
+	}
+
+	if commands := h.commands(); len(commands) > 0 {
+		t.Errorf("check ran commands: %v", commands)
+	}
+	assertExists(t, h.definitionPath(serviceName(port)), false)
+	assertExists(t, filepath.Join(dir, "node"), false)
+}
+
+// captureStdout returns what fn prints on standard output.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+	fn()
+	w.Close()
+	return string(<-done)
+}
+
+// S. Connection check: the FlowFuse platform is checked with the CA bundle
+// and proxy settings before anything is installed, and the MQTT broker of a
+// device.yml is checked too
+func TestConnectivity(t *testing.T) {
+	h := newHarness(t, systemd)
+	platform := httptest.NewUnstartedServer(h.handler())
+	// The rejected handshakes are expected
+	platform.Config.ErrorLog = log.New(io.Discard, "", 0)
+	platform.StartTLS()
+	t.Cleanup(platform.Close)
+	caPath := h.path("platform-ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: platform.Certificate().Raw})
+	if err := os.WriteFile(caPath, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	dir := h.path("opt", "ff")
+	configure := "flowfuse-device-agent --otc-no-start"
+
+	// A private CA that is not trusted stops the installation before the
+	// one-time code is used
+	err := cmd.Install(testNodeVersion, "latest", platform.URL, testOTC, dir, false, port, nil)
+	if err == nil {
+		t.Fatal("install with an untrusted platform certificate succeeded")
+	}
+	assertContains(t, "error", err.Error(), "not trusted", "--ca-cert", "--skip-connectivity-check")
+	h.assertNotRun(configure)
+	assertExists(t, filepath.Join(dir, "node"), false)
+
+	// A platform that is not listening may be down for a moment, so the
+	// installation only warns
+	closed := fmt.Sprintf("http://127.0.0.1:%d", freePort(t))
+	if err := cmd.Install(testNodeVersion, "latest", closed, testOTC, h.path("opt", "closed"), false, freePort(t), nil); err != nil {
+		t.Errorf("install with an unreachable platform failed: %v", err)
+	}
+	h.assertRun(configure, closed)
+
+	// --skip-connectivity-check installs without the check
+	validate.SkipConnectivityCheck = true
+	err = cmd.Install(testNodeVersion, "latest", platform.URL, testOTC, h.path("opt", "skipped"), false, freePort(t), nil)
+	validate.SkipConnectivityCheck = false
+	if err != nil {
+		t.Errorf("install with --skip-connectivity-check failed: %v", err)
+	}
+	h.resetCommands()
+
+	// With its CA the installation goes ahead
+	if err := cmd.Install(testNodeVersion, "latest", platform.URL, testOTC, dir, false, port, []string{caPath}); err != nil {
+		t.Fatalf("install with the platform CA failed: %v", err)
+	}
+	h.assertRun(configure, platform.URL)
+
+	// The details of the connection and the broker of device.yml
+	t.Setenv("NODE_EXTRA_CA_CERTS", caPath)
+	conn, err := validate.VerifyPlatform(platform.URL)
+	if err != nil {
+		t.Fatalf("platform check failed: %v", err)
+	}
+	assertContains(t, "connection details", strings.Join(conn.Describe(), "\n"), "TLS 1.3, certificate chain:", "HTTP 200")
+	if _, err := validate.VerifyPlatform(strings.Replace(platform.URL, "127.0.0.1", "localhost", 1)); err == nil {
+		t.Error("platform check with a certificate for another name succeeded")
+	} else {
+		assertContains(t, "error", err.Error(), "not valid for that name")
+	}
+	if _, err := validate.VerifyBroker("mqtt://" + h.broker.Addr().String()); err != nil {
+		t.Errorf("broker check failed: %v", err)
+	}
+	if _, err := validate.VerifyBroker("mqtts://" + platform.Listener.Addr().String()); err != nil {
+		t.Errorf("TLS broker check failed: %v", err)
+	}
+	if _, err := validate.VerifyBroker(fmt.Sprintf("mqtt://127.0.0.1:%d", freePort(t))); err == nil {
+		t.Error("check of a broker that is not listening succeeded")
+	}
+	if _, err := validate.VerifyBroker("http://" + h.broker.Addr().String()); err == nil {
+		t.Error("check of a broker URL with an unsupported scheme succeeded")
+	}
+}
+
+// T. Backup and restore: an archive brings an installation back on a wiped
+// system, with the Node.js runtime and the Device Agent installed again
+func TestBackupRestore(t *testing.T) {
+	forEachInit(t, func(t *testing.T, h *harness) {
+		port := freePort(t)
+		dir := h.path("opt", "ff")
+		h.install(dir, port)
+		name := serviceName(port)
+		flows := filepath.Join(dir, "project", "flows.json")
+		h.mkdir(filepath.Join("opt", "ff", "project"))
+		if err := os.WriteFile(flows, []byte(`[{"id":"flow"}]`), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		archive := h.path("backup.tar.gz")
+		if err := cmd.Backup(archive, dir); err != nil {
+			t.Fatalf("backup failed: %v", err)
+		}
+
+		// Wipe the installation, its caches and the service account
+		if err := cmd.Uninstall(dir, cmd.UninstallOptions{Purge: true}); err != nil {
+			t.Fatalf("uninstall failed: %v", err)
+		}
+		assertExists(t, filepath.Join(dir, "node"), false)
+		assertExists(t, filepath.Join(dir, "installer.conf"), false)
+
+		h.resetCommands()
+		if err := cmd.Restore(archive, ""); err != nil {
+			t.Fatalf("restore failed: %v", err)
+		}
+		assertExists(t, filepath.Join(dir, "node", "bin", "node"), true)
+		assertExists(t, filepath.Join(dir, "node", "bin", "flowfuse-device-agent"), true)
+		if data, err := os.ReadFile(flows); err != nil || string(data) != `[{"id":"flow"}]` {
+			t.Errorf("restored flows.json is %q, %v", data, err)
+		}
+		assertExists(t, filepath.Join(dir, "device.yml"), true)
+		cfg := h.config(dir)
+		if cfg.NodeVersion != testNodeVersion || cfg.AgentVersion != testAgentVersion || cfg.Port != port {
+			t.Errorf("installer.conf records Node.js %q, agent %q and port %d, want %q, %q and %d", cfg.NodeVersion, cfg.AgentVersion, cfg.Port, testNodeVersion, testAgentVersion, port)
+		}
+		if !h.running(name) {
+			t.Errorf("service %s is not running after the restore", name)
+		}
+	})
+}
+
+// U. Node-RED nodes are installed outside the Node-RED user directory the
+// Device Agent manages, and found by Node-RED through NODE_PATH
+func TestNodeREDNodes(t *testing.T) {
+	forEachInit(t, func(t *testing.T, h *harness) {
+		port := freePort(t)
+		dir := h.path("opt", "ff")
+		name := serviceName(port)
+		node, err := nodejs.ParsePackageSpec("node-red-contrib-example@1.2.3", config.PackageTargetNodeRED)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodejs.ExtraPackages = []config.NpmPackage{node}
+		h.install(dir, port)
+		nodesDir := filepath.Join(dir, nodejs.NodeREDNodesDir)
+		installed := filepath.Join(nodesDir, "node_modules", "node-red-contrib-example", "package.json")
+		assertExists(t, installed, true)
+		assertContains(t, "service definition", h.definition(name), "NODE_PATH", filepath.Join(nodesDir, "node_modules"))
+
+		// The Device Agent writes the package.json of each snapshot into the
+		// user directory, prunes its node_modules to match and removes the
+		// directory on a clean stop
+		userDir := filepath.Join(dir, nodejs.NodeREDUserDir)
+		if err := os.MkdirAll(filepath.Join(userDir, "node_modules", "node-red"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(userDir, "package.json"), []byte(`{"name":"snapshot","dependencies":{"node-red":"4.0.0"}}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.RemoveAll(userDir); err != nil {
+			t.Fatal(err)
+		}
+		assertExists(t, installed, true)
+
+		// An update reinstalls the recorded node into the same directory
+		nodejs.ExtraPackages = nil
+		h.resetCommands()
+		if err := cmd.Update(testAgentVersion, "", dir, true, false); err != nil {
+			t.Fatalf("update failed: %v", err)
+		}
+		h.assertRun("npm", "--prefix "+nodesDir)
+		assertExists(t, installed, true)
+	})
+}
@@ -0,0 +1,185 @@
+//go:build linux
+
+package e2e
+
+import "strings"
+
+// Stub commands. Each records its command line in $FF_CMDLOG and keeps its
+// state (accounts, running services) below $FF_ROOT/.stub.
+
+// logLine records the command line of a stub.
+const logLine = `echo "${0##*/} $*" >> "$FF_CMDLOG"
+`
+
+// lastArg sets $last to the last argument.
+const lastArg = `for last; do :; done
+`
+
+// sudoStub drops the sudo options and runs the command as the current user.
+const sudoStub = `while [ $# -gt 0 ]; do
+    case "$1" in
+        -v) [ $# -eq 1 ] && exit 0; shift ;;
+        -n|-E|--preserve-env=*) shift ;;
+        -u) shift 2 ;;
+        --) shift; break ;;
+        *) break ;;
+    esac
+done
+[ $# -eq 0 ] && exit 0
+exec "$@"
+`
+
+const idStub = lastArg + `[ -e "$FF_ROOT/.stub/users/$last" ] || { echo "id: '$last': no such user" >&2; exit 1; }
+case "$1" in
+    -u|-g) echo 999 ;;
+    -Gn) echo "$last" ;;
+    *) echo "uid=999($last) gid=999($last) groups=999($last)" ;;
+esac
+`
+
+const getentStub = `case "$1" in
+    passwd) [ -e "$FF_ROOT/.stub/users/$2" ] && echo "$2:x:999:999::/home/$2:/sbin/nologin" ;;
+    group) [ -e "$FF_ROOT/.stub/groups/$2" ] && echo "$2:x:999:" ;;
+    *) exit 2 ;;
+esac
+`
+
+const addUserStub = logLine + lastArg + `touch "$FF_ROOT/.stub/users/$last" "$FF_ROOT/.stub/groups/$last"
+`
+
+const addGroupStub = logLine + lastArg + `touch "$FF_ROOT/.stub/groups/$last"
+`
+
+const delUserStub = logLine + lastArg + `rm -f "$FF_ROOT/.stub/users/$last"
+`
+
+const delGroupStub = logLine + lastArg + `rm -f "$FF_ROOT/.stub/groups/$last"
+`
+
+// systemctlStub tracks started units; is-active reports them.
+const systemctlStub = logLine + `state="$FF_ROOT/.stub/running"
+case "$1" in
+    start) touch "$state/$2" ;;
+    stop) rm -f "$state/$2" ;;
+    is-active) [ "$2" = --quiet ] && shift; [ -e "$state/$2" ] ;;
+    status) [ -e "$state/$2" ] && echo "active (running)" || { echo "inactive (dead)"; exit 3; } ;;
+esac
+`
+
+// serviceStub implements "service <name> <action>" and "rc-service <name> <action>".
+const serviceStub = logLine + `state="$FF_ROOT/.stub/running"
+case "$2" in
+    start) touch "$state/$1" ;;
+    stop) rm -f "$state/$1" ;;
+    status) [ -e "$state/$1" ] ;;
+esac
+`
+
+// npmStub installs the Device Agent stub as the @flowfuse/device-agent
+// package; other packages installed with --prefix get a package.json in its
+// node_modules, the rest are only recorded.
+const npmStub = logLine + `action=
+specs=
+local=
+while [ $# -gt 0 ]; do
+    case "$1" in
+        --version) echo 10.9.2; exit 0 ;;
+        --prefix) local=$2; shift ;;
+        --cache|--registry) shift ;;
+        -*) ;;
+        *) if [ -z "$action" ]; then action=$1; else specs="$specs $1"; fi ;;
+    esac
+    shift
+done
+prefix="${npm_config_prefix:-.}"
+package="$prefix/lib/node_modules/@flowfuse/device-agent"
+case "$action" in
+    view) echo "$FF_AGENT_LATEST" ;;
+    install)
+        for spec in $specs; do
+            scope=
+            case "$spec" in @*) scope=@ ;; esac
+            rest="${spec#@}"
+            case "$rest" in
+                *@*) name="$scope${rest%%@*}"; version="${rest#*@}" ;;
+                *) name="$spec"; version="$FF_AGENT_LATEST" ;;
+            esac
+            if [ "$name" != "@flowfuse/device-agent" ]; then
+                if [ -n "$local" ]; then
+                    mkdir -p "$local/node_modules/$name"
+                    echo "{\"name\":\"$name\",\"version\":\"$version\"}" > "$local/node_modules/$name/package.json"
+                fi
+                continue
+            fi
+            mkdir -p "$prefix/bin" "$package"
+            cp "$FF_ROOT/.stub/flowfuse-device-agent" "$prefix/bin/flowfuse-device-agent"
+            echo "{\"name\":\"$name\",\"version\":\"$version\"}" > "$package/package.json"
+        done ;;
+    uninstall) rm -rf "$package" "$prefix/bin/flowfuse-device-agent" ;;
+esac
+`
+
+// agentStub writes the device.yml of a registered device when it is given a
+// one-time code, as "flowfuse-device-agent --otc-no-start" does.
+const agentStub = logLine + `dir=.
+otc=
+url=
+while [ $# -gt 0 ]; do
+    case "$1" in
+        -d|--dir) dir=$2; shift ;;
+        -o|--otc) otc=$2; shift ;;
+        -u|--ff-url) url=$2; shift ;;
+    esac
+    shift
+done
+[ -n "$otc" ] || exit 0
+cat > "$dir/device.yml" <<EOF
+deviceId: device-$otc
+forgeURL: $url
+token: token-$otc
+credentialSecret: secret-$otc
+brokerURL: $FF_BROKER_URL
+brokerUsername: device:$otc
+brokerPassword: password-$otc
+EOF
+`
+
+// nodeStub reports version as the Node.js version.
+func nodeStub(version string) string {
+	return strings.ReplaceAll(`case "$1" in
+    --version|-v) echo vVERSION ;;
+esac
+`, "VERSION", version)
+}
+
+// stubCommands returns the stub scripts by command name for a system using
+// the given init system.
+func stubCommands(init initSystem) map[string]string {
+	stubs := map[string]string{
+		"sudo":     sudoStub,
+		"id":       idStub,
+		"getent":   getentStub,
+		"useradd":  addUserStub,
+		"adduser":  addUserStub,
+		"groupadd": addGroupStub,
+		"addgroup": addGroupStub,
+		"userdel":  delUserStub,
+		"deluser":  delUserStub,
+		"groupdel": delGroupStub,
+		"usermod":  logLine,
+		"gpasswd":  logLine,
+		"chown":    logLine,
+	}
+	switch init {
+	case systemd:
+		stubs["systemctl"] = systemctlStub
+		stubs["journalctl"] = logLine
+	case sysVInit:
+		stubs["service"] = serviceStub
+		stubs["update-rc.d"] = logLine
+	case openRC:
+		stubs["rc-service"] = serviceStub
+		stubs["rc-update"] = logLine
+	}
+	return stubs
+}
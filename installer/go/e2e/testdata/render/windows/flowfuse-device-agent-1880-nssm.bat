@@ -0,0 +1,15 @@
+nssm.exe install flowfuse-device-agent-1880 c:\opt\flowfuse-device\node\flowfuse-device-agent.cmd
+nssm.exe set flowfuse-device-agent-1880 AppDirectory c:\opt\flowfuse-device
+nssm.exe set flowfuse-device-agent-1880 AppParameters "--dir \"c:\opt\flowfuse-device\" --port 1880"
+nssm.exe set flowfuse-device-agent-1880 AppRestartDelay 30000
+nssm.exe set flowfuse-device-agent-1880 AppRotateBytes 10240
+nssm.exe set flowfuse-device-agent-1880 AppRotateFiles 1
+nssm.exe set flowfuse-device-agent-1880 AppRotateOnline 1
+nssm.exe set flowfuse-device-agent-1880 AppStderr c:\opt\flowfuse-device\flowfuse-device-agent-error.log
+nssm.exe set flowfuse-device-agent-1880 AppStderrCreationDisposition 4
+nssm.exe set flowfuse-device-agent-1880 AppStdout c:\opt\flowfuse-device\flowfuse-device-agent.log
+nssm.exe set flowfuse-device-agent-1880 AppStdoutCreationDisposition 4
+nssm.exe set flowfuse-device-agent-1880 Description "FlowFuse Device Agent Service running from c:\opt\flowfuse-device on port 1880"
+nssm.exe set flowfuse-device-agent-1880 DisplayName "FlowFuse Device Agent (1880)"
+nssm.exe set flowfuse-device-agent-1880 ObjectName LocalService
+nssm.exe set flowfuse-device-agent-1880 AppEnvironmentExtra NODE_OPTIONS=--max_old_space_size=512 c:\opt\flowfuse-device\node;%PATH% NODE_PATH=c:\opt\flowfuse-device\node-red-nodes\node_modules
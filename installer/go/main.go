@@ -1,16 +1,27 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/flowfuse/device-agent-installer/cmd"
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
+	"github.com/flowfuse/device-agent-installer/pkg/certs"
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/credentials"
+	"github.com/flowfuse/device-agent-installer/pkg/download"
 	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
+	"github.com/flowfuse/device-agent-installer/pkg/selfupdate"
+	"github.com/flowfuse/device-agent-installer/pkg/service"
 	"github.com/flowfuse/device-agent-installer/pkg/style"
 	"github.com/flowfuse/device-agent-installer/pkg/utils"
+	"github.com/flowfuse/device-agent-installer/pkg/validate"
 	"github.com/spf13/pflag"
 )
 
@@ -18,35 +29,147 @@ var (
 	agentVersion        string
 	flowfuseURL         string
 	flowfuseOneTimeCode string
+	otcFile             string
+	provisioningToken   string
+	provisioningTeam    string
+	provisioningName    string
+	provisioningFile    string
+	logFile             string
+	logDir              string
+	logFormat           string
 	nodeVersion         string
 	serviceUsername     string
+	serviceHome         string
 	installDir          string
-	caCertPath          string
+	nodejsMirror        string
+	npmRegistry         string
+	cacheDir            string
+	encryptCredentials  string
+	backupArchive       string
+	restoreArchive      string
+	diagnosticsArchive  string
+	renderDir           string
+	renderOS            string
+	renderInit          string
+	checkFormat         string
+	manifestURL         string
+	autoUpdateChannel   string
+	autoUpdateWindow    string
 	instVersion         string
 	showVersion         bool
 	help                bool
 	uninstall           bool
 	updateNode          bool
 	updateAgent         bool
+	keepConfig          bool
+	otcStdin            bool
+	existingAccount     bool
+	keepData            bool
+	purge               bool
 	debugMode           bool
+	offline             bool
+	strict              bool
+	status              bool
+	caSystemStore       bool
+	rotateCA            bool
+	check               bool
+	skipConnectivity    bool
+	doctor              bool
+	doctorFix           bool
+	cacheList           bool
+	cachePrune          bool
+	selfUpdate          bool
+	noUpdateCheck       bool
+	enableAutoUpdate    bool
+	disableAutoUpdate   bool
+	runAutoUpdate       bool
+	stageUpdate         bool
+	applyStaged         bool
+	adopt               bool
 	port                int
+	logKeep             int
+	autoUpdateJitter    int
+	serviceUID          int
+	serviceGID          int
+	serviceGroups       []string
+	npmPackages         []string
+	caCertPaths         []string
+	agentArgs           []string
+	environment         []string
+	nodeREDNodes        []string
 )
 
 func init() {
 	pflag.StringVarP(&nodeVersion, "nodejs-version", "n", "22.23.0", "Node.js version to install (minimum)")
 	pflag.StringVarP(&agentVersion, "agent-version", "a", "latest", "Device agent version to install/update to")
 	pflag.StringVarP(&serviceUsername, "service-user", "s", "flowfuse", "Username for the service account")
+	pflag.IntVar(&serviceUID, "service-uid", 0, "UID for a newly created service account (default: system assigned)")
+	pflag.IntVar(&serviceGID, "service-gid", 0, "GID for the group of a newly created service account (default: system assigned)")
+	pflag.StringSliceVar(&serviceGroups, "service-groups", nil, "Comma-separated supplementary groups for the service account, e.g. dialout,gpio,i2c")
+	pflag.StringVar(&serviceHome, "service-home", "", "Home directory for a newly created service account (default: /home/<service-user>)")
+	pflag.BoolVar(&existingAccount, "use-existing-account", false, "Run the service as the existing account given with --service-user instead of creating one (e.g. an LDAP user, DOMAIN\\user or NT SERVICE\\<service>)")
 	pflag.StringVarP(&flowfuseURL, "url", "u", "", "FlowFuse URL")
 	pflag.StringVarP(&flowfuseOneTimeCode, "otc", "o", "", "FlowFuse one time code for authentication (optional for interactive installation)")
+	pflag.StringVar(&otcFile, "otc-file", "", "Read the one time code from a file, keeping it out of the process list and shell history")
+	pflag.BoolVar(&otcStdin, "otc-stdin", false, "Read the one time code from the first line of standard input")
+	pflag.StringVar(&provisioningToken, "provisioning-token", "", "Team provisioning token; the Device Agent registers itself as a new device on its first start (requires --url and --provisioning-team)")
+	pflag.StringVar(&provisioningTeam, "provisioning-team", "", "ID of the team the provisioned device is added to")
+	pflag.StringVar(&provisioningName, "provisioning-name", "", "Name of the provisioning configuration, shown as the device type")
+	pflag.StringVar(&provisioningFile, "provisioning-file", "", "Path to a provisioning device.yml (forgeURL, provisioningTeam, provisioningToken) to install")
 	pflag.StringVarP(&installDir, "dir", "d", "", "Custom installation directory (default: /opt/flowfuse-device on Unix, c:\\opt\\flowfuse-device on Windows)")
 	pflag.IntVarP(&port, "port", "p", 1880, "TCP port for the device agent (1-65535)")
-	pflag.StringVar(&caCertPath, "ca-cert", "", "Path to a CA certificate bundle (PEM) the Device Agent should trust")
+	pflag.StringArrayVar(&caCertPaths, "ca-cert", nil, "Path to a CA certificate bundle (PEM) the Device Agent should trust (repeatable)")
+	pflag.BoolVar(&caSystemStore, "ca-system-store", false, "Add the operating system trust store to the CA bundle of the Device Agent")
+	pflag.BoolVar(&rotateCA, "rotate-ca", false, "Replace the CA bundle of an installed Device Agent with --ca-cert/--ca-system-store and restart the service")
+	pflag.StringVar(&nodejsMirror, "nodejs-mirror", os.Getenv("NODEJS_ORG_MIRROR"), "Node.js distribution mirror tried before the official sources (default: $NODEJS_ORG_MIRROR)")
+	pflag.StringVar(&npmRegistry, "npm-registry", os.Getenv("npm_config_registry"), "npm registry the Device Agent and extra packages are installed from (default: $npm_config_registry, or the public registry)")
+	pflag.StringVar(&cacheDir, "cache-dir", "", "Shared artifact cache directory (default: /var/cache/flowfuse-installer on Unix, %ProgramData%\\FlowFuse\\installer-cache on Windows)")
+	pflag.StringVar(&encryptCredentials, "encrypt-credentials", "", "Encrypt the device credentials in device.yml with the given key source: systemd-creds, keyfile or dpapi")
+	pflag.BoolVar(&offline, "offline", false, "Install or update using only artifacts already in the cache, without network access")
+	pflag.BoolVar(&skipConnectivity, "skip-connectivity-check", false, "Install without checking the connection to the FlowFuse platform first")
+	pflag.BoolVar(&strict, "strict", false, "Fail instead of warning when the Node.js version is end-of-life or has a newer security release")
+	pflag.StringVar(&backupArchive, "backup", "", "Back up the device agent state (configuration and project data) to the given .tar.gz archive")
+	pflag.StringVar(&restoreArchive, "restore", "", "Restore the device agent from an archive created with --backup")
+	pflag.StringVar(&diagnosticsArchive, "collect-diagnostics", "", "Collect logs, configuration (with secrets redacted) and system details into the given .tar.gz archive for a support ticket")
+	pflag.StringVar(&renderDir, "render", "", "Write the service definition and installer.conf an installation with the given options would create to a directory, without installing anything")
+	pflag.StringVar(&renderOS, "render-os", "", "With --render, the operating system to render for: linux, darwin or windows (default: this system)")
+	pflag.StringVar(&renderInit, "render-init", "", "With --render, the Linux init system to render for: systemd, sysvinit or openrc (default: this system's, or systemd)")
+	pflag.BoolVar(&check, "check", false, "Check whether this system meets the requirements of an installation with the given options and report every result, without installing anything")
+	pflag.StringVar(&checkFormat, "check-format", cmd.CheckFormatText, "With --check, the report format: text or json (printed on standard output)")
+	pflag.BoolVar(&status, "status", false, "Show the status of the installed device agent")
+	pflag.BoolVar(&doctor, "doctor", false, "Check the installation for common problems")
+	pflag.BoolVar(&doctorFix, "fix", false, "With --doctor, repair the problems that can be repaired safely")
+	pflag.BoolVar(&cacheList, "cache-list", false, "List the contents of the artifact cache")
+	pflag.BoolVar(&cachePrune, "cache-prune", false, "Remove cached artifacts unused for 30 days")
+	pflag.StringArrayVar(&agentArgs, "agent-arg", nil, "Extra argument passed to the Device Agent by the service, kept on reinstall; an empty value removes them (repeatable)")
+	pflag.StringArrayVar(&environment, "env", nil, "Extra environment variable of the service as KEY=VALUE, kept on reinstall; an empty value removes them (repeatable)")
+	pflag.StringArrayVar(&npmPackages, "npm-package", nil, "Extra global npm package to install, pinned as name@version (repeatable)")
+	pflag.StringArrayVar(&nodeREDNodes, "node-red-node", nil, "Node-RED node to pre-install into the Node-RED user directory, pinned as name@version (repeatable)")
 	pflag.BoolVarP(&showVersion, "version", "v", false, "Display installer version")
+	pflag.BoolVar(&enableAutoUpdate, "enable-auto-update", false, "Schedule daily Device Agent updates in a maintenance window, with a health check and rollback")
+	pflag.BoolVar(&disableAutoUpdate, "disable-auto-update", false, "Remove the scheduled Device Agent updates")
+	pflag.StringVar(&autoUpdateChannel, "auto-update-channel", config.AutoUpdateChannelMinor, "Versions installed by scheduled updates: pinned (--agent-version, default: the installed version), minor (new minor and patch releases) or latest")
+	pflag.StringVar(&autoUpdateWindow, "auto-update-window", "02:00-04:00", "Daily maintenance window for scheduled updates, in local time (HH:MM-HH:MM)")
+	pflag.IntVar(&autoUpdateJitter, "auto-update-jitter", 30, "Maximum random delay in minutes before a scheduled update starts")
+	pflag.BoolVar(&runAutoUpdate, "run-auto-update", false, "Run a scheduled update now; used by the job installed with --enable-auto-update")
+	pflag.BoolVar(&selfUpdate, "self-update", false, "Replace this installer with the latest release, verified against the release signing key")
+	pflag.BoolVar(&noUpdateCheck, "no-update-check", os.Getenv("FLOWFUSE_INSTALLER_NO_UPDATE_CHECK") != "", "Do not check for a newer installer release (default: set if $FLOWFUSE_INSTALLER_NO_UPDATE_CHECK is set)")
+	pflag.StringVar(&manifestURL, "installer-manifest-url", os.Getenv("FLOWFUSE_INSTALLER_MANIFEST_URL"), "Installer release manifest used by --self-update and the update check (default: latest GitHub release, or $FLOWFUSE_INSTALLER_MANIFEST_URL)")
 	pflag.BoolVarP(&help, "help", "h", false, "Display help information")
 	pflag.BoolVar(&uninstall, "uninstall", false, "Uninstall the device agent")
+	pflag.BoolVar(&keepConfig, "keep-config", false, "With --uninstall, keep device.yml, installer.conf and the CA bundle")
+	pflag.BoolVar(&keepData, "keep-data", false, "With --uninstall, keep the Node-RED user directory and project files")
+	pflag.BoolVar(&purge, "purge", false, "With --uninstall, also remove caches, external logs and the service user without prompting")
 	pflag.BoolVar(&updateNode, "update-nodejs", false, "Update bundled Node.js to specified version")
 	pflag.BoolVar(&updateAgent, "update-agent", false, "Update the Device Agent package to specified version")
+	pflag.BoolVar(&stageUpdate, "stage-update", false, "With --update-nodejs/--update-agent, install the new versions next to the running ones without stopping the service")
+	pflag.BoolVar(&applyStaged, "apply-staged", false, "Switch to the update prepared with --stage-update, restarting the service")
+	pflag.BoolVar(&adopt, "adopt", false, "Move a Device Agent installed without the installer (global npm install and hand-written service) under the installer's management")
 	pflag.BoolVar(&debugMode, "debug", false, "Enable debug logging")
+	pflag.StringVar(&logFile, "log-file", "", "Write the installer log to this file (appended to if it exists)")
+	pflag.StringVar(&logDir, "log-dir", "", "Write the installer log to a timestamped file in this directory")
+	pflag.StringVar(&logFormat, "log-format", logger.FormatText, "Installer log file format: text or json")
+	pflag.IntVar(&logKeep, "log-keep", 10, "Number of installer logs kept in <dir>/logs/installer")
 	pflag.Parse()
 
 	if help {
@@ -59,15 +182,47 @@ func init() {
 		fmt.Print("\n")
 		fmt.Println("Usage:")
 		fmt.Println("  Installation:")
-		fmt.Printf("    %s --otc <one-time-code> [--agent-version <version>] [--nodejs-version <version>] [--dir <custom-dir>] [--port <n>] [--ca-cert <path>]\n", exeName)
+		fmt.Printf("    %s --otc <one-time-code> [--agent-version <version>] [--nodejs-version <version>] [--dir <custom-dir>] [--port <n>] [--ca-cert <path>] [--encrypt-credentials <source>]\n", exeName)
+		fmt.Printf("    %s --otc-file <path> | --otc-stdin [--agent-version <version>] ... (or set FLOWFUSE_OTC)\n", exeName)
+		fmt.Printf("    %s --url <url> --provisioning-team <team-id> --provisioning-token <token> [--provisioning-name <name>] ... (zero-touch enrolment)\n", exeName)
+		fmt.Printf("    %s --provisioning-file <device.yml> ...\n", exeName)
+		fmt.Printf("    %s --otc <one-time-code> --agent-arg <arg> [--agent-arg <arg>] --env KEY=VALUE [--env KEY=VALUE] ... (extra Device Agent arguments and service environment)\n", exeName)
 		fmt.Printf("    %s [--agent-version <version>] [--nodejs-version <version>] [--dir <custom-dir>] [--port <n>] [--ca-cert <path>] (interactive mode)\n", exeName)
 		fmt.Println("  Update:")
-		fmt.Printf("    %s --update-agent [--agent-version <version>]\n", exeName)
+		fmt.Printf("    %s --update-agent [--agent-version <version>] [--npm-package <name@version>] [--node-red-node <name@version>]\n", exeName)
 		fmt.Printf("    %s --update-nodejs [--nodejs-version <version>]\n", exeName)
 		fmt.Printf("    %s --update-agent --update-nodejs [--agent-version <version>] [--nodejs-version <version>]\n", exeName)
+		fmt.Println("  Staged update:")
+		fmt.Printf("    %s --stage-update --update-agent|--update-nodejs [--agent-version <version>] [--nodejs-version <version>]\n", exeName)
+		fmt.Printf("    %s --apply-staged [--dir <custom-working-directory>]\n", exeName)
+		fmt.Println("  Adopt a manual installation:")
+		fmt.Printf("    %s --adopt [--dir <custom-working-directory>] [--agent-version <version>] [--nodejs-version <version>] [--port <n>] [--service-user <name>]\n", exeName)
+		fmt.Println("  Backup and restore:")
+		fmt.Printf("    %s --backup <archive.tar.gz> [--dir <custom-working-directory>]\n", exeName)
+		fmt.Printf("    %s --restore <archive.tar.gz> [--dir <custom-working-directory>]\n", exeName)
+		fmt.Println("  CA bundle rotation:")
+		fmt.Printf("    %s --rotate-ca --ca-cert <bundle.pem> [--ca-cert <bundle.pem>] [--ca-system-store] [--dir <custom-working-directory>]\n", exeName)
+		fmt.Println("  Automatic updates:")
+		fmt.Printf("    %s --enable-auto-update [--auto-update-channel pinned|minor|latest] [--agent-version <version>] [--auto-update-window HH:MM-HH:MM] [--auto-update-jitter <minutes>] [--dir <custom-working-directory>]\n", exeName)
+		fmt.Printf("    %s --disable-auto-update [--dir <custom-working-directory>]\n", exeName)
+		fmt.Println("  Review:")
+		fmt.Printf("    %s --render <dir> [--render-os linux|darwin|windows] [--render-init systemd|sysvinit|openrc] [--dir <custom-dir>] [--port <n>] [--ca-cert <path>] [--encrypt-credentials <source>]\n", exeName)
+		fmt.Println("  System requirements:")
+		fmt.Printf("    %s --check [--check-format text|json] [--strict] [--url <url>] [--nodejs-version <version>] [--dir <custom-dir>] [--port <n>] [--ca-cert <path>]\n", exeName)
+		fmt.Println("  Status:")
+		fmt.Printf("    %s --status [--dir <custom-working-directory>] [--strict]\n", exeName)
+		fmt.Println("  Diagnostics:")
+		fmt.Printf("    %s --doctor [--fix] [--dir <custom-working-directory>]\n", exeName)
+		fmt.Printf("    %s --collect-diagnostics <archive.tar.gz> [--dir <custom-working-directory>]\n", exeName)
+		fmt.Println("  Cache:")
+		fmt.Printf("    %s --cache-list [--cache-dir <dir>]\n", exeName)
+		fmt.Printf("    %s --cache-prune [--cache-dir <dir>]\n", exeName)
+		fmt.Println("  Installer update:")
+		fmt.Printf("    %s --self-update\n", exeName)
 		fmt.Println("  Uninstall:")
 		fmt.Printf("    %s --uninstall\n", exeName)
 		fmt.Printf("    %s --uninstall --dir <custom-working-directory>\n", exeName)
+		fmt.Printf("    %s --uninstall [--keep-config] [--keep-data] [--purge]\n", exeName)
 		fmt.Print("\n")
 		fmt.Println("Options:")
 		pflag.PrintDefaults()
@@ -83,6 +238,24 @@ func init() {
 func main() {
 	utils.ServiceUsername = serviceUsername
 	utils.DefaultPort = port
+	utils.ServiceUID = serviceUID
+	utils.ServiceGID = serviceGID
+	utils.ServiceHome = serviceHome
+	utils.UseExistingAccount = existingAccount
+	if pflag.CommandLine.Changed("service-groups") {
+		utils.ServiceGroups = append([]string{}, serviceGroups...)
+	}
+	nodejs.MirrorURL = nodejsMirror
+	nodejs.Registry = npmRegistry
+	cache.Dir = cacheDir
+	download.Offline = offline
+	credentials.Encryption = encryptCredentials
+	certs.SystemStore = caSystemStore
+	nodejs.Strict = strict
+	validate.SkipConnectivityCheck = skipConnectivity
+	nodejs.AutoSelectVersion = !pflag.CommandLine.Changed("nodejs-version")
+	selfupdate.ManifestURL = manifestURL
+	selfupdate.CheckDisabled = noUpdateCheck
 	var err error
 	var exitCode int
 
@@ -91,7 +264,97 @@ func main() {
 		os.Exit(2)
 	}
 
+	if serviceUID < 0 || serviceGID < 0 {
+		fmt.Println("Invalid --service-uid or --service-gid value. Please specify a positive number.")
+		os.Exit(2)
+	}
+
+	if pflag.CommandLine.Changed("agent-arg") {
+		service.AgentArgs = []string{}
+		for _, arg := range agentArgs {
+			if arg == "" {
+				continue
+			}
+			if err := service.ValidateAgentArg(arg); err != nil {
+				fmt.Printf("Invalid --agent-arg value: %s\n", err)
+				os.Exit(2)
+			}
+			if name, _, _ := strings.Cut(arg, "="); name == "--config" && encryptCredentials != "" {
+				fmt.Println("--agent-arg --config cannot be used with --encrypt-credentials, which passes the decrypted device configuration with --config.")
+				os.Exit(2)
+			}
+			service.AgentArgs = append(service.AgentArgs, arg)
+		}
+	}
+	if pflag.CommandLine.Changed("env") {
+		service.Environment = []string{}
+		for _, spec := range environment {
+			if spec == "" {
+				continue
+			}
+			if _, _, err := service.ParseEnvironment(spec); err != nil {
+				fmt.Printf("Invalid --env value: %s\n", err)
+				os.Exit(2)
+			}
+			service.Environment = append(service.Environment, spec)
+		}
+		service.RegisterEnvironmentSecrets(service.Environment)
+	}
+
+	for _, spec := range npmPackages {
+		pkg, err := nodejs.ParsePackageSpec(spec, config.PackageTargetGlobal)
+		if err != nil {
+			fmt.Printf("Invalid --npm-package value: %s\n", err)
+			os.Exit(2)
+		}
+		nodejs.ExtraPackages = append(nodejs.ExtraPackages, pkg)
+	}
+	for _, spec := range nodeREDNodes {
+		pkg, err := nodejs.ParsePackageSpec(spec, config.PackageTargetNodeRED)
+		if err != nil {
+			fmt.Printf("Invalid --node-red-node value: %s\n", err)
+			os.Exit(2)
+		}
+		nodejs.ExtraPackages = append(nodejs.ExtraPackages, pkg)
+	}
+
+	if (renderOS != "" || renderInit != "") && renderDir == "" {
+		fmt.Println("--render-os and --render-init can only be used with --render.")
+		os.Exit(2)
+	}
+
+	if stageUpdate && !updateNode && !updateAgent {
+		fmt.Println("--stage-update needs --update-nodejs and/or --update-agent.")
+		os.Exit(2)
+	}
+
+	if pflag.CommandLine.Changed("check-format") && !check {
+		fmt.Println("--check-format can only be used with --check.")
+		os.Exit(2)
+	}
+	if checkFormat != cmd.CheckFormatText && checkFormat != cmd.CheckFormatJSON {
+		fmt.Println("Invalid --check-format value. Please specify text or json.")
+		os.Exit(2)
+	}
+
+	if doctorFix && !doctor {
+		fmt.Println("--fix can only be used with --doctor.")
+		os.Exit(2)
+	}
+
+	if logFormat != logger.FormatText && logFormat != logger.FormatJSON {
+		fmt.Println("Invalid --log-format value. Please specify text or json.")
+		os.Exit(2)
+	}
+
 	// Initialize logger
+	logger.FilePath = logFile
+	logger.Dir = logDir
+	logger.Format = logFormat
+	if check && checkFormat == cmd.CheckFormatJSON {
+		// Keep standard output for the report
+		logger.Console = os.Stderr
+	}
 	if err := logger.Initialize(debugMode); err != nil {
 		fmt.Printf("Warning: Failed to initialize logger: %s\n", err)
 	} else {
@@ -111,9 +374,46 @@ func main() {
 		os.Exit(130)
 	}()
 
+	// Resolve the one-time code and keep it out of every log from here on
+	flowfuseOneTimeCode, err = utils.ResolveOneTimeCode(flowfuseOneTimeCode, otcFile, otcStdin)
+	if err != nil {
+		logger.Error("%v", err)
+		logger.Close()
+		os.Exit(2)
+	}
+	logger.RegisterSecret(flowfuseOneTimeCode)
+	os.Unsetenv("FLOWFUSE_OTC")
+	if pflag.CommandLine.Changed("otc") {
+		logger.Info("%s --otc is visible in the process list and shell history, prefer --otc-file, --otc-stdin or FLOWFUSE_OTC", style.Yellow("Warning:"))
+	}
+
+	// Resolve the provisioning configuration used instead of a one-time code
+	logger.RegisterSecret(provisioningToken)
+	nodejs.ProvisioningConfig, err = utils.ResolveProvisioningConfiguration(flowfuseURL, provisioningTeam, provisioningToken, provisioningName, provisioningFile)
+	if err != nil {
+		logger.Error("%v", err)
+		logger.Close()
+		os.Exit(2)
+	}
+	if nodejs.ProvisioningConfig != "" {
+		if flowfuseOneTimeCode != "" {
+			logger.Error("A one-time code cannot be combined with a provisioning token.")
+			logger.Close()
+			os.Exit(2)
+		}
+		if encryptCredentials != "" {
+			logger.Error("--encrypt-credentials cannot be combined with a provisioning token, the Device Agent writes its credentials when it registers. Run the installer again with --encrypt-credentials once the device is registered.")
+			logger.Close()
+			os.Exit(2)
+		}
+	}
+	if pflag.CommandLine.Changed("provisioning-token") {
+		logger.Info("%s --provisioning-token is visible in the process list and shell history, prefer --provisioning-file", style.Yellow("Warning:"))
+	}
+
 	// Log startup information
-	logger.Debug("Command line arguments: node=%s, agent=%s, user=%s, url=%s, debug=%v, customInstallDir=%s, port=%d, caCert=%s",
-		nodeVersion, agentVersion, serviceUsername, flowfuseURL, debugMode, installDir, port, caCertPath)
+	logger.Debug("Command line arguments: node=%s, agent=%s, user=%s, url=%s, debug=%v, customInstallDir=%s, port=%d, caCert=%v, caSystemStore=%v, nodejsMirror=%s, cacheDir=%s, offline=%v, strict=%v",
+		nodeVersion, agentVersion, serviceUsername, flowfuseURL, debugMode, installDir, port, caCertPaths, caSystemStore, nodejsMirror, cacheDir, offline, strict)
 	operatingSystem, architecture := utils.GetOSDetails()
 	logger.Debug("Detected system: %s, detected architecture: %s", operatingSystem, architecture)
 
@@ -124,21 +424,101 @@ func main() {
 		logger.Debug("FlowFuse Device Agent Installer version: %s", instVersion)
 	}
 
-	if uninstall {
-		err = cmd.Uninstall(installDir)
+	selfupdate.RemoveOldExecutable()
+	updateNotice := func() {}
+	if !selfUpdate {
+		updateNotice = selfupdate.StartCheck(instVersion)
+	}
+
+	if selfUpdate {
+		err = cmd.SelfUpdate(instVersion)
+	} else if renderDir != "" {
+		err = cmd.Render(renderDir, renderOS, renderInit, nodeVersion, agentVersion, installDir, port, caCertPaths)
+	} else if check {
+		err = cmd.Check(installDir, flowfuseURL, nodeVersion, port, caCertPaths, checkFormat)
+	} else if backupArchive != "" {
+		err = cmd.Backup(backupArchive, installDir)
+	} else if restoreArchive != "" {
+		err = cmd.Restore(restoreArchive, installDir)
+	} else if enableAutoUpdate {
+		policy := config.AutoUpdatePolicy{
+			Channel:       autoUpdateChannel,
+			Window:        autoUpdateWindow,
+			JitterMinutes: autoUpdateJitter,
+		}
+		if pflag.CommandLine.Changed("agent-version") {
+			policy.Version = agentVersion
+		}
+		err = cmd.EnableAutoUpdate(installDir, policy)
+	} else if disableAutoUpdate {
+		err = cmd.DisableAutoUpdate(installDir)
+	} else if runAutoUpdate {
+		err = cmd.RunAutoUpdate(installDir)
+	} else if rotateCA {
+		err = cmd.RotateCA(installDir, caCertPaths)
+	} else if doctor {
+		err = cmd.Doctor(installDir, doctorFix)
+	} else if diagnosticsArchive != "" {
+		err = cmd.CollectDiagnostics(diagnosticsArchive, installDir, instVersion)
+	} else if status {
+		err = cmd.Status(installDir)
+	} else if cacheList {
+		err = cmd.CacheList()
+	} else if cachePrune {
+		err = cmd.CachePrune()
+	} else if uninstall {
+		err = cmd.Uninstall(installDir, cmd.UninstallOptions{
+			KeepConfig: keepConfig,
+			KeepData:   keepData,
+			Purge:      purge,
+		})
+	} else if adopt {
+		adoptAgentVersion := ""
+		if pflag.CommandLine.Changed("agent-version") {
+			adoptAgentVersion = agentVersion
+		}
+		adoptPort := 0
+		if pflag.CommandLine.Changed("port") {
+			adoptPort = port
+		}
+		err = cmd.Adopt(nodeVersion, adoptAgentVersion, installDir, adoptPort, caCertPaths, !pflag.CommandLine.Changed("service-user"))
+	} else if applyStaged {
+		err = cmd.ApplyStaged(installDir)
+	} else if stageUpdate {
+		err = cmd.StageUpdate(agentVersion, nodeVersion, installDir, updateAgent, updateNode)
 	} else if updateNode || updateAgent {
 		err = cmd.Update(agentVersion, nodeVersion, installDir, updateAgent, updateNode)
 	} else {
 		logger.Info("")
 		logger.Info("Let's get your connected to FlowFuse.")
 		logger.Info("")
-		err = cmd.Install(nodeVersion, agentVersion, flowfuseURL, flowfuseOneTimeCode, installDir, false, port, caCertPath)
+		err = cmd.Install(nodeVersion, agentVersion, flowfuseURL, flowfuseOneTimeCode, installDir, false, port, caCertPaths)
 	}
 
-	if err != nil {
-		exitCode = 1
-	} else {
+	updateNotice()
+
+	switch {
+	case err == nil:
 		exitCode = 0
+	case check && !errors.Is(err, cmd.ErrNotReady):
+		// The checks could not be run, as opposed to a system that is not ready
+		exitCode = 3
+	default:
+		exitCode = 1
+	}
+
+	// Without --log-file or --log-dir, keep the log with the installation.
+	// --check does not change the working directory, so its log stays in the
+	// temporary directory.
+	logger.Close()
+	if _, statErr := os.Stat(logger.GetLogFilePath()); statErr == nil && logFile == "" && logDir == "" && !check {
+		if workDir, wdErr := utils.GetWorkingDirectory(installDir); wdErr == nil {
+			if _, statErr := os.Stat(workDir); statErr == nil {
+				if _, archiveErr := utils.ArchiveInstallerLog(logger.GetLogFilePath(), filepath.Join(workDir, "logs", "installer"), logKeep); archiveErr != nil {
+					fmt.Fprintf(os.Stderr, "Warning: installer log kept at %s: %v\n", logger.GetLogFilePath(), archiveErr)
+				}
+			}
+		}
 	}
 
 	os.Exit(exitCode)
@@ -0,0 +1,261 @@
+// Package autoupdate holds the policy of scheduled Device Agent updates: the
+// maintenance window, the version channel and the random start delay, and
+// the installer copy the scheduled job runs.
+package autoupdate
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+)
+
+// Window is a daily maintenance window in local time. A window whose end is
+// not after its start runs past midnight, e.g. "23:00-01:00".
+type Window struct {
+	// Start and End are offsets from midnight
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseWindow parses a maintenance window written as "HH:MM-HH:MM".
+//
+// Parameters:
+//   - window: The window, e.g. "02:00-04:00"
+//
+// Returns:
+//   - Window: The parsed window
+//   - error: An error if the window is malformed or empty
+func ParseWindow(window string) (Window, error) {
+	start, end, ok := strings.Cut(strings.TrimSpace(window), "-")
+	if !ok {
+		return Window{}, fmt.Errorf("invalid maintenance window %q, expected HH:MM-HH:MM", window)
+	}
+	var w Window
+	var err error
+	if w.Start, err = parseClock(start); err != nil {
+		return Window{}, fmt.Errorf("invalid maintenance window %q: %w", window, err)
+	}
+	if w.End, err = parseClock(end); err != nil {
+		return Window{}, fmt.Errorf("invalid maintenance window %q: %w", window, err)
+	}
+	if w.Start == w.End {
+		return Window{}, fmt.Errorf("invalid maintenance window %q: start and end are the same", window)
+	}
+	return w, nil
+}
+
+// parseClock parses a local time of day written as "HH:MM".
+func parseClock(clock string) (time.Duration, error) {
+	hours, minutes, ok := strings.Cut(strings.TrimSpace(clock), ":")
+	if !ok || len(minutes) != 2 {
+		return 0, fmt.Errorf("%q is not a time of day (HH:MM)", clock)
+	}
+	h, err := strconv.Atoi(hours)
+	if err != nil || h < 0 || h > 23 {
+		return 0, fmt.Errorf("%q is not a time of day (HH:MM)", clock)
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m < 0 || m > 59 {
+		return 0, fmt.Errorf("%q is not a time of day (HH:MM)", clock)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// StartClock returns the hour and minute the window starts at.
+func (w Window) StartClock() (int, int) {
+	return int(w.Start / time.Hour), int(w.Start % time.Hour / time.Minute)
+}
+
+// Remaining returns how much of the window is left at t, or zero if t is
+// outside the window.
+//
+// Parameters:
+//   - t: The time to check, in local time
+//
+// Returns:
+//   - time.Duration: The time until the window closes
+func (w Window) Remaining(t time.Time) time.Duration {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Sub(midnight)
+	end := w.End
+	if end <= w.Start {
+		// The window runs past midnight: either it opened yesterday, or it
+		// closes tomorrow
+		if now < end {
+			return end - now
+		}
+		end += 24 * time.Hour
+	}
+	if now < w.Start || now >= end {
+		return 0
+	}
+	return end - now
+}
+
+// String formats the window as "HH:MM-HH:MM".
+func (w Window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", int(w.Start/time.Hour), int(w.Start%time.Hour/time.Minute), int(w.End/time.Hour), int(w.End%time.Hour/time.Minute))
+}
+
+// ValidatePolicy checks that a policy is complete and consistent.
+//
+// Parameters:
+//   - policy: The policy to check
+//
+// Returns:
+//   - error: An error describing the first problem found, nil if the policy is valid
+func ValidatePolicy(policy *config.AutoUpdatePolicy) error {
+	switch policy.Channel {
+	case config.AutoUpdateChannelPinned:
+		if policy.Version == "" || policy.Version == "latest" {
+			return fmt.Errorf("the pinned channel needs a Device Agent version (x.y.z)")
+		}
+	case config.AutoUpdateChannelMinor, config.AutoUpdateChannelLatest:
+	default:
+		return fmt.Errorf("invalid update channel %q, expected %s, %s or %s", policy.Channel,
+			config.AutoUpdateChannelPinned, config.AutoUpdateChannelMinor, config.AutoUpdateChannelLatest)
+	}
+	if _, err := ParseWindow(policy.Window); err != nil {
+		return err
+	}
+	if policy.JitterMinutes < 0 {
+		return fmt.Errorf("the update jitter cannot be negative")
+	}
+	return nil
+}
+
+// Jitter returns the random delay before an update starts: up to the
+// policy's jitter, but never more than half of what is left of the window so
+// that the update has time to finish inside it.
+//
+// Parameters:
+//   - policy: The update policy
+//   - remaining: What is left of the maintenance window
+//
+// Returns:
+//   - time.Duration: The delay
+func Jitter(policy *config.AutoUpdatePolicy, remaining time.Duration) time.Duration {
+	limit := time.Duration(policy.JitterMinutes) * time.Minute
+	if limit > remaining/2 {
+		limit = remaining / 2
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// VersionRange returns the semver range the channel of a policy follows from
+// the installed Device Agent version, or "" for the latest release.
+//
+// Parameters:
+//   - policy: The update policy
+//   - installedVersion: The installed Device Agent version
+//
+// Returns:
+//   - string: The range, e.g. "^3.6.1"
+func VersionRange(policy *config.AutoUpdatePolicy, installedVersion string) string {
+	switch policy.Channel {
+	case config.AutoUpdateChannelPinned:
+		return policy.Version
+	case config.AutoUpdateChannelMinor:
+		return "^" + installedVersion
+	}
+	return ""
+}
+
+// InstallerPath returns where the installer copy run by the scheduled jobs is
+// kept. It is outside the working directory, which the service account can
+// write to, because the jobs run it with full privileges.
+func InstallerPath() string {
+	if runtime.GOOS == "windows" {
+		programData := os.Getenv("ProgramData")
+		if programData == "" {
+			programData = `C:\ProgramData`
+		}
+		return filepath.Join(programData, "FlowFuse", "installer", "flowfuse-device-installer.exe")
+	}
+	return utils.SystemPath("/usr/local/lib/flowfuse-device-installer/flowfuse-device-installer")
+}
+
+// InstallInstaller copies the running installer to InstallerPath, replacing
+// an older copy, unless it is that copy.
+//
+// Returns:
+//   - string: The path of the copy
+//   - error: An error if the installer cannot be copied
+func InstallInstaller() (string, error) {
+	logger.LogFunctionEntry("InstallInstaller", nil)
+
+	dest := InstallerPath()
+	exePath, err := os.Executable()
+	if err == nil {
+		exePath, err = filepath.EvalSymlinks(exePath)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to locate the installer executable: %w", err)
+		logger.LogFunctionExit("InstallInstaller", nil, err)
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(dest); err == nil && resolved == exePath {
+		logger.LogFunctionExit("InstallInstaller", dest, nil)
+		return dest, nil
+	}
+
+	if runtime.GOOS == "windows" {
+		err = copyInstaller(exePath, dest)
+	} else {
+		staged := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".new")
+		for _, args := range [][]string{
+			{"mkdir", "-p", filepath.Dir(dest)},
+			{"cp", exePath, staged},
+			{"chmod", "755", staged},
+			{"mv", "-f", staged, dest},
+		} {
+			if output, cmdErr := exec.Command("sudo", args...).CombinedOutput(); cmdErr != nil {
+				exec.Command("sudo", "rm", "-f", staged).Run()
+				err = fmt.Errorf("failed to copy the installer to %s: %w\nOutput: %s", dest, cmdErr, output)
+				break
+			}
+		}
+	}
+	if err != nil {
+		logger.LogFunctionExit("InstallInstaller", nil, err)
+		return "", err
+	}
+
+	logger.Debug("Installer copied to %s", dest)
+	logger.LogFunctionExit("InstallInstaller", dest, nil)
+	return dest, nil
+}
+
+// copyInstaller copies the installer on Windows, where the installer runs
+// elevated and needs no sudo.
+func copyInstaller(src, dest string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", src, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(dest), err)
+	}
+	staged := dest + ".new"
+	if err := os.WriteFile(staged, data, 0755); err != nil {
+		return fmt.Errorf("failed to write %s: %w", staged, err)
+	}
+	if err := os.Rename(staged, dest); err != nil {
+		os.Remove(staged)
+		return fmt.Errorf("failed to replace %s: %w", dest, err)
+	}
+	return nil
+}
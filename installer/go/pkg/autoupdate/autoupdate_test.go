@@ -0,0 +1,116 @@
+package autoupdate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+)
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		window     string
+		start, end time.Duration
+		ok         bool
+	}{
+		{"02:00-04:00", 2 * time.Hour, 4 * time.Hour, true},
+		{" 02:30 - 04:15 ", 2*time.Hour + 30*time.Minute, 4*time.Hour + 15*time.Minute, true},
+		{"23:00-01:00", 23 * time.Hour, time.Hour, true},
+		{"0:00-23:59", 0, 23*time.Hour + 59*time.Minute, true},
+		{"02:00-02:00", 0, 0, false},
+		{"02:00", 0, 0, false},
+		{"24:00-01:00", 0, 0, false},
+		{"02:60-04:00", 0, 0, false},
+		{"02:0-04:00", 0, 0, false},
+		{"-1:00-04:00", 0, 0, false},
+		{"two-four", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		w, err := ParseWindow(tt.window)
+		if (err == nil) != tt.ok || (tt.ok && (w.Start != tt.start || w.End != tt.end)) {
+			t.Errorf("ParseWindow(%q) = %v, %v, want %s-%s, ok %v", tt.window, w, err, tt.start, tt.end, tt.ok)
+		}
+	}
+}
+
+func TestWindowRemaining(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2026, 3, 14, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		window string
+		t      time.Time
+		want   time.Duration
+	}{
+		{"02:00-04:00", at(1, 59), 0},
+		{"02:00-04:00", at(2, 0), 2 * time.Hour},
+		{"02:00-04:00", at(3, 30), 30 * time.Minute},
+		{"02:00-04:00", at(4, 0), 0},
+		{"02:00-04:00", at(23, 0), 0},
+		// Windows that cross midnight
+		{"23:00-01:00", at(22, 59), 0},
+		{"23:00-01:00", at(23, 0), 2 * time.Hour},
+		{"23:00-01:00", at(23, 45), 75 * time.Minute},
+		{"23:00-01:00", at(0, 0), time.Hour},
+		{"23:00-01:00", at(0, 30), 30 * time.Minute},
+		{"23:00-01:00", at(1, 0), 0},
+		{"23:00-01:00", at(12, 0), 0},
+		{"22:00-00:00", at(23, 0), time.Hour},
+		{"22:00-00:00", at(0, 0), 0},
+	}
+	for _, tt := range tests {
+		w, err := ParseWindow(tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Remaining(tt.t); got != tt.want {
+			t.Errorf("%s.Remaining(%s) = %s, want %s", tt.window, tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestValidatePolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy config.AutoUpdatePolicy
+		ok     bool
+	}{
+		{"latest", config.AutoUpdatePolicy{Channel: config.AutoUpdateChannelLatest, Window: "02:00-04:00"}, true},
+		{"minor", config.AutoUpdatePolicy{Channel: config.AutoUpdateChannelMinor, Window: "23:00-01:00", JitterMinutes: 30}, true},
+		{"pinned", config.AutoUpdatePolicy{Channel: config.AutoUpdateChannelPinned, Version: "3.6.1", Window: "02:00-04:00"}, true},
+		{"pinned without version", config.AutoUpdatePolicy{Channel: config.AutoUpdateChannelPinned, Window: "02:00-04:00"}, false},
+		{"pinned to latest", config.AutoUpdatePolicy{Channel: config.AutoUpdateChannelPinned, Version: "latest", Window: "02:00-04:00"}, false},
+		{"unknown channel", config.AutoUpdatePolicy{Channel: "nightly", Window: "02:00-04:00"}, false},
+		{"no channel", config.AutoUpdatePolicy{Window: "02:00-04:00"}, false},
+		{"invalid window", config.AutoUpdatePolicy{Channel: config.AutoUpdateChannelLatest, Window: "02:00"}, false},
+		{"negative jitter", config.AutoUpdatePolicy{Channel: config.AutoUpdateChannelLatest, Window: "02:00-04:00", JitterMinutes: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := ValidatePolicy(&tt.policy); (err == nil) != tt.ok {
+			t.Errorf("ValidatePolicy(%s) = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	tests := []struct {
+		name      string
+		jitter    int
+		remaining time.Duration
+		max       time.Duration
+	}{
+		{"within the jitter", 10, 2 * time.Hour, 10 * time.Minute},
+		{"half of the window left", 60, 30 * time.Minute, 15 * time.Minute},
+		{"no jitter", 0, 2 * time.Hour, 0},
+		{"window closed", 10, 0, 0},
+	}
+	for _, tt := range tests {
+		policy := &config.AutoUpdatePolicy{JitterMinutes: tt.jitter}
+		for i := 0; i < 100; i++ {
+			if got := Jitter(policy, tt.remaining); got < 0 || (tt.max == 0 && got != 0) || (tt.max > 0 && got >= tt.max) {
+				t.Fatalf("%s: Jitter = %s, want in [0, %s)", tt.name, got, tt.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,468 @@
+// Package cache implements the installer's shared local artifact cache.
+//
+// Downloaded artifacts (Node.js archives, release metadata) are stored
+// content-addressed by their SHA-256 checksum, so reinstalling, running
+// several instances on one host, or rolling back to a previous version reuses
+// the local copy instead of fetching hundreds of MB again. The npm cache used
+// for Device Agent package installs lives under the same root, shared by all
+// instances that run as the same service user.
+//
+// Layout:
+//
+//	<dir>/index.json                 cache index (name, source, size, use times)
+//	<dir>/artifacts/<sha256>/<name>  cached artifacts
+//	<dir>/npm/<service-user>/        npm cache (cacache, itself content-addressed)
+//	<dir>/downloads/                 downloads in progress (private to the installer)
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/download"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+)
+
+// Dir is the cache root selected with --cache-dir. When empty, DefaultDir is used.
+var Dir string
+
+// PruneAge is how long an artifact may stay unused before --cache-prune removes it.
+const PruneAge = 30 * 24 * time.Hour
+
+// Entry describes one cached artifact.
+type Entry struct {
+	SHA256   string    `json:"sha256"`
+	Name     string    `json:"name"`
+	Source   string    `json:"source,omitempty"`
+	Size     int64     `json:"size"`
+	Added    time.Time `json:"added"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// index is the on-disk cache index, keyed by checksum.
+type index struct {
+	Entries map[string]*Entry `json:"entries"`
+}
+
+// DefaultDir returns the OS-specific default cache root.
+func DefaultDir() string {
+	if runtime.GOOS == "windows" {
+		programData := os.Getenv("ProgramData")
+		if programData == "" {
+			programData = `C:\ProgramData`
+		}
+		return filepath.Join(programData, "FlowFuse", "installer-cache")
+	}
+	return "/var/cache/flowfuse-installer"
+}
+
+// Root returns the cache root in use.
+func Root() string {
+	if Dir != "" {
+		return Dir
+	}
+	return DefaultDir()
+}
+
+// DownloadDir returns the directory below the cache root that artifacts are
+// downloaded into before they are verified and cached. Only the user running
+// the installer can access it, so a partial download found there on the next
+// run was left by the installer and can be resumed.
+//
+// Returns:
+//   - string: The path of the directory
+//   - error: An error if the directory cannot be created or secured
+func DownloadDir() (string, error) {
+	if err := ensureDir(Root()); err != nil {
+		return "", err
+	}
+	dir := filepath.Join(Root(), "downloads")
+	if err := ensurePrivateDir(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Lookup returns the path of the cached artifact with the given checksum.
+// The entry's last-use time is refreshed so it survives pruning.
+//
+// Parameters:
+//   - sum: The hex-encoded SHA-256 checksum of the artifact
+//
+// Returns:
+//   - string: The path to the cached file
+//   - bool: false if the artifact is not cached (or its file has gone missing)
+func Lookup(sum string) (string, bool) {
+	sum = strings.ToLower(sum)
+	idx := loadIndex()
+	entry, ok := idx.Entries[sum]
+	if !ok {
+		return "", false
+	}
+	path := artifactPath(entry)
+	if info, err := os.Stat(path); err != nil || info.Size() != entry.Size {
+		logger.Debug("Cache entry %s (%s) is missing or incomplete", sum, entry.Name)
+		return "", false
+	}
+	touch(idx, entry)
+	logger.Debug("Cache hit for %s (%s)", entry.Name, sum)
+	return path, true
+}
+
+// FindByName returns the most recently used cached artifact with the given
+// file name. It is used when the checksum cannot be looked up (offline mode).
+// The file is re-hashed and only returned if it still matches its checksum.
+//
+// Parameters:
+//   - name: The artifact file name (e.g. "node-v22.23.0-linux-x64.tar.gz")
+//
+// Returns:
+//   - string: The path to the cached file
+//   - bool: false if no intact artifact with that name is cached
+func FindByName(name string) (string, bool) {
+	idx := loadIndex()
+	var best *Entry
+	for _, entry := range idx.Entries {
+		if entry.Name == name && (best == nil || entry.LastUsed.After(best.LastUsed)) {
+			best = entry
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	path := artifactPath(best)
+	sum, err := download.FileSHA256(path)
+	if err != nil || !strings.EqualFold(sum, best.SHA256) {
+		logger.Debug("Cached %s failed verification: %v", name, err)
+		return "", false
+	}
+	touch(idx, best)
+	return path, true
+}
+
+// Store copies the file at srcPath into the cache under its checksum and
+// records it in the index. If sum is empty it is computed. Failing to write
+// the cache is never fatal for an install, so callers normally only log the
+// returned error.
+//
+// Parameters:
+//   - srcPath: The downloaded file to cache
+//   - sum: The expected SHA-256 checksum (empty = compute)
+//   - source: Where the artifact was downloaded from (informational)
+//
+// Returns:
+//   - string: The path of the cached copy
+//   - error: An error if the file could not be hashed or copied
+func Store(srcPath, sum, source string) (string, error) {
+	if sum == "" {
+		var err error
+		if sum, err = download.FileSHA256(srcPath); err != nil {
+			return "", err
+		}
+	}
+	sum = strings.ToLower(sum)
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat %s: %w", srcPath, err)
+	}
+
+	entry := &Entry{
+		SHA256:   sum,
+		Name:     filepath.Base(srcPath),
+		Source:   source,
+		Size:     info.Size(),
+		Added:    time.Now().UTC(),
+		LastUsed: time.Now().UTC(),
+	}
+	destPath := artifactPath(entry)
+	if err := ensureDir(filepath.Dir(destPath)); err != nil {
+		return "", err
+	}
+	if err := copyFile(srcPath, destPath); err != nil {
+		return "", err
+	}
+
+	idx := loadIndex()
+	if existing, ok := idx.Entries[sum]; ok {
+		entry.Added = existing.Added
+	}
+	idx.Entries[sum] = entry
+	if err := saveIndex(idx); err != nil {
+		return "", err
+	}
+	logger.Debug("Cached %s as %s", entry.Name, sum)
+	return destPath, nil
+}
+
+// List returns all cached artifacts, most recently used first.
+func List() []Entry {
+	idx := loadIndex()
+	entries := make([]Entry, 0, len(idx.Entries))
+	for _, entry := range idx.Entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+	return entries
+}
+
+// Prune removes artifacts that have not been used for longer than maxAge, as
+// well as files in the artifacts directory that the index does not know about
+// (e.g. left behind by an interrupted copy).
+//
+// Parameters:
+//   - maxAge: Entries unused for longer than this are removed
+//
+// Returns:
+//   - []Entry: The entries that were removed
+//   - int64: The number of bytes freed
+//   - error: An error if the cache could not be updated
+func Prune(maxAge time.Duration) ([]Entry, int64, error) {
+	idx := loadIndex()
+	cutoff := time.Now().Add(-maxAge)
+	var removed []Entry
+	var freed int64
+
+	for sum, entry := range idx.Entries {
+		_, statErr := os.Stat(artifactPath(entry))
+		if entry.LastUsed.After(cutoff) && statErr == nil {
+			continue
+		}
+		if err := removeAll(filepath.Join(Root(), "artifacts", sum)); err != nil {
+			return removed, freed, err
+		}
+		if statErr == nil {
+			freed += entry.Size
+		}
+		removed = append(removed, *entry)
+		delete(idx.Entries, sum)
+	}
+
+	// Remove directories not referenced by the index.
+	artifactsDir := filepath.Join(Root(), "artifacts")
+	if dirEntries, err := os.ReadDir(artifactsDir); err == nil {
+		for _, d := range dirEntries {
+			if _, ok := idx.Entries[d.Name()]; ok {
+				continue
+			}
+			orphan := filepath.Join(artifactsDir, d.Name())
+			freed += dirSize(orphan)
+			logger.Debug("Removing orphaned cache entry %s", orphan)
+			if err := removeAll(orphan); err != nil {
+				return removed, freed, err
+			}
+		}
+	}
+
+	if err := saveIndex(idx); err != nil {
+		return removed, freed, err
+	}
+	return removed, freed, nil
+}
+
+// NpmDir returns the npm cache directory shared by all instances running as
+// serviceUser, creating it (owned by that user) if needed. npm's cache is
+// itself content-addressed, so package tarballs fetched for one instance or
+// version are reused by the next install, update or rollback.
+//
+// Parameters:
+//   - serviceUser: The account npm runs as
+//
+// Returns:
+//   - string: The npm cache directory
+//   - error: An error if the directory could not be created
+func NpmDir(serviceUser string) (string, error) {
+	dir := filepath.Join(Root(), "npm", serviceUser)
+	if err := ensureDir(dir); err != nil {
+		return "", err
+	}
+	if runtime.GOOS != "windows" {
+		if output, err := exec.Command("sudo", "chown", "-R", serviceUser, dir).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("failed to set npm cache ownership: %w\nOutput: %s", err, output)
+		}
+	}
+	return dir, nil
+}
+
+// NpmUsage returns the disk usage of each per-user npm cache, keyed by user.
+func NpmUsage() map[string]int64 {
+	usage := map[string]int64{}
+	dirEntries, err := os.ReadDir(filepath.Join(Root(), "npm"))
+	if err != nil {
+		return usage
+	}
+	for _, d := range dirEntries {
+		if d.IsDir() {
+			usage[d.Name()] = dirSize(filepath.Join(Root(), "npm", d.Name()))
+		}
+	}
+	return usage
+}
+
+// artifactPath returns the location of entry's file inside the cache.
+func artifactPath(entry *Entry) string {
+	return filepath.Join(Root(), "artifacts", entry.SHA256, entry.Name)
+}
+
+// touch refreshes the last-use time of entry and saves the index. Failures
+// are logged only: a stale timestamp merely makes the entry prune earlier.
+func touch(idx *index, entry *Entry) {
+	entry.LastUsed = time.Now().UTC()
+	if err := saveIndex(idx); err != nil {
+		logger.Debug("Could not update cache index: %v", err)
+	}
+}
+
+// loadIndex reads the cache index, returning an empty index if it does not
+// exist or cannot be parsed.
+func loadIndex() *index {
+	idx := &index{Entries: map[string]*Entry{}}
+	data, err := os.ReadFile(filepath.Join(Root(), "index.json"))
+	if err != nil {
+		return idx
+	}
+	if err := json.Unmarshal(data, idx); err != nil {
+		logger.Debug("Ignoring unreadable cache index: %v", err)
+		return &index{Entries: map[string]*Entry{}}
+	}
+	if idx.Entries == nil {
+		idx.Entries = map[string]*Entry{}
+	}
+	return idx
+}
+
+// saveIndex writes the cache index atomically.
+func saveIndex(idx *index) error {
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache index: %w", err)
+	}
+	if err := ensureDir(Root()); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(Root(), "index.json"), data)
+}
+
+// ensureDir creates dir (world-readable) if it does not exist. The default
+// cache root is only writable by root on Unix, so sudo is used as a fallback.
+func ensureDir(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err == nil || runtime.GOOS == "windows" {
+		return err
+	}
+	if output, err := exec.Command("sudo", "mkdir", "-p", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create cache directory %s: %w\nOutput: %s", dir, err, output)
+	}
+	if output, err := exec.Command("sudo", "chmod", "755", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set cache directory permissions: %w\nOutput: %s", err, output)
+	}
+	return nil
+}
+
+// writeFile writes data to path via a temporary file and rename, falling
+// back to sudo when the cache root is not writable by the current user.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err == nil {
+		return os.Rename(tmp, path)
+	} else if runtime.GOOS == "windows" {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	tempFile, err := os.CreateTemp("", "flowfuse-cache-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	tempFile.Close()
+	if output, err := exec.Command("sudo", "cp", tempFile.Name(), tmp).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to write %s: %w\nOutput: %s", path, err, output)
+	}
+	if output, err := exec.Command("sudo", "chmod", "644", tmp).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %w\nOutput: %s", path, err, output)
+	}
+	if output, err := exec.Command("sudo", "mv", "-f", tmp, path).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to write %s: %w\nOutput: %s", path, err, output)
+	}
+	return nil
+}
+
+// copyFile copies src to dest, using sudo on Unix when dest is not writable.
+func copyFile(src, dest string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", src, err)
+	}
+	if err := os.WriteFile(dest, data, 0644); err == nil {
+		return nil
+	} else if runtime.GOOS == "windows" {
+		return fmt.Errorf("failed to copy %s to cache: %w", src, err)
+	}
+	if output, err := exec.Command("sudo", "cp", src, dest).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to copy %s to cache: %w\nOutput: %s", src, err, output)
+	}
+	if output, err := exec.Command("sudo", "chmod", "644", dest).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %w\nOutput: %s", dest, err, output)
+	}
+	return nil
+}
+
+// removeAll removes path, using sudo on Unix when needed.
+func removeAll(path string) error {
+	if err := os.RemoveAll(path); err == nil || runtime.GOOS == "windows" {
+		return err
+	}
+	if output, err := exec.Command("sudo", "rm", "-rf", path).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to remove %s: %w\nOutput: %s", path, err, output)
+	}
+	return nil
+}
+
+// dirSize returns the total size of regular files below path.
+func dirSize(path string) int64 {
+	var size int64
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// Purge removes the whole cache directory, including the npm caches.
+//
+// Returns:
+//   - int64: The number of bytes freed
+//   - error: An error if the directory could not be removed
+func Purge() (int64, error) {
+	root := Root()
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return 0, nil
+	}
+	size := dirSize(root)
+	if err := removeAll(root); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package cache
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// ensurePrivateDir makes dir a directory that only the current user can
+// access. An existing one that is not owned by the user, or is accessible to
+// others, is removed first, so that no file in it was created by someone else.
+func ensurePrivateDir(dir string) error {
+	if info, err := os.Lstat(dir); err == nil {
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if info.IsDir() && info.Mode().Perm() == 0700 && ok && int(stat.Uid) == os.Getuid() {
+			return nil
+		}
+		if err := removeAll(dir); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Mkdir(dir, 0700); err == nil {
+		return nil
+	}
+	// The default cache root is only writable by root
+	owner := strconv.Itoa(os.Getuid()) + ":" + strconv.Itoa(os.Getgid())
+	for _, args := range [][]string{{"mkdir", dir}, {"chmod", "700", dir}, {"chown", owner, dir}} {
+		if output, err := exec.Command("sudo", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to create download directory %s: %w\nOutput: %s", dir, err, output)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// privateSIDs are the well-known SIDs of SYSTEM and the Administrators
+var privateSIDs = []string{"S-1-5-18", "S-1-5-32-544"}
+
+// ensurePrivateDir makes dir a directory that only SYSTEM and the
+// Administrators can access. An existing one is kept, with the partial
+// downloads in it, if its owner and access rules are limited to them;
+// otherwise it is removed first, so that no file in it was created by
+// someone else.
+func ensurePrivateDir(dir string) error {
+	if info, err := os.Lstat(dir); err == nil {
+		if info.IsDir() && isPrivateDir(dir) {
+			return nil
+		}
+		if err := removeAll(dir); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create download directory %s: %w", dir, err)
+	}
+	grants := []string{dir, "/inheritance:r"}
+	for _, sid := range privateSIDs {
+		grants = append(grants, "/grant:r", "*"+sid+":(OI)(CI)F")
+	}
+	if output, err := exec.Command("icacls", grants...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to restrict permissions of %s: %w\nOutput: %s", dir, err, output)
+	}
+	return nil
+}
+
+// isPrivateDir reports whether dir does not inherit access rules and only
+// SYSTEM and the Administrators own it and have access to it.
+func isPrivateDir(dir string) bool {
+	allowed := "'" + strings.Join(privateSIDs, "','") + "'"
+	script := fmt.Sprintf(`$sid = [System.Security.Principal.SecurityIdentifier]
+$acl = Get-Acl -LiteralPath '%s'
+if (-not $acl.AreAccessRulesProtected) { exit 1 }
+if ($acl.GetOwner($sid).Value -notin %s) { exit 1 }
+foreach ($rule in $acl.GetAccessRules($true, $true, $sid)) {
+    if ($rule.IdentityReference.Value -notin %s) { exit 1 }
+}`, strings.ReplaceAll(dir, "'", "''"), allowed, allowed)
+	return exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script).Run() == nil
+}
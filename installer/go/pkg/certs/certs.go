@@ -0,0 +1,290 @@
+// Package certs builds and inspects the CA certificate bundle the Device Agent
+// trusts through NODE_EXTRA_CA_CERTS.
+//
+// A bundle is assembled from one or more PEM files (--ca-cert) and, optionally,
+// the operating system trust store (--ca-system-store). Every input is parsed
+// and validated, duplicate certificates are dropped, and the result is written
+// as plain PEM.
+package certs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+)
+
+// NearExpiry is how long before its expiry a certificate is reported.
+const NearExpiry = 30 * 24 * time.Hour
+
+// maxListedCertificates is the largest bundle whose certificates are all
+// listed; larger bundles, e.g. a previously imported trust store, are only
+// counted unless debug logging is enabled.
+const maxListedCertificates = 10
+
+// SystemStore adds the operating system trust store to the bundle
+// (--ca-system-store).
+var SystemStore bool
+
+// systemBundles are the CA bundle files of common Linux distributions, in
+// order of preference.
+var systemBundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian, Ubuntu, Alpine, Arch
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // Fedora, RHEL
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // older RHEL and CentOS
+	"/etc/ssl/ca-bundle.pem",                            // openSUSE
+	"/etc/ssl/cert.pem",                                 // LibreSSL based systems
+}
+
+// systemCertDir holds individual certificates when there is no bundle file.
+const systemCertDir = "/etc/ssl/certs"
+
+// darwinKeychains are exported for the macOS trust store.
+var darwinKeychains = []string{
+	"/System/Library/Keychains/SystemRootCertificates.keychain",
+	"/Library/Keychains/System.keychain",
+}
+
+// Parse reads the certificates of a PEM bundle.
+//
+// Parameters:
+//   - data: The PEM data
+//
+// Returns:
+//   - []*x509.Certificate: The certificates in the order they appear
+//   - error: An error if the data is empty, holds no PEM certificates, holds a
+//     private key or another PEM block, or a certificate cannot be parsed
+func Parse(data []byte) ([]*x509.Certificate, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, fmt.Errorf("the bundle is empty")
+	}
+
+	var certificates []*x509.Certificate
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("certificate %d is invalid: %w", len(certificates)+1, err)
+			}
+			certificates = append(certificates, cert)
+		case strings.Contains(block.Type, "PRIVATE KEY"):
+			return nil, fmt.Errorf("the bundle contains a private key, only CA certificates may be given")
+		default:
+			return nil, fmt.Errorf("unsupported PEM block %q, only CERTIFICATE blocks may be given", block.Type)
+		}
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no PEM certificates found, the bundle must be PEM encoded (-----BEGIN CERTIFICATE-----)")
+	}
+	return certificates, nil
+}
+
+// ReadFile reads and parses a PEM bundle file.
+//
+// Parameters:
+//   - path: The bundle file
+//
+// Returns:
+//   - []*x509.Certificate: The certificates of the bundle
+//   - error: An error if the file is not a readable, valid PEM bundle
+func ReadFile(path string) ([]*x509.Certificate, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("CA certificate %q is not accessible: %w", path, err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("CA certificate %q is not a regular file", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate %q: %w", path, err)
+	}
+	certificates, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("CA certificate %q is invalid: %w", path, err)
+	}
+	return certificates, nil
+}
+
+// Build assembles a bundle from PEM files and, if includeSystem is set, the
+// operating system trust store. The certificates of each file are logged with
+// their expiry date, and certificates that have expired or expire soon are
+// reported as warnings.
+//
+// Parameters:
+//   - paths: The PEM bundle files
+//   - includeSystem: Whether to add the operating system trust store
+//
+// Returns:
+//   - []byte: The bundle in PEM format
+//   - error: An error if a file is invalid, the trust store cannot be read, or
+//     the bundle would be empty
+func Build(paths []string, includeSystem bool) ([]byte, error) {
+	var bundle bytes.Buffer
+	seen := map[string]bool{}
+	add := func(cert *x509.Certificate) bool {
+		fingerprint := Fingerprint(cert)
+		if seen[fingerprint] {
+			return false
+		}
+		seen[fingerprint] = true
+		pem.Encode(&bundle, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		return true
+	}
+
+	now := time.Now()
+	for _, path := range paths {
+		certificates, err := ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("CA bundle %s: %d certificate(s)", path, len(certificates))
+		for _, cert := range certificates {
+			if len(certificates) <= maxListedCertificates {
+				logger.Info("  %s", Describe(cert))
+			} else {
+				logger.Debug("  %s", Describe(cert))
+			}
+			if !add(cert) {
+				logger.Debug("Skipping duplicate certificate %s", cert.Subject)
+			}
+		}
+		for _, warning := range ExpiryWarnings(certificates, now) {
+			logger.Info("Warning: %s", warning)
+		}
+	}
+
+	if includeSystem {
+		certificates, err := SystemCertificates()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the system trust store: %w", err)
+		}
+		added := 0
+		for _, cert := range certificates {
+			if add(cert) {
+				added++
+			}
+		}
+		logger.Info("Imported %d certificate(s) from the system trust store", added)
+	}
+
+	if len(seen) == 0 {
+		return nil, fmt.Errorf("the CA bundle would be empty")
+	}
+	return bundle.Bytes(), nil
+}
+
+// SystemCertificates returns the certificates of the operating system trust
+// store: the distribution CA bundle (or /etc/ssl/certs) on Linux, the system
+// keychains on macOS and the local machine root store on Windows.
+//
+// Returns:
+//   - []*x509.Certificate: The trusted certificates
+//   - error: An error if no trust store was found or it could not be read
+func SystemCertificates() ([]*x509.Certificate, error) {
+	switch runtime.GOOS {
+	case "linux":
+		for _, path := range systemBundles {
+			if certificates, err := ReadFile(path); err == nil {
+				logger.Debug("Using system CA bundle %s", path)
+				return certificates, nil
+			}
+		}
+		matches, _ := filepath.Glob(filepath.Join(systemCertDir, "*.pem"))
+		var certificates []*x509.Certificate
+		for _, path := range matches {
+			if parsed, err := ReadFile(path); err == nil {
+				certificates = append(certificates, parsed...)
+			}
+		}
+		if len(certificates) == 0 {
+			return nil, fmt.Errorf("no CA certificates found in %s", systemCertDir)
+		}
+		return certificates, nil
+
+	case "darwin":
+		var certificates []*x509.Certificate
+		for _, keychain := range darwinKeychains {
+			exportCmd := exec.Command("security", "find-certificate", "-a", "-p", keychain)
+			output, err := exportCmd.Output()
+			if err != nil {
+				logger.Debug("Failed to export keychain %s: %v", keychain, err)
+				continue
+			}
+			if parsed, err := Parse(output); err == nil {
+				certificates = append(certificates, parsed...)
+			}
+		}
+		if len(certificates) == 0 {
+			return nil, fmt.Errorf("no CA certificates could be exported from the system keychains")
+		}
+		return certificates, nil
+
+	case "windows":
+		return windowsRootCertificates()
+
+	default:
+		return nil, fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+	}
+}
+
+// ExpiryWarnings describes the certificates that have expired or expire
+// within NearExpiry.
+//
+// Parameters:
+//   - certificates: The certificates to check
+//   - now: The reference time
+//
+// Returns:
+//   - []string: One message per expired or expiring certificate
+func ExpiryWarnings(certificates []*x509.Certificate, now time.Time) []string {
+	var warnings []string
+	for _, cert := range certificates {
+		switch {
+		case now.After(cert.NotAfter):
+			warnings = append(warnings, fmt.Sprintf("CA certificate %s expired on %s", cert.Subject, cert.NotAfter.Format("2006-01-02")))
+		case cert.NotAfter.Sub(now) < NearExpiry:
+			warnings = append(warnings, fmt.Sprintf("CA certificate %s expires on %s, rotate it with --rotate-ca", cert.Subject, cert.NotAfter.Format("2006-01-02")))
+		}
+	}
+	return warnings
+}
+
+// Describe returns the subject and expiry date of a certificate.
+//
+// Parameters:
+//   - cert: The certificate
+//
+// Returns:
+//   - string: e.g. "CN=Example Root CA,O=Example (expires 2030-01-01)"
+func Describe(cert *x509.Certificate) string {
+	return fmt.Sprintf("%s (expires %s)", cert.Subject, cert.NotAfter.Format("2006-01-02"))
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate.
+//
+// Parameters:
+//   - cert: The certificate
+//
+// Returns:
+//   - string: The hex encoded fingerprint
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
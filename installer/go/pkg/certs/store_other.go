@@ -0,0 +1,20 @@
+//go:build !windows
+
+package certs
+
+import (
+	"crypto/x509"
+	"fmt"
+)
+
+// windowsRootCertificates returns the certificates of the local machine root
+// store.
+//
+// Returns:
+//   - []*x509.Certificate: the trusted root certificates
+//   - error: non-nil if the store could not be read
+//
+// Note: The root store is only available on Windows; this implementation always fails.
+func windowsRootCertificates() ([]*x509.Certificate, error) {
+	return nil, fmt.Errorf("the Windows root store is only available on Windows")
+}
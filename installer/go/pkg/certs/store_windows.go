@@ -0,0 +1,48 @@
+//go:build windows
+
+package certs
+
+import (
+	"crypto/x509"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// windowsRootCertificates returns the certificates of the local machine root
+// store.
+//
+// Returns:
+//   - []*x509.Certificate: the trusted root certificates
+//   - error: non-nil if the store could not be read
+func windowsRootCertificates() ([]*x509.Certificate, error) {
+	storeName, err := windows.UTF16PtrFromString("ROOT")
+	if err != nil {
+		return nil, err
+	}
+	store, err := windows.CertOpenStore(windows.CERT_STORE_PROV_SYSTEM, 0, 0,
+		windows.CERT_SYSTEM_STORE_LOCAL_MACHINE|windows.CERT_STORE_READONLY_FLAG, uintptr(unsafe.Pointer(storeName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the root store: %w", err)
+	}
+	defer windows.CertCloseStore(store, 0)
+
+	var certificates []*x509.Certificate
+	var ctx *windows.CertContext
+	for {
+		ctx, err = windows.CertEnumCertificatesInStore(store, ctx)
+		if err != nil || ctx == nil {
+			break
+		}
+		encoded := make([]byte, ctx.Length)
+		copy(encoded, unsafe.Slice(ctx.EncodedCert, ctx.Length))
+		if cert, err := x509.ParseCertificate(encoded); err == nil {
+			certificates = append(certificates, cert)
+		}
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no certificates found in the root store")
+	}
+	return certificates, nil
+}
@@ -7,14 +7,46 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/flowfuse/device-agent-installer/pkg/logger"
 	"github.com/flowfuse/device-agent-installer/pkg/utils"
 )
 
+// Targets for extra npm packages installed alongside the Device Agent.
+const (
+	// PackageTargetGlobal installs into the bundled Node.js prefix (CLIs).
+	PackageTargetGlobal = "global"
+	// PackageTargetNodeRED installs into the Node-RED user directory (nodes).
+	PackageTargetNodeRED = "node-red"
+)
+
+// NpmPackage is an extra npm package pinned at install time.
+type NpmPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Target  string `json:"target"`
+}
+
+// Spec returns the package in npm's name@version form.
+func (p NpmPackage) Spec() string {
+	return p.Name + "@" + p.Version
+}
+
 // InstallerConfig holds the configuration for the installer
 type InstallerConfig struct {
 	ServiceUsername string `json:"serviceUsername"`
+	// ServiceUID, ServiceGID and ServiceHome are the account settings the
+	// service user was created with (--service-uid, --service-gid, --service-home).
+	ServiceUID  int    `json:"serviceUid,omitempty"`
+	ServiceGID  int    `json:"serviceGid,omitempty"`
+	ServiceHome string `json:"serviceHome,omitempty"`
+	// ServiceGroups are the supplementary groups of the service user
+	// (--service-groups), reconciled when the installer runs again.
+	ServiceGroups []string `json:"serviceGroups,omitempty"`
+	// ExistingAccount is set when the service runs as an account that the
+	// installer did not create (--use-existing-account); it is never removed.
+	ExistingAccount bool `json:"existingAccount,omitempty"`
 	ServiceName     string `json:"serviceName"`
 	AgentVersion    string `json:"agentVersion"`
 	NodeVersion     string `json:"nodeVersion"`
@@ -22,6 +54,85 @@ type InstallerConfig struct {
 	// NodeExtraCACerts is the in-workdir path to the installed custom CA bundle,
 	// re-applied on reinstall so CA trust survives without re-passing --ca-cert.
 	NodeExtraCACerts string `json:"nodeExtraCACerts,omitempty"`
+	// CacheDir is the artifact cache selected with --cache-dir at install time,
+	// reused by updates so rollbacks find the previously downloaded archives.
+	CacheDir string `json:"cacheDir,omitempty"`
+	// NpmRegistry is the npm registry selected with --npm-registry, reused by
+	// updates so they install from the same registry.
+	NpmRegistry string `json:"npmRegistry,omitempty"`
+	// ExtraPackages are the pinned npm packages and Node-RED nodes installed
+	// next to the agent; updates reinstall them.
+	ExtraPackages []NpmPackage `json:"extraPackages,omitempty"`
+	// CredentialEncryption is the key source the device credentials are
+	// encrypted with (--encrypt-credentials), empty for plaintext device.yml.
+	CredentialEncryption string `json:"credentialEncryption,omitempty"`
+	// AgentArgs are extra Device Agent arguments (--agent-arg) and Environment
+	// extra environment variables as KEY=VALUE (--env), written into the
+	// service definition and kept on reinstall.
+	AgentArgs   []string `json:"agentArgs,omitempty"`
+	Environment []string `json:"environment,omitempty"`
+	// AutoUpdate is the scheduled Device Agent update policy
+	// (--enable-auto-update), nil when automatic updates are disabled.
+	AutoUpdate *AutoUpdatePolicy `json:"autoUpdate,omitempty"`
+	// LastAutoUpdate is the outcome of the most recent scheduled update run.
+	LastAutoUpdate *AutoUpdateResult `json:"lastAutoUpdate,omitempty"`
+	// StagedUpdate is the runtime prepared with --stage-update, nil when no
+	// update is waiting for --apply-staged.
+	StagedUpdate *StagedUpdate `json:"stagedUpdate,omitempty"`
+	// KeptByUninstall is set when "--uninstall --keep-config" kept the
+	// configuration; the next install reuses it without asking.
+	KeptByUninstall bool `json:"keptByUninstall,omitempty"`
+}
+
+// StagedUpdate records a runtime that was installed next to the one in use
+// and is switched to with --apply-staged.
+type StagedUpdate struct {
+	Time         time.Time `json:"time"`
+	NodeVersion  string    `json:"nodeVersion"`
+	AgentVersion string    `json:"agentVersion"`
+	// ExtraPackages are the packages installed with the staged runtime
+	ExtraPackages []NpmPackage `json:"extraPackages,omitempty"`
+}
+
+// Channels of the automatic update policy.
+const (
+	// AutoUpdateChannelPinned installs exactly AutoUpdatePolicy.Version
+	AutoUpdateChannelPinned = "pinned"
+	// AutoUpdateChannelMinor follows new minor and patch releases of the installed major version
+	AutoUpdateChannelMinor = "minor"
+	// AutoUpdateChannelLatest follows the latest release
+	AutoUpdateChannelLatest = "latest"
+)
+
+// AutoUpdatePolicy controls when and to which version the scheduled job
+// updates the Device Agent.
+type AutoUpdatePolicy struct {
+	Channel string `json:"channel"`
+	// Version is the version installed by the pinned channel
+	Version string `json:"version,omitempty"`
+	// Window is the daily maintenance window in local time, "HH:MM-HH:MM"
+	Window string `json:"window"`
+	// JitterMinutes is the upper bound of the random delay before an update
+	// starts, so that a fleet does not update all at once
+	JitterMinutes int `json:"jitterMinutes"`
+}
+
+// Outcomes of a scheduled update run.
+const (
+	AutoUpdateUpdated    = "updated"
+	AutoUpdateUpToDate   = "up-to-date"
+	AutoUpdateSkipped    = "skipped"
+	AutoUpdateRolledBack = "rolled-back"
+	AutoUpdateFailed     = "failed"
+)
+
+// AutoUpdateResult records a scheduled update run.
+type AutoUpdateResult struct {
+	Time        time.Time `json:"time"`
+	Result      string    `json:"result"`
+	FromVersion string    `json:"fromVersion,omitempty"`
+	ToVersion   string    `json:"toVersion,omitempty"`
+	Message     string    `json:"message,omitempty"`
 }
 
 // GetConfigPath returns the path to the installer configuration file.
@@ -188,6 +299,10 @@ func UpdateConfigField(fieldName, value, customWorkDir string) error {
 		cfg.Port = port
 	case "nodeExtraCACerts":
 		cfg.NodeExtraCACerts = value
+	case "cacheDir":
+		cfg.CacheDir = value
+	case "credentialEncryption":
+		cfg.CredentialEncryption = value
 	default:
 		logger.LogFunctionExit("UpdateConfigField", "error", fmt.Errorf("unknown field name: %s", fieldName))
 		return fmt.Errorf("unknown field name: %s", fieldName)
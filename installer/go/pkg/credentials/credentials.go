@@ -0,0 +1,518 @@
+package credentials
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// Key sources for encrypting the device credentials (--encrypt-credentials).
+const (
+	// ModeSystemdCreds encrypts with systemd-creds, using the TPM2 when available
+	ModeSystemdCreds = "systemd-creds"
+	// ModeKeyFile encrypts with AES-256-GCM and a key file readable only by the service user
+	ModeKeyFile = "keyfile"
+	// ModeDPAPI encrypts with the Windows Data Protection API (machine scope)
+	ModeDPAPI = "dpapi"
+)
+
+// Encryption is the key source used to encrypt the device credentials, empty
+// when device.yml is stored in plaintext (--encrypt-credentials).
+var Encryption string
+
+// secretFields are the device.yml fields removed from the plaintext file when
+// the credentials are encrypted.
+var secretFields = []string{"token", "credentialSecret", "brokerPassword"}
+
+// keyFileDir holds the key files, outside the working directory so backups of
+// the working directory do not contain the key next to the encrypted data.
+const keyFileDir = "/etc/flowfuse-device-agent"
+
+// decryptScriptName is the helper run by the service before the agent starts
+// to decrypt the credentials in keyfile mode.
+const decryptScriptName = "decrypt-credentials.js"
+
+// decryptScript decrypts a keyfile-encrypted device.yml into a private file.
+// Usage: node decrypt-credentials.js <key file> <encrypted file> <output file>
+const decryptScript = `'use strict'
+const crypto = require('crypto')
+const fs = require('fs')
+const path = require('path')
+
+const [keyFile, encryptedFile, outputFile] = process.argv.slice(2)
+const key = Buffer.from(fs.readFileSync(keyFile, 'utf8').trim(), 'hex')
+const encrypted = JSON.parse(fs.readFileSync(encryptedFile, 'utf8'))
+const decipher = crypto.createDecipheriv('aes-256-gcm', key, Buffer.from(encrypted.iv, 'base64'))
+decipher.setAuthTag(Buffer.from(encrypted.tag, 'base64'))
+const plain = Buffer.concat([decipher.update(Buffer.from(encrypted.data, 'base64')), decipher.final()])
+fs.mkdirSync(path.dirname(outputFile), { recursive: true, mode: 0o700 })
+fs.writeFileSync(outputFile, plain, { mode: 0o600 })
+`
+
+// encryptedFile is the on-disk format of a keyfile-encrypted device.yml.
+type encryptedFile struct {
+	Algorithm string `json:"alg"`
+	IV        string `json:"iv"`
+	Tag       string `json:"tag"`
+	Data      string `json:"data"`
+}
+
+// Validate checks that a key source is known and usable on this system.
+//
+// Parameters:
+//   - mode: The key source, empty for no encryption
+//   - systemd: Whether the service will be managed by systemd
+//
+// Returns:
+//   - error: An error if the key source is unknown or not supported here
+func Validate(mode string, systemd bool) error {
+	if err := ValidateFor(mode, runtime.GOOS, systemd); err != nil {
+		return err
+	}
+	if mode == ModeSystemdCreds {
+		if _, err := exec.LookPath("systemd-creds"); err != nil {
+			return fmt.Errorf("--encrypt-credentials=%s requires systemd-creds (systemd 250 or later)", mode)
+		}
+	}
+	return nil
+}
+
+// ValidateFor checks that a key source is known and supported on an
+// operating system, without checking the tools it needs on this system.
+//
+// Parameters:
+//   - mode: The key source, empty for no encryption
+//   - goos: The operating system (linux, darwin or windows)
+//   - systemd: Whether the service will be managed by systemd
+//
+// Returns:
+//   - error: An error if the key source is unknown or not supported there
+func ValidateFor(mode, goos string, systemd bool) error {
+	switch mode {
+	case "":
+		return nil
+	case ModeSystemdCreds, ModeKeyFile:
+		if goos != "linux" || !systemd {
+			return fmt.Errorf("--encrypt-credentials=%s requires Linux with systemd", mode)
+		}
+		return nil
+	case ModeDPAPI:
+		if goos != "windows" {
+			return fmt.Errorf("--encrypt-credentials=%s is only supported on Windows", mode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown credential key source %q, use %s, %s or %s", mode, ModeSystemdCreds, ModeKeyFile, ModeDPAPI)
+	}
+}
+
+// EncryptedConfigPath returns the path of the encrypted device configuration
+// for a key source.
+//
+// Parameters:
+//   - workDir: The working directory of the installation
+//   - mode: The key source
+//
+// Returns:
+//   - string: The path of the encrypted file, empty if mode is empty
+func EncryptedConfigPath(workDir, mode string) string {
+	switch mode {
+	case ModeSystemdCreds:
+		return filepath.Join(workDir, "device.yml.cred")
+	case ModeKeyFile:
+		return filepath.Join(workDir, "device.yml.enc")
+	case ModeDPAPI:
+		return filepath.Join(workDir, "device.yml.dpapi")
+	}
+	return ""
+}
+
+// KeyFilePath returns the path of the key file used in keyfile mode.
+//
+// Parameters:
+//   - serviceName: The name of the service the key belongs to
+//
+// Returns:
+//   - string: The key file path
+func KeyFilePath(serviceName string) string {
+	return filepath.Join(keyFileDir, serviceName+".key")
+}
+
+// Protect secures the device configuration after the Device Agent has been
+// configured. device.yml is always restricted to the service user; when
+// Encryption is set, its secrets are encrypted with the selected key source and
+// removed from the plaintext file. When device.yml does not exist yet (manual
+// configuration) or holds no secrets (provisioning), nothing is encrypted.
+//
+// Parameters:
+//   - workDir: The working directory of the installation
+//   - serviceName: The name of the service that runs the agent
+//
+// Returns:
+//   - error: An error if the permissions could not be applied or encryption failed
+func Protect(workDir, serviceName string) error {
+	logger.LogFunctionEntry("Protect", map[string]interface{}{
+		"workDir":     workDir,
+		"serviceName": serviceName,
+		"encryption":  Encryption,
+	})
+
+	configPath := filepath.Join(workDir, "device.yml")
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		logger.LogFunctionExit("Protect", "no device.yml", nil)
+		return nil
+	}
+
+	if err := utils.SecureDeviceConfiguration(configPath); err != nil {
+		logger.LogFunctionExit("Protect", nil, err)
+		return err
+	}
+	if Encryption == "" {
+		logger.LogFunctionExit("Protect", "permissions only", nil)
+		return nil
+	}
+
+	content, err := utils.ReadPrivilegedFile(configPath)
+	if err != nil {
+		logger.LogFunctionExit("Protect", nil, err)
+		return fmt.Errorf("failed to read %s: %w", configPath, err)
+	}
+	stripped, found, err := stripSecrets(content)
+	if err != nil {
+		logger.LogFunctionExit("Protect", nil, err)
+		return fmt.Errorf("failed to parse %s: %w", configPath, err)
+	}
+	encryptedPath := EncryptedConfigPath(workDir, Encryption)
+	if !found {
+		if _, err := os.Stat(encryptedPath); err == nil {
+			logger.Debug("Credentials are already encrypted in %s", encryptedPath)
+		} else {
+			logger.Info("Warning: device.yml holds no device credentials yet, they are not encrypted")
+		}
+		logger.LogFunctionExit("Protect", "nothing to encrypt", nil)
+		return nil
+	}
+
+	logger.Info("Encrypting device credentials with %s...", Encryption)
+	var encrypted []byte
+	switch Encryption {
+	case ModeSystemdCreds:
+		encrypted, err = encryptSystemdCreds(content)
+	case ModeKeyFile:
+		encrypted, err = encryptKeyFile(content, serviceName)
+		if err == nil {
+			err = writeFile(filepath.Join(workDir, decryptScriptName), []byte(decryptScript), "644")
+		}
+	case ModeDPAPI:
+		encrypted, err = dpapiProtect(content)
+	default:
+		err = fmt.Errorf("unknown credential key source %q", Encryption)
+	}
+	if err != nil {
+		logger.LogFunctionExit("Protect", nil, err)
+		return fmt.Errorf("failed to encrypt device credentials: %w", err)
+	}
+
+	if err := writeFile(encryptedPath, encrypted, "600"); err != nil {
+		logger.LogFunctionExit("Protect", nil, err)
+		return err
+	}
+	if err := writeFile(configPath, stripped, "600"); err != nil {
+		logger.LogFunctionExit("Protect", nil, err)
+		return err
+	}
+
+	logger.Info("Device credentials encrypted to %s", encryptedPath)
+	logger.LogFunctionExit("Protect", "success", nil)
+	return nil
+}
+
+// SystemdSettings returns the systemd unit settings that decrypt the device
+// configuration when the service starts.
+//
+// Parameters:
+//   - workDir: The working directory of the installation
+//   - serviceName: The name of the service
+//   - nodeBinDir: The bundled Node.js binary directory
+//
+// Returns:
+//   - credentialFile: The file for LoadCredentialEncrypted=, if any
+//   - decryptCommand: The command for ExecStartPre=, if any
+//   - configPath: The decrypted configuration passed to the agent with --config, if any
+func SystemdSettings(workDir, serviceName, nodeBinDir string) (credentialFile, decryptCommand, configPath string) {
+	switch Encryption {
+	case ModeSystemdCreds:
+		return EncryptedConfigPath(workDir, ModeSystemdCreds), "", "${CREDENTIALS_DIRECTORY}/device.yml"
+	case ModeKeyFile:
+		configPath = filepath.Join("/run", serviceName, "device.yml")
+		decryptCommand = fmt.Sprintf("%s %s %s %s %s",
+			filepath.Join(nodeBinDir, "node"),
+			filepath.Join(workDir, decryptScriptName),
+			KeyFilePath(serviceName),
+			EncryptedConfigPath(workDir, ModeKeyFile),
+			configPath)
+		return "", decryptCommand, configPath
+	}
+	return "", "", ""
+}
+
+// WindowsLauncher writes the PowerShell script that decrypts the device
+// configuration with DPAPI and then runs the agent, for use as the service
+// application in dpapi mode. The decrypted file is written to the profile of
+// the service account and removed when the agent exits.
+//
+// Parameters:
+//   - workDir: The working directory of the installation
+//   - agentPath: The path of flowfuse-device-agent.cmd
+//   - port: The port the agent listens on
+//   - args: Extra arguments passed to the agent
+//
+// Returns:
+//   - string: The path of the launcher script
+//   - error: An error if the script could not be written
+func WindowsLauncher(workDir, agentPath string, port int, args []string) (string, error) {
+	quote := func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" }
+	extraArgs := ""
+	for _, arg := range args {
+		extraArgs += " " + quote(arg)
+	}
+	script := strings.Join([]string{
+		`$ErrorActionPreference = 'Stop'`,
+		`Add-Type -AssemblyName System.Security`,
+		fmt.Sprintf(`$encrypted = [IO.File]::ReadAllBytes(%s)`, quote(EncryptedConfigPath(workDir, ModeDPAPI))),
+		`$plain = [Security.Cryptography.ProtectedData]::Unprotect($encrypted, $null, 'LocalMachine')`,
+		`$dir = if ($env:LOCALAPPDATA) { Join-Path $env:LOCALAPPDATA 'FlowFuse' } else { Join-Path $env:TEMP 'FlowFuse' }`,
+		`New-Item -ItemType Directory -Force -Path $dir | Out-Null`,
+		fmt.Sprintf(`$config = Join-Path $dir 'device-%d.yml'`, port),
+		`[IO.File]::WriteAllBytes($config, $plain)`,
+		fmt.Sprintf(`try { & %s --dir %s --port %d --config $config%s; exit $LASTEXITCODE }`, quote(agentPath), quote(workDir), port, extraArgs),
+		`finally { Remove-Item -Force -ErrorAction SilentlyContinue $config }`,
+		``,
+	}, "\r\n")
+
+	scriptPath := filepath.Join(workDir, "start-device-agent.ps1")
+	if err := os.WriteFile(scriptPath, []byte(script), 0644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", scriptPath, err)
+	}
+	return scriptPath, nil
+}
+
+// RemoveKeyFile deletes the key file of a service, if there is one.
+//
+// Parameters:
+//   - serviceName: The name of the service the key belongs to
+//
+// Returns:
+//   - bool: true if a key file was removed
+func RemoveKeyFile(serviceName string) bool {
+	if runtime.GOOS == "windows" {
+		return false
+	}
+	keyPath := KeyFilePath(serviceName)
+	if exec.Command("sudo", "test", "-e", keyPath).Run() != nil {
+		return false
+	}
+	if output, err := exec.Command("sudo", "rm", "-f", keyPath).CombinedOutput(); err != nil {
+		logger.Error("Failed to remove key file %s: %v\nOutput: %s", keyPath, err, output)
+		return false
+	}
+	return true
+}
+
+// CheckPermissions reports files holding device credentials that are
+// readable by users other than their owner.
+//
+// Parameters:
+//   - workDir: The working directory of the installation
+//   - serviceName: The name of the service
+//
+// Returns:
+//   - []string: A description of each problem found
+func CheckPermissions(workDir, serviceName string) []string {
+	var problems []string
+	paths := []string{filepath.Join(workDir, "device.yml")}
+	for _, mode := range []string{ModeSystemdCreds, ModeKeyFile, ModeDPAPI} {
+		paths = append(paths, EncryptedConfigPath(workDir, mode))
+	}
+	paths = append(paths, KeyFilePath(serviceName))
+
+	for _, path := range paths {
+		problem, err := utils.CheckDeviceConfigurationPermissions(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Debug("Cannot check permissions of %s: %v", path, err)
+			}
+			continue
+		}
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+// stripSecrets removes the secret fields from a device.yml document, keeping
+// the remaining fields and their order.
+func stripSecrets(content []byte) ([]byte, bool, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, false, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return content, false, nil
+	}
+
+	mapping := doc.Content[0]
+	found := false
+	var kept []*yaml.Node
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if isSecretField(mapping.Content[i].Value) {
+			found = true
+			continue
+		}
+		kept = append(kept, mapping.Content[i], mapping.Content[i+1])
+	}
+	if !found {
+		return content, false, nil
+	}
+	mapping.Content = kept
+
+	stripped, err := yaml.Marshal(&doc)
+	if err != nil {
+		return nil, false, err
+	}
+	return stripped, true, nil
+}
+
+// isSecretField reports whether a device.yml key holds a secret.
+func isSecretField(key string) bool {
+	for _, field := range secretFields {
+		if key == field {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptSystemdCreds encrypts content with systemd-creds for use with
+// LoadCredentialEncrypted=, binding it to the TPM2 when one is available.
+func encryptSystemdCreds(content []byte) ([]byte, error) {
+	cmd := exec.Command("sudo", "systemd-creds", "encrypt", "--name=device.yml", "--with-key=auto", "-", "-")
+	cmd.Stdin = strings.NewReader(string(content))
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	logger.Debug("Encrypt command: %s", cmd.String())
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("systemd-creds encrypt failed: %w\nOutput: %s", err, stderr.String())
+	}
+	return output, nil
+}
+
+// encryptKeyFile encrypts content with AES-256-GCM using the service's key
+// file, creating the key file on first use.
+func encryptKeyFile(content []byte, serviceName string) ([]byte, error) {
+	key, err := ensureKeyFile(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nil, iv, content, nil)
+	tagStart := len(sealed) - gcm.Overhead()
+
+	return json.MarshalIndent(encryptedFile{
+		Algorithm: "aes-256-gcm",
+		IV:        base64.StdEncoding.EncodeToString(iv),
+		Tag:       base64.StdEncoding.EncodeToString(sealed[tagStart:]),
+		Data:      base64.StdEncoding.EncodeToString(sealed[:tagStart]),
+	}, "", "  ")
+}
+
+// ensureKeyFile returns the service's AES-256 key, generating and storing a
+// new key readable only by the service user if none exists.
+func ensureKeyFile(serviceName string) ([]byte, error) {
+	keyPath := KeyFilePath(serviceName)
+	if existing, err := utils.ReadPrivilegedFile(keyPath); err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(existing)))
+		if err == nil && len(key) == 32 {
+			logger.Debug("Using existing key file %s", keyPath)
+			return key, nil
+		}
+		return nil, fmt.Errorf("key file %s is not a valid 256-bit hex key", keyPath)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	if output, err := exec.Command("sudo", "mkdir", "-p", "-m", "755", keyFileDir).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w\nOutput: %s", keyFileDir, err, output)
+	}
+	if err := writeFile(keyPath, []byte(hex.EncodeToString(key)+"\n"), "400"); err != nil {
+		return nil, err
+	}
+	logger.Info("Created key file %s", keyPath)
+	return key, nil
+}
+
+// writeFile writes content to path, owned by the service user with the given
+// octal mode on Linux and macOS. On Windows the device configuration ACL is
+// applied instead.
+func writeFile(path string, content []byte, mode string) error {
+	if runtime.GOOS == "windows" {
+		if err := os.WriteFile(path, content, 0600); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		return utils.SecureDeviceConfiguration(path)
+	}
+
+	tempFile, err := os.CreateTemp("", "flowfuse-credentials-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.Write(content); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	tempFile.Close()
+
+	owner := utils.ServiceUsername
+	if runtime.GOOS == "linux" {
+		owner = utils.ServiceOwner()
+	}
+	for _, args := range [][]string{
+		{"cp", tempFile.Name(), path},
+		{"chown", owner, path},
+		{"chmod", mode, path},
+	} {
+		if output, err := exec.Command("sudo", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to write %s: %w\nOutput: %s", path, err, output)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package credentials
+
+import "fmt"
+
+// dpapiProtect encrypts data with DPAPI in machine scope, so the service
+// account can decrypt it on this machine only.
+//
+// Parameters:
+//   - data: the data to encrypt
+//
+// Returns:
+//   - []byte: the encrypted data
+//   - error: non-nil if the encryption failed
+//
+// Note: DPAPI is only available on Windows; this implementation always fails.
+func dpapiProtect(data []byte) ([]byte, error) {
+	return nil, fmt.Errorf("DPAPI is only available on Windows")
+}
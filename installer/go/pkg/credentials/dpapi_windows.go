@@ -0,0 +1,32 @@
+//go:build windows
+
+package credentials
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// dpapiProtect encrypts data with DPAPI in machine scope, so the service
+// account can decrypt it on this machine only.
+//
+// Parameters:
+//   - data: the data to encrypt
+//
+// Returns:
+//   - []byte: the encrypted data
+//   - error: non-nil if the encryption failed
+func dpapiProtect(data []byte) ([]byte, error) {
+	in := windows.DataBlob{Size: uint32(len(data))}
+	if len(data) > 0 {
+		in.Data = &data[0]
+	}
+	var out windows.DataBlob
+	if err := windows.CryptProtectData(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_LOCAL_MACHINE|windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+
+	return append([]byte(nil), unsafe.Slice(out.Data, out.Size)...), nil
+}
@@ -0,0 +1,411 @@
+// Package download provides the HTTP client used for every artifact the
+// installer fetches (Node.js archives, NSSM, release metadata).
+//
+// Downloads are written to a "<dest>.part" file first and only renamed into
+// place once complete (and, when a checksum is given, verified). An interrupted
+// transfer is resumed with an HTTP Range request on the next attempt, so a
+// flaky satellite or cellular link does not restart a large archive from zero.
+// Each source is retried with exponential backoff before falling back to the
+// next mirror in the list.
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+)
+
+// Offline disables all network access for artifact downloads. It is set from
+// the --offline flag; artifacts must then come from the local cache.
+var Offline bool
+
+// ErrOffline is returned by File when Offline is set.
+var ErrOffline = errors.New("network access is disabled (--offline)")
+
+// Options controls how a single artifact is fetched.
+type Options struct {
+	// Label is a short human-readable name shown in progress output
+	// (e.g. "Node.js 22.23.0"). Defaults to the destination file name.
+	Label string
+	// SHA256 is the expected hex-encoded checksum of the complete file.
+	// When empty the download is not verified.
+	SHA256 string
+	// Retries is the number of attempts made against each source before
+	// moving on to the next one.
+	Retries int
+	// ConnectTimeout bounds DNS, TCP connect and TLS handshake.
+	ConnectTimeout time.Duration
+	// ReadTimeout is the longest the transfer may stall (no bytes received,
+	// including waiting for response headers) before the attempt is aborted.
+	ReadTimeout time.Duration
+	// BaseBackoff is the delay before the second attempt; it doubles on each
+	// further attempt up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Quiet suppresses progress output (used for small metadata files).
+	Quiet bool
+}
+
+// DefaultOptions returns the options used for artifact downloads unless a
+// caller overrides them.
+func DefaultOptions() Options {
+	return Options{
+		Retries:        4,
+		ConnectTimeout: 30 * time.Second,
+		ReadTimeout:    60 * time.Second,
+		BaseBackoff:    2 * time.Second,
+		MaxBackoff:     60 * time.Second,
+	}
+}
+
+// permanentError marks a failure that retrying the same source will not fix
+// (e.g. HTTP 404 or a checksum mismatch); the next mirror is tried immediately.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// File downloads an artifact to destPath, trying each URL in urls in priority
+// order. Every source is retried opts.Retries times with exponential backoff;
+// partial data is kept between attempts and resumed with a Range request.
+// Zero-valued fields of opts fall back to DefaultOptions.
+//
+// Parameters:
+//   - urls: Candidate URLs for the same artifact (primary first, then mirrors)
+//   - destPath: Where the complete (and verified) file should be written
+//   - opts: Download options
+//
+// Returns:
+//   - error: describing the last failure across all sources, nil on success
+func File(urls []string, destPath string, opts Options) error {
+	logger.LogFunctionEntry("download.File", map[string]interface{}{
+		"urls":     urls,
+		"destPath": destPath,
+	})
+	opts = withDefaults(opts)
+	if opts.Label == "" {
+		opts.Label = filepath.Base(destPath)
+	}
+	if Offline {
+		return fmt.Errorf("cannot download %s: %w", opts.Label, ErrOffline)
+	}
+	if len(urls) == 0 {
+		return fmt.Errorf("no download sources for %s", opts.Label)
+	}
+
+	partPath := destPath + ".part"
+	client := newClient(opts)
+
+	var lastErr error
+	for _, url := range urls {
+		for attempt := 1; attempt <= opts.Retries; attempt++ {
+			logger.Debug("Downloading %s from %s (attempt %d/%d)", opts.Label, url, attempt, opts.Retries)
+			err := fetch(client, url, partPath, opts)
+			if err == nil {
+				err = verify(partPath, opts.SHA256)
+			}
+			if err == nil {
+				if err := os.Rename(partPath, destPath); err != nil {
+					return fmt.Errorf("failed to finalize download of %s: %w", opts.Label, err)
+				}
+				logger.LogFunctionExit("download.File", destPath, nil)
+				return nil
+			}
+
+			lastErr = err
+			logger.Debug("Download of %s from %s failed: %v", opts.Label, url, err)
+			var perm *permanentError
+			if errors.As(err, &perm) {
+				break
+			}
+			if attempt < opts.Retries {
+				delay := backoff(opts, attempt)
+				logger.Info("Download of %s interrupted (%v), retrying in %s...", opts.Label, err, delay)
+				time.Sleep(delay)
+			}
+		}
+	}
+	_ = os.Remove(partPath)
+	err := fmt.Errorf("failed to download %s from all sources: %w", opts.Label, lastErr)
+	logger.LogFunctionExit("download.File", nil, err)
+	return err
+}
+
+// withDefaults fills zero-valued fields of opts from DefaultOptions.
+func withDefaults(opts Options) Options {
+	def := DefaultOptions()
+	if opts.Retries <= 0 {
+		opts.Retries = def.Retries
+	}
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = def.ConnectTimeout
+	}
+	if opts.ReadTimeout <= 0 {
+		opts.ReadTimeout = def.ReadTimeout
+	}
+	if opts.BaseBackoff <= 0 {
+		opts.BaseBackoff = def.BaseBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = def.MaxBackoff
+	}
+	return opts
+}
+
+// backoff returns the delay before the attempt following the given one:
+// BaseBackoff, 2*BaseBackoff, 4*BaseBackoff, ... capped at MaxBackoff.
+func backoff(opts Options, attempt int) time.Duration {
+	delay := opts.BaseBackoff
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= opts.MaxBackoff {
+			return opts.MaxBackoff
+		}
+	}
+	return delay
+}
+
+// NewHTTPClient returns an HTTP client configured like the one used for
+// artifact downloads: proxy settings from the environment, connect and
+// response-header timeouts, and trust for the custom CA bundle (if any).
+// It is intended for small metadata requests made by other packages.
+func NewHTTPClient(timeout time.Duration) *http.Client {
+	opts := withDefaults(Options{ConnectTimeout: timeout, ReadTimeout: timeout})
+	client := newClient(opts)
+	client.Timeout = timeout
+	return client
+}
+
+// newClient builds the HTTP client for a download. The overall request has no
+// deadline (large archives on slow links can legitimately take a long time);
+// stalls are caught by ResponseHeaderTimeout and the idle reader instead.
+func newClient(opts Options) *http.Client {
+	dialer := &net.Dialer{Timeout: opts.ConnectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   opts.ConnectTimeout,
+		ResponseHeaderTimeout: opts.ReadTimeout,
+		TLSClientConfig:       &tls.Config{RootCAs: RootCAs()},
+	}
+	return &http.Client{Transport: transport}
+}
+
+// RootCAs returns the system certificate pool extended with the bundle named
+// by NODE_EXTRA_CA_CERTS (set from --ca-cert), so downloads behind a
+// TLS-intercepting proxy trust the same CA as the Device Agent. It returns nil
+// (use the system defaults) when no extra bundle is configured or readable.
+func RootCAs() *x509.CertPool {
+	extra := os.Getenv("NODE_EXTRA_CA_CERTS")
+	if extra == "" {
+		return nil
+	}
+	data, err := os.ReadFile(extra)
+	if err != nil {
+		logger.Debug("Could not read CA bundle %s for downloads: %v", extra, err)
+		return nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		logger.Debug("No certificates found in CA bundle %s", extra)
+	}
+	return pool
+}
+
+// fetch performs one download attempt from url into partPath, resuming from
+// the current size of partPath when the server supports Range requests.
+func fetch(client *http.Client, url, partPath string, opts Options) error {
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil {
+		offset = info.Size()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return &permanentError{fmt.Errorf("invalid request: %w", err)}
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		logger.Debug("Resuming download of %s at byte %d", opts.Label, offset)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	logger.Debug("Received response from %s: status=%s content-length=%d", url, resp.Status, resp.ContentLength)
+
+	flags := os.O_CREATE | os.O_WRONLY
+	var total int64 = -1
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Server ignored (or we didn't send) the Range header: start over.
+		offset = 0
+		flags |= os.O_TRUNC
+		total = resp.ContentLength
+	case http.StatusPartialContent:
+		start, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			_ = os.Remove(partPath)
+			return fmt.Errorf("server returned an unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+		total = size
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is already complete (or larger than the resource).
+		if _, size, ok := parseContentRange(resp.Header.Get("Content-Range")); ok && size == offset {
+			return nil
+		}
+		_ = os.Remove(partPath)
+		return fmt.Errorf("partial download is not resumable, restarting")
+	case http.StatusNotFound, http.StatusForbidden, http.StatusGone, http.StatusUnauthorized:
+		return &permanentError{fmt.Errorf("unexpected response status: %s", resp.Status)}
+	default:
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+
+	out, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return &permanentError{fmt.Errorf("failed to create download file: %w", err)}
+	}
+
+	progress := newProgress(opts, offset, total)
+	body := &idleReader{r: resp.Body, timeout: opts.ReadTimeout, cancel: cancel}
+	body.arm()
+	written, copyErr := io.Copy(io.MultiWriter(out, progress), body)
+	body.stop()
+	progress.finish(copyErr == nil)
+	closeErr := out.Close()
+	logger.Debug("Wrote %d bytes to %s", written, partPath)
+
+	if copyErr != nil {
+		if body.timedOut() {
+			return fmt.Errorf("no data received for %s", opts.ReadTimeout)
+		}
+		return fmt.Errorf("failed to write download: %w", copyErr)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to finalize download: %w", closeErr)
+	}
+	if total > 0 && offset+written != total {
+		return fmt.Errorf("download incomplete: got %d of %d bytes", offset+written, total)
+	}
+	return nil
+}
+
+// verify checks the SHA-256 checksum of path against expected. A mismatching
+// file is removed so the next source starts from a clean slate.
+func verify(path, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	sum, err := FileSHA256(path)
+	if err != nil {
+		return err
+	}
+	logger.Debug("Verifying checksum: computed=%s expected=%s", sum, expected)
+	if !strings.EqualFold(sum, expected) {
+		_ = os.Remove(path)
+		return &permanentError{fmt.Errorf("checksum mismatch: got %s, expected %s", sum, expected)}
+	}
+	return nil
+}
+
+// FileSHA256 returns the hex-encoded SHA-256 checksum of the file at path.
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// parseContentRange parses "bytes <start>-<end>/<size>" (or "bytes */<size>")
+// and returns start and size. size is -1 when the server reports "*".
+func parseContentRange(value string) (int64, int64, bool) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, 0, false
+	}
+	spec := strings.TrimPrefix(value, "bytes ")
+	rangePart, sizePart, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, false
+	}
+	size := int64(-1)
+	if sizePart != "*" {
+		n, err := strconv.ParseInt(sizePart, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		size = n
+	}
+	if rangePart == "*" {
+		return 0, size, true
+	}
+	startStr, _, found := strings.Cut(rangePart, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, size, true
+}
+
+// idleReader cancels the request when no data has been read for timeout,
+// turning a silently stalled connection into a retryable error.
+type idleReader struct {
+	r       io.Reader
+	timeout time.Duration
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+func (ir *idleReader) arm() {
+	ir.timer = time.AfterFunc(ir.timeout, func() {
+		ir.expired.Store(true)
+		ir.cancel()
+	})
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if n > 0 {
+		ir.timer.Reset(ir.timeout)
+	}
+	return n, err
+}
+
+func (ir *idleReader) stop() { ir.timer.Stop() }
+
+func (ir *idleReader) timedOut() bool { return ir.expired.Load() }
@@ -0,0 +1,287 @@
+package download
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testOptions retries quickly and without progress output.
+func testOptions(content []byte) Options {
+	sum := sha256.Sum256(content)
+	return Options{
+		SHA256:      hex.EncodeToString(sum[:]),
+		Retries:     3,
+		BaseBackoff: time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+		Quiet:       true,
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		value       string
+		start, size int64
+		ok          bool
+	}{
+		{"bytes 0-99/100", 0, 100, true},
+		{"bytes 50-99/100", 50, 100, true},
+		{" bytes 50-99/100 ", 50, 100, true},
+		{"bytes 50-99/*", 50, -1, true},
+		{"bytes */100", 0, 100, true},
+		{"bytes 50-99", 0, 0, false},
+		{"items 50-99/100", 0, 0, false},
+		{"bytes x-99/100", 0, 0, false},
+		{"bytes 50/100", 0, 0, false},
+		{"bytes 50-99/many", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, size, ok := parseContentRange(tt.value)
+		if ok != tt.ok || (ok && (start != tt.start || size != tt.size)) {
+			t.Errorf("parseContentRange(%q) = %d, %d, %v, want %d, %d, %v", tt.value, start, size, ok, tt.start, tt.size, tt.ok)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	opts := Options{BaseBackoff: 2 * time.Second, MaxBackoff: 10 * time.Second}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{4, 10 * time.Second},
+		{10, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := backoff(opts, tt.attempt); got != tt.want {
+			t.Errorf("backoff(attempt %d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestFileRetriesAndMirrors(t *testing.T) {
+	content := []byte("node-v22.23.0-linux-x64.tar.xz")
+	serve := func(w http.ResponseWriter, r *http.Request) { w.Write(content) }
+	fail := func(status int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(status) }
+	}
+	tests := []struct {
+		name string
+		// primary answers the n-th request (from 1) to the first source
+		primary      func(n int32) http.HandlerFunc
+		wantPrimary  int32
+		wantMirror   int32
+		wantErr      bool
+		wrongContent bool
+	}{
+		{
+			name:        "first attempt",
+			primary:     func(int32) http.HandlerFunc { return serve },
+			wantPrimary: 1,
+		},
+		{
+			name: "retried after server errors",
+			primary: func(n int32) http.HandlerFunc {
+				if n < 3 {
+					return fail(http.StatusServiceUnavailable)
+				}
+				return serve
+			},
+			wantPrimary: 3,
+		},
+		{
+			name:        "mirror after the retries",
+			primary:     func(int32) http.HandlerFunc { return fail(http.StatusBadGateway) },
+			wantPrimary: 3,
+			wantMirror:  1,
+		},
+		{
+			name:        "mirror at once when not found",
+			primary:     func(int32) http.HandlerFunc { return fail(http.StatusNotFound) },
+			wantPrimary: 1,
+			wantMirror:  1,
+		},
+		{
+			name: "mirror at once on a checksum mismatch",
+			primary: func(int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("tampered")) }
+			},
+			wantPrimary: 1,
+			wantMirror:  1,
+		},
+		{
+			name:        "all sources fail",
+			primary:     func(int32) http.HandlerFunc { return fail(http.StatusInternalServerError) },
+			wantPrimary: 3,
+			wantMirror:  3,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var primaryCount, mirrorCount atomic.Int32
+			primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tt.primary(primaryCount.Add(1))(w, r)
+			}))
+			defer primary.Close()
+			mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mirrorCount.Add(1)
+				if tt.wantErr {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				serve(w, r)
+			}))
+			defer mirror.Close()
+
+			dest := filepath.Join(t.TempDir(), "node.tar.xz")
+			err := File([]string{primary.URL, mirror.URL}, dest, testOptions(content))
+			if tt.wantErr {
+				if err == nil {
+					t.Error("File succeeded, want an error")
+				}
+				if _, statErr := os.Stat(dest + ".part"); statErr == nil {
+					t.Error("the partial download was left behind")
+				}
+			} else if err != nil {
+				t.Fatalf("File failed: %v", err)
+			} else if got, _ := os.ReadFile(dest); !bytes.Equal(got, content) {
+				t.Errorf("downloaded %q, want %q", got, content)
+			}
+			if primaryCount.Load() != tt.wantPrimary || mirrorCount.Load() != tt.wantMirror {
+				t.Errorf("requests to primary, mirror = %d, %d, want %d, %d",
+					primaryCount.Load(), mirrorCount.Load(), tt.wantPrimary, tt.wantMirror)
+			}
+		})
+	}
+}
+
+func TestFileResume(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	serveContent := func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "node.tar.xz", time.Time{}, bytes.NewReader(content))
+	}
+	tests := []struct {
+		name       string
+		part       []byte
+		handler    func(n int32) http.HandlerFunc
+		wantRanges []string
+	}{
+		{
+			name:       "resumed after 206",
+			part:       content[:10],
+			handler:    func(int32) http.HandlerFunc { return serveContent },
+			wantRanges: []string{"bytes=10-"},
+		},
+		{
+			name: "restarted when the range is ignored",
+			part: []byte("stale data"),
+			handler: func(int32) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) { w.Write(content) }
+			},
+			wantRanges: []string{"bytes=10-"},
+		},
+		{
+			name:       "complete partial download",
+			part:       content,
+			handler:    func(int32) http.HandlerFunc { return serveContent },
+			wantRanges: []string{fmt.Sprintf("bytes=%d-", len(content))},
+		},
+		{
+			name: "restarted after an unexpected range",
+			part: content[:10],
+			handler: func(n int32) http.HandlerFunc {
+				if n > 1 {
+					return serveContent
+				}
+				return func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+					w.WriteHeader(http.StatusPartialContent)
+					w.Write(content)
+				}
+			},
+			wantRanges: []string{"bytes=10-", ""},
+		},
+		{
+			name: "resumed after an interrupted transfer",
+			handler: func(n int32) http.HandlerFunc {
+				if n > 1 {
+					return serveContent
+				}
+				return func(w http.ResponseWriter, r *http.Request) {
+					// Announce the full length but close the connection early
+					w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+					w.Write(content[:20])
+				}
+			},
+			wantRanges: []string{"", "bytes=20-"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var count atomic.Int32
+			var ranges []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ranges = append(ranges, r.Header.Get("Range"))
+				tt.handler(count.Add(1))(w, r)
+			}))
+			defer server.Close()
+
+			dest := filepath.Join(t.TempDir(), "node.tar.xz")
+			if tt.part != nil {
+				if err := os.WriteFile(dest+".part", tt.part, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := File([]string{server.URL}, dest, testOptions(content)); err != nil {
+				t.Fatalf("File failed: %v", err)
+			}
+			if got, _ := os.ReadFile(dest); !bytes.Equal(got, content) {
+				t.Errorf("downloaded %q, want %q", got, content)
+			}
+			if strings.Join(ranges, ",") != strings.Join(tt.wantRanges, ",") {
+				t.Errorf("Range headers %q, want %q", ranges, tt.wantRanges)
+			}
+		})
+	}
+}
+
+func TestFileOffline(t *testing.T) {
+	Offline = true
+	defer func() { Offline = false }()
+	if err := File([]string{"http://127.0.0.1:1/node.tar.xz"}, filepath.Join(t.TempDir(), "node.tar.xz"), Options{}); err == nil {
+		t.Error("File succeeded while offline")
+	}
+}
+
+func TestProgressRate(t *testing.T) {
+	tests := []struct {
+		name            string
+		offset, written int64
+		want            string
+	}{
+		{"new download", 0, 4 * 1024 * 1024, "2.0 MB/s"},
+		{"resumed download", 100 * 1024 * 1024, 4 * 1024 * 1024, "2.0 MB/s"},
+	}
+	for _, tt := range tests {
+		p := newProgress(Options{Quiet: true}, tt.offset, -1)
+		p.started = time.Now().Add(-2 * time.Second)
+		p.current += tt.written
+		if got := p.rate(); got != tt.want {
+			t.Errorf("%s: rate() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
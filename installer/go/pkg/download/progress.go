@@ -0,0 +1,142 @@
+package download
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/style"
+)
+
+// progressBarWidth is the number of cells in the TTY progress bar.
+const progressBarWidth = 30
+
+// progressRedrawInterval limits how often the TTY progress bar is redrawn.
+const progressRedrawInterval = 200 * time.Millisecond
+
+// progressLogStep is the percentage step between progress log lines when
+// stdout is not a terminal (e.g. when the installer is run from a pipeline).
+const progressLogStep = 10
+
+// progressLogBytes is the interval between progress log lines when the total
+// size is unknown and stdout is not a terminal.
+const progressLogBytes = 10 * 1024 * 1024
+
+// progress reports download progress. In an interactive terminal it redraws a
+// single progress bar line; otherwise it logs a line every progressLogStep
+// percent so logs from non-interactive runs still show the transfer advancing.
+type progress struct {
+	label       string
+	quiet       bool
+	interactive bool
+	current     int64
+	offset      int64 // bytes already on disk when the attempt started
+	total       int64 // -1 when unknown
+	lastDraw    time.Time
+	lastLogged  int64 // last logged percent (or byte count when total unknown)
+	started     time.Time
+}
+
+func newProgress(opts Options, offset, total int64) *progress {
+	p := &progress{
+		label:       opts.Label,
+		quiet:       opts.Quiet,
+		interactive: style.Interactive(),
+		current:     offset,
+		offset:      offset,
+		total:       total,
+		started:     time.Now(),
+	}
+	if !p.quiet && !p.interactive {
+		if offset > 0 {
+			logger.Info("Resuming download of %s at %s", p.label, FormatBytes(offset))
+		} else {
+			logger.Info("Downloading %s...", p.label)
+		}
+		if total > 0 {
+			p.lastLogged = offset * 100 / total / progressLogStep * progressLogStep
+		} else {
+			p.lastLogged = offset
+		}
+	}
+	return p
+}
+
+// Write implements io.Writer so progress can sit in an io.MultiWriter next to
+// the destination file.
+func (p *progress) Write(b []byte) (int, error) {
+	p.current += int64(len(b))
+	if p.quiet {
+		return len(b), nil
+	}
+	if p.interactive {
+		if time.Since(p.lastDraw) >= progressRedrawInterval {
+			p.draw()
+		}
+		return len(b), nil
+	}
+
+	if p.total > 0 {
+		percent := p.current * 100 / p.total
+		if percent >= p.lastLogged+progressLogStep {
+			p.lastLogged = percent / progressLogStep * progressLogStep
+			logger.Info("Downloading %s: %d%% (%s of %s)", p.label, p.lastLogged, FormatBytes(p.current), FormatBytes(p.total))
+		}
+	} else if p.current >= p.lastLogged+progressLogBytes {
+		p.lastLogged = p.current
+		logger.Info("Downloading %s: %s", p.label, FormatBytes(p.current))
+	}
+	return len(b), nil
+}
+
+// draw redraws the TTY progress bar line.
+func (p *progress) draw() {
+	p.lastDraw = time.Now()
+	style.ClearLine()
+	if p.total > 0 {
+		fraction := float64(p.current) / float64(p.total)
+		fmt.Fprintf(os.Stdout, "%s %s %3.0f%% %s/%s %s", p.label, style.ProgressBar(fraction, progressBarWidth),
+			fraction*100, FormatBytes(p.current), FormatBytes(p.total), style.Dim(p.rate()))
+	} else {
+		fmt.Fprintf(os.Stdout, "%s %s %s", p.label, FormatBytes(p.current), style.Dim(p.rate()))
+	}
+}
+
+// finish completes the progress output for one attempt.
+func (p *progress) finish(ok bool) {
+	if p.quiet {
+		return
+	}
+	if p.interactive {
+		p.draw()
+		fmt.Fprintln(os.Stdout)
+	}
+	if ok {
+		logger.Debug("Downloaded %s (%s) in %s", p.label, FormatBytes(p.current-p.offset), time.Since(p.started).Round(time.Second))
+	}
+}
+
+// rate returns the average transfer rate of this attempt, e.g. "1.2 MB/s".
+// The bytes of a resumed download that were already on disk do not count.
+func (p *progress) rate() string {
+	elapsed := time.Since(p.started).Seconds()
+	if elapsed < 1 {
+		return ""
+	}
+	return FormatBytes(int64(float64(p.current-p.offset)/elapsed)) + "/s"
+}
+
+// FormatBytes renders n as a human-readable size using binary units.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
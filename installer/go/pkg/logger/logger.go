@@ -4,21 +4,50 @@
 // having its own logger instance. The package is designed to be thread-safe and
 // supports enabling/disabling debug logging.
 //
+// Secrets are removed from every message before it is written, see Redact.
+//
 // Log file management is handled internally, with operations for opening, closing,
 // and configuring the log file path. All logging operations are protected by a mutex
 // to ensure thread safety in concurrent environments.
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Log file formats (--log-format).
+const (
+	// FormatText writes plain text lines prefixed with the level
+	FormatText = "text"
+	// FormatJSON writes one JSON object per line with time, level, step and message
+	FormatJSON = "json"
+)
+
+// Log file location and format, set from the command line before Initialize.
+var (
+	// FilePath is the log file to append to (--log-file); empty for a new timestamped file
+	FilePath string
+	// Dir is the directory of the timestamped log file (--log-dir); empty for the system temporary directory
+	Dir string
+	// Format is the log file format, FormatText or FormatJSON (--log-format)
+	Format = FormatText
+	// Console receives the info and debug messages; standard output unless a
+	// command prints a machine-readable report there (--check-format json)
+	Console io.Writer = os.Stdout
+)
+
+// LogFilePrefix is the file name prefix of timestamped installer log files.
+const LogFilePrefix = "flowfuse-device-installer-"
+
 // ansiEscapeRE matches ANSI SGR escape sequences (e.g. those produced by the
 // style package). They are stripped from file output so the log file stays
 // plain text while the console keeps its styling.
@@ -48,6 +77,10 @@ var (
 	logFile *os.File
 	logFilePath string
 
+	// steps is the stack of functions entered with LogFunctionEntry; the
+	// innermost one is the step ID of JSON log entries
+	steps []string
+
 	// Mutex for thread safety
 	mutex sync.Mutex
 )
@@ -55,8 +88,9 @@ var (
 
 // Initialize sets up the logger system with file and console logging capabilities.
 //
-// The function creates a timestamped log file in the system's temporary directory
-// and initializes multiple logger instances for different severity levels (debug, info, error)
+// The function appends to FilePath if set, otherwise it creates a timestamped log file
+// in Dir (or the system's temporary directory). The file is only readable by its owner.
+// It initializes multiple logger instances for different severity levels (debug, info, error)
 // with appropriate formatting for both file and console output.
 //
 // The debug parameter controls whether debug-level logging is enabled.
@@ -69,25 +103,41 @@ func Initialize(debug bool) error {
 
 	debugEnabled = debug
 
-	logDir := os.TempDir()
-
-	timestamp := time.Now().Format("20060102-150405")
-	logFilename := fmt.Sprintf("flowfuse-device-installer-%s.log", timestamp)
-	logFilePath = filepath.Join(logDir, logFilename)
+	if FilePath != "" {
+		logFilePath = FilePath
+	} else {
+		logDir := Dir
+		if logDir == "" {
+			logDir = os.TempDir()
+		}
+		timestamp := time.Now().Format("20060102-150405")
+		logFilename := fmt.Sprintf("%s%s.log", LogFilePrefix, timestamp)
+		logFilePath = filepath.Join(logDir, logFilename)
+	}
+	if err := os.MkdirAll(filepath.Dir(logFilePath), 0700); err != nil {
+		mutex.Unlock()
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
 
 	var err error
-	logFile, err = os.OpenFile(logFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	logFile, err = os.OpenFile(logFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
 	if err != nil {
 		mutex.Unlock()
 		return fmt.Errorf("failed to open log file: %w", err)
 	}
+	// An existing file keeps its mode on open, so restrict it explicitly
+	if err := logFile.Chmod(0600); err != nil {
+		logFile.Close()
+		mutex.Unlock()
+		return fmt.Errorf("failed to set log file permissions: %w", err)
+	}
 
 	fileDebugLogger = log.New(logFile, "[DEBUG] ", log.Ldate|log.Ltime|log.Lshortfile)
 	fileInfoLogger = log.New(logFile, "[INFO] ", log.Ldate|log.Ltime)
 	fileErrorLogger = log.New(logFile, "[ERROR] ", log.Ldate|log.Ltime|log.Lshortfile)
 
-	consoleDebugLogger = log.New(os.Stdout, "[DEBUG] ", 0)
-	consoleInfoLogger = log.New(os.Stdout, "", 0)
+	consoleDebugLogger = log.New(Console, "[DEBUG] ", 0)
+	consoleInfoLogger = log.New(Console, "", 0)
 	consoleErrorLogger = log.New(os.Stderr, "[ERROR] ", 0)
 
 	mutex.Unlock()
@@ -109,13 +159,53 @@ func Close() error {
 
 	if logFile != nil {
 		if debugEnabled {
-			fileDebugLogger.Output(2, "Closing log file")
+			writeFile(fileDebugLogger, "debug", 2, "Closing log file")
 		}
-		return logFile.Close()
+		err := logFile.Close()
+		logFile = nil
+		fileDebugLogger, fileInfoLogger, fileErrorLogger = nil, nil, nil
+		return err
 	}
 	return nil
 }
 
+// writeFile writes a message to the log file in the configured format. The
+// caller must hold the mutex.
+//
+// Parameters:
+//   - textLogger: The text logger for the level
+//   - level: The level name used in JSON entries
+//   - calldepth: The call depth for the source location of text entries
+//   - message: The message to write
+func writeFile(textLogger *log.Logger, level string, calldepth int, message string) {
+	if textLogger == nil || logFile == nil {
+		return
+	}
+	message = stripANSI(message)
+
+	if Format != FormatJSON {
+		textLogger.Output(calldepth+1, message)
+		return
+	}
+
+	entry := struct {
+		Time    string `json:"time"`
+		Level   string `json:"level"`
+		Step    string `json:"step,omitempty"`
+		Message string `json:"msg"`
+	}{
+		Time:    time.Now().Format(time.RFC3339Nano),
+		Level:   level,
+		Message: message,
+	}
+	if len(steps) > 0 {
+		entry.Step = strings.Join(steps, "/")
+	}
+	if line, err := json.Marshal(entry); err == nil {
+		logFile.Write(append(line, '\n'))
+	}
+}
+
 // Debug logs a debug message if debugging is enabled.
 //
 // The message is formatted according to the format specifier and the remaining arguments.
@@ -133,11 +223,9 @@ func Debug(format string, v ...interface{}) {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	message := fmt.Sprintf(format, v...)
+	message := Redact(fmt.Sprintf(format, v...))
 
-	if fileDebugLogger != nil {
-		fileDebugLogger.Output(2, stripANSI(message))
-	}
+	writeFile(fileDebugLogger, "debug", 2, message)
 
 	if consoleDebugLogger != nil {
 		consoleDebugLogger.Output(2, message)
@@ -156,11 +244,9 @@ func Info(format string, v ...interface{}) {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	message := fmt.Sprintf(format, v...)
+	message := Redact(fmt.Sprintf(format, v...))
 
-	if fileInfoLogger != nil {
-		fileInfoLogger.Output(2, stripANSI(message))
-	}
+	writeFile(fileInfoLogger, "info", 2, message)
 
 	if consoleInfoLogger != nil {
 		consoleInfoLogger.Output(2, message)
@@ -182,11 +268,9 @@ func Error(format string, v ...interface{}) {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	message := fmt.Sprintf(format, v...)
+	message := Redact(fmt.Sprintf(format, v...))
 
-	if fileErrorLogger != nil {
-		fileErrorLogger.Output(2, stripANSI(message))
-	}
+	writeFile(fileErrorLogger, "error", 2, message)
 
 	if consoleErrorLogger != nil {
 		consoleErrorLogger.Output(2, message)
@@ -195,7 +279,8 @@ func Error(format string, v ...interface{}) {
 
 // LogFunctionEntry logs the entry point of a function with its parameters if debug logging is enabled.
 // It creates a log entry with the prefix "ENTER:" followed by the function name and its parameters.
-// If debug logging is disabled, this function returns without logging.
+// The function also becomes the current step of JSON log entries until LogFunctionExit.
+// If debug logging is disabled, this function records the step without logging.
 //
 // Parameters:
 //   - functionName: The name of the function being entered.
@@ -208,6 +293,10 @@ func Error(format string, v ...interface{}) {
 //	    "name": "example",
 //	})
 func LogFunctionEntry(functionName string, params map[string]interface{}) {
+	mutex.Lock()
+	steps = append(steps, functionName)
+	mutex.Unlock()
+
 	if !debugEnabled {
 		return
 	}
@@ -220,17 +309,25 @@ func LogFunctionEntry(functionName string, params map[string]interface{}) {
 // It takes the name of the function, the return value, and any error that occurred.
 // If an error is provided, it logs that the function returned an error.
 // Otherwise, it logs the function's result.
-// This function is a no-op when debug logging is disabled.
+// The function's step ends whether or not debug logging is enabled.
 func LogFunctionExit(functionName string, result interface{}, err error) {
-	if !debugEnabled {
-		return
+	if debugEnabled {
+		if err != nil {
+			Debug("EXIT: %s returned error: %v", functionName, err)
+		} else {
+			Debug("EXIT: %s completed with result: %v", functionName, result)
+		}
 	}
 
-	if err != nil {
-		Debug("EXIT: %s returned error: %v", functionName, err)
-	} else {
-		Debug("EXIT: %s completed with result: %v", functionName, result)
+	// Leave the step, and any inner steps that did not log their exit
+	mutex.Lock()
+	for i := len(steps) - 1; i >= 0; i-- {
+		if steps[i] == functionName {
+			steps = steps[:i]
+			break
+		}
 	}
+	mutex.Unlock()
 }
 
 // GetLogFilePath returns the current path of the log file.
@@ -0,0 +1,225 @@
+package nodejs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
+	"github.com/flowfuse/device-agent-installer/pkg/download"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/style"
+)
+
+// Strict turns Node.js release advisories into failures (--strict).
+var Strict bool
+
+// releaseScheduleURL is the Node.js release working group's schedule, which
+// holds the end-of-life date of every release line.
+const releaseScheduleURL = "https://raw.githubusercontent.com/nodejs/Release/main/schedule.json"
+
+// eolWarningPeriod is how long before its end-of-life a release line is
+// reported as nearing EOL.
+const eolWarningPeriod = 90 * 24 * time.Hour
+
+// distRelease is one entry of the distribution's index.json.
+type distRelease struct {
+	Version  string `json:"version"`
+	Date     string `json:"date"`
+	Security bool   `json:"security"`
+	// LTS is false for Current releases and the codename for LTS releases.
+	LTS interface{} `json:"lts"`
+}
+
+// releaseLine is one entry of the release schedule, keyed by "v<major>".
+type releaseLine struct {
+	End      string `json:"end"`
+	Codename string `json:"codename"`
+}
+
+// CheckNodeRelease reports release advisories for a Node.js version: an
+// end-of-life or soon-to-be end-of-life release line, and newer security
+// releases in the same line. Advisories are logged as warnings; in strict mode
+// they are returned as an error instead.
+//
+// The release metadata is downloaded when possible and cached, so the check
+// also works offline once the metadata has been fetched. When no metadata is
+// available at all the check is skipped.
+//
+// Parameters:
+//   - version: The Node.js version to check (e.g. "22.23.0")
+//
+// Returns:
+//   - error: An error listing the advisories in strict mode, nil otherwise
+func CheckNodeRelease(version string) error {
+	advisories, err := GetNodeReleaseAdvisories(version)
+	if err != nil {
+		logger.Debug("Skipping Node.js release check: %v", err)
+		return nil
+	}
+	if len(advisories) == 0 {
+		logger.Debug("No release advisories for Node.js %s", version)
+		return nil
+	}
+
+	if Strict {
+		for _, advisory := range advisories {
+			logger.Error("%s", advisory)
+		}
+		return fmt.Errorf("node.js %s has %d release advisory(ies) and --strict is set", version, len(advisories))
+	}
+
+	for _, advisory := range advisories {
+		logger.Info("%s %s", style.Yellow("Warning:"), advisory)
+	}
+	return nil
+}
+
+// GetNodeReleaseAdvisories returns the release advisories for a Node.js
+// version as human-readable messages.
+//
+// Parameters:
+//   - version: The Node.js version to check (e.g. "22.23.0")
+//
+// Returns:
+//   - []string: The advisories, empty if the version is current
+//   - error: An error if neither the release index nor the schedule is available
+func GetNodeReleaseAdvisories(version string) ([]string, error) {
+	current, ok := parseNodeVersion(version)
+	if !ok {
+		return nil, fmt.Errorf("invalid Node.js version: %s", version)
+	}
+
+	var advisories []string
+	var indexErr, scheduleErr error
+
+	var schedule map[string]releaseLine
+	if scheduleErr = fetchReleaseMetadata([]string{releaseScheduleURL}, "node-release-schedule.json", &schedule); scheduleErr == nil {
+		if line, ok := schedule[fmt.Sprintf("v%d", current[0])]; ok {
+			if end, err := time.Parse("2006-01-02", line.End); err == nil {
+				name := fmt.Sprintf("v%d", current[0])
+				if line.Codename != "" {
+					name = fmt.Sprintf("v%d (%s)", current[0], line.Codename)
+				}
+				switch remaining := time.Until(end); {
+				case remaining <= 0:
+					advisories = append(advisories, fmt.Sprintf("Node.js %s is end-of-life since %s and no longer receives security fixes", name, line.End))
+				case remaining <= eolWarningPeriod:
+					advisories = append(advisories, fmt.Sprintf("Node.js %s reaches end-of-life on %s", name, line.End))
+				}
+			}
+		}
+	}
+
+	var releases []distRelease
+	var indexURLs []string
+	for _, base := range DistBaseURLs() {
+		indexURLs = append(indexURLs, base+"/index.json")
+	}
+	if indexErr = fetchReleaseMetadata(indexURLs, "node-index.json", &releases); indexErr == nil {
+		var latestSecurity, latestInLine string
+		var latestSecurityVersion, latestVersion [3]int
+		for _, release := range releases {
+			v, ok := parseNodeVersion(release.Version)
+			if !ok || v[0] != current[0] || compareNodeVersions(v, current) <= 0 {
+				continue
+			}
+			if compareNodeVersions(v, latestVersion) > 0 {
+				latestVersion, latestInLine = v, strings.TrimPrefix(release.Version, "v")
+			}
+			if release.Security && compareNodeVersions(v, latestSecurityVersion) > 0 {
+				latestSecurityVersion, latestSecurity = v, strings.TrimPrefix(release.Version, "v")
+			}
+		}
+		if latestSecurity != "" {
+			advisories = append(advisories, fmt.Sprintf("Node.js %s is a security release newer than %s, update with --update-nodejs --nodejs-version %s", latestSecurity, version, latestInLine))
+		}
+	}
+
+	if scheduleErr != nil && indexErr != nil {
+		return nil, fmt.Errorf("release metadata unavailable: %v; %v", scheduleErr, indexErr)
+	}
+	return advisories, nil
+}
+
+// fetchReleaseMetadata downloads a JSON metadata file from the first
+// reachable URL and decodes it into v. A successful download is stored in the
+// artifact cache under name; when offline or no URL is reachable, the cached
+// copy is used instead.
+//
+// Parameters:
+//   - urls: The candidate URLs, in priority order
+//   - name: The file name used for the cached copy
+//   - v: The value to decode the JSON into
+//
+// Returns:
+//   - error: An error if the metadata is neither downloadable nor cached
+func fetchReleaseMetadata(urls []string, name string, v interface{}) error {
+	var lastErr error = download.ErrOffline
+	if !download.Offline {
+		client := download.NewHTTPClient(15 * time.Second)
+		for _, url := range urls {
+			body, err := fetchURL(client, url)
+			if err != nil {
+				lastErr = err
+				logger.Debug("Failed to fetch %s: %v", url, err)
+				continue
+			}
+			if err := json.Unmarshal(body, v); err != nil {
+				lastErr = fmt.Errorf("failed to parse %s: %w", url, err)
+				continue
+			}
+			storeReleaseMetadata(body, name, url)
+			return nil
+		}
+	}
+
+	cachedPath, ok := cache.FindByName(name)
+	if !ok {
+		return lastErr
+	}
+	body, err := os.ReadFile(cachedPath)
+	if err != nil {
+		return fmt.Errorf("failed to read cached %s: %w", name, err)
+	}
+	logger.Debug("Using cached %s", name)
+	return json.Unmarshal(body, v)
+}
+
+// fetchURL returns the body of a successful GET request to url.
+func fetchURL(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// storeReleaseMetadata saves downloaded metadata in the artifact cache for
+// later offline use. Failures are logged only.
+func storeReleaseMetadata(body []byte, name, source string) {
+	tempDir, err := os.MkdirTemp("", "flowfuse-nodejs-metadata")
+	if err != nil {
+		logger.Debug("Could not cache %s: %v", name, err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	tempPath := filepath.Join(tempDir, name)
+	if err := os.WriteFile(tempPath, body, 0644); err != nil {
+		logger.Debug("Could not cache %s: %v", name, err)
+		return
+	}
+	if _, err := cache.Store(tempPath, "", source); err != nil {
+		logger.Debug("Could not cache %s: %v", name, err)
+	}
+}
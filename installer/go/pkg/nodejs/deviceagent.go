@@ -8,7 +8,9 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
 	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/download"
 	"github.com/flowfuse/device-agent-installer/pkg/logger"
 	"github.com/flowfuse/device-agent-installer/pkg/utils"
 )
@@ -20,6 +22,70 @@ const packageName = "@flowfuse/device-agent"
 // sudo silently ignores it when unset.
 const preserveEnv = "--preserve-env=PATH,NODE_EXTRA_CA_CERTS"
 
+// ProvisioningConfig is a provisioning device.yml (see
+// utils.ResolveProvisioningConfiguration) written by ConfigureDeviceAgent
+// instead of running the one-time code setup
+var ProvisioningConfig string
+
+// npmCacheArgs returns the npm flags that select the shared npm cache for
+// serviceUser (see cache.NpmDir) and the registry set with --npm-registry and,
+// in offline mode, forbid network access so packages are installed from that
+// cache only.
+//
+// Parameters:
+//   - serviceUser: The account npm runs as
+//
+// Returns:
+//   - []string: npm command line flags
+//   - error: An error if the cache directory could not be prepared
+func npmCacheArgs(serviceUser string) ([]string, error) {
+	npmCacheDir, err := cache.NpmDir(serviceUser)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare npm cache: %w", err)
+	}
+	args := []string{"--cache", npmCacheDir}
+	if Registry != "" {
+		args = append(args, "--registry", Registry)
+	}
+	if download.Offline {
+		args = append(args, "--offline")
+	}
+	return args, nil
+}
+
+// newNpmInstallCmd builds an "npm install" command that runs as serviceUser
+// with the shared npm cache, as used for the Device Agent and extra packages.
+//
+// Parameters:
+//   - serviceUser: The account npm runs as
+//   - newPath: The PATH environment entry that puts the bundled Node.js first
+//   - installArgs: The install flags and package specs
+//   - env: Additional environment entries (e.g. npm_config_prefix)
+//
+// Returns:
+//   - *exec.Cmd: The prepared command
+//   - error: An error if the npm cache cannot be prepared or the OS is unsupported
+func newNpmInstallCmd(serviceUser, newPath string, installArgs []string, env ...string) (*exec.Cmd, error) {
+	cacheArgs, err := npmCacheArgs(serviceUser)
+	if err != nil {
+		return nil, err
+	}
+
+	var installCmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux", "darwin":
+		args := append([]string{preserveEnv, "-u", serviceUser, npmBinPath, "install"}, cacheArgs...)
+		installCmd = exec.Command("sudo", append(args, installArgs...)...)
+	case "windows":
+		args := append([]string{"/C", npmBinPath, "install"}, cacheArgs...)
+		installCmd = exec.Command("cmd", append(args, installArgs...)...)
+	default:
+		return nil, fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+	}
+	installCmd.Env = append(append(os.Environ(), env...), newPath)
+	return installCmd, nil
+}
+
 // InstallDeviceAgent installs the FlowFuse Device Agent with the specified version
 // to the given base directory. It requires Node.js to be already installed.
 // The function will:
@@ -37,6 +103,12 @@ const preserveEnv = "--preserve-env=PATH,NODE_EXTRA_CA_CERTS"
 // - The installation process fails
 func InstallDeviceAgent(version, baseDir string, update bool) error {
 	setNodeDirectories(baseDir)
+	return installDeviceAgent(version, update)
+}
+
+// installDeviceAgent installs the Device Agent into the Node.js installation
+// selected with setNodeDirectories or setNodeDirectoriesAt.
+func installDeviceAgent(version string, update bool) error {
 	nodeBinDirPath := GetNodeBinDir()
 
 	if _, err := os.Stat(nodeBinPath); os.IsNotExist(err) {
@@ -66,19 +138,9 @@ func InstallDeviceAgent(version, baseDir string, update bool) error {
 	}
 
 	// Create install command
-	var installCmd *exec.Cmd
-	npmPrefix := fmt.Sprintf("npm_config_prefix=%s", nodeBaseDir)
-	switch runtime.GOOS {
-	case "linux", "darwin":
-		installCmd = exec.Command("sudo", preserveEnv, "-u", serviceUser, npmBinPath, "install", "-g", "--cache", filepath.Join(nodeBaseDir, ".npm-cache"), packageName)
-		env := os.Environ()
-		installCmd.Env = append(env, npmPrefix, newPath)
-	case "windows":
-		installCmd = exec.Command("cmd", "/C", npmBinPath, "install", "-g", packageName)
-		env := os.Environ()
-		installCmd.Env = append(env, npmPrefix, newPath)
-	default:
-		return fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+	installCmd, err := newNpmInstallCmd(serviceUser, newPath, []string{"-g", packageName}, fmt.Sprintf("npm_config_prefix=%s", nodeBaseDir))
+	if err != nil {
+		return err
 	}
 
 	logger.Info("%s", startMsg)
@@ -91,6 +153,22 @@ func InstallDeviceAgent(version, baseDir string, update bool) error {
 	return nil
 }
 
+// GetDeviceAgentPath returns the path of the flowfuse-device-agent executable
+// that npm installs next to the bundled Node.js binary.
+//
+// Parameters:
+//   - baseDir: The base directory where Node.js is installed
+//
+// Returns:
+//   - string: The path of the executable (flowfuse-device-agent.cmd on Windows)
+func GetDeviceAgentPath(baseDir string) string {
+	setNodeDirectories(baseDir)
+	if runtime.GOOS == "windows" {
+		return filepath.Join(GetNodeBinDir(), "flowfuse-device-agent.cmd")
+	}
+	return filepath.Join(GetNodeBinDir(), "flowfuse-device-agent")
+}
+
 // getDeviceAgentVersion retrieves version of cuirrently installed Device agent from installer config file.
 //
 // Returns:
@@ -138,13 +216,20 @@ func GetLatestDeviceAgentVersion(baseDir string) (string, error) {
 		return "", fmt.Errorf("failed to set PATH: %w", err)
 	}
 
+	cacheArgs, err := npmCacheArgs(serviceUser)
+	if err != nil {
+		return "", err
+	}
+
 	switch runtime.GOOS {
 	case "linux", "darwin":
-		viewCmd = exec.Command("sudo", preserveEnv, "-u", serviceUser, npmBinPath, "--cache", filepath.Join(nodeBaseDir, ".npm-cache"), "view", packageName, "version", "--no-update-notifier", "-silent")
+		args := append([]string{preserveEnv, "-u", serviceUser, npmBinPath}, cacheArgs...)
+		viewCmd = exec.Command("sudo", append(args, "view", packageName, "version", "--no-update-notifier", "-silent")...)
 		env := os.Environ()
 		viewCmd.Env = append(env, newPath)
 	case "windows":
-		viewCmd = exec.Command("powershell", "-Command", "&", fmt.Sprintf(`'%s'`, npmBinPath), "--cache", fmt.Sprintf(`'%s'`, filepath.Join(nodeBaseDir, ".npm-cache")), "view", packageName, "version", "--no-update-notifier", "-silent")
+		args := []string{"-Command", "&", fmt.Sprintf(`'%s'`, npmBinPath), "--cache", fmt.Sprintf(`'%s'`, cacheArgs[1])}
+		viewCmd = exec.Command("powershell", append(append(args, cacheArgs[2:]...), "view", packageName, "version", "--no-update-notifier", "-silent")...)
 		env := os.Environ()
 		viewCmd.Env = append(env, newPath)
 	default:
@@ -265,10 +350,11 @@ func UninstallDeviceAgent(baseDir string) error {
 }
 
 // ConfigureDeviceAgent handles the device agent configuration based on OTC availability.
-// It supports three modes:
+// It supports four modes:
 // 1. otc: Configures Device Agent using provided one time code (OTC) and URL
 // 2. manual: Without OTC, prompts for device configuration and saves as device.yml
 // 3. install-only: If neither OTC nor config is provided, it does not configure the Device Agent
+// 4. provisioning: Saves ProvisioningConfig as device.yml, the agent registers itself on start
 //
 // Parameters:
 //   - url: The URL of the FlowFuse platform to connect to
@@ -276,7 +362,7 @@ func UninstallDeviceAgent(baseDir string) error {
 //   - baseDir: The base directory where configuration files will be stored
 //
 // Returns:
-//   - installMode: The mode used ("otc", "manual", "install-only")
+//   - installMode: The mode used ("otc", "manual", "install-only", "provisioning")
 //   - autoStartService: Whether the service should be started automatically
 //   - error: Any error that occurred during configuration
 func ConfigureDeviceAgent(url, token, baseDir string, port int) (string, bool, error) {
@@ -293,6 +379,14 @@ func ConfigureDeviceAgent(url, token, baseDir string, port int) (string, bool, e
 		return "none", true, nil
 	}
 
+	if ProvisioningConfig != "" {
+		logger.Info("Writing provisioning configuration...")
+		if err := utils.SaveDeviceConfiguration(ProvisioningConfig, deviceConfigPath); err != nil {
+			return "", false, fmt.Errorf("failed to save provisioning configuration: %w", err)
+		}
+		return "provisioning", true, nil
+	}
+
 	// Check if node is installed
 	if _, err := os.Stat(nodeBinPath); os.IsNotExist(err) {
 		logger.Error("Node.js not found, please restart installator script")
@@ -316,6 +410,8 @@ func ConfigureDeviceAgent(url, token, baseDir string, port int) (string, bool, e
 	// Build the arguments shared across platforms first, adding the optional
 	// -o/-u flags only when a value is provided, then layer the OS-specific
 	// flags on top inside each case.
+	// The agent only accepts the one-time code as -o, so it is visible in the
+	// process list while this command runs; the logger redacts it.
 	agentArgs := []string{"--otc-no-start", "--installer-mode"}
 	if token != "" {
 		agentArgs = append(agentArgs, "-o", token)
@@ -361,7 +457,7 @@ func ConfigureDeviceAgent(url, token, baseDir string, port int) (string, bool, e
 	var chownCmd *exec.Cmd
 	switch runtime.GOOS {
 	case "linux":
-		chownCmd = exec.Command("sudo", "chown", "-R", serviceUser+":"+serviceUser, baseDir)
+		chownCmd = exec.Command("sudo", "chown", "-R", utils.ServiceOwner(), baseDir)
 	case "darwin":
 		chownCmd = exec.Command("sudo", "chown", "-R", serviceUser, baseDir)
 	case "windows":
@@ -0,0 +1,248 @@
+package nodejs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/download"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+)
+
+// AutoSelectVersion is set when the Node.js version was not chosen explicitly
+// with --nodejs-version, so an install may replace an incompatible default
+// with a compatible version.
+var AutoSelectVersion bool
+
+// defaultRegistryURL is the npm registry queried for package metadata when
+// no registry is configured.
+const defaultRegistryURL = "https://registry.npmjs.org"
+
+// Registry is the npm registry set with --npm-registry (default
+// $npm_config_registry). npm installs the Device Agent and the extra packages
+// from it, and their metadata is read from it; empty for the public registry.
+var Registry string
+
+// packageManifest is the subset of an npm registry version manifest used here.
+type packageManifest struct {
+	Version string `json:"version"`
+	Engines struct {
+		Node string `json:"node"`
+	} `json:"engines"`
+}
+
+// packageDocument is the subset of an npm registry package document (all
+// versions of a package) used here.
+type packageDocument struct {
+	DistTags map[string]string          `json:"dist-tags"`
+	Versions map[string]json.RawMessage `json:"versions"`
+}
+
+// CheckDeviceAgentCompatibility verifies that a Device Agent version supports
+// a Node.js version, according to the engines.node field of the package.
+//
+// When the versions are incompatible a compatible Node.js version is looked
+// up in the Node.js release index (preferring LTS releases). If autoSelect is
+// set that version is returned in place of nodeVersion; otherwise an error is
+// returned and the version is suggested to the user. Offline, the package.json
+// of the Device Agent tarball in the npm cache is used instead of the registry
+// metadata. When neither can be read the check is skipped.
+//
+// Parameters:
+//   - agentVersion: The Device Agent version to install ("latest" or x.y.z)
+//   - nodeVersion: The Node.js version the agent will run on
+//   - autoSelect: Whether an incompatible nodeVersion may be replaced
+//
+// Returns:
+//   - string: The Node.js version to use
+//   - error: An error if the versions are incompatible and no version was auto-selected
+func CheckDeviceAgentCompatibility(agentVersion, nodeVersion string, autoSelect bool) (string, error) {
+	logger.LogFunctionEntry("CheckDeviceAgentCompatibility", map[string]interface{}{
+		"agentVersion": agentVersion,
+		"nodeVersion":  nodeVersion,
+		"autoSelect":   autoSelect,
+	})
+
+	manifest, err := getDeviceAgentManifest(agentVersion)
+	if err != nil {
+		logger.Debug("Skipping Device Agent compatibility check: %v", err)
+		logger.LogFunctionExit("CheckDeviceAgentCompatibility", "skipped", nil)
+		return nodeVersion, nil
+	}
+	engines := strings.TrimSpace(manifest.Engines.Node)
+	if engines == "" {
+		logger.Debug("Device Agent %s does not declare a Node.js engine range", manifest.Version)
+		logger.LogFunctionExit("CheckDeviceAgentCompatibility", "no engines", nil)
+		return nodeVersion, nil
+	}
+
+	compatible, err := satisfiesNodeRange(nodeVersion, engines)
+	if err != nil {
+		logger.Debug("Skipping Device Agent compatibility check: %v", err)
+		logger.LogFunctionExit("CheckDeviceAgentCompatibility", "skipped", nil)
+		return nodeVersion, nil
+	}
+	if compatible {
+		logger.Debug("Device Agent %s supports Node.js %s (engines: %s)", manifest.Version, nodeVersion, engines)
+		logger.LogFunctionExit("CheckDeviceAgentCompatibility", "compatible", nil)
+		return nodeVersion, nil
+	}
+
+	suggested := findCompatibleNodeVersion(engines)
+	if suggested != "" && autoSelect {
+		logger.Info("Device Agent %s requires Node.js %s, using Node.js %s instead of %s", manifest.Version, engines, suggested, nodeVersion)
+		logger.LogFunctionExit("CheckDeviceAgentCompatibility", suggested, nil)
+		return suggested, nil
+	}
+
+	err = fmt.Errorf("device agent %s requires Node.js %s, which does not include Node.js %s", manifest.Version, engines, nodeVersion)
+	if suggested != "" {
+		logger.Error("Device Agent %s requires Node.js %s. Use --nodejs-version %s (or another compatible version).", manifest.Version, engines, suggested)
+	} else {
+		logger.Error("Device Agent %s requires Node.js %s. Choose a compatible version with --nodejs-version.", manifest.Version, engines)
+	}
+	logger.LogFunctionExit("CheckDeviceAgentCompatibility", nil, err)
+	return nodeVersion, err
+}
+
+// getDeviceAgentManifest fetches the registry manifest of a Device Agent
+// version from RegistryURL, or offline reads it from the npm cache.
+//
+// Parameters:
+//   - version: The Device Agent version or dist-tag (e.g. "latest")
+//
+// Returns:
+//   - *packageManifest: The version manifest
+//   - error: An error if the manifest could not be fetched or parsed
+func getDeviceAgentManifest(version string) (*packageManifest, error) {
+	if download.Offline {
+		return cachedDeviceAgentManifest(version)
+	}
+
+	manifestURL := fmt.Sprintf("%s/%s/%s", RegistryURL(), url.PathEscape(packageName), url.PathEscape(version))
+
+	body, err := fetchURL(download.NewHTTPClient(15*time.Second), manifestURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", manifestURL, err)
+	}
+	var manifest packageManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", manifestURL, err)
+	}
+	return &manifest, nil
+}
+
+// ResolveDeviceAgentVersion returns the highest published Device Agent
+// version that satisfies a semver range, or the version tagged "latest" when
+// the range is empty. Prereleases are never selected.
+//
+// Parameters:
+//   - rng: The semver range, e.g. "^3.6.1", or "" for the latest release
+//
+// Returns:
+//   - string: The selected version
+//   - error: An error if the registry cannot be queried or no version matches
+func ResolveDeviceAgentVersion(rng string) (string, error) {
+	logger.LogFunctionEntry("ResolveDeviceAgentVersion", map[string]interface{}{
+		"range": rng,
+	})
+	if download.Offline {
+		logger.LogFunctionExit("ResolveDeviceAgentVersion", nil, download.ErrOffline)
+		return "", download.ErrOffline
+	}
+
+	packageURL := fmt.Sprintf("%s/%s", RegistryURL(), url.PathEscape(packageName))
+	body, err := fetchURL(download.NewHTTPClient(15*time.Second), packageURL)
+	if err != nil {
+		err = fmt.Errorf("failed to fetch %s: %w", packageURL, err)
+		logger.LogFunctionExit("ResolveDeviceAgentVersion", nil, err)
+		return "", err
+	}
+	var document packageDocument
+	if err := json.Unmarshal(body, &document); err != nil {
+		err = fmt.Errorf("failed to parse %s: %w", packageURL, err)
+		logger.LogFunctionExit("ResolveDeviceAgentVersion", nil, err)
+		return "", err
+	}
+
+	if rng == "" {
+		latest := document.DistTags["latest"]
+		if latest == "" {
+			err := fmt.Errorf("%s has no latest release", packageName)
+			logger.LogFunctionExit("ResolveDeviceAgentVersion", nil, err)
+			return "", err
+		}
+		logger.LogFunctionExit("ResolveDeviceAgentVersion", latest, nil)
+		return latest, nil
+	}
+
+	best := ""
+	var bestVersion [3]int
+	for version := range document.Versions {
+		parsed, ok := parseNodeVersion(version)
+		if !ok || strings.Count(version, ".") != 2 {
+			continue
+		}
+		if matches, err := satisfiesNodeRange(version, rng); err != nil {
+			logger.LogFunctionExit("ResolveDeviceAgentVersion", nil, err)
+			return "", err
+		} else if matches && (best == "" || compareNodeVersions(parsed, bestVersion) > 0) {
+			best, bestVersion = version, parsed
+		}
+	}
+	if best == "" {
+		err := fmt.Errorf("no %s release matches %s", packageName, rng)
+		logger.LogFunctionExit("ResolveDeviceAgentVersion", nil, err)
+		return "", err
+	}
+	logger.LogFunctionExit("ResolveDeviceAgentVersion", best, nil)
+	return best, nil
+}
+
+// RegistryURL returns the npm registry to query for package metadata: the
+// registry npm installs from (see Registry).
+func RegistryURL() string {
+	registry := Registry
+	if registry == "" {
+		registry = defaultRegistryURL
+	}
+	return strings.TrimRight(registry, "/")
+}
+
+// findCompatibleNodeVersion returns the newest Node.js release satisfying
+// engines, preferring LTS releases, or an empty string if none is known.
+func findCompatibleNodeVersion(engines string) string {
+	var releases []distRelease
+	var indexURLs []string
+	for _, base := range DistBaseURLs() {
+		indexURLs = append(indexURLs, base+"/index.json")
+	}
+	if err := fetchReleaseMetadata(indexURLs, "node-index.json", &releases); err != nil {
+		logger.Debug("Cannot suggest a compatible Node.js version: %v", err)
+		return ""
+	}
+
+	var bestLTS, bestAny string
+	var bestLTSVersion, bestAnyVersion [3]int
+	for _, release := range releases {
+		v, ok := parseNodeVersion(release.Version)
+		if !ok {
+			continue
+		}
+		if ok, err := satisfiesNodeRange(release.Version, engines); err != nil || !ok {
+			continue
+		}
+		if compareNodeVersions(v, bestAnyVersion) > 0 {
+			bestAnyVersion, bestAny = v, strings.TrimPrefix(release.Version, "v")
+		}
+		if lts, isLTS := release.LTS.(string); isLTS && lts != "" && compareNodeVersions(v, bestLTSVersion) > 0 {
+			bestLTSVersion, bestLTS = v, strings.TrimPrefix(release.Version, "v")
+		}
+	}
+	if bestLTS != "" {
+		return bestLTS
+	}
+	return bestAny
+}
@@ -9,8 +9,11 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
 	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/download"
 	"github.com/flowfuse/device-agent-installer/pkg/logger"
 	"github.com/flowfuse/device-agent-installer/pkg/utils"
 )
@@ -18,6 +21,11 @@ import (
 // NodeDir is the directory where Node.js files will be stored
 const NodeDir = "node"
 
+// MirrorURL is an optional Node.js distribution mirror (the equivalent of
+// https://nodejs.org/dist) tried before the official sources. It is set from
+// the --nodejs-mirror flag or the NODEJS_ORG_MIRROR environment variable.
+var MirrorURL string
+
 var nodeBaseDir string
 var nodeBinPath string
 var npmBinPath string
@@ -65,7 +73,10 @@ func isNodeInstalled(versionStr, baseDir string) bool {
 		"versionStr": versionStr,
 	})
 
-	if output, err := getInstalledNodeVersion(baseDir); err != nil {
+	// installer.conf can outlive the runtime, e.g. after "--uninstall --keep-config"
+	if _, err := os.Stat(nodeBinPath); err != nil {
+		logger.Debug("Node.js binary %s not found: %v", nodeBinPath, err)
+	} else if output, err := getInstalledNodeVersion(baseDir); err != nil {
 		logger.Debug("Failed to get installed Node.js version: %v", err)
 	} else {
 		installedVersionStr := strings.TrimSpace(string(output))
@@ -94,7 +105,16 @@ func setNodeDirectories(basedir string) {
 		"basedir": basedir,
 	})
 	
-	nodeBaseDir = filepath.Join(basedir, NodeDir)
+	setNodeDirectoriesAt(filepath.Join(basedir, NodeDir))
+}
+
+// setNodeDirectoriesAt configures the Node.js and NPM executable paths for a
+// Node.js installation in nodeDir, e.g. a staged runtime (see StageRuntime).
+//
+// Parameters:
+//   - nodeDir: The directory Node.js is or will be installed in.
+func setNodeDirectoriesAt(nodeDir string) {
+	nodeBaseDir = nodeDir
 	if runtime.GOOS == "windows" {
 		nodeBinPath = filepath.Join(nodeBaseDir, "node.exe")
 		npmBinPath = filepath.Join(nodeBaseDir, "npm.cmd")
@@ -102,7 +122,7 @@ func setNodeDirectories(basedir string) {
 		nodeBinPath = filepath.Join(nodeBaseDir, "bin", "node")
 		npmBinPath = filepath.Join(nodeBaseDir, "bin", "npm")
 	}
-	logger.LogFunctionExit("setNodeDirectories", map[string]interface{}{
+	logger.LogFunctionExit("setNodeDirectoriesAt", map[string]interface{}{
 		"node.js base dir": nodeBaseDir,
 		"Node.js path": nodeBinPath,
 		"NPM path": npmBinPath,
@@ -193,16 +213,124 @@ func installNodeJs(version string, update bool) error {
 		}
 	}
 
-	downloadURL, err := getNodeDownloadURL(version)
+	archivePath, err := getNodeArchive(version)
 	if err != nil {
 		return err
 	}
 
-	return downloadAndExtractNode(downloadURL, version)
+	return extractNode(archivePath, version)
+}
+
+// getNodeArchive returns the path to a verified Node.js archive for version,
+// drawing from the shared artifact cache when possible.
+//
+// The archive checksum is read from the release's SHASUMS256.txt and used as
+// the cache key: on a hit no download happens at all. On a miss the archive is
+// downloaded (verified against that checksum) and added to the cache. When the
+// checksum cannot be fetched (offline mode or no network), the most recent
+// intact cached archive with the expected file name is used; an archive that
+// cannot be verified is never downloaded.
+//
+// Parameters:
+//   - version: The Node.js version (without the 'v' prefix)
+//
+// Returns:
+//   - string: The path to the archive (inside the cache, or a temp file if caching failed)
+//   - error: An error if the archive is neither cached nor downloadable with its checksum
+func getNodeArchive(version string) (string, error) {
+	fileName, err := getNodeArchiveName(version)
+	if err != nil {
+		return "", err
+	}
+
+	sum, sumErr := getNodeArchiveChecksum(version, fileName)
+	if sumErr != nil {
+		logger.Debug("Could not determine checksum for %s: %v", fileName, sumErr)
+		if path, ok := cache.FindByName(fileName); ok {
+			logger.Info("Using cached Node.js %s archive", version)
+			return path, nil
+		}
+		if download.Offline {
+			return "", fmt.Errorf("node.js %s (%s) is not in the local cache %s and --offline is set", version, fileName, cache.Root())
+		}
+		return "", fmt.Errorf("cannot verify the Node.js %s download, its checksum is not available: %w", version, sumErr)
+	} else if path, ok := cache.Lookup(sum); ok {
+		logger.Info("Using cached Node.js %s archive", version)
+		return path, nil
+	}
+
+	downloadURLs, err := getNodeDownloadURLs(version)
+	if err != nil {
+		return "", err
+	}
+
+	downloadDir, err := cache.DownloadDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to create download directory: %w", err)
+	}
+
+	archivePath := filepath.Join(downloadDir, fileName)
+	if err := download.File(downloadURLs, archivePath, download.Options{Label: fmt.Sprintf("Node.js %s", version), SHA256: sum}); err != nil {
+		return "", fmt.Errorf("failed to download Node.js: %w", err)
+	}
+
+	cachedPath, err := cache.Store(archivePath, sum, downloadURLs[0])
+	if err != nil {
+		logger.Debug("Could not add %s to the cache: %v", fileName, err)
+		return archivePath, nil
+	}
+	_ = os.Remove(archivePath)
+	return cachedPath, nil
+}
+
+// getNodeArchiveChecksum fetches SHASUMS256.txt for version from the
+// distribution sources and returns the checksum listed for fileName.
+//
+// Parameters:
+//   - version: The Node.js version (without the 'v' prefix)
+//   - fileName: The archive file name to look up
+//
+// Returns:
+//   - string: The hex-encoded SHA-256 checksum
+//   - error: An error if no source could provide the checksum
+func getNodeArchiveChecksum(version, fileName string) (string, error) {
+	if download.Offline {
+		return "", download.ErrOffline
+	}
+	client := download.NewHTTPClient(30 * time.Second)
+	var lastErr error
+	for _, base := range DistBaseURLs() {
+		url := fmt.Sprintf("%s/v%s/SHASUMS256.txt", base, version)
+		resp, err := client.Get(url)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("%s: unexpected response status: %s", url, resp.Status)
+			continue
+		}
+		for _, line := range strings.Split(string(body), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[1] == fileName {
+				return fields[0], nil
+			}
+		}
+		lastErr = fmt.Errorf("%s does not list %s", url, fileName)
+	}
+	return "", lastErr
 }
 
-// getNodeDownloadURL constructs the download URL for NodeJS based on the specified version
-// and the current system's architecture and operating system.
+// getNodeDownloadURLs constructs the candidate download URLs for NodeJS based on the
+// specified version and the current system's architecture and operating system.
+// The URLs point at the same archive on different sources, in priority order:
+// the configured mirror (if any) first, then the official distribution sites.
 //
 // The function supports the following architectures:
 // - amd64 (mapped to x64)
@@ -210,16 +338,51 @@ func installNodeJs(version string, update bool) error {
 // - arm64
 // - arm (mapped to armv7l)
 //
-// Currently, only the Linux operating system is supported.
-//
 // Parameters:
 //   - version: The NodeJS version string (without the 'v' prefix)
 //
 // Returns:
-//   - A string containing the complete URL to download the appropriate NodeJS tarball
+//   - A slice of URLs to download the appropriate NodeJS archive from
 //   - An error if the current architecture or operating system is unsupported
-func getNodeDownloadURL(version string) (string, error) {
-	var baseUrl string
+func getNodeDownloadURLs(version string) ([]string, error) {
+	fileName, err := getNodeArchiveName(version)
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, base := range DistBaseURLs() {
+		urls = append(urls, fmt.Sprintf("%s/v%s/%s", base, version, fileName))
+	}
+	return urls, nil
+}
+
+// DistBaseURLs returns the distribution roots (the directories holding
+// the v<version>/ folders and index.json) in priority order. Alpine uses the
+// unofficial musl builds, which are not available from the official sites.
+func DistBaseURLs() []string {
+	var bases []string
+	if MirrorURL != "" {
+		bases = append(bases, strings.TrimRight(MirrorURL, "/"))
+	}
+	if utils.UseOfficialNodejs() {
+		bases = append(bases, "https://nodejs.org/dist", "https://nodejs.org/download/release")
+	} else {
+		bases = append(bases, "https://unofficial-builds.nodejs.org/download/release")
+	}
+	return bases
+}
+
+// getNodeArchiveName returns the file name of the Node.js archive for the
+// current platform, e.g. "node-v22.23.0-linux-x64.tar.gz".
+//
+// Parameters:
+//   - version: The NodeJS version string (without the 'v' prefix)
+//
+// Returns:
+//   - string: The archive file name
+//   - error: An error if the current architecture or operating system is unsupported
+func getNodeArchiveName(version string) (string, error) {
 	var arch string
 	switch runtime.GOARCH {
 	case "amd64":
@@ -234,78 +397,41 @@ func getNodeDownloadURL(version string) (string, error) {
 		return "", fmt.Errorf("unsupported architecture: %s", runtime.GOARCH)
 	}
 
-	if utils.UseOfficialNodejs() {
-		baseUrl = fmt.Sprintf("https://nodejs.org/dist/v%s", version)
-	} else {
-		baseUrl = fmt.Sprintf("https://unofficial-builds.nodejs.org/download/release/v%s", version)
-	}
-
 	switch runtime.GOOS {
 	case "linux":
 		if utils.IsAlpine() {
 			arch += "-musl"
 		}
-		return fmt.Sprintf("%s/node-v%s-linux-%s.tar.gz", baseUrl, version, arch), nil
+		return fmt.Sprintf("node-v%s-linux-%s.tar.gz", version, arch), nil
 	case "windows":
-		return fmt.Sprintf("%s/node-v%s-win-%s.zip", baseUrl, version, arch), nil
+		return fmt.Sprintf("node-v%s-win-%s.zip", version, arch), nil
 	case "darwin":
-		return fmt.Sprintf("%s/node-v%s-darwin-%s.tar.gz", baseUrl, version, arch), nil
+		return fmt.Sprintf("node-v%s-darwin-%s.tar.gz", version, arch), nil
 	default:
 		return "", fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
 	}
 }
 
-// downloadAndExtractNode downloads Node.js from the specified URL and extracts it to the
-// appropriate location on the filesystem.
-//
-// It creates a temporary file, downloads the Node.js archive from the provided URL,
-// and extracts it based on the archive format (currently only supports .tar.gz).
+// extractNode extracts the Node.js archive at archivePath to the appropriate
+// location on the filesystem, based on the archive format.
 // On Linux systems, it also sets appropriate ownership and permissions for the
 // Node.js executable files and directories.
 //
 // Parameters:
-//   - url: The URL to download Node.js archive from
+//   - archivePath: The path to the Node.js archive
 //   - version: The version of Node.js being installed (used for extraction)
 //
 // Returns:
-//   - error: An error if any step of the download, extraction or permission setting fails
-func downloadAndExtractNode(url, version string) error {
-	logger.Debug("Downloading Node.js from %s", url)
-
-	// Create a temporary file for the download
-	tempFile, err := os.CreateTemp("", "nodejs-download")
-	if err != nil {
-		return fmt.Errorf("failed to create temporary file: %w", err)
-	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
-
-	// Download the file
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("failed to download Node.js: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download Node.js: HTTP status %d", resp.StatusCode)
-	}
-
-	_, err = io.Copy(tempFile, resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to save Node.js download: %w", err)
-	}
-
-	// Close the file before extraction
-	tempFile.Close()
-
+//   - error: An error if any step of the extraction or permission setting fails
+func extractNode(archivePath, version string) error {
 	logger.Debug("Extracting Node.js...")
 
 	// Extract based on file type
-	if strings.HasSuffix(url, ".tar.gz") {
-		err = utils.ExtractTarGz(tempFile.Name(), nodeBaseDir, version)
-	} else if strings.HasSuffix(url, ".zip") {
-		err = utils.ExtractZip(tempFile.Name(), nodeBaseDir, version)
+	var err error
+	if strings.HasSuffix(archivePath, ".tar.gz") {
+		err = utils.ExtractTarGz(archivePath, nodeBaseDir, version)
+	} else if strings.HasSuffix(archivePath, ".zip") {
+		err = utils.ExtractZip(archivePath, nodeBaseDir, version)
 	} else {
 		err = fmt.Errorf("unsupported archive format")
 	}
@@ -374,6 +500,48 @@ func IsNodeUpdateRequired(nodeVersion, workDir string) (bool, error) {
 	return true, nil
 }
 
+// GetRuntimeVersions reports the versions of the bundled Node.js and npm as
+// reported by the binaries themselves, which may differ from installer.conf
+// after a failed update.
+//
+// Parameters:
+//   - baseDir: The base directory where Node.js is installed
+//
+// Returns:
+//   - string: The Node.js version (e.g. "v22.23.0")
+//   - string: The npm version, empty if it could not be determined
+//   - error: An error if the bundled Node.js is missing or cannot be run
+func GetRuntimeVersions(baseDir string) (string, string, error) {
+	setNodeDirectories(baseDir)
+	if _, err := os.Stat(nodeBinPath); err != nil {
+		return "", "", fmt.Errorf("node.js not found in %s: %w", nodeBaseDir, err)
+	}
+
+	output, err := exec.Command(nodeBinPath, "--version").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to run %s: %w", nodeBinPath, err)
+	}
+	nodeVersion := strings.TrimSpace(string(output))
+
+	newPath, err := utils.SetEnvPath(GetNodeBinDir())
+	if err != nil {
+		return nodeVersion, "", nil
+	}
+	var npmCmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		npmCmd = exec.Command("cmd", "/C", npmBinPath, "--version")
+	} else {
+		npmCmd = exec.Command(npmBinPath, "--version")
+	}
+	npmCmd.Env = append(os.Environ(), newPath)
+	output, err = npmCmd.Output()
+	if err != nil {
+		logger.Debug("Failed to run %s: %v", npmBinPath, err)
+		return nodeVersion, "", nil
+	}
+	return nodeVersion, strings.TrimSpace(string(output)), nil
+}
+
 // UpdateNodeJs updates the Node.js installation to the specified version.
 //
 // Parameters:
@@ -407,3 +575,48 @@ func UpdateNodeJs(nodeVersion, workDir string) error {
 	logger.Info("Node.js successfully updated to version %s", nodeVersion)
 	return nil
 }
+
+// RestoreNodeJs reinstalls a previously used Node.js version after a failed
+// update. The archive is normally taken from the shared artifact cache, so the
+// rollback works even when the failure was caused by the network.
+//
+// Parameters:
+//   - nodeVersion: The Node.js version to restore
+//   - workDir: The working directory where Node.js should be installed
+//
+// Returns:
+//   - error: An error object if the restore fails, nil otherwise
+func RestoreNodeJs(nodeVersion, workDir string) error {
+	logger.Info("Rolling back to Node.js %s...", nodeVersion)
+	if err := ReinstallNodeJs(nodeVersion, workDir); err != nil {
+		return fmt.Errorf("failed to restore Node.js %s: %w", nodeVersion, err)
+	}
+
+	logger.Info("Node.js %s restored", nodeVersion)
+	return nil
+}
+
+// ReinstallNodeJs removes whatever is left of the bundled Node.js and installs
+// the given version again, e.g. after a partial installation or update.
+// Globally installed npm packages, including the Device Agent, are removed
+// with it and must be reinstalled.
+//
+// Parameters:
+//   - nodeVersion: The Node.js version to install
+//   - workDir: The working directory where Node.js should be installed
+//
+// Returns:
+//   - error: An error object if the installation fails, nil otherwise
+func ReinstallNodeJs(nodeVersion, workDir string) error {
+	setNodeDirectories(workDir)
+
+	if _, err := os.Stat(nodeBaseDir); err == nil {
+		if err := utils.RemoveDirectory(nodeBaseDir); err != nil {
+			return fmt.Errorf("failed to remove partial Node.js installation: %w", err)
+		}
+	}
+
+	// Not EnsureNodeJs: it trusts the version recorded in installer.conf,
+	// which still names the version being reinstalled
+	return installNodeJs(nodeVersion, false)
+}
@@ -0,0 +1,162 @@
+package nodejs
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+)
+
+// npmCacheEntry is the subset of an entry of npm's cache index used here.
+type npmCacheEntry struct {
+	Key       string `json:"key"`
+	Integrity string `json:"integrity"`
+}
+
+// cachedDeviceAgentManifest reads the package.json of a Device Agent tarball
+// in the npm cache of the service user, which an offline install installs
+// from. For "latest" or another dist-tag the newest cached version is read.
+//
+// Parameters:
+//   - version: The Device Agent version or dist-tag (e.g. "latest")
+//
+// Returns:
+//   - *packageManifest: The package.json of the cached tarball
+//   - error: An error if no matching tarball is cached or it cannot be read
+func cachedDeviceAgentManifest(version string) (*packageManifest, error) {
+	cacheDir := filepath.Join(cache.Root(), "npm", utils.ServiceUsername, "_cacache")
+	tarballs, err := cachedTarballs(cacheDir, packageName)
+	if err != nil {
+		return nil, err
+	}
+
+	integrity, found := tarballs[version]
+	if !found {
+		if _, exact := parseNodeVersion(version); exact && strings.Count(version, ".") == 2 {
+			return nil, fmt.Errorf("%s@%s is not in the npm cache", packageName, version)
+		}
+		var newest [3]int
+		for cached, sum := range tarballs {
+			if parsed, ok := parseNodeVersion(cached); ok && (integrity == "" || compareNodeVersions(parsed, newest) > 0) {
+				integrity, newest = sum, parsed
+			}
+		}
+		if integrity == "" {
+			return nil, fmt.Errorf("%s is not in the npm cache", packageName)
+		}
+	}
+
+	contentPath, err := cacheContentPath(cacheDir, integrity)
+	if err != nil {
+		return nil, err
+	}
+	return readTarballManifest(contentPath)
+}
+
+// cachedTarballs lists the tarballs of a package in an npm cache directory
+// (npm's "_cacache"), mapping each version to the integrity of its content.
+func cachedTarballs(cacheDir, name string) (map[string]string, error) {
+	// Tarball URLs end in "<name>/-/<name without scope>-<version>.tgz"
+	marker := name + "/-/" + path.Base(name) + "-"
+	tarballs := map[string]string{}
+	err := filepath.WalkDir(filepath.Join(cacheDir, "index-v5"), func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		// Each line is "<hash>\t<entry>"; later lines replace earlier ones
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			_, data, ok := strings.Cut(scanner.Text(), "\t")
+			if !ok {
+				continue
+			}
+			var entry npmCacheEntry
+			if json.Unmarshal([]byte(data), &entry) != nil {
+				continue
+			}
+			idx := strings.LastIndex(entry.Key, marker)
+			if idx < 0 || !strings.HasSuffix(entry.Key, ".tgz") {
+				continue
+			}
+			version := strings.TrimSuffix(entry.Key[idx+len(marker):], ".tgz")
+			if entry.Integrity == "" {
+				delete(tarballs, version)
+			} else {
+				tarballs[version] = entry.Integrity
+			}
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the npm cache %s: %w", cacheDir, err)
+	}
+	return tarballs, nil
+}
+
+// cacheContentPath returns where npm keeps the content with the given
+// subresource integrity ("sha512-<base64>") in an npm cache directory.
+func cacheContentPath(cacheDir, integrity string) (string, error) {
+	for _, sri := range strings.Fields(integrity) {
+		algorithm, digest, ok := strings.Cut(sri, "-")
+		if !ok {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(digest)
+		if err != nil || len(sum) < 3 {
+			continue
+		}
+		hexSum := hex.EncodeToString(sum)
+		return filepath.Join(cacheDir, "content-v2", algorithm, hexSum[:2], hexSum[2:4], hexSum[4:]), nil
+	}
+	return "", fmt.Errorf("invalid integrity %q in the npm cache", integrity)
+}
+
+// readTarballManifest reads package/package.json from an npm package tarball.
+func readTarballManifest(tarballPath string) (*packageManifest, error) {
+	file, err := os.Open(tarballPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", tarballPath, err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", tarballPath, err)
+	}
+	defer gz.Close()
+
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s has no package.json", tarballPath)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", tarballPath, err)
+		}
+		if header.Name != "package/package.json" {
+			continue
+		}
+		var manifest packageManifest
+		if err := json.NewDecoder(archive).Decode(&manifest); err != nil {
+			return nil, fmt.Errorf("failed to parse package.json in %s: %w", tarballPath, err)
+		}
+		return &manifest, nil
+	}
+}
@@ -0,0 +1,122 @@
+package nodejs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flowfuse/device-agent-installer/pkg/cache"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+)
+
+// cacheTarball adds a Device Agent tarball with the given engines.node range
+// to the npm cache below cacheDir, the way npm stores it, and returns the
+// index line that records it.
+func cacheTarball(t *testing.T, cacheDir, version, engines string) string {
+	t.Helper()
+	manifest, err := json.Marshal(map[string]interface{}{
+		"name":    packageName,
+		"version": version,
+		"engines": map[string]string{"node": engines},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	for name, data := range map[string][]byte{"package/README.md": []byte("# Device Agent"), "package/package.json": manifest} {
+		if err := archive.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		archive.Write(data)
+	}
+	archive.Close()
+	gz.Close()
+
+	sum := sha512.Sum512(buf.Bytes())
+	hexSum := fmt.Sprintf("%x", sum)
+	content := filepath.Join(cacheDir, "content-v2", "sha512", hexSum[:2], hexSum[2:4], hexSum[4:])
+	if err := os.MkdirAll(filepath.Dir(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(content, buf.Bytes(), 0444); err != nil {
+		t.Fatal(err)
+	}
+	return indexLine(t, version, "sha512-"+base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// indexLine returns an npm cache index line for the tarball of version.
+func indexLine(t *testing.T, version, integrity string) string {
+	t.Helper()
+	entry := map[string]interface{}{
+		"key":       fmt.Sprintf("make-fetch-happen:request-cache:https://registry.npmjs.org/%s/-/device-agent-%s.tgz", packageName, version),
+		"integrity": nil,
+	}
+	if integrity != "" {
+		entry["integrity"] = integrity
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "0123456789abcdef\t" + string(data)
+}
+
+func TestCachedDeviceAgentManifest(t *testing.T) {
+	previousDir, previousUser := cache.Dir, utils.ServiceUsername
+	t.Cleanup(func() { cache.Dir, utils.ServiceUsername = previousDir, previousUser })
+	cache.Dir = t.TempDir()
+	utils.ServiceUsername = "flowfuse"
+	cacheDir := filepath.Join(cache.Dir, "npm", "flowfuse", "_cacache")
+
+	if _, err := cachedDeviceAgentManifest("latest"); err == nil {
+		t.Error("cachedDeviceAgentManifest without an npm cache succeeded")
+	}
+
+	lines := []string{
+		cacheTarball(t, cacheDir, "3.5.0", ">=18"),
+		cacheTarball(t, cacheDir, "3.6.1", ">=20"),
+		// Removed from the cache after it was added
+		cacheTarball(t, cacheDir, "3.7.0", ">=22"),
+		indexLine(t, "3.7.0", ""),
+		"not an index line",
+	}
+	bucket := filepath.Join(cacheDir, "index-v5", "ab", "cd", "bucket")
+	if err := os.MkdirAll(filepath.Dir(bucket), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bucket, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		version, want, engines string
+	}{
+		{"3.5.0", "3.5.0", ">=18"},
+		{"3.6.1", "3.6.1", ">=20"},
+		{"latest", "3.6.1", ">=20"},
+		{"3.7.0", "", ""},
+		{"3.4.0", "", ""},
+	}
+	for _, tt := range tests {
+		manifest, err := cachedDeviceAgentManifest(tt.version)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("cachedDeviceAgentManifest(%q) = %+v, want an error", tt.version, manifest)
+			}
+			continue
+		}
+		if err != nil || manifest.Version != tt.want || manifest.Engines.Node != tt.engines {
+			t.Errorf("cachedDeviceAgentManifest(%q) = %+v, %v, want %s with engines %s", tt.version, manifest, err, tt.want, tt.engines)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package nodejs
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+)
+
+// ExtraPackages are the extra npm packages requested with --npm-package and
+// --node-red-node.
+var ExtraPackages []config.NpmPackage
+
+// NodeREDUserDir is the Node-RED user directory of the Device Agent,
+// relative to the working directory.
+const NodeREDUserDir = "project"
+
+// NodeREDNodesDir is the npm prefix the Node-RED nodes of --node-red-node are
+// installed into, relative to the working directory. The Device Agent owns
+// the Node-RED user directory: it rewrites its package.json for each
+// snapshot, prunes what is not listed there and removes it on a clean stop.
+// Node-RED loads the nodes of this directory through NODE_PATH instead.
+const NodeREDNodesDir = "node-red-nodes"
+
+// ParsePackageSpec parses a pinned package spec such as "node-red-contrib-foo@1.2.3"
+// or "@scope/name@1.0.0". An exact version is required so every device gets the
+// same package.
+//
+// Parameters:
+//   - spec: The package spec in name@version form
+//   - target: config.PackageTargetGlobal or config.PackageTargetNodeRED
+//
+// Returns:
+//   - config.NpmPackage: The parsed package
+//   - error: An error if the spec has no exact version
+func ParsePackageSpec(spec, target string) (config.NpmPackage, error) {
+	spec = strings.TrimSpace(spec)
+	at := strings.LastIndex(spec, "@")
+	if at <= 0 {
+		return config.NpmPackage{}, fmt.Errorf("package %q must be pinned as name@version", spec)
+	}
+	pkg := config.NpmPackage{
+		Name:    spec[:at],
+		Version: strings.TrimPrefix(spec[at+1:], "v"),
+		Target:  target,
+	}
+	if _, parts, err := parsePartialVersion(pkg.Version); err != nil || parts != 3 {
+		return config.NpmPackage{}, fmt.Errorf("package %q must be pinned to an exact version (x.y.z)", spec)
+	}
+	return pkg, nil
+}
+
+// MergePackages combines the packages saved in the installer configuration
+// with newly requested ones. A requested package replaces a saved package of
+// the same name and target, so re-running with a new version re-pins it.
+//
+// Parameters:
+//   - saved: The packages recorded in installer.conf
+//   - requested: The packages given on the command line
+//
+// Returns:
+//   - []config.NpmPackage: The combined list, in first-seen order
+func MergePackages(saved, requested []config.NpmPackage) []config.NpmPackage {
+	merged := append([]config.NpmPackage{}, saved...)
+	for _, pkg := range requested {
+		replaced := false
+		for i := range merged {
+			if merged[i].Name == pkg.Name && merged[i].Target == pkg.Target {
+				merged[i] = pkg
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, pkg)
+		}
+	}
+	return merged
+}
+
+// InstallExtraPackages installs extra npm packages next to the Device Agent,
+// running npm as the service user with the shared npm cache, like the agent
+// install. Global packages go into the bundled Node.js prefix; Node-RED nodes
+// go into NodeREDNodesDir, which is created if needed.
+// Installing an already present version is a no-op for npm, so this is also
+// used to reconcile the packages after an update.
+//
+// Parameters:
+//   - packages: The packages to install
+//   - baseDir: The working directory of the installation
+//
+// Returns:
+//   - error: An error if Node.js is missing or an npm install fails
+func InstallExtraPackages(packages []config.NpmPackage, baseDir string) error {
+	logger.LogFunctionEntry("InstallExtraPackages", map[string]interface{}{
+		"packages": packages,
+		"baseDir":  baseDir,
+	})
+
+	if len(packages) == 0 {
+		logger.LogFunctionExit("InstallExtraPackages", "nothing to install", nil)
+		return nil
+	}
+
+	setNodeDirectories(baseDir)
+	err := installExtraPackages(packages, baseDir)
+	logger.LogFunctionExit("InstallExtraPackages", nil, err)
+	return err
+}
+
+// installExtraPackages installs extra npm packages with the Node.js
+// installation selected with setNodeDirectories or setNodeDirectoriesAt.
+func installExtraPackages(packages []config.NpmPackage, baseDir string) error {
+	if _, err := os.Stat(nodeBinPath); os.IsNotExist(err) {
+		return fmt.Errorf("node.js not found, please restart installator script")
+	}
+
+	serviceUser := utils.ServiceUsername
+	newPath, err := utils.SetEnvPath(GetNodeBinDir())
+	if err != nil {
+		logger.Error("Failed to set PATH: %v", err)
+		return fmt.Errorf("failed to set PATH: %w", err)
+	}
+
+	var globalSpecs, nodeREDSpecs []string
+	for _, pkg := range packages {
+		switch pkg.Target {
+		case config.PackageTargetNodeRED:
+			nodeREDSpecs = append(nodeREDSpecs, pkg.Spec())
+		default:
+			globalSpecs = append(globalSpecs, pkg.Spec())
+		}
+	}
+
+	if len(globalSpecs) > 0 {
+		logger.Info("Installing npm packages: %s...", strings.Join(globalSpecs, ", "))
+		installCmd, err := newNpmInstallCmd(serviceUser, newPath, append([]string{"-g"}, globalSpecs...), fmt.Sprintf("npm_config_prefix=%s", nodeBaseDir))
+		if err != nil {
+			return err
+		}
+		logger.Debug("Install command: %s", installCmd.String())
+		if output, err := installCmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to install npm packages: %w\nOutput: %s", err, output)
+		}
+	}
+
+	if len(nodeREDSpecs) > 0 {
+		nodesDir := filepath.Join(baseDir, NodeREDNodesDir)
+		if err := ensureServiceUserDir(nodesDir, serviceUser); err != nil {
+			return err
+		}
+
+		logger.Info("Installing Node-RED nodes: %s...", strings.Join(nodeREDSpecs, ", "))
+		installCmd, err := newNpmInstallCmd(serviceUser, newPath, append([]string{"--prefix", nodesDir, "--save-exact"}, nodeREDSpecs...))
+		if err != nil {
+			return err
+		}
+		installCmd.Dir = nodesDir
+		logger.Debug("Install command: %s", installCmd.String())
+		if output, err := installCmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to install Node-RED nodes: %w\nOutput: %s", err, output)
+		}
+	}
+
+	logger.Info("Extra packages installed successfully!")
+	return nil
+}
+
+// ensureServiceUserDir creates dir if needed and, on Linux and macOS, makes it
+// owned by the service user so npm running as that user can write to it.
+func ensureServiceUserDir(dir, serviceUser string) error {
+	if runtime.GOOS == "windows" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+		return nil
+	}
+
+	mkdirCmd := exec.Command("sudo", "mkdir", "-p", dir)
+	if output, err := mkdirCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create %s: %w\nOutput: %s", dir, err, output)
+	}
+	chownCmd := exec.Command("sudo", "chown", serviceUser, dir)
+	if output, err := chownCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set ownership of %s: %w\nOutput: %s", dir, err, output)
+	}
+	return nil
+}
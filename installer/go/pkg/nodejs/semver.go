@@ -0,0 +1,265 @@
+package nodejs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseNodeVersion parses a Node.js version such as "v22.23.0" or "22.23".
+func parseNodeVersion(version string) ([3]int, bool) {
+	var parsed [3]int
+	parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(version), "v"), ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return parsed, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
+
+// compareNodeVersions returns -1, 0 or 1 when a is lower than, equal to or
+// higher than b.
+func compareNodeVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionBound is a single primitive comparison such as ">=18.0.0".
+type versionBound struct {
+	op      string
+	version [3]int
+}
+
+// satisfiesNodeRange reports whether version satisfies an npm semver range as
+// used in a package's engines.node field, e.g. ">=18.0.0", "^18.18.0 || >=20"
+// or "18 - 22". Node.js releases have no prerelease tags, so a prerelease in
+// the range only moves its bound: ">=20.0.0-0" includes 20.0.0 and
+// "<=20.0.0-rc.1" excludes it.
+//
+// Parameters:
+//   - version: The Node.js version (e.g. "22.23.0", with or without 'v')
+//   - rng: The semver range
+//
+// Returns:
+//   - bool: true if the version is in the range
+//   - error: An error if the version or range cannot be parsed
+func satisfiesNodeRange(version, rng string) (bool, error) {
+	v, ok := parseNodeVersion(version)
+	if !ok {
+		return false, fmt.Errorf("invalid Node.js version: %s", version)
+	}
+	for _, set := range strings.Split(rng, "||") {
+		bounds, err := parseRangeSet(set)
+		if err != nil {
+			return false, fmt.Errorf("invalid version range %q: %w", rng, err)
+		}
+		matched := true
+		for _, bound := range bounds {
+			if !bound.matches(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matches reports whether v passes the comparison.
+func (b versionBound) matches(v [3]int) bool {
+	c := compareNodeVersions(v, b.version)
+	switch b.op {
+	case ">=":
+		return c >= 0
+	case ">":
+		return c > 0
+	case "<=":
+		return c <= 0
+	case "<":
+		return c < 0
+	}
+	return c == 0
+}
+
+// parseRangeSet converts one "||"-separated part of a range into the
+// primitive bounds that must all hold.
+func parseRangeSet(set string) ([]versionBound, error) {
+	fields := strings.Fields(set)
+
+	// Hyphen range: "a - b"
+	if len(fields) == 3 && fields[1] == "-" {
+		lowVersion, _ := splitPrerelease(fields[0])
+		low, lowParts, err := parsePartialVersion(lowVersion)
+		if err != nil {
+			return nil, err
+		}
+		highVersion, highPrerelease := splitPrerelease(fields[2])
+		high, highParts, err := parsePartialVersion(highVersion)
+		if err != nil {
+			return nil, err
+		}
+		bounds := []versionBound{{">=", low}}
+		if lowParts == 0 {
+			bounds = nil
+		}
+		switch {
+		case highParts == 0:
+		case highParts < 3:
+			bounds = append(bounds, versionBound{"<", bumpVersion(high, highParts-1)})
+		case highPrerelease:
+			bounds = append(bounds, versionBound{"<", high})
+		default:
+			bounds = append(bounds, versionBound{"<=", high})
+		}
+		return bounds, nil
+	}
+
+	// Join operators separated from their version by whitespace (">= 18").
+	var comparators []string
+	for i := 0; i < len(fields); i++ {
+		if strings.Trim(fields[i], "<>=^~") == "" && i+1 < len(fields) {
+			comparators = append(comparators, fields[i]+fields[i+1])
+			i++
+			continue
+		}
+		comparators = append(comparators, fields[i])
+	}
+
+	var bounds []versionBound
+	for _, comparator := range comparators {
+		parsed, err := parseComparator(comparator)
+		if err != nil {
+			return nil, err
+		}
+		bounds = append(bounds, parsed...)
+	}
+	return bounds, nil
+}
+
+// parseComparator converts a single comparator (">=18", "^20.9", "22.x") into
+// primitive bounds.
+func parseComparator(comparator string) ([]versionBound, error) {
+	op := strings.TrimRight(comparator[:len(comparator)-len(strings.TrimLeft(comparator, "<>=^~"))], " ")
+	version, prerelease := splitPrerelease(comparator[len(op):])
+	v, parts, err := parsePartialVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	if prerelease {
+		if parts != 3 {
+			return nil, fmt.Errorf("invalid version %q", comparator[len(op):])
+		}
+		// The release follows its prereleases, so it is above the bound
+		switch op {
+		case "", "=":
+			return []versionBound{{"<", [3]int{0, 0, 0}}}, nil
+		case ">":
+			op = ">="
+		case "<=":
+			op = "<"
+		}
+	}
+	if parts == 0 {
+		// "*", "x" or an empty set matches everything, as does ">=*".
+		if op == "<" || op == ">" {
+			return []versionBound{{"<", [3]int{0, 0, 0}}}, nil
+		}
+		return nil, nil
+	}
+
+	switch op {
+	case "", "=":
+		if parts == 3 {
+			return []versionBound{{"=", v}}, nil
+		}
+		return []versionBound{{">=", v}, {"<", bumpVersion(v, parts-1)}}, nil
+	case ">=":
+		return []versionBound{{">=", v}}, nil
+	case ">":
+		if parts == 3 {
+			return []versionBound{{">", v}}, nil
+		}
+		return []versionBound{{">=", bumpVersion(v, parts-1)}}, nil
+	case "<":
+		return []versionBound{{"<", v}}, nil
+	case "<=":
+		if parts == 3 {
+			return []versionBound{{"<=", v}}, nil
+		}
+		return []versionBound{{"<", bumpVersion(v, parts-1)}}, nil
+	case "~", "~>":
+		if parts == 1 {
+			return []versionBound{{">=", v}, {"<", bumpVersion(v, 0)}}, nil
+		}
+		return []versionBound{{">=", v}, {"<", bumpVersion(v, 1)}}, nil
+	case "^":
+		// Bump the first non-zero part (or the last given part if all are zero).
+		idx := parts - 1
+		for i := 0; i < parts; i++ {
+			if v[i] != 0 {
+				idx = i
+				break
+			}
+		}
+		return []versionBound{{">=", v}, {"<", bumpVersion(v, idx)}}, nil
+	}
+	return nil, fmt.Errorf("unsupported operator %q", op)
+}
+
+// parsePartialVersion parses a possibly partial version ("18", "18.x",
+// "20.9.0"), returning the version padded with zeros and the number of parts
+// that were given.
+func parsePartialVersion(s string) ([3]int, int, error) {
+	var v [3]int
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if s == "" {
+		return v, 0, nil
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, 0, fmt.Errorf("invalid version %q", s)
+	}
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			return v, i, nil
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, 0, fmt.Errorf("invalid version %q", s)
+		}
+		v[i] = n
+	}
+	return v, len(parts), nil
+}
+
+// splitPrerelease removes build metadata ("+build") and a prerelease tag
+// ("-rc.1") from a version, reporting whether it had a prerelease tag.
+func splitPrerelease(version string) (string, bool) {
+	version, _, _ = strings.Cut(version, "+")
+	version, prerelease, found := strings.Cut(version, "-")
+	return version, found && prerelease != ""
+}
+
+// bumpVersion increments part idx of v and zeroes the parts after it.
+func bumpVersion(v [3]int, idx int) [3]int {
+	v[idx]++
+	for i := idx + 1; i < 3; i++ {
+		v[i] = 0
+	}
+	return v
+}
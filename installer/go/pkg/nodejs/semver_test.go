@@ -0,0 +1,71 @@
+package nodejs
+
+import "testing"
+
+func TestSatisfiesNodeRange(t *testing.T) {
+	tests := []struct {
+		name, rng string
+		in, out   []string
+	}{
+		{"exact", "20.9.0", []string{"20.9.0", "v20.9.0"}, []string{"20.9.1", "20.8.9"}},
+		{"caret", "^18.18.0", []string{"18.18.0", "18.20.4"}, []string{"18.17.9", "19.0.0"}},
+		{"caret major", "^18", []string{"18.0.0", "18.99.0"}, []string{"17.9.0", "19.0.0"}},
+		{"caret zero major", "^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0", "0.2.2"}},
+		{"caret zero minor", "^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"tilde", "~20.9.1", []string{"20.9.1", "20.9.7"}, []string{"20.9.0", "20.10.0"}},
+		{"tilde minor", "~20.9", []string{"20.9.0", "20.9.7"}, []string{"20.10.0", "20.8.0"}},
+		{"tilde major", "~20", []string{"20.0.0", "20.10.0"}, []string{"21.0.0", "19.9.9"}},
+		{"x-range", "20.x", []string{"20.0.0", "20.19.1"}, []string{"19.9.9", "21.0.0"}},
+		{"x-range minor", "20.9.x", []string{"20.9.0", "20.9.5"}, []string{"20.10.0"}},
+		{"partial", "22", []string{"22.0.0", "22.23.0"}, []string{"21.9.9", "23.0.0"}},
+		{"star", "*", []string{"0.0.0", "24.1.0"}, nil},
+		{"empty", "", []string{"0.0.0", "24.1.0"}, nil},
+		{"greater than x", ">20.x", []string{"21.0.0"}, []string{"20.99.0"}},
+		{"less equal x", "<=20.x", []string{"20.99.0"}, []string{"21.0.0"}},
+		{"or", "^18.18.0 || >=20", []string{"18.18.0", "20.0.0", "24.1.0"}, []string{"18.17.0", "19.9.0"}},
+		{"or of exact", "16.20.2 || 18.20.4", []string{"16.20.2", "18.20.4"}, []string{"17.0.0"}},
+		{"hyphen", "18 - 22", []string{"18.0.0", "22.99.0"}, []string{"17.9.9", "23.0.0"}},
+		{"hyphen full", "18.17.0 - 20.9.0", []string{"18.17.0", "20.9.0"}, []string{"18.16.9", "20.9.1"}},
+		{"hyphen minor", "18.17 - 20.9", []string{"18.17.0", "20.9.9"}, []string{"18.16.0", "20.10.0"}},
+		{"bounded", ">=18.0.0 <22.0.0", []string{"18.0.0", "21.99.99"}, []string{"17.9.9", "22.0.0"}},
+		{"bounded spaced", ">= 18 < 22", []string{"18.0.0", "21.0.0"}, []string{"17.0.0", "22.0.0"}},
+		{"bounded inclusive", ">18.0.0 <=20.9.0", []string{"18.0.1", "20.9.0"}, []string{"18.0.0", "20.9.1"}},
+		{"prerelease lower bound", ">=20.0.0-0", []string{"20.0.0", "20.1.0"}, []string{"19.9.9"}},
+		{"prerelease upper bound", "<22.0.0-0", []string{"21.99.0"}, []string{"22.0.0"}},
+		{"prerelease less equal", "<=20.0.0-rc.1", []string{"19.9.9"}, []string{"20.0.0"}},
+		{"prerelease greater", ">20.0.0-rc.1", []string{"20.0.0"}, []string{"19.9.9"}},
+		{"prerelease exact", "20.0.0-rc.1", nil, []string{"20.0.0", "19.9.9"}},
+		{"prerelease caret", "^20.0.0-beta", []string{"20.0.0", "20.5.0"}, []string{"21.0.0"}},
+		{"prerelease hyphen", "18.0.0-0 - 22.0.0-0", []string{"18.0.0", "21.9.9"}, []string{"22.0.0"}},
+		{"build metadata", "<=20.9.0+build.1", []string{"20.9.0"}, []string{"20.9.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, version := range tt.in {
+				if ok, err := satisfiesNodeRange(version, tt.rng); err != nil || !ok {
+					t.Errorf("satisfiesNodeRange(%q, %q) = %v, %v, want true", version, tt.rng, ok, err)
+				}
+			}
+			for _, version := range tt.out {
+				if ok, err := satisfiesNodeRange(version, tt.rng); err != nil || ok {
+					t.Errorf("satisfiesNodeRange(%q, %q) = %v, %v, want false", version, tt.rng, ok, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSatisfiesNodeRangeErrors(t *testing.T) {
+	tests := []struct{ version, rng string }{
+		{"latest", ">=18"},
+		{"20.0.0", ">=eighteen"},
+		{"20.0.0", "!=18"},
+		{"20.0.0", "1.2.3.4"},
+		{"20.0.0", ">=20.x-rc.1"},
+	}
+	for _, tt := range tests {
+		if _, err := satisfiesNodeRange(tt.version, tt.rng); err == nil {
+			t.Errorf("satisfiesNodeRange(%q, %q) succeeded, want an error", tt.version, tt.rng)
+		}
+	}
+}
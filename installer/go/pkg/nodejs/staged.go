@@ -0,0 +1,285 @@
+package nodejs
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/flowfuse/device-agent-installer/pkg/config"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+)
+
+// StagedNodeDir is the directory next to NodeDir a staged runtime is
+// prepared in (see StageRuntime).
+const StagedNodeDir = "node.staged"
+
+// PreviousNodeDir holds the replaced runtime while a staged runtime is
+// switched to, so that it can be restored.
+const PreviousNodeDir = "node.previous"
+
+// StageRuntime prepares a complete runtime (Node.js, the Device Agent and the
+// extra packages) in StagedNodeDir, next to the runtime the service uses, so
+// that it can be switched to later with only a service restart. The Node.js
+// archive and the npm packages are taken from the artifact cache when present.
+// A previously staged runtime is replaced.
+//
+// Node-RED nodes are installed into a copy of NodeREDNodesDir inside the
+// staged runtime, so the nodes the running agent loads are not changed;
+// SwitchToStagedRuntime moves the copy into place.
+//
+// Parameters:
+//   - nodeVersion: The Node.js version to stage
+//   - agentVersion: The Device Agent version to stage (x.y.z)
+//   - workDir: The working directory of the installation
+//   - packages: The extra packages to install
+//
+// Returns:
+//   - error: An error if any part of the runtime cannot be installed; the
+//     partially staged runtime is removed
+func StageRuntime(nodeVersion, agentVersion, workDir string, packages []config.NpmPackage) error {
+	logger.LogFunctionEntry("StageRuntime", map[string]interface{}{
+		"nodeVersion":  nodeVersion,
+		"agentVersion": agentVersion,
+		"workDir":      workDir,
+		"packages":     packages,
+	})
+	// Later calls use the runtime of the service again
+	defer setNodeDirectories(workDir)
+
+	if err := DiscardStagedRuntime(workDir); err != nil {
+		logger.LogFunctionExit("StageRuntime", nil, err)
+		return err
+	}
+
+	stagedDir := filepath.Join(workDir, StagedNodeDir)
+	setNodeDirectoriesAt(stagedDir)
+	err := installNodeJs(nodeVersion, false)
+	if err == nil {
+		err = installDeviceAgent(agentVersion, false)
+	}
+	if err == nil && len(packages) > 0 {
+		err = stageNodeREDNodesDir(workDir, stagedDir, packages)
+		if err == nil {
+			// Node-RED nodes go into the NodeREDNodesDir copy in stagedDir
+			err = installExtraPackages(packages, stagedDir)
+		}
+	}
+	if err != nil {
+		if rmErr := utils.RemoveDirectory(stagedDir); rmErr != nil {
+			logger.Debug("Failed to remove the partially staged runtime: %v", rmErr)
+		}
+		logger.LogFunctionExit("StageRuntime", nil, err)
+		return err
+	}
+
+	logger.LogFunctionExit("StageRuntime", "success", nil)
+	return nil
+}
+
+// IsRuntimeStaged reports whether a staged runtime is waiting to be switched to.
+//
+// Parameters:
+//   - workDir: The working directory of the installation
+//
+// Returns:
+//   - bool: true if StagedNodeDir exists
+func IsRuntimeStaged(workDir string) bool {
+	info, err := os.Stat(filepath.Join(workDir, StagedNodeDir))
+	return err == nil && info.IsDir()
+}
+
+// SwitchToStagedRuntime makes the staged runtime the runtime of the service,
+// keeping the replaced one in PreviousNodeDir. The service must be stopped.
+// Only directories are renamed, so the switch takes no noticeable time.
+//
+// Parameters:
+//   - workDir: The working directory of the installation
+//
+// Returns:
+//   - error: An error if the directories cannot be renamed; the runtime of the
+//     service is then left in place
+func SwitchToStagedRuntime(workDir string) error {
+	logger.LogFunctionEntry("SwitchToStagedRuntime", map[string]interface{}{
+		"workDir": workDir,
+	})
+
+	current := filepath.Join(workDir, NodeDir)
+	staged := filepath.Join(workDir, StagedNodeDir)
+	previous := filepath.Join(workDir, PreviousNodeDir)
+
+	if _, err := os.Stat(previous); err == nil {
+		if err := utils.RemoveDirectory(previous); err != nil {
+			logger.LogFunctionExit("SwitchToStagedRuntime", nil, err)
+			return err
+		}
+	}
+	if err := renameDirectory(current, previous); err != nil {
+		logger.LogFunctionExit("SwitchToStagedRuntime", nil, err)
+		return err
+	}
+	if err := renameDirectory(staged, current); err != nil {
+		if rbErr := renameDirectory(previous, current); rbErr != nil {
+			logger.Error("Failed to move the previous runtime back: %v", rbErr)
+		}
+		logger.LogFunctionExit("SwitchToStagedRuntime", nil, err)
+		return err
+	}
+
+	// Move the staged Node-RED nodes into place, keeping the replaced ones
+	// with the previous runtime
+	stagedNodesDir := filepath.Join(current, NodeREDNodesDir)
+	if _, err := os.Stat(stagedNodesDir); err == nil {
+		if err := swapNodeREDNodesDir(workDir, stagedNodesDir, filepath.Join(previous, NodeREDNodesDir)); err != nil {
+			logger.LogFunctionExit("SwitchToStagedRuntime", nil, err)
+			return err
+		}
+	}
+
+	logger.LogFunctionExit("SwitchToStagedRuntime", "success", nil)
+	return nil
+}
+
+// RestorePreviousRuntime undoes SwitchToStagedRuntime, e.g. when the service
+// does not start with the new runtime. The new runtime is removed.
+//
+// Parameters:
+//   - workDir: The working directory of the installation
+//
+// Returns:
+//   - error: An error if the previous runtime cannot be moved back
+func RestorePreviousRuntime(workDir string) error {
+	logger.LogFunctionEntry("RestorePreviousRuntime", map[string]interface{}{
+		"workDir": workDir,
+	})
+
+	current := filepath.Join(workDir, NodeDir)
+	previous := filepath.Join(workDir, PreviousNodeDir)
+	if _, err := os.Stat(previous); err != nil {
+		err = fmt.Errorf("the previous runtime is missing: %w", err)
+		logger.LogFunctionExit("RestorePreviousRuntime", nil, err)
+		return err
+	}
+	previousNodesDir := filepath.Join(previous, NodeREDNodesDir)
+	if _, err := os.Stat(previousNodesDir); err == nil {
+		if err := swapNodeREDNodesDir(workDir, previousNodesDir, ""); err != nil {
+			logger.LogFunctionExit("RestorePreviousRuntime", nil, err)
+			return err
+		}
+	}
+	if err := utils.RemoveDirectory(current); err != nil {
+		logger.LogFunctionExit("RestorePreviousRuntime", nil, err)
+		return err
+	}
+	err := renameDirectory(previous, current)
+	logger.LogFunctionExit("RestorePreviousRuntime", nil, err)
+	return err
+}
+
+// RemovePreviousRuntime removes the runtime kept by SwitchToStagedRuntime.
+//
+// Parameters:
+//   - workDir: The working directory of the installation
+//
+// Returns:
+//   - error: An error if the directory cannot be removed
+func RemovePreviousRuntime(workDir string) error {
+	previous := filepath.Join(workDir, PreviousNodeDir)
+	if _, err := os.Stat(previous); os.IsNotExist(err) {
+		return nil
+	}
+	return utils.RemoveDirectory(previous)
+}
+
+// DiscardStagedRuntime removes a staged runtime, if there is one.
+//
+// Parameters:
+//   - workDir: The working directory of the installation
+//
+// Returns:
+//   - error: An error if the directory cannot be removed
+func DiscardStagedRuntime(workDir string) error {
+	if !IsRuntimeStaged(workDir) {
+		return nil
+	}
+	logger.Debug("Removing the staged runtime...")
+	return utils.RemoveDirectory(filepath.Join(workDir, StagedNodeDir))
+}
+
+// nodeREDPackageFiles are the files of NodeREDNodesDir that record the
+// installed Node-RED nodes.
+var nodeREDPackageFiles = []string{"package.json", "package-lock.json"}
+
+// stageNodeREDNodesDir prepares the copy of NodeREDNodesDir in stagedDir that
+// the Node-RED nodes of packages are installed into, starting from the package
+// files of the directory in use so that the nodes installed there are kept.
+func stageNodeREDNodesDir(workDir, stagedDir string, packages []config.NpmPackage) error {
+	staged := false
+	for _, pkg := range packages {
+		staged = staged || pkg.Target == config.PackageTargetNodeRED
+	}
+	if !staged {
+		return nil
+	}
+
+	stagedNodesDir := filepath.Join(stagedDir, NodeREDNodesDir)
+	if err := ensureServiceUserDir(stagedNodesDir, utils.ServiceUsername); err != nil {
+		return err
+	}
+	for _, name := range nodeREDPackageFiles {
+		src := filepath.Join(workDir, NodeREDNodesDir, name)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		dst := filepath.Join(stagedNodesDir, name)
+		switch runtime.GOOS {
+		case "linux", "darwin":
+			if output, err := exec.Command("sudo", "cp", "-p", src, dst).CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to copy %s: %w\nOutput: %s", src, err, output)
+			}
+		default:
+			data, err := os.ReadFile(src)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", src, err)
+			}
+			if err := os.WriteFile(dst, data, 0644); err != nil {
+				return fmt.Errorf("failed to write %s: %w", dst, err)
+			}
+		}
+	}
+	return nil
+}
+
+// swapNodeREDNodesDir replaces NodeREDNodesDir with fromDir. The replaced
+// directory is moved to keepDir, or removed if keepDir is empty.
+func swapNodeREDNodesDir(workDir, fromDir, keepDir string) error {
+	nodesDir := filepath.Join(workDir, NodeREDNodesDir)
+	if _, err := os.Stat(nodesDir); err == nil {
+		if keepDir != "" {
+			if err := renameDirectory(nodesDir, keepDir); err != nil {
+				return err
+			}
+		} else if err := utils.RemoveDirectory(nodesDir); err != nil {
+			return err
+		}
+	}
+	return renameDirectory(fromDir, nodesDir)
+}
+
+// renameDirectory renames a directory of the installation, with sudo on
+// Linux and macOS where the working directory belongs to the service user.
+func renameDirectory(from, to string) error {
+	switch runtime.GOOS {
+	case "linux", "darwin":
+		if output, err := exec.Command("sudo", "mv", from, to).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to move %s to %s: %w\nOutput: %s", from, to, err, output)
+		}
+	default:
+		if err := os.Rename(from, to); err != nil {
+			return fmt.Errorf("failed to move %s to %s: %w", from, to, err)
+		}
+	}
+	return nil
+}
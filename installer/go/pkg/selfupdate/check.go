@@ -0,0 +1,142 @@
+package selfupdate
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/download"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/style"
+)
+
+// CheckInterval is how long the result of a check for a newer release is
+// reused before the release metadata is fetched again.
+const CheckInterval = 24 * time.Hour
+
+// noticeWait is the longest the notice waits for a check that is still
+// running. Only runs that are due for a check (at most once per
+// CheckInterval) can be delayed, and by no more than this.
+const noticeWait = 2 * time.Second
+
+// checkState is the result of the last check, kept in the user's cache
+// directory so that most runs need no network request at all.
+type checkState struct {
+	Checked       time.Time `json:"checked"`
+	LatestVersion string    `json:"latestVersion"`
+	// ManifestURL is the override the check was made with, so a result from
+	// a test server is not reused for the public releases and vice versa
+	ManifestURL string `json:"manifestURL,omitempty"`
+}
+
+// StartCheck looks for a newer installer release in the background and
+// returns a function that prints a notice if one is known. The notice waits
+// at most noticeWait for a check that has not finished yet and otherwise
+// falls back to the result of the previous check; a failed check is ignored.
+//
+// Nothing is checked when CheckDisabled or download.Offline is set, or when
+// the running installer is a development build.
+//
+// Parameters:
+//   - currentVersion: The version of the running installer
+//
+// Returns:
+//   - func(): Prints the notice; safe to call when no check was started
+func StartCheck(currentVersion string) func() {
+	if CheckDisabled || download.Offline || !IsRelease(currentVersion) {
+		logger.Debug("Skipping the check for a newer installer release")
+		return func() {}
+	}
+
+	state := loadCheckState()
+	if state == nil || state.ManifestURL != ManifestURL {
+		state = &checkState{ManifestURL: ManifestURL}
+	}
+	known := state.LatestVersion
+
+	var result chan string
+	if time.Since(state.Checked) > CheckInterval {
+		result = make(chan string, 1)
+		go func() {
+			defer close(result)
+			// A failed check is recorded too, so that a host without access
+			// to the releases is not delayed on every run
+			state.Checked = time.Now()
+			latest, err := LatestVersion()
+			if err != nil {
+				logger.Debug("Could not check for a newer installer release: %v", err)
+				saveCheckState(state)
+				return
+			}
+			state.LatestVersion = latest
+			saveCheckState(state)
+			result <- latest
+		}()
+	}
+
+	return func() {
+		latest := known
+		if result != nil {
+			select {
+			case fresh, ok := <-result:
+				if ok {
+					latest = fresh
+				}
+			case <-time.After(noticeWait):
+				logger.Debug("The check for a newer installer release did not finish in time")
+			}
+		}
+		if IsNewer(latest, currentVersion) {
+			logger.Info("")
+			logger.Info("%s installer %s is available (this is %s), update with --self-update", style.Yellow("Notice:"), latest, currentVersion)
+		}
+	}
+}
+
+// checkStatePath returns where the result of the last check is kept.
+func checkStatePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "flowfuse-device-installer", "update-check.json"), nil
+}
+
+// loadCheckState returns the result of the last check, or nil if there is none.
+func loadCheckState() *checkState {
+	path, err := checkStatePath()
+	if err != nil {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var state checkState
+	if err := json.Unmarshal(data, &state); err != nil {
+		logger.Debug("Ignoring invalid %s: %v", path, err)
+		return nil
+	}
+	return &state
+}
+
+// saveCheckState records the result of a check. Failures are logged only.
+func saveCheckState(state *checkState) {
+	path, err := checkStatePath()
+	if err != nil {
+		logger.Debug("Could not record the update check: %v", err)
+		return
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		logger.Debug("Could not record the update check: %v", err)
+		return
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		logger.Debug("Could not record the update check: %v", err)
+	}
+}
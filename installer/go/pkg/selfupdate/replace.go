@@ -0,0 +1,165 @@
+package selfupdate
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/flowfuse/device-agent-installer/pkg/download"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+)
+
+// oldSuffix marks the previous executable on Windows, where a running
+// executable can be renamed but not replaced or removed.
+const oldSuffix = ".old"
+
+// Apply downloads the installer binary of the running platform from a
+// verified manifest and atomically replaces the running executable with it.
+// The binary is written next to the executable, checked against the checksum
+// in the manifest and only then renamed over the executable, so an
+// interrupted or corrupted download never leaves a broken installer behind.
+//
+// Parameters:
+//   - manifest: The verified release manifest (see FetchManifest)
+//   - manifestURL: The URL the manifest was downloaded from
+//
+// Returns:
+//   - string: The path of the replaced executable
+//   - error: An error if the download, verification or replacement fails
+func Apply(manifest *Manifest, manifestURL string) (string, error) {
+	logger.LogFunctionEntry("selfupdate.Apply", map[string]interface{}{
+		"version":     manifest.Version,
+		"manifestURL": manifestURL,
+	})
+
+	artifact, artifactURL, err := ArtifactURL(manifest, manifestURL)
+	if err != nil {
+		logger.LogFunctionExit("selfupdate.Apply", nil, err)
+		return "", err
+	}
+	exePath, err := executablePath()
+	if err != nil {
+		logger.LogFunctionExit("selfupdate.Apply", nil, err)
+		return "", err
+	}
+
+	opts := download.DefaultOptions()
+	opts.Label = "Installer " + manifest.Version
+	opts.SHA256 = artifact.SHA256
+
+	// Stage the new binary in the same directory so the final rename is atomic
+	dir := filepath.Dir(exePath)
+	staged := filepath.Join(dir, "."+filepath.Base(exePath)+".new")
+	if runtime.GOOS == "windows" || isWritable(dir) {
+		if err := download.File([]string{artifactURL}, staged, opts); err != nil {
+			os.Remove(staged + ".part")
+			logger.LogFunctionExit("selfupdate.Apply", nil, err)
+			return "", fmt.Errorf("failed to download installer %s: %w", manifest.Version, err)
+		}
+		err = replace(exePath, staged)
+		logger.LogFunctionExit("selfupdate.Apply", exePath, err)
+		return exePath, err
+	}
+
+	// The executable's directory is not writable (e.g. /usr/local/bin), so
+	// download to a temporary directory and move the binary into place with sudo
+	logger.Debug("%s is not writable, replacing the installer with sudo", dir)
+	tempDir, err := os.MkdirTemp("", "flowfuse-installer-update")
+	if err != nil {
+		logger.LogFunctionExit("selfupdate.Apply", nil, err)
+		return "", fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+	downloaded := filepath.Join(tempDir, filepath.Base(exePath))
+	if err := download.File([]string{artifactURL}, downloaded, opts); err != nil {
+		logger.LogFunctionExit("selfupdate.Apply", nil, err)
+		return "", fmt.Errorf("failed to download installer %s: %w", manifest.Version, err)
+	}
+	for _, args := range [][]string{
+		{"cp", downloaded, staged},
+		{"chmod", "755", staged},
+		{"mv", "-f", staged, exePath},
+	} {
+		if output, err := exec.Command("sudo", args...).CombinedOutput(); err != nil {
+			exec.Command("sudo", "rm", "-f", staged).Run()
+			err = fmt.Errorf("failed to replace %s: %w\nOutput: %s", exePath, err, output)
+			logger.LogFunctionExit("selfupdate.Apply", nil, err)
+			return "", err
+		}
+	}
+
+	logger.LogFunctionExit("selfupdate.Apply", exePath, nil)
+	return exePath, nil
+}
+
+// RemoveOldExecutable removes the executable left behind by a previous
+// self-update on Windows. Failures are logged only.
+func RemoveOldExecutable() {
+	if runtime.GOOS != "windows" {
+		return
+	}
+	exePath, err := executablePath()
+	if err != nil {
+		return
+	}
+	if err := os.Remove(exePath + oldSuffix); err != nil && !os.IsNotExist(err) {
+		logger.Debug("Could not remove the previous installer executable: %v", err)
+	}
+}
+
+// executablePath returns the resolved path of the running executable.
+func executablePath() (string, error) {
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate the installer executable: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(exePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to locate the installer executable: %w", err)
+	}
+	return resolved, nil
+}
+
+// replace renames the verified binary staged over exePath. On Windows the
+// running executable is first moved aside, and restored if the new binary
+// cannot be moved into place.
+func replace(exePath, staged string) error {
+	if err := os.Chmod(staged, 0755); err != nil {
+		os.Remove(staged)
+		return fmt.Errorf("failed to make %s executable: %w", staged, err)
+	}
+
+	if runtime.GOOS == "windows" {
+		old := exePath + oldSuffix
+		os.Remove(old)
+		if err := os.Rename(exePath, old); err != nil {
+			os.Remove(staged)
+			return fmt.Errorf("failed to move %s aside: %w", exePath, err)
+		}
+		if err := os.Rename(staged, exePath); err != nil {
+			os.Rename(old, exePath)
+			os.Remove(staged)
+			return fmt.Errorf("failed to replace %s: %w", exePath, err)
+		}
+		return nil
+	}
+
+	if err := os.Rename(staged, exePath); err != nil {
+		os.Remove(staged)
+		return fmt.Errorf("failed to replace %s: %w", exePath, err)
+	}
+	return nil
+}
+
+// isWritable reports whether the current user can create files in dir.
+func isWritable(dir string) bool {
+	probe, err := os.CreateTemp(dir, ".flowfuse-installer-*")
+	if err != nil {
+		return false
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return true
+}
@@ -0,0 +1,329 @@
+// Package selfupdate checks for and installs newer releases of the installer
+// itself.
+//
+// Every installer release (tag installer-v<version>) publishes a manifest,
+// installer-manifest.json, listing the binary and SHA-256 checksum of each
+// platform, and a detached Ed25519 signature of the manifest,
+// installer-manifest.json.sig (base64). --self-update only installs a binary
+// whose checksum is listed in a manifest signed with the release key embedded
+// at build time.
+//
+// Manifest:
+//
+//	{
+//	  "version": "1.7.0",
+//	  "artifacts": {
+//	    "linux-amd64": {"name": "flowfuse-device-installer-linux-amd64", "sha256": "..."}
+//	  }
+//	}
+//
+// Artifact names are resolved relative to the manifest URL.
+package selfupdate
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/download"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+)
+
+// ManifestURL overrides the release manifest location (--installer-manifest-url,
+// FLOWFUSE_INSTALLER_MANIFEST_URL), e.g. to test against a local server.
+// When empty, the manifest of the latest installer-v* GitHub release is used.
+var ManifestURL string
+
+// PublicKey is the base64-encoded (PKIX DER) Ed25519 key release manifests are
+// signed with. It is set at build time:
+//
+//	go build -ldflags "-X github.com/flowfuse/device-agent-installer/pkg/selfupdate.PublicKey=<key>"
+//
+// Builds without a key cannot self-update.
+var PublicKey string
+
+// CheckDisabled turns off the background check for a newer release
+// (--no-update-check, FLOWFUSE_INSTALLER_NO_UPDATE_CHECK).
+var CheckDisabled bool
+
+const (
+	// releasesURL lists the releases of the repository the installer is released from
+	releasesURL = "https://api.github.com/repos/FlowFuse/device-agent/releases?per_page=100"
+	// releaseDownloadURL is the download location of a release asset
+	releaseDownloadURL = "https://github.com/FlowFuse/device-agent/releases/download/%s/%s"
+	// releasesPage is shown to operators who have to update manually
+	releasesPage = "https://github.com/FlowFuse/device-agent/releases"
+	// tagPrefix marks installer releases among the repository's releases
+	tagPrefix = "installer-v"
+	// manifestName is the release asset holding the manifest
+	manifestName = "installer-manifest.json"
+	// signatureSuffix is appended to the manifest URL for its signature
+	signatureSuffix = ".sig"
+	// requestTimeout bounds each metadata request
+	requestTimeout = 15 * time.Second
+)
+
+// Artifact is the installer binary of one platform.
+type Artifact struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest describes an installer release.
+type Manifest struct {
+	Version string `json:"version"`
+	// Artifacts are keyed by "<GOOS>-<GOARCH>", e.g. "linux-arm64"
+	Artifacts map[string]Artifact `json:"artifacts"`
+}
+
+// githubRelease is the part of a GitHub release the installer uses.
+type githubRelease struct {
+	TagName    string `json:"tag_name"`
+	Draft      bool   `json:"draft"`
+	Prerelease bool   `json:"prerelease"`
+}
+
+// Platform returns the manifest key of the running platform.
+func Platform() string {
+	return runtime.GOOS + "-" + runtime.GOARCH
+}
+
+// ReleasesPage returns the web page listing the installer releases.
+func ReleasesPage() string {
+	return releasesPage
+}
+
+// LatestVersion returns the version of the latest installer release without
+// verifying the manifest signature. It is meant for the update notice only.
+//
+// Returns:
+//   - string: The latest version, e.g. "1.7.0"
+//   - error: An error if the release metadata cannot be fetched
+func LatestVersion() (string, error) {
+	if download.Offline {
+		return "", download.ErrOffline
+	}
+	client := download.NewHTTPClient(requestTimeout)
+	if ManifestURL == "" {
+		tag, err := latestTag(client)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimPrefix(tag, tagPrefix), nil
+	}
+	manifest, _, err := fetchManifest(client, ManifestURL)
+	if err != nil {
+		return "", err
+	}
+	return manifest.Version, nil
+}
+
+// FetchManifest downloads the manifest of the latest installer release and
+// verifies its signature.
+//
+// Returns:
+//   - *Manifest: The verified manifest
+//   - string: The manifest URL, which artifact names are relative to
+//   - error: An error if the manifest cannot be fetched, is not signed with
+//     the release key, or this build has no release key
+func FetchManifest() (*Manifest, string, error) {
+	if download.Offline {
+		return nil, "", download.ErrOffline
+	}
+	key, err := publicKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	client := download.NewHTTPClient(requestTimeout)
+	manifestURL := ManifestURL
+	if manifestURL == "" {
+		tag, err := latestTag(client)
+		if err != nil {
+			return nil, "", err
+		}
+		manifestURL = fmt.Sprintf(releaseDownloadURL, tag, manifestName)
+	}
+
+	manifest, data, err := fetchManifest(client, manifestURL)
+	if err != nil {
+		return nil, "", err
+	}
+	encoded, err := get(client, manifestURL+signatureSuffix)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to download the manifest signature: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, "", fmt.Errorf("the manifest signature is not valid base64: %w", err)
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return nil, "", fmt.Errorf("the signature of %s does not match the installer release key", manifestURL)
+	}
+	logger.Debug("Verified the signature of %s", manifestURL)
+	return manifest, manifestURL, nil
+}
+
+// ArtifactURL returns the download URL of the artifact of the running platform.
+//
+// Parameters:
+//   - manifest: The release manifest
+//   - manifestURL: The URL the manifest was downloaded from
+//
+// Returns:
+//   - Artifact: The artifact of the running platform
+//   - string: Its download URL
+//   - error: An error if the release has no binary for the running platform
+func ArtifactURL(manifest *Manifest, manifestURL string) (Artifact, string, error) {
+	artifact, ok := manifest.Artifacts[Platform()]
+	if !ok || artifact.Name == "" || artifact.SHA256 == "" {
+		return Artifact{}, "", fmt.Errorf("installer %s has no binary for %s", manifest.Version, Platform())
+	}
+	base, err := url.Parse(manifestURL)
+	if err != nil {
+		return Artifact{}, "", fmt.Errorf("invalid manifest URL %s: %w", manifestURL, err)
+	}
+	ref, err := url.Parse(artifact.Name)
+	if err != nil {
+		return Artifact{}, "", fmt.Errorf("invalid artifact name %s: %w", artifact.Name, err)
+	}
+	return artifact, base.ResolveReference(ref).String(), nil
+}
+
+// IsNewer reports whether version is a newer release than current. A current
+// version that is not a release version (e.g. a development build) is
+// considered older than any release.
+//
+// Parameters:
+//   - version: The candidate version, e.g. "1.7.0"
+//   - current: The running version
+//
+// Returns:
+//   - bool: true if version is newer than current
+func IsNewer(version, current string) bool {
+	v, ok := parseVersion(version)
+	if !ok {
+		return false
+	}
+	c, ok := parseVersion(current)
+	if !ok {
+		return true
+	}
+	for i := range v {
+		if v[i] != c[i] {
+			return v[i] > c[i]
+		}
+	}
+	return false
+}
+
+// IsRelease reports whether version is a release version (e.g. "1.7.0")
+// rather than a development build.
+func IsRelease(version string) bool {
+	_, ok := parseVersion(version)
+	return ok
+}
+
+// parseVersion parses "major.minor.patch", with an optional "v" prefix.
+// Pre-release versions are not releases and are rejected.
+func parseVersion(version string) ([3]int, bool) {
+	var v [3]int
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+// publicKey decodes the embedded release key.
+func publicKey() (ed25519.PublicKey, error) {
+	if PublicKey == "" {
+		return nil, fmt.Errorf("this installer build has no release signing key and cannot update itself, download the latest installer from %s", releasesPage)
+	}
+	der, err := base64.StdEncoding.DecodeString(PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid release signing key: %w", err)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid release signing key: %w", err)
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the release signing key is not an Ed25519 key")
+	}
+	return key, nil
+}
+
+// latestTag returns the tag of the newest published installer release.
+func latestTag(client *http.Client) (string, error) {
+	data, err := get(client, releasesURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to list installer releases: %w", err)
+	}
+	var releases []githubRelease
+	if err := json.Unmarshal(data, &releases); err != nil {
+		return "", fmt.Errorf("failed to parse the release list: %w", err)
+	}
+	latest := ""
+	for _, release := range releases {
+		if release.Draft || release.Prerelease || !strings.HasPrefix(release.TagName, tagPrefix) {
+			continue
+		}
+		version := strings.TrimPrefix(release.TagName, tagPrefix)
+		if IsNewer(version, latest) {
+			latest = version
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no installer release found")
+	}
+	return tagPrefix + latest, nil
+}
+
+// fetchManifest downloads and parses a manifest, returning it with its raw
+// bytes for signature verification.
+func fetchManifest(client *http.Client, manifestURL string) (*Manifest, []byte, error) {
+	data, err := get(client, manifestURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to download the release manifest: %w", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse the release manifest: %w", err)
+	}
+	if !IsRelease(manifest.Version) {
+		return nil, nil, fmt.Errorf("the release manifest has an invalid version %q", manifest.Version)
+	}
+	return &manifest, data, nil
+}
+
+// get returns the body of a successful GET request to rawURL.
+func get(client *http.Client, rawURL string) ([]byte, error) {
+	logger.Debug("Fetching %s", rawURL)
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected response status: %s", rawURL, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,176 @@
+package selfupdate
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// releaseServer serves a manifest with one artifact for the running platform
+// and its signature, and makes it the release of ManifestURL and PublicKey.
+func releaseServer(t *testing.T, binary []byte, checksum string) *httptest.Server {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousKey, previousURL := PublicKey, ManifestURL
+	t.Cleanup(func() { PublicKey, ManifestURL = previousKey, previousURL })
+	PublicKey = base64.StdEncoding.EncodeToString(der)
+
+	manifest, err := json.Marshal(Manifest{
+		Version:   "1.7.0",
+		Artifacts: map[string]Artifact{Platform(): {Name: "installer-binary", SHA256: checksum}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := ed25519.Sign(priv, manifest)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/release/"+manifestName, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(manifest)
+	})
+	mux.HandleFunc("/release/"+manifestName+signatureSuffix, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(base64.StdEncoding.EncodeToString(signature) + "\n"))
+	})
+	mux.HandleFunc("/release/installer-binary", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(binary)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	ManifestURL = server.URL + "/release/" + manifestName
+	return server
+}
+
+func TestFetchManifest(t *testing.T) {
+	server := releaseServer(t, []byte("binary"), strings.Repeat("0", 64))
+
+	manifest, manifestURL, err := FetchManifest()
+	if err != nil {
+		t.Fatalf("FetchManifest with a valid signature failed: %v", err)
+	}
+	if manifest.Version != "1.7.0" || manifestURL != ManifestURL {
+		t.Errorf("FetchManifest = %q from %q, want 1.7.0 from %q", manifest.Version, manifestURL, ManifestURL)
+	}
+	_, artifactURL, err := ArtifactURL(manifest, manifestURL)
+	if err != nil || artifactURL != server.URL+"/release/installer-binary" {
+		t.Errorf("ArtifactURL = %q, %v, want the artifact next to the manifest", artifactURL, err)
+	}
+	if latest, err := LatestVersion(); err != nil || latest != "1.7.0" {
+		t.Errorf("LatestVersion = %q, %v, want 1.7.0", latest, err)
+	}
+
+	// A manifest signed with another key is rejected
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	PublicKey = base64.StdEncoding.EncodeToString(der)
+	if _, _, err := FetchManifest(); err == nil || !strings.Contains(err.Error(), "does not match the installer release key") {
+		t.Errorf("FetchManifest with another release key returned %v", err)
+	}
+
+	// So is a build without a key
+	PublicKey = ""
+	if _, _, err := FetchManifest(); err == nil || !strings.Contains(err.Error(), "no release signing key") {
+		t.Errorf("FetchManifest without a release key returned %v", err)
+	}
+}
+
+func TestApplyChecksumMismatch(t *testing.T) {
+	releaseServer(t, []byte("tampered binary"), strings.Repeat("0", 64))
+	exePath, err := executablePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(exePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, manifestURL, err := FetchManifest()
+	if err != nil {
+		t.Fatalf("FetchManifest failed: %v", err)
+	}
+	if _, err := Apply(manifest, manifestURL); err == nil {
+		t.Fatal("Apply of a binary with a checksum mismatch succeeded")
+	}
+
+	after, err := os.Stat(exePath)
+	if err != nil {
+		t.Fatalf("the executable is gone after a failed update: %v", err)
+	}
+	if !os.SameFile(before, after) || after.Size() != before.Size() {
+		t.Error("the executable was replaced by a binary with a checksum mismatch")
+	}
+	staged := filepath.Join(filepath.Dir(exePath), "."+filepath.Base(exePath)+".new")
+	for _, leftover := range []string{staged, staged + ".part"} {
+		if _, err := os.Stat(leftover); err == nil {
+			t.Errorf("%s was left behind", leftover)
+		}
+	}
+}
+
+func TestIsNewer(t *testing.T) {
+	tests := []struct {
+		version, current string
+		want             bool
+	}{
+		{"1.7.0", "1.6.9", true},
+		{"1.10.0", "1.9.0", true},
+		{"2.0.0", "1.99.99", true},
+		{"v1.7.1", "1.7.0", true},
+		{"1.7.0", "1.7.0", false},
+		{"1.6.0", "1.7.0", false},
+		// Pre-releases are not releases: never offered, and older than any release when running
+		{"1.8.0-beta.1", "1.7.0", false},
+		{"1.7.0", "1.7.0-beta.1", true},
+		{"1.7.0", "dev", true},
+		{"1.7", "1.6.0", false},
+		{"", "1.6.0", false},
+	}
+	for _, tt := range tests {
+		if got := IsNewer(tt.version, tt.current); got != tt.want {
+			t.Errorf("IsNewer(%q, %q) = %v, want %v", tt.version, tt.current, got, tt.want)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    [3]int
+		ok      bool
+	}{
+		{"1.7.0", [3]int{1, 7, 0}, true},
+		{"v12.0.3", [3]int{12, 0, 3}, true},
+		{"1.7.0-rc.1", [3]int{}, false},
+		{"1.7.0+build", [3]int{}, false},
+		{"1.7", [3]int{}, false},
+		{"1.-7.0", [3]int{}, false},
+		{"dev", [3]int{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseVersion(tt.version)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("parseVersion(%q) = %v, %v, want %v, %v", tt.version, got, ok, tt.want, tt.ok)
+		}
+	}
+}
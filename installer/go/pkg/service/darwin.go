@@ -23,6 +23,9 @@ type LaunchdConfig struct {
 	NodeBinDir string
 	Port       int
 	NodeExtraCACerts string // Optional custom CA bundle path (NODE_EXTRA_CA_CERTS)
+	NodePath         string // Directory of the extra Node-RED nodes (NODE_PATH)
+	AgentArgs        []string    // Extra agent arguments (--agent-arg)
+	Environment      [][2]string // Extra environment variables (--env) as name and value
 }
 
 // newsyslogConfig holds the data for the newsyslog configuration
@@ -33,6 +36,12 @@ type newsyslogConfig struct {
 }
 
 
+// launchDaemonsDir is where launchd property lists of system services are installed.
+const launchDaemonsDir = "/Library/LaunchDaemons"
+
+// newsyslogDir is where newsyslog configurations are installed.
+const newsyslogDir = "/etc/newsyslog.d"
+
 // setLabel function maps a service name "flowfuse-device-agent-<port>"
 // to a launchd label "com.flowfuse.device-agent-<port>". The legacy
 // name "flowfuse-device-agent" maps to "com.flowfuse.device-agent".
@@ -61,7 +70,7 @@ func setLabel(serviceName string) string {
 //   - The corresponding plist file path (e.g., "/Library/LaunchDaemons/com.flowfuse.device-agent-8080.plist")
 func setPlistPath(label string) string {
 	plistFileName := fmt.Sprintf("%s.plist", label)
-	return filepath.Join("/Library/LaunchDaemons", plistFileName)
+	return filepath.Join(launchDaemonsDir, plistFileName)
 }
 
 // setNewsyslogConfPath sets the newsyslog configuration file path for the service based on the launchd label.
@@ -73,7 +82,7 @@ func setPlistPath(label string) string {
 //   - The corresponding newsyslog configuration file path (e.g., "/etc/newsyslog.d/com.flowfuse.device-agent-8080.conf")
 func setNewsyslogConfPath(label string) string {
 	nsConfFileName := fmt.Sprintf("%s.conf", label)
-	return filepath.Join("/etc/newsyslog.d/", nsConfFileName)
+	return filepath.Join(newsyslogDir, nsConfFileName)
 }
 
 // InstallDarwin installs the service on macOS using launchd
@@ -103,19 +112,7 @@ func InstallDarwin(serviceName, workDir string, port int, caCertPath string) err
 		return fmt.Errorf("failed to set logs directory ownership: %w\nOutput: %s", err, output)
 	}
 
-	logFilePath := filepath.Join(logDir, "flowfuse-device-agent.log")
-	errorLogFilePath := filepath.Join(logDir, "flowfuse-device-agent-error.log")
-
-	config := LaunchdConfig{
-		Label:            label,
-		WorkDir:          workDir,
-		LogFile:          logFilePath,
-		ErrorFile:        errorLogFilePath,
-		User:             serviceUser,
-		NodeBinDir:       nodejs.GetNodeBinDir(),
-		Port:             port,
-		NodeExtraCACerts: caCertPath,
-	}
+	config := launchdConfig(filepath.Join, serviceName, workDir, nodejs.GetNodeBinDir(), port, caCertPath)
 
 	tmpl, err := template.New("launchd").Parse(launchdTemplate)
 	if err != nil {
@@ -154,11 +151,41 @@ func InstallDarwin(serviceName, workDir string, port int, caCertPath string) err
 		return fmt.Errorf("failed to load launchd service: %w\nOutput: %s", err, output)
 	}
 
-	createNewsyslogConfig(label, serviceUser, logFilePath, errorLogFilePath)
+	createNewsyslogConfig(label, serviceUser, config.LogFile, config.ErrorFile)
 
 	return nil
 }
 
+// launchdConfig returns the data of the launchd template. The service logs to
+// <workDir>/logs.
+//
+// Parameters:
+//   - join: Joins the elements of a path on the target system
+//   - serviceName: The name of the service (e.g., "flowfuse-device-agent-8080")
+//   - workDir: The working directory of the installation
+//   - nodeBinDir: The directory with the node and flowfuse-device-agent executables
+//   - port: The port the Device Agent listens on
+//   - caCertPath: The CA bundle passed in NODE_EXTRA_CA_CERTS, if any
+//
+// Returns:
+//   - LaunchdConfig: The template data
+func launchdConfig(join func(elem ...string) string, serviceName, workDir, nodeBinDir string, port int, caCertPath string) LaunchdConfig {
+	logDir := join(workDir, "logs")
+	return LaunchdConfig{
+		Label:            setLabel(serviceName),
+		WorkDir:          workDir,
+		LogFile:          join(logDir, "flowfuse-device-agent.log"),
+		ErrorFile:        join(logDir, "flowfuse-device-agent-error.log"),
+		User:             utils.ServiceUsername,
+		NodeBinDir:       nodeBinDir,
+		Port:             port,
+		NodeExtraCACerts: caCertPath,
+		NodePath:         nodePath(join, workDir),
+		AgentArgs:        AgentArgs,
+		Environment:      environmentVariables(),
+	}
+}
+
 // StartDarwin starts the service on macOS
 // It uses launchctl to start the service and checks its status
 //
@@ -280,6 +307,47 @@ func IsInstalledDarwin(serviceName string) bool {
 	return serviceRunning && fileExists
 }
 
+// IsRunningDarwin checks if the service is running on macOS, i.e. launchd
+// reports a process ID for its label
+//
+// Parameters:
+//   - serviceName: The name of the service to check
+//
+// Returns:
+//   - bool: true if the service is running, false otherwise
+func IsRunningDarwin(serviceName string) bool {
+	output, err := exec.Command("sudo", "launchctl", "list", setLabel(serviceName)).Output()
+	return err == nil && strings.Contains(string(output), `"PID" = `)
+}
+
+// NewsyslogConfigPath returns the newsyslog configuration that rotates the
+// service logs on macOS.
+//
+// Parameters:
+//   - serviceName: The name of the service
+//
+// Returns:
+//   - string: The configuration file path in /etc/newsyslog.d
+func NewsyslogConfigPath(serviceName string) string {
+	return setNewsyslogConfPath(setLabel(serviceName))
+}
+
+// RestoreNewsyslogConfig recreates the log rotation configuration of an
+// installed service on macOS, e.g. after it was removed by a system cleanup.
+//
+// Parameters:
+//   - serviceName: The name of the service
+//   - workDir: The working directory holding the service logs
+//
+// Returns:
+//   - error: An error if the configuration could not be written
+func RestoreNewsyslogConfig(serviceName, workDir string) error {
+	logDir := filepath.Join(workDir, "logs")
+	return createNewsyslogConfig(setLabel(serviceName), utils.ServiceUsername,
+		filepath.Join(logDir, "flowfuse-device-agent.log"),
+		filepath.Join(logDir, "flowfuse-device-agent-error.log"))
+}
+
 // createNewsyslogConfig creates a configuration file for the newsyslog service
 // to manage log rotation for the FlowFuse Device Agent. It generates the configuration
 // based on the provided service user, log file, and error file paths, then installs it
@@ -343,3 +411,10 @@ func createNewsyslogConfig(label, serviceUser, logFile, errorFile string) error
 	logger.Debug("Log files rotation configuration created successfully at %s", nsConfFilePath)
 	return nil
 }
+
+// definitionFilesDarwin returns the paths of the launchd plist and newsyslog
+// configuration generated for serviceName.
+func definitionFilesDarwin(serviceName string) []string {
+	label := setLabel(serviceName)
+	return []string{setPlistPath(label), setNewsyslogConfPath(label)}
+}
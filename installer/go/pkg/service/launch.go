@@ -0,0 +1,238 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
+)
+
+// AgentArgs are extra command line arguments passed to the Device Agent after
+// --dir and --port (--agent-arg). nil keeps the arguments of a previous
+// installation; an empty slice removes them.
+var AgentArgs []string
+
+// Environment are extra environment variables of the service as KEY=VALUE
+// (--env). nil keeps the variables of a previous installation; an empty slice
+// removes them.
+var Environment []string
+
+// envNamePattern matches the environment variable names every service
+// definition format can express
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// safeWordPattern matches arguments that need no quoting in any service
+// definition format
+var safeWordPattern = regexp.MustCompile(`^[A-Za-z0-9_./:=@+,-]+$`)
+
+// managedEnvironment are the variables the installer sets itself
+var managedEnvironment = []string{"PATH", "NODE_PATH", "NODE_EXTRA_CA_CERTS"}
+
+// managedArgs are the Device Agent options the installer sets itself
+var managedArgs = []string{"--dir", "-d", "--port", "-p"}
+
+// ValidateAgentArg checks an extra Device Agent argument.
+//
+// Parameters:
+//   - arg: The argument as given with --agent-arg
+//
+// Returns:
+//   - error: An error if the argument cannot be passed to the agent, or sets
+//     an option the installer manages (--dir, --port)
+func ValidateAgentArg(arg string) error {
+	if strings.ContainsAny(arg, "\x00\r\n") {
+		return fmt.Errorf("agent argument %q contains a line break", arg)
+	}
+	name, _, _ := strings.Cut(arg, "=")
+	for _, managed := range managedArgs {
+		if name == managed {
+			return fmt.Errorf("agent argument %s is set by the installer, use the installer's --dir and --port options", name)
+		}
+	}
+	return nil
+}
+
+// ParseEnvironment checks an extra environment variable of the service.
+//
+// Parameters:
+//   - spec: The variable as given with --env, KEY=VALUE
+//
+// Returns:
+//   - string: The variable name
+//   - string: The value
+//   - error: An error if spec is not KEY=VALUE, the name is not a valid
+//     variable name or one the installer sets, or the value has a line break
+func ParseEnvironment(spec string) (string, string, error) {
+	name, value, ok := strings.Cut(spec, "=")
+	if !ok {
+		return "", "", fmt.Errorf("environment variable %q is not KEY=VALUE", spec)
+	}
+	if !envNamePattern.MatchString(name) {
+		return "", "", fmt.Errorf("invalid environment variable name %q", name)
+	}
+	for _, managed := range managedEnvironment {
+		if strings.EqualFold(name, managed) {
+			return "", "", fmt.Errorf("environment variable %s is set by the installer", managed)
+		}
+	}
+	if strings.ContainsAny(value, "\x00\r\n") {
+		return "", "", fmt.Errorf("environment variable %s contains a line break", name)
+	}
+	return name, value, nil
+}
+
+// RegisterEnvironmentSecrets registers the values of the extra environment
+// variables whose names look like secrets (see logger.IsSecretName), so that
+// they are redacted wherever they appear, e.g. in a launchd property list.
+//
+// Parameters:
+//   - environment: Variables as KEY=VALUE
+func RegisterEnvironmentSecrets(environment []string) {
+	for _, spec := range environment {
+		if name, value, ok := strings.Cut(spec, "="); ok && logger.IsSecretName(name) {
+			logger.RegisterSecret(value)
+		}
+	}
+}
+
+// nodePath returns the NODE_PATH of the service: the node_modules directory
+// of the Node-RED nodes installed with --node-red-node (see
+// nodejs.NodeREDNodesDir), which Node-RED loads besides the nodes of its user
+// directory.
+//
+// Parameters:
+//   - join: Joins the elements of a path on the target system
+//   - workDir: The working directory of the installation
+//
+// Returns:
+//   - string: The NODE_PATH value
+func nodePath(join func(elem ...string) string, workDir string) string {
+	return join(workDir, nodejs.NodeREDNodesDir, "node_modules")
+}
+
+// environmentVariables splits Environment into names and values; entries
+// that do not parse are skipped, they are rejected when the flags are read.
+func environmentVariables() [][2]string {
+	vars := make([][2]string, 0, len(Environment))
+	for _, spec := range Environment {
+		if name, value, err := ParseEnvironment(spec); err == nil {
+			vars = append(vars, [2]string{name, value})
+		}
+	}
+	return vars
+}
+
+// systemdArgs returns AgentArgs as a suffix of a systemd ExecStart= line.
+// Quotes and backslashes are escaped, and specifiers (%) and variable
+// references ($) are doubled so systemd passes them on unchanged.
+func systemdArgs() string {
+	var suffix strings.Builder
+	for _, arg := range AgentArgs {
+		arg = strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+		suffix.WriteString(" " + systemdQuote(arg))
+	}
+	return suffix.String()
+}
+
+// systemdEnvironment returns the values of the Environment= lines of a
+// systemd unit.
+func systemdEnvironment() []string {
+	var lines []string
+	for _, v := range environmentVariables() {
+		value := strings.ReplaceAll(v[1], "%", "%%")
+		lines = append(lines, `"`+strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v[0]+"="+value)+`"`)
+	}
+	return lines
+}
+
+// systemdQuote quotes a word of a systemd command line if needed.
+func systemdQuote(s string) string {
+	if safeWordPattern.MatchString(s) {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// shellArgs returns AgentArgs as a suffix of the double-quoted argument
+// variable of a SysVInit or OpenRC script. The variable is parsed by a shell
+// again when the agent starts, so each argument is single-quoted for that
+// shell and the result escaped for the double quotes.
+func shellArgs() string {
+	var suffix strings.Builder
+	for _, arg := range AgentArgs {
+		suffix.WriteString(" " + shellQuote(arg))
+	}
+	return doubleQuoteEscape(suffix.String())
+}
+
+// sysVInitEnvironment returns the export statements of a SysVInit script.
+func sysVInitEnvironment() []string {
+	var lines []string
+	for _, v := range environmentVariables() {
+		lines = append(lines, fmt.Sprintf(`export %s="%s"`, v[0], doubleQuoteEscape(v[1])))
+	}
+	return lines
+}
+
+// openRCEnvironment returns the -e options of supervise-daemon, escaped for
+// the double-quoted supervise_daemon_args of an OpenRC script.
+func openRCEnvironment() string {
+	var args strings.Builder
+	for _, v := range environmentVariables() {
+		args.WriteString(" -e " + shellQuote(v[0]+"="+v[1]))
+	}
+	return doubleQuoteEscape(args.String())
+}
+
+// shellQuote quotes a word for a POSIX shell if needed.
+func shellQuote(s string) string {
+	if safeWordPattern.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// doubleQuoteEscape escapes the characters a POSIX shell interprets inside
+// double quotes.
+func doubleQuoteEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(s)
+}
+
+// windowsArgs returns AgentArgs as a suffix of a Windows command line, quoted
+// the way the C runtime of Node.js splits it.
+func windowsArgs() string {
+	var suffix strings.Builder
+	for _, arg := range AgentArgs {
+		suffix.WriteString(" " + windowsQuote(arg))
+	}
+	return suffix.String()
+}
+
+// windowsQuote quotes a word of a Windows command line if needed; backslashes
+// before a quote are doubled.
+func windowsQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"") {
+		return s
+	}
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	backslashes := 0
+	for _, c := range s {
+		switch c {
+		case '\\':
+			backslashes++
+			continue
+		case '"':
+			quoted.WriteString(strings.Repeat(`\`, 2*backslashes+1))
+		default:
+			quoted.WriteString(strings.Repeat(`\`, backslashes))
+		}
+		backslashes = 0
+		quoted.WriteRune(c)
+	}
+	quoted.WriteString(strings.Repeat(`\`, 2*backslashes))
+	quoted.WriteByte('"')
+	return quoted.String()
+}
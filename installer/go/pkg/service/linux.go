@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"text/template"
 
+	"github.com/flowfuse/device-agent-installer/pkg/credentials"
 	"github.com/flowfuse/device-agent-installer/pkg/logger"
 	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
 	"github.com/flowfuse/device-agent-installer/pkg/utils"
@@ -21,7 +22,14 @@ type ServiceConfig struct {
 	LogFile          string // Log file path for openrc scripts
 	ErrorLogFile     string // Error log file path for openrc scripts
 	Port             int
-	NodeExtraCACerts string // Optional custom CA bundle path (NODE_EXTRA_CA_CERTS)
+	NodeExtraCACerts string   // Optional custom CA bundle path (NODE_EXTRA_CA_CERTS)
+	NodePath         string   // Directory of the extra Node-RED nodes (NODE_PATH)
+	CredentialFile   string   // Encrypted device configuration for LoadCredentialEncrypted (systemd)
+	DecryptCommand   string   // Command decrypting the device configuration before start (systemd)
+	ConfigPath       string   // Decrypted device configuration passed to the agent with --config
+	AgentArgs        string   // Extra agent arguments (--agent-arg), quoted for the init system
+	Environment      []string // Extra environment variables (--env), quoted for systemd or sysvinit
+	SuperviseEnv     string   // Extra environment variables as supervise-daemon options (openrc)
 }
 
 // IsSystemd returns true if the system was booted with systemd as its init
@@ -42,7 +50,7 @@ func IsSystemd() bool {
 	defer logger.LogFunctionExit("IsSystemd", nil, nil)
 
 	// systemd is only the active init system if it has populated /run/systemd/system.
-	if _, err := os.Stat("/run/systemd/system"); err != nil {
+	if _, err := os.Stat(utils.SystemPath("/run/systemd/system")); err != nil {
 		return false
 	}
 	_, err := exec.LookPath("systemctl")
@@ -129,15 +137,9 @@ func InstallSystemd(serviceName, workDir string, port int, caCertPath string) er
 	})
 	defer logger.LogFunctionExit("InstallSystemd", nil, nil)
 
-	config := ServiceConfig{
-		User:             utils.ServiceUsername,
-		WorkDir:          workDir,
-		NodeBinDir:       nodejs.GetNodeBinDir(),
-		Port:             port,
-		NodeExtraCACerts: caCertPath,
-	}
+	config := systemdConfig(serviceName, workDir, nodejs.GetNodeBinDir(), port, caCertPath)
 
-	serviceFilePath := "/etc/systemd/system/" + serviceName + ".service"
+	serviceFilePath := systemdUnitPath(serviceName)
 
 	tmpl, err := template.New("service").Parse(SystemdServiceTemplate)
 	if err != nil {
@@ -204,16 +206,9 @@ func InstallSysVInit(serviceName, workDir string, port int, caCertPath string) e
 	})
 	defer logger.LogFunctionExit("InstallSysVInit", nil, nil)
 
-	config := ServiceConfig{
-		User:             utils.ServiceUsername,
-		WorkDir:          workDir,
-		NodeBinDir:       nodejs.GetNodeBinDir(),
-		ServiceName:      serviceName,
-		Port:             port,
-		NodeExtraCACerts: caCertPath,
-	}
+	config := sysVInitConfig(serviceName, workDir, nodejs.GetNodeBinDir(), port, caCertPath)
 
-	serviceFilePath := "/etc/init.d/" + serviceName
+	serviceFilePath := initScriptPath(serviceName)
 
 	tmpl, err := template.New("service").Parse(SysVInitServiceTemplate)
 	if err != nil {
@@ -294,20 +289,9 @@ func InstallOpenRC(serviceName, workDir string, port int, caCertPath string) err
 		return fmt.Errorf("failed to set logs directory ownership: %w\nOutput: %s", err, output)
 	}
 
-	logFilePath := filepath.Join(logDir, fmt.Sprintf("%s.log", serviceName))
-	errorLogFilePath := filepath.Join(logDir, fmt.Sprintf("%s-error.log", serviceName))
-
-	config := ServiceConfig{
-		User:             utils.ServiceUsername,
-		WorkDir:          workDir,
-		NodeBinDir:       nodejs.GetNodeBinDir(),
-		LogFile:          logFilePath,
-		ErrorLogFile:     errorLogFilePath,
-		Port:             port,
-		NodeExtraCACerts: caCertPath,
-	}
+	config := openRCConfig(filepath.Join, serviceName, workDir, nodejs.GetNodeBinDir(), port, caCertPath)
 
-	serviceFilePath := "/etc/init.d/" + serviceName
+	serviceFilePath := initScriptPath(serviceName)
 
 	tmpl, err := template.New("service").Parse(OpenRCServiceTemplate)
 	if err != nil {
@@ -342,6 +326,70 @@ func InstallOpenRC(serviceName, workDir string, port int, caCertPath string) err
 	return nil
 }
 
+// systemdConfig returns the data of the systemd unit template.
+//
+// Parameters:
+//   - serviceName: The name of the service
+//   - workDir: The working directory of the installation
+//   - nodeBinDir: The directory with the node and flowfuse-device-agent executables
+//   - port: The port the Device Agent listens on
+//   - caCertPath: The CA bundle passed in NODE_EXTRA_CA_CERTS, if any
+//
+// Returns:
+//   - ServiceConfig: The template data
+func systemdConfig(serviceName, workDir, nodeBinDir string, port int, caCertPath string) ServiceConfig {
+	config := ServiceConfig{
+		User:             utils.ServiceUsername,
+		WorkDir:          workDir,
+		NodeBinDir:       nodeBinDir,
+		Port:             port,
+		NodeExtraCACerts: caCertPath,
+		NodePath:         nodePath(filepath.Join, workDir),
+		ServiceName:      serviceName,
+		AgentArgs:        systemdArgs(),
+		Environment:      systemdEnvironment(),
+	}
+	config.CredentialFile, config.DecryptCommand, config.ConfigPath = credentials.SystemdSettings(workDir, serviceName, nodeBinDir)
+	return config
+}
+
+// sysVInitConfig returns the data of the SysVInit script template; see
+// systemdConfig for the parameters.
+func sysVInitConfig(serviceName, workDir, nodeBinDir string, port int, caCertPath string) ServiceConfig {
+	return ServiceConfig{
+		User:             utils.ServiceUsername,
+		WorkDir:          workDir,
+		NodeBinDir:       nodeBinDir,
+		ServiceName:      serviceName,
+		Port:             port,
+		NodeExtraCACerts: caCertPath,
+		NodePath:         nodePath(filepath.Join, workDir),
+		AgentArgs:        shellArgs(),
+		Environment:      sysVInitEnvironment(),
+	}
+}
+
+// openRCConfig returns the data of the OpenRC script template, which logs to
+// <workDir>/logs; see systemdConfig for the other parameters.
+//
+// Parameters:
+//   - join: Joins the elements of a path on the target system
+func openRCConfig(join func(elem ...string) string, serviceName, workDir, nodeBinDir string, port int, caCertPath string) ServiceConfig {
+	logDir := join(workDir, "logs")
+	return ServiceConfig{
+		User:             utils.ServiceUsername,
+		WorkDir:          workDir,
+		NodeBinDir:       nodeBinDir,
+		LogFile:          join(logDir, fmt.Sprintf("%s.log", serviceName)),
+		ErrorLogFile:     join(logDir, fmt.Sprintf("%s-error.log", serviceName)),
+		Port:             port,
+		NodeExtraCACerts: caCertPath,
+		NodePath:         nodePath(join, workDir),
+		AgentArgs:        shellArgs(),
+		SuperviseEnv:     openRCEnvironment(),
+	}
+}
+
 // StartLinux starts a service on Linux systems.
 // It detects whether to use systemd or sysvinit based on the service location.
 //
@@ -587,7 +635,7 @@ func UninstallSystemd(serviceName string) error {
 	disableCmd := exec.Command("sudo", "systemctl", "disable", serviceName)
 	_ = disableCmd.Run()
 
-	serviceFilePath := "/etc/systemd/system/" + serviceName + ".service"
+	serviceFilePath := systemdUnitPath(serviceName)
 
 	// Check if service file exists before attempting removal
 	if _, err := os.Stat(serviceFilePath); err != nil {
@@ -640,7 +688,7 @@ func UninstallSysVInit(serviceName string) error {
 		_ = disableCmd.Run()
 	}
 
-	serviceFilePath := "/etc/init.d/" + serviceName
+	serviceFilePath := initScriptPath(serviceName)
 
 	// Check if service script exists before attempting removal
 	if _, err := os.Stat(serviceFilePath); err != nil {
@@ -683,7 +731,7 @@ func UninstallOpenRC(serviceName string) error {
 		logger.Debug("OpenRC service removed from registry successfully")
 	}
 
-	serviceFilePath := "/etc/init.d/" + serviceName
+	serviceFilePath := initScriptPath(serviceName)
 
 	// Check if service script exists before attempting removal
 	if _, err := os.Stat(serviceFilePath); err != nil {
@@ -728,7 +776,7 @@ func IsInstalledLinux(serviceName string) bool {
 //   - true if the service is installed
 //   - false if the service is not installed
 func IsInstalledSystemd(serviceName string) bool {
-	serviceFilePath := "/etc/systemd/system/" + serviceName + ".service"
+	serviceFilePath := systemdUnitPath(serviceName)
 	_, err := os.Stat(serviceFilePath)
 	return err == nil
 }
@@ -742,7 +790,54 @@ func IsInstalledSystemd(serviceName string) bool {
 //   - true if the service is installed
 //   - false if the service is not installed
 func IsInstalledSysVInit(serviceName string) bool {
-	serviceFilePath := "/etc/init.d/" + serviceName
+	serviceFilePath := initScriptPath(serviceName)
 	_, err := os.Stat(serviceFilePath)
 	return err == nil
 }
+
+// IsRunningLinux checks if the service is running, asking the detected init system
+//
+// Parameters:
+//   - serviceName: the name of the service to check
+//
+// Returns:
+//   - true if the service is running
+//   - false if the service is stopped, not installed or no init system was found
+func IsRunningLinux(serviceName string) bool {
+	var statusCmd *exec.Cmd
+	if IsSystemd() {
+		statusCmd = exec.Command("sudo", "systemctl", "is-active", "--quiet", serviceName)
+	} else if IsSysVInit() {
+		statusCmd = exec.Command("sudo", "service", serviceName, "status")
+	} else if IsOpenRC() {
+		statusCmd = exec.Command("sudo", "rc-service", serviceName, "status")
+	} else {
+		return false
+	}
+	return statusCmd.Run() == nil
+}
+
+// definitionFilesLinux returns the paths where a service definition for
+// serviceName may have been generated (systemd unit or init script).
+func definitionFilesLinux(serviceName string) []string {
+	return []string{
+		systemdUnitPath(serviceName),
+		initScriptPath(serviceName),
+	}
+}
+
+// systemdUnitDir is where systemd units are installed.
+const systemdUnitDir = "/etc/systemd/system"
+
+// initScriptDir is where SysVinit and OpenRC scripts are installed.
+const initScriptDir = "/etc/init.d"
+
+// systemdUnitPath returns the path of the systemd unit of serviceName.
+func systemdUnitPath(serviceName string) string {
+	return utils.SystemPath(systemdUnitDir + "/" + serviceName + ".service")
+}
+
+// initScriptPath returns the path of the SysVinit or OpenRC script of serviceName.
+func initScriptPath(serviceName string) string {
+	return utils.SystemPath(initScriptDir + "/" + serviceName)
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package service
+
+import "fmt"
+
+// setServicePassword sets the account and password a registered service logs
+// on with.
+//
+// Parameters:
+//   - serviceName: The name of the service
+//   - account: The account the service runs as
+//   - password: The password of the account
+//
+// Returns:
+//   - error: nil on success, otherwise an error indicating the failure
+//
+// Note: Windows services only; this implementation always fails.
+func setServicePassword(serviceName, account, password string) error {
+	return fmt.Errorf("service passwords are only supported on Windows")
+}
@@ -0,0 +1,51 @@
+//go:build windows
+
+package service
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// setServicePassword sets the account and password a registered service logs
+// on with through the Service Control Manager, so the password is not passed
+// on a command line where other processes could read it. The other settings
+// of the service are left unchanged.
+//
+// Parameters:
+//   - serviceName: The name of the service
+//   - account: The account the service runs as
+//   - password: The password of the account
+//
+// Returns:
+//   - error: nil on success, otherwise an error indicating the failure
+//
+// Note: this function is implemented for Windows systems.
+func setServicePassword(serviceName, account, password string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("failed to open service %s: %w", serviceName, err)
+	}
+	defer s.Close()
+
+	accountPtr, err := windows.UTF16PtrFromString(account)
+	if err != nil {
+		return fmt.Errorf("invalid account %s: %w", account, err)
+	}
+	passwordPtr, err := windows.UTF16PtrFromString(password)
+	if err != nil {
+		return fmt.Errorf("invalid password: %w", err)
+	}
+	if err := windows.ChangeServiceConfig(s.Handle, windows.SERVICE_NO_CHANGE, windows.SERVICE_NO_CHANGE, windows.SERVICE_NO_CHANGE,
+		nil, nil, nil, nil, accountPtr, passwordPtr, nil); err != nil {
+		return fmt.Errorf("failed to set the password of %s: %w", account, err)
+	}
+	return nil
+}
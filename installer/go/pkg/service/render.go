@@ -0,0 +1,252 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/flowfuse/device-agent-installer/pkg/credentials"
+	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+)
+
+// Init systems a Linux service definition can be rendered for
+const (
+	InitSystemd  = "systemd"
+	InitSysVInit = "sysvinit"
+	InitOpenRC   = "openrc"
+)
+
+// Target is the system a service definition is rendered for.
+type Target struct {
+	OS   string // linux, darwin or windows
+	Init string // InitSystemd, InitSysVInit or InitOpenRC; Linux only
+}
+
+// RenderedFile is a file of a rendered service definition.
+type RenderedFile struct {
+	Name    string // File name in the render directory
+	Path    string // Where the installer writes the file; empty for the NSSM settings, which are kept in the registry
+	Mode    string // Permissions the installer sets
+	Content []byte
+}
+
+// DetectTarget returns the target of the running system.
+//
+// Returns:
+//   - Target: The operating system and, on Linux, the init system that Install would use
+func DetectTarget() Target {
+	target := Target{OS: runtime.GOOS}
+	if target.OS == "linux" {
+		switch {
+		case IsSystemd():
+			target.Init = InitSystemd
+		case IsSysVInit():
+			target.Init = InitSysVInit
+		case IsOpenRC():
+			target.Init = InitOpenRC
+		}
+	}
+	return target
+}
+
+// Validate checks that the target is supported.
+//
+// Returns:
+//   - error: An error naming the unsupported operating system or init system
+func (t Target) Validate() error {
+	switch t.OS {
+	case "linux":
+		switch t.Init {
+		case InitSystemd, InitSysVInit, InitOpenRC:
+			return nil
+		}
+		return fmt.Errorf("unsupported init system %q, use %s, %s or %s", t.Init, InitSystemd, InitSysVInit, InitOpenRC)
+	case "darwin", "windows":
+		if t.Init != "" {
+			return fmt.Errorf("an init system can only be chosen for linux")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported operating system %q, use linux, darwin or windows", t.OS)
+}
+
+// String formats the target, e.g. "linux/systemd".
+func (t Target) String() string {
+	if t.Init == "" {
+		return t.OS
+	}
+	return t.OS + "/" + t.Init
+}
+
+// Join joins the elements of a path with the separator of the target, so
+// that definitions for Windows can be rendered on Linux and vice versa.
+//
+// Parameters:
+//   - elem: The path elements
+//
+// Returns:
+//   - string: The joined path
+func (t Target) Join(elem ...string) string {
+	if t.OS != "windows" {
+		return path.Join(elem...)
+	}
+	slashed := make([]string, len(elem))
+	for i, e := range elem {
+		slashed[i] = strings.ReplaceAll(e, `\`, "/")
+	}
+	return strings.ReplaceAll(path.Join(slashed...), "/", `\`)
+}
+
+// Render executes the service definition templates for a target without
+// installing anything: the systemd unit, SysVInit or OpenRC script, the launchd
+// plist and newsyslog configuration, or the NSSM settings as the batch script
+// "nssm dump" would print. The definitions use the service account and
+// credential settings in effect, like Install.
+//
+// Parameters:
+//   - target: The system to render for
+//   - serviceName: The name of the service
+//   - workDir: The working directory of the installation on the target
+//   - port: The port the Device Agent listens on
+//   - caCertPath: The CA bundle passed in NODE_EXTRA_CA_CERTS, if any
+//
+// Returns:
+//   - []RenderedFile: The rendered files
+//   - error: An error if the target is not supported or a template fails
+func Render(target Target, serviceName, workDir string, port int, caCertPath string) ([]RenderedFile, error) {
+	if err := target.Validate(); err != nil {
+		return nil, err
+	}
+
+	nodeBinDir := target.Join(workDir, nodejs.NodeDir, "bin")
+	if target.OS == "windows" {
+		nodeBinDir = target.Join(workDir, nodejs.NodeDir)
+	}
+
+	var files []RenderedFile
+	add := func(name, installPath, mode, text string, data interface{}) error {
+		content, err := executeTemplate(name, text, data)
+		if err != nil {
+			return err
+		}
+		files = append(files, RenderedFile{Name: name, Path: installPath, Mode: mode, Content: content})
+		return nil
+	}
+
+	var err error
+	switch target.OS {
+	case "linux":
+		switch target.Init {
+		case InitSystemd:
+			err = add(serviceName+".service", path.Join(systemdUnitDir, serviceName+".service"), "644",
+				SystemdServiceTemplate, systemdConfig(serviceName, workDir, nodeBinDir, port, caCertPath))
+		case InitSysVInit:
+			err = add(serviceName, path.Join(initScriptDir, serviceName), "755",
+				SysVInitServiceTemplate, sysVInitConfig(serviceName, workDir, nodeBinDir, port, caCertPath))
+		case InitOpenRC:
+			err = add(serviceName, path.Join(initScriptDir, serviceName), "755",
+				OpenRCServiceTemplate, openRCConfig(target.Join, serviceName, workDir, nodeBinDir, port, caCertPath))
+		}
+	case "darwin":
+		config := launchdConfig(target.Join, serviceName, workDir, nodeBinDir, port, caCertPath)
+		err = add(config.Label+".plist", path.Join(launchDaemonsDir, config.Label+".plist"), "644", launchdTemplate, config)
+		if err == nil {
+			err = add(config.Label+".conf", path.Join(newsyslogDir, config.Label+".conf"), "644", newsyslogTemplate,
+				newsyslogConfig{LogFile: config.LogFile, ErrorFile: config.ErrorFile, User: config.User})
+		}
+	case "windows":
+		files = append(files, RenderedFile{
+			Name:    serviceName + "-nssm.bat",
+			Content: renderNssmScript(target, serviceName, workDir, nodeBinDir, port, caCertPath),
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// executeTemplate executes one of the service definition templates.
+func executeTemplate(name, text string, data interface{}) ([]byte, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s template: %w", name, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to execute %s template: %w", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// renderNssmScript returns the NSSM commands InstallWindows runs, as a batch
+// script. The PATH of the installer process, which the service inherits, is
+// shown as %PATH% after the Node.js directory.
+//
+// The arguments are quoted for the command line of nssm.exe (see
+// windowsQuote) and then escaped for cmd.exe: percent signs are doubled and
+// &, |, <, > and ^ outside quotes are escaped with ^.
+func renderNssmScript(target Target, serviceName, workDir, nodeBinDir string, port int, caCertPath string) []byte {
+	// Stands in for %PATH%, which the script expands when it runs
+	const pathPlaceholder = "\x00PATH\x00"
+	command := func(args ...string) string {
+		for i, arg := range args {
+			args[i] = windowsQuote(arg)
+		}
+		line := batchEscape("nssm.exe " + strings.Join(args, " "))
+		return strings.ReplaceAll(line, pathPlaceholder, "%PATH%") + "\r\n"
+	}
+
+	var script strings.Builder
+	application := nssmApplication(target.Join(nodeBinDir, "flowfuse-device-agent.cmd"))
+	script.WriteString(command("install", serviceName, application))
+
+	params := nssmParameters(target.Join, workDir, port)
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		script.WriteString(command("set", serviceName, name, params[name]))
+	}
+
+	account := "LocalService"
+	if utils.UseExistingAccount {
+		account = utils.ServiceUsername
+	}
+	script.WriteString(command("set", serviceName, "ObjectName", account))
+
+	environment := nssmEnvironment(nodeBinDir+";"+pathPlaceholder, nodePath(target.Join, workDir), caCertPath)
+	script.WriteString(command(append([]string{"set", serviceName, "AppEnvironmentExtra"}, environment...)...))
+
+	if credentials.Encryption == credentials.ModeDPAPI {
+		script.WriteString("rem The service runs start-device-agent.ps1, which decrypts device.yml.dpapi and starts the agent\r\n")
+	}
+	return []byte(script.String())
+}
+
+// batchEscape escapes a command line for a batch script. cmd.exe expands
+// %...% everywhere and treats every double quote as the start or end of a
+// quoted part, regardless of backslashes.
+func batchEscape(line string) string {
+	var escaped strings.Builder
+	quoted := false
+	for _, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '%':
+			escaped.WriteByte('%')
+		case !quoted && strings.ContainsRune("&|<>^", c):
+			escaped.WriteByte('^')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
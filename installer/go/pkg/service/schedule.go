@@ -0,0 +1,433 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+)
+
+// UpdateJob is a daily job that runs a scheduled Device Agent update.
+type UpdateJob struct {
+	// ServiceName is the service the job updates
+	ServiceName string
+	// Args is the command the job runs, starting with the executable
+	Args []string
+	// Hour and Minute are the local time the job starts at
+	Hour   int
+	Minute int
+}
+
+// updateJobConfig holds the values used in the update job templates.
+type updateJobConfig struct {
+	UpdateJob
+	JobName string
+	Label   string
+	Command string
+}
+
+// windowsTaskFolder is the Task Scheduler folder holding the update tasks.
+const windowsTaskFolder = `FlowFuse\`
+
+// UpdateJobName returns the name of the scheduled update job of a service.
+//
+// Parameters:
+//   - serviceName: The name of the service (e.g., "flowfuse-device-agent-8080")
+//
+// Returns:
+//   - The name of the job (e.g., "flowfuse-device-agent-8080-update")
+func UpdateJobName(serviceName string) string {
+	return serviceName + "-update"
+}
+
+// InstallUpdateJob schedules a daily update job, replacing an existing job of
+// the same service. It uses a systemd timer where systemd is running, cron on
+// other Linux systems, a launchd calendar job on macOS and a Task Scheduler
+// task on Windows. The job runs as root (SYSTEM on Windows).
+//
+// Parameters:
+//   - job: The job to schedule
+//
+// Returns:
+//   - error: nil if successful, otherwise an error explaining what went wrong
+func InstallUpdateJob(job UpdateJob) error {
+	logger.LogFunctionEntry("InstallUpdateJob", map[string]interface{}{
+		"serviceName": job.ServiceName,
+		"args":        job.Args,
+		"hour":        job.Hour,
+		"minute":      job.Minute,
+	})
+
+	var err error
+	switch runtime.GOOS {
+	case "linux":
+		switch {
+		case IsSystemd():
+			err = installSystemdUpdateJob(job)
+		default:
+			err = installCronUpdateJob(job)
+		}
+	case "darwin":
+		err = installLaunchdUpdateJob(job)
+	case "windows":
+		err = installWindowsUpdateJob(job)
+	default:
+		err = fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+	}
+
+	logger.LogFunctionExit("InstallUpdateJob", nil, err)
+	return err
+}
+
+// UninstallUpdateJob removes the scheduled update job of a service. It is not
+// an error if the service has no job.
+//
+// Parameters:
+//   - serviceName: The name of the service
+//
+// Returns:
+//   - error: nil if successful, otherwise an error explaining what went wrong
+func UninstallUpdateJob(serviceName string) error {
+	logger.LogFunctionEntry("UninstallUpdateJob", map[string]interface{}{
+		"serviceName": serviceName,
+	})
+
+	var err error
+	switch runtime.GOOS {
+	case "linux":
+		if IsSystemd() {
+			err = uninstallSystemdUpdateJob(serviceName)
+		}
+		if cronErr := uninstallCronUpdateJob(serviceName); err == nil {
+			err = cronErr
+		}
+	case "darwin":
+		err = uninstallLaunchdUpdateJob(serviceName)
+	case "windows":
+		if IsUpdateJobInstalled(serviceName) {
+			output, deleteErr := exec.Command("schtasks", "/Delete", "/TN", windowsTaskFolder+UpdateJobName(serviceName), "/F").CombinedOutput()
+			if deleteErr != nil {
+				err = fmt.Errorf("failed to delete scheduled task: %w\nOutput: %s", deleteErr, output)
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+	}
+
+	logger.LogFunctionExit("UninstallUpdateJob", nil, err)
+	return err
+}
+
+// IsUpdateJobInstalled reports whether a service has a scheduled update job.
+//
+// Parameters:
+//   - serviceName: The name of the service
+//
+// Returns:
+//   - bool: true if the job is scheduled
+func IsUpdateJobInstalled(serviceName string) bool {
+	switch runtime.GOOS {
+	case "linux":
+		if _, err := os.Stat(systemdUpdateTimerPath(serviceName)); err == nil {
+			return true
+		}
+		if _, err := os.Stat(cronFilePath(serviceName)); err == nil {
+			return true
+		}
+		crontab, _ := readRootCrontab()
+		return strings.Contains(crontab, cronMarker(serviceName))
+	case "darwin":
+		_, err := os.Stat(setPlistPath(updateJobLabel(serviceName)))
+		return err == nil
+	case "windows":
+		return exec.Command("schtasks", "/Query", "/TN", windowsTaskFolder+UpdateJobName(serviceName)).Run() == nil
+	}
+	return false
+}
+
+// installSystemdUpdateJob writes a oneshot unit running the update and a
+// timer starting it, and enables the timer.
+func installSystemdUpdateJob(job UpdateJob) error {
+	cfg := newUpdateJobConfig(job)
+	quoted := make([]string, len(job.Args))
+	for i, arg := range job.Args {
+		quoted[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+	}
+	cfg.Command = strings.Join(quoted, " ")
+
+	if err := writeTemplate(SystemdUpdateServiceTemplate, cfg, systemdUpdateServicePath(job.ServiceName), "644"); err != nil {
+		return err
+	}
+	if err := writeTemplate(SystemdUpdateTimerTemplate, cfg, systemdUpdateTimerPath(job.ServiceName), "644"); err != nil {
+		return err
+	}
+
+	reloadCmd := exec.Command("sudo", "systemctl", "daemon-reload")
+	if output, err := reloadCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to reload systemd: %w\nOutput: %s", err, output)
+	}
+	enableCmd := exec.Command("sudo", "systemctl", "enable", cfg.JobName+".timer")
+	if output, err := enableCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to enable update timer: %w\nOutput: %s", err, output)
+	}
+	// Restart so that a changed schedule takes effect at once
+	restartCmd := exec.Command("sudo", "systemctl", "restart", cfg.JobName+".timer")
+	if output, err := restartCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to start update timer: %w\nOutput: %s", err, output)
+	}
+	return nil
+}
+
+// uninstallSystemdUpdateJob disables the update timer and removes its units.
+func uninstallSystemdUpdateJob(serviceName string) error {
+	timerPath := systemdUpdateTimerPath(serviceName)
+	servicePath := systemdUpdateServicePath(serviceName)
+	if _, err := os.Stat(timerPath); os.IsNotExist(err) {
+		if _, err := os.Stat(servicePath); os.IsNotExist(err) {
+			logger.Debug("No update timer for %s, skipping removal", serviceName)
+			return nil
+		}
+	}
+
+	_ = exec.Command("sudo", "systemctl", "disable", "--now", UpdateJobName(serviceName)+".timer").Run()
+
+	rmCmd := exec.Command("sudo", "rm", "-f", timerPath, servicePath)
+	if output, err := rmCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to remove update timer: %w\nOutput: %s", err, output)
+	}
+	reloadCmd := exec.Command("sudo", "systemctl", "daemon-reload")
+	if output, err := reloadCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to reload systemd: %w\nOutput: %s", err, output)
+	}
+	return nil
+}
+
+// installCronUpdateJob adds the job to /etc/cron.d or, where that is not
+// read (e.g. BusyBox crond on Alpine), to root's crontab.
+func installCronUpdateJob(job UpdateJob) error {
+	quoted := make([]string, len(job.Args))
+	for i, arg := range job.Args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	// cron turns an unescaped % into a newline
+	command := strings.ReplaceAll(strings.Join(quoted, " "), "%", `\%`) + " >/dev/null 2>&1"
+
+	if _, err := os.Stat(filepath.Dir(cronFilePath(job.ServiceName))); err == nil {
+		entry := fmt.Sprintf("# Scheduled update of the FlowFuse Device Agent (%s)\n%d %d * * * root %s\n", job.ServiceName, job.Minute, job.Hour, command)
+		return writeFile(entry, cronFilePath(job.ServiceName), "644")
+	}
+
+	crontabPath := rootCrontabPath()
+	if _, err := os.Stat(filepath.Dir(crontabPath)); err != nil {
+		return fmt.Errorf("neither systemd nor cron was found to schedule updates")
+	}
+	crontab, err := readRootCrontab()
+	if err != nil {
+		return err
+	}
+	lines := removeCronEntry(crontab, job.ServiceName)
+	lines = append(lines, fmt.Sprintf("%d %d * * * %s %s", job.Minute, job.Hour, command, cronMarker(job.ServiceName)))
+	if err := writeFile(strings.Join(lines, "\n")+"\n", crontabPath, "600"); err != nil {
+		return err
+	}
+	notifyCrond()
+	return nil
+}
+
+// uninstallCronUpdateJob removes the job from /etc/cron.d and root's crontab.
+func uninstallCronUpdateJob(serviceName string) error {
+	if _, err := os.Stat(cronFilePath(serviceName)); err == nil {
+		rmCmd := exec.Command("sudo", "rm", "-f", cronFilePath(serviceName))
+		if output, err := rmCmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to remove cron entry: %w\nOutput: %s", err, output)
+		}
+	}
+
+	crontab, err := readRootCrontab()
+	if err != nil || !strings.Contains(crontab, cronMarker(serviceName)) {
+		return nil
+	}
+	lines := removeCronEntry(crontab, serviceName)
+	content := ""
+	if len(lines) > 0 {
+		content = strings.Join(lines, "\n") + "\n"
+	}
+	if err := writeFile(content, rootCrontabPath(), "600"); err != nil {
+		return err
+	}
+	notifyCrond()
+	return nil
+}
+
+// installLaunchdUpdateJob writes and loads a launchd job with a calendar interval.
+func installLaunchdUpdateJob(job UpdateJob) error {
+	cfg := newUpdateJobConfig(job)
+	plistPath := setPlistPath(cfg.Label)
+	if _, err := os.Stat(plistPath); err == nil {
+		_ = exec.Command("sudo", "launchctl", "unload", "-w", plistPath).Run()
+	}
+	if err := writeTemplate(launchdUpdateTemplate, cfg, plistPath, "644"); err != nil {
+		return err
+	}
+	chownCmd := exec.Command("sudo", "chown", "root:wheel", plistPath)
+	if output, err := chownCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set update job ownership: %w\nOutput: %s", err, output)
+	}
+	loadCmd := exec.Command("sudo", "launchctl", "load", "-w", plistPath)
+	if output, err := loadCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to load update job: %w\nOutput: %s", err, output)
+	}
+	return nil
+}
+
+// uninstallLaunchdUpdateJob unloads the launchd job and removes its plist.
+func uninstallLaunchdUpdateJob(serviceName string) error {
+	plistPath := setPlistPath(updateJobLabel(serviceName))
+	if _, err := os.Stat(plistPath); os.IsNotExist(err) {
+		logger.Debug("No update job for %s, skipping removal", serviceName)
+		return nil
+	}
+	_ = exec.Command("sudo", "launchctl", "unload", "-w", plistPath).Run()
+	rmCmd := exec.Command("sudo", "rm", "-f", plistPath)
+	if output, err := rmCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to remove update job: %w\nOutput: %s", err, output)
+	}
+	return nil
+}
+
+// installWindowsUpdateJob creates (or replaces) a daily Task Scheduler task
+// running as SYSTEM.
+func installWindowsUpdateJob(job UpdateJob) error {
+	quoted := make([]string, len(job.Args))
+	for i, arg := range job.Args {
+		quoted[i] = `"` + arg + `"`
+	}
+	createCmd := exec.Command("schtasks", "/Create", "/F",
+		"/TN", windowsTaskFolder+UpdateJobName(job.ServiceName),
+		"/TR", strings.Join(quoted, " "),
+		"/SC", "DAILY",
+		"/ST", fmt.Sprintf("%02d:%02d", job.Hour, job.Minute),
+		"/RU", "SYSTEM",
+		"/RL", "HIGHEST")
+	if output, err := createCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create scheduled task: %w\nOutput: %s", err, output)
+	}
+	return nil
+}
+
+// newUpdateJobConfig returns the template values of a job.
+func newUpdateJobConfig(job UpdateJob) updateJobConfig {
+	return updateJobConfig{
+		UpdateJob: job,
+		JobName:   UpdateJobName(job.ServiceName),
+		Label:     updateJobLabel(job.ServiceName),
+	}
+}
+
+// updateJobLabel returns the launchd label of the update job of a service
+// (e.g. "com.flowfuse.device-agent-8080.update").
+func updateJobLabel(serviceName string) string {
+	return setLabel(serviceName) + ".update"
+}
+
+// systemdUpdateServicePath returns the path of the oneshot update unit.
+func systemdUpdateServicePath(serviceName string) string {
+	return utils.SystemPath("/etc/systemd/system/" + UpdateJobName(serviceName) + ".service")
+}
+
+// systemdUpdateTimerPath returns the path of the update timer unit.
+func systemdUpdateTimerPath(serviceName string) string {
+	return utils.SystemPath("/etc/systemd/system/" + UpdateJobName(serviceName) + ".timer")
+}
+
+// cronFilePath returns the path of the update job in /etc/cron.d.
+func cronFilePath(serviceName string) string {
+	return utils.SystemPath("/etc/cron.d/" + UpdateJobName(serviceName))
+}
+
+// rootCrontabPath returns the path of root's crontab as read by BusyBox crond.
+func rootCrontabPath() string {
+	return utils.SystemPath("/etc/crontabs/root")
+}
+
+// cronMarker tags the entry of a service in root's crontab.
+func cronMarker(serviceName string) string {
+	return "# " + UpdateJobName(serviceName)
+}
+
+// readRootCrontab returns root's crontab, or an empty string if it does not exist.
+func readRootCrontab() (string, error) {
+	if _, err := os.Stat(rootCrontabPath()); err != nil {
+		return "", nil
+	}
+	output, err := exec.Command("sudo", "cat", rootCrontabPath()).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", rootCrontabPath(), err)
+	}
+	return string(output), nil
+}
+
+// removeCronEntry returns the lines of a crontab without the entry of a service.
+func removeCronEntry(crontab, serviceName string) []string {
+	var lines []string
+	if strings.TrimSpace(crontab) == "" {
+		return lines
+	}
+	for _, line := range strings.Split(strings.TrimRight(crontab, "\n"), "\n") {
+		if strings.HasSuffix(line, cronMarker(serviceName)) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// notifyCrond tells BusyBox crond to reload root's crontab.
+func notifyCrond() {
+	updatePath := filepath.Join(filepath.Dir(rootCrontabPath()), "cron.update")
+	if output, err := exec.Command("sudo", "sh", "-c", "echo root >> "+updatePath).CombinedOutput(); err != nil {
+		logger.Debug("Could not notify crond: %v\nOutput: %s", err, output)
+	}
+}
+
+// writeTemplate renders a template and installs it as a root-owned file.
+func writeTemplate(text string, data interface{}, path, mode string) error {
+	tmpl, err := template.New(filepath.Base(path)).Parse(text)
+	if err != nil {
+		return fmt.Errorf("failed to parse template of %s: %w", path, err)
+	}
+	var content strings.Builder
+	if err := tmpl.Execute(&content, data); err != nil {
+		return fmt.Errorf("failed to execute template of %s: %w", path, err)
+	}
+	return writeFile(content.String(), path, mode)
+}
+
+// writeFile installs content as a root-owned file with the given mode.
+func writeFile(content, path, mode string) error {
+	tmpFile, err := os.CreateTemp("", "flowfuse-update-job-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.WriteString(content); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	tmpFile.Close()
+
+	copyCmd := exec.Command("sudo", "cp", tmpFile.Name(), path)
+	if output, err := copyCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to write %s: %w\nOutput: %s", path, err, output)
+	}
+	if err := exec.Command("sudo", "chmod", mode, path).Run(); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %w", path, err)
+	}
+	return nil
+}
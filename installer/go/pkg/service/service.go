@@ -2,7 +2,13 @@ package service
 
 import (
 	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/flowfuse/device-agent-installer/pkg/logger"
 )
@@ -114,3 +120,187 @@ func IsInstalled(serviceName string) bool {
 		return false
 	}
 }
+
+// OtherServices returns the names of the FlowFuse Device Agent services on
+// this system other than serviceName, such as instances on other ports. They
+// share the artifact cache and, by default, the service account.
+//
+// Parameters:
+//   - serviceName: The name of the service to leave out
+//
+// Returns:
+//   - []string: The names of the other services, sorted
+func OtherServices(serviceName string) []string {
+	const base = "flowfuse-device-agent"
+	found := map[string]bool{}
+	add := func(name string) {
+		if name != serviceName && (name == base || strings.HasPrefix(name, base+"-")) && !strings.HasSuffix(name, "-update") {
+			found[name] = true
+		}
+	}
+
+	switch runtime.GOOS {
+	case "linux":
+		units, _ := filepath.Glob(systemdUnitPath(base + "*"))
+		for _, unit := range units {
+			add(strings.TrimSuffix(filepath.Base(unit), ".service"))
+		}
+		scripts, _ := filepath.Glob(initScriptPath(base + "*"))
+		for _, script := range scripts {
+			add(filepath.Base(script))
+		}
+	case "darwin":
+		labelBase := setLabel(base)
+		plists, _ := filepath.Glob(setPlistPath(labelBase + "*"))
+		for _, plist := range plists {
+			label := strings.TrimSuffix(filepath.Base(plist), ".plist")
+			if !strings.HasSuffix(label, ".update") {
+				add(base + strings.TrimPrefix(label, labelBase))
+			}
+		}
+	case "windows":
+		output, err := exec.Command("sc", "query", "type=", "service", "state=", "all").Output()
+		if err != nil {
+			logger.Debug("Failed to list services: %v", err)
+			break
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			if name, ok := strings.CutPrefix(strings.TrimSpace(line), "SERVICE_NAME:"); ok {
+				add(strings.TrimSpace(name))
+			}
+		}
+	}
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsRunning checks if the service with the given name is currently running.
+//
+// Parameters:
+//   - serviceName: the name of the service to check
+//
+// Returns:
+//   - bool: true if the service is running, false otherwise or if the OS is not supported
+func IsRunning(serviceName string) bool {
+	switch runtime.GOOS {
+	case "linux":
+		return IsRunningLinux(serviceName)
+	case "windows":
+		return IsRunningWindows(serviceName)
+	case "darwin":
+		return IsRunningDarwin(serviceName)
+	default:
+		return false
+	}
+}
+
+// ExportDefinition returns the service definition generated for the given
+// service, keyed by file name, so it can be kept with a backup. On Linux and
+// macOS these are the unit/init script, plist and newsyslog files that exist;
+// on Windows it is the NSSM configuration as produced by "nssm dump".
+//
+// Parameters:
+//   - serviceName: The name of the service
+//   - workDir: The working directory of the installation (holds NSSM on Windows)
+//
+// Returns:
+//   - map[string][]byte: The definition files by name
+//   - error: An error if the definition could not be read or the OS is not supported
+func ExportDefinition(serviceName, workDir string) (map[string][]byte, error) {
+	var paths []string
+	switch runtime.GOOS {
+	case "linux":
+		paths = definitionFilesLinux(serviceName)
+	case "darwin":
+		paths = definitionFilesDarwin(serviceName)
+	case "windows":
+		return exportDefinitionWindows(serviceName, workDir)
+	default:
+		return nil, fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+	}
+
+	files := map[string][]byte{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		files[filepath.Base(path)] = data
+	}
+	return files, nil
+}
+
+// LogFiles returns the log files the service writes outside the working
+// directory, e.g. the SysVinit log in /var/log. They are left behind by
+// Uninstall and only removed on purge.
+//
+// Parameters:
+//   - serviceName: The name of the service
+//
+// Returns:
+//   - []string: The paths of existing log files
+func LogFiles(serviceName string) []string {
+	var candidates []string
+	if runtime.GOOS == "linux" {
+		candidates = append(candidates, "/var/log/"+serviceName+".log")
+	}
+
+	var files []string
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// Diagnostics returns the service manager's view of the service for a
+// diagnostics bundle, keyed by file name: the status output and, with systemd,
+// the most recent journal entries. A command that fails contributes its output
+// followed by the error, so the bundle shows why the information is missing.
+//
+// Parameters:
+//   - serviceName: The name of the service
+//   - journalLines: The number of journal lines to include
+//
+// Returns:
+//   - map[string][]byte: The collected output by file name
+func Diagnostics(serviceName string, journalLines int) map[string][]byte {
+	commands := map[string]*exec.Cmd{}
+	switch runtime.GOOS {
+	case "linux":
+		switch {
+		case IsSystemd():
+			commands["status.txt"] = exec.Command("sudo", "systemctl", "status", serviceName, "--no-pager", "--full")
+			commands["journal.log"] = exec.Command("sudo", "journalctl", "-u", serviceName, "--no-pager", "-o", "short-iso", "-n", strconv.Itoa(journalLines))
+		case IsSysVInit():
+			commands["status.txt"] = exec.Command("sudo", "service", serviceName, "status")
+		case IsOpenRC():
+			commands["status.txt"] = exec.Command("sudo", "rc-service", serviceName, "status")
+		}
+	case "darwin":
+		commands["status.txt"] = exec.Command("sudo", "launchctl", "list", setLabel(serviceName))
+	case "windows":
+		commands["status.txt"] = exec.Command("sc.exe", "query", serviceName)
+		commands["config.txt"] = exec.Command("sc.exe", "qc", serviceName)
+	}
+
+	files := map[string][]byte{}
+	for name, cmd := range commands {
+		logger.Debug("Diagnostics command: %s", cmd.String())
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			output = append(output, []byte(fmt.Sprintf("\n%s: %v\n", cmd.String(), err))...)
+		}
+		files[name] = output
+	}
+	return files
+}
@@ -15,8 +15,14 @@ WorkingDirectory={{.WorkDir}}
 
 Environment="NODE_OPTIONS=--max_old_space_size=512"
 Environment="PATH={{.NodeBinDir}}:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+Environment="NODE_PATH={{.NodePath}}"
 {{if .NodeExtraCACerts}}Environment="NODE_EXTRA_CA_CERTS={{.NodeExtraCACerts}}"
-{{end}}ExecStart=/usr/bin/env -S flowfuse-device-agent --dir {{.WorkDir}} --port {{.Port}}
+{{end}}{{range .Environment}}Environment={{.}}
+{{end}}{{if .CredentialFile}}LoadCredentialEncrypted=device.yml:{{.CredentialFile}}
+{{end}}{{if .DecryptCommand}}RuntimeDirectory={{.ServiceName}}
+RuntimeDirectoryMode=0700
+ExecStartPre={{.DecryptCommand}}
+{{end}}ExecStart=/usr/bin/env -S flowfuse-device-agent --dir {{.WorkDir}} --port {{.Port}}{{if .ConfigPath}} --config {{.ConfigPath}}{{end}}{{.AgentArgs}}
 # Use SIGINT to stop
 KillSignal=SIGINT
 # Auto restart on crash
@@ -45,7 +51,7 @@ const SysVInitServiceTemplate = `#!/bin/sh
 
 PATH={{.NodeBinDir}}:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin
 DAEMON="{{.NodeBinDir}}/flowfuse-device-agent"
-DAEMON_ARGS="--dir {{.WorkDir}} --port {{.Port}}"
+DAEMON_ARGS="--dir {{.WorkDir}} --port {{.Port}}{{.AgentArgs}}"
 NAME="{{.ServiceName}}"
 DESC="FlowFuse Device Agent"
 PIDFILE=/var/run/$NAME.pid
@@ -60,7 +66,9 @@ WORKING_DIR={{.WorkDir}}
 do_start() {
     log_daemon_msg "Starting $DESC" "$NAME"
     export NODE_OPTIONS="--max_old_space_size=512"
+    export NODE_PATH="{{.NodePath}}"
 {{if .NodeExtraCACerts}}    export NODE_EXTRA_CA_CERTS="{{.NodeExtraCACerts}}"
+{{end}}{{range .Environment}}    {{.}}
 {{end}}
     start-stop-daemon --start --quiet --background --user $USER --chdir $WORKING_DIR \
         --make-pidfile --pidfile $PIDFILE --startas /bin/bash \
@@ -116,7 +124,8 @@ const launchdTemplate = `<?xml version="1.0" encoding="UTF-8"?>
         <string>{{.WorkDir}}</string>
     <string>--port</string>
     <string>{{.Port}}</string>
-    </array>
+{{range .AgentArgs}}        <string>{{html .}}</string>
+{{end}}    </array>
     <key>UserName</key>
     <string>{{.User}}</string>
     <key>RunAtLoad</key>
@@ -138,8 +147,12 @@ const launchdTemplate = `<?xml version="1.0" encoding="UTF-8"?>
         <string>--max_old_space_size=512</string>
         <key>PATH</key>
         <string>{{.NodeBinDir}}:/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin</string>
+        <key>NODE_PATH</key>
+        <string>{{.NodePath}}</string>
 {{if .NodeExtraCACerts}}        <key>NODE_EXTRA_CA_CERTS</key>
         <string>{{.NodeExtraCACerts}}</string>
+{{end}}{{range .Environment}}        <key>{{html (index . 0)}}</key>
+        <string>{{html (index . 1)}}</string>
 {{end}}    </dict>
 </dict>
 </plist>`
@@ -155,11 +168,56 @@ name="FlowFuse Device Agent"
 description="FlowFuse Device Agent"
 supervisor="supervise-daemon"
 command="{{.NodeBinDir}}/flowfuse-device-agent"
-command_args="--dir {{.WorkDir}} --port {{.Port}}"
-supervise_daemon_args=" -d {{.WorkDir}} --stdout {{.LogFile}} --stderr {{.ErrorLogFile}} -e "PATH=\"{{.NodeBinDir}}:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"\""{{if .NodeExtraCACerts}}" -e NODE_EXTRA_CA_CERTS=\"{{.NodeExtraCACerts}}\""{{end}}
+command_args="--dir {{.WorkDir}} --port {{.Port}}{{.AgentArgs}}"
+supervise_daemon_args=" -d {{.WorkDir}} --stdout {{.LogFile}} --stderr {{.ErrorLogFile}} -e "PATH=\"{{.NodeBinDir}}:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"\"" -e NODE_PATH=\"{{.NodePath}}\""{{if .NodeExtraCACerts}}" -e NODE_EXTRA_CA_CERTS=\"{{.NodeExtraCACerts}}\""{{end}}{{if .SuperviseEnv}}"{{.SuperviseEnv}}"{{end}}
 command_user="{{.User}}"
 
 depend() {
     use net logger
 }
 `
+
+// SystemdUpdateServiceTemplate is the template for the oneshot unit that runs
+// a scheduled Device Agent update
+const SystemdUpdateServiceTemplate = `[Unit]
+Description=Scheduled update of the FlowFuse Device Agent ({{.ServiceName}})
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart={{.Command}}`
+
+// SystemdUpdateTimerTemplate is the template for the timer that starts the
+// scheduled Device Agent update at the beginning of the maintenance window
+const SystemdUpdateTimerTemplate = `[Unit]
+Description=Maintenance window of the FlowFuse Device Agent ({{.ServiceName}})
+
+[Timer]
+OnCalendar=*-*-* {{printf "%02d:%02d" .Hour .Minute}}:00
+Unit={{.JobName}}.service
+
+[Install]
+WantedBy=timers.target`
+
+// launchdUpdateTemplate is the template for the launchd job that runs a
+// scheduled Device Agent update
+const launchdUpdateTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>Label</key>
+    <string>{{.Label}}</string>
+    <key>ProgramArguments</key>
+    <array>
+{{range .Args}}        <string>{{html .}}</string>
+{{end}}    </array>
+    <key>StartCalendarInterval</key>
+    <dict>
+        <key>Hour</key>
+        <integer>{{.Hour}}</integer>
+        <key>Minute</key>
+        <integer>{{.Minute}}</integer>
+    </dict>
+</dict>
+</plist>`
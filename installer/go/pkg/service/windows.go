@@ -1,17 +1,14 @@
 package service
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"time"
 
+	"github.com/flowfuse/device-agent-installer/pkg/credentials"
+	"github.com/flowfuse/device-agent-installer/pkg/download"
 	"github.com/flowfuse/device-agent-installer/pkg/logger"
 	"github.com/flowfuse/device-agent-installer/pkg/nodejs"
 	"github.com/flowfuse/device-agent-installer/pkg/utils"
@@ -50,7 +47,7 @@ func nssmDownloadURLs() []string {
 //     - Standard output and error log files
 //     - Restart delay (30 seconds)
 //     - Node.js environment options (memory limit of 512MB)
-//     - Service user (LocalService)
+//     - Service user (LocalService, or the existing account with --use-existing-account)
 //
 // Parameters:
 //   - serviceName: The name to use for the Windows service
@@ -75,8 +72,17 @@ func InstallWindows(serviceName, workDir string, port int, caCertPath string) er
 
 	logger.Debug("Creating Windows service...")
 
+	// With DPAPI-encrypted credentials the service runs a launcher that
+	// decrypts the device configuration before starting the agent
+	if credentials.Encryption == credentials.ModeDPAPI {
+		if _, err := credentials.WindowsLauncher(workDir, deviceAgentPath, port, AgentArgs); err != nil {
+			return err
+		}
+	}
+	application := nssmApplication(deviceAgentPath)
+
 	// Install the service
-	installCmd := exec.Command(nssmPath, "install", serviceName, deviceAgentPath)
+	installCmd := exec.Command(nssmPath, "install", serviceName, application)
 	logger.Debug("Install command: %s", installCmd.String())
 	if output, err := installCmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to create service: %w\nOutput: %s", err, output)
@@ -87,6 +93,13 @@ func InstallWindows(serviceName, workDir string, port int, caCertPath string) er
 		return err
 	}
 
+	// A virtual service account only exists now that its service is registered
+	if utils.UseExistingAccount && utils.IsVirtualServiceAccount(utils.ServiceUsername) {
+		if err := utils.GrantServiceAccess(workDir); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -101,47 +114,123 @@ func InstallWindows(serviceName, workDir string, port int, caCertPath string) er
 // Returns:
 //   - error: nil on success, otherwise an error indicating the failure
 func configureService(nssmPath, serviceName, workDir string, port int, caCertPath string) error {
-	serviceParams := map[string]string{
+	for param, value := range nssmParameters(filepath.Join, workDir, port) {
+		if err := setNssmParam(nssmPath, serviceName, param, value); err != nil {
+			return err
+		}
+	}
+
+	if err := setServiceAccount(nssmPath, serviceName); err != nil {
+		return err
+	}
+
+	// The AppEnvironmentExtra parameter needs multiple values, which requires a direct command
+	envValues := append([]string{"set", serviceName, "AppEnvironmentExtra"}, nssmEnvironment(os.Getenv("PATH"), nodePath(filepath.Join, workDir), caCertPath)...)
+	envCmd := exec.Command(nssmPath, envValues...)
+	logger.Debug("Set environment command: %s", envCmd.String())
+	if output, err := envCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set environment variables: %w\nOutput: %s", err, output)
+	}
+
+	return nil
+}
+
+// nssmApplication returns the application the service runs: the Device Agent,
+// or PowerShell running the credential launcher with DPAPI-encrypted credentials.
+//
+// Parameters:
+//   - deviceAgentPath: The path of flowfuse-device-agent.cmd
+//
+// Returns:
+//   - string: The application path
+func nssmApplication(deviceAgentPath string) string {
+	if credentials.Encryption == credentials.ModeDPAPI {
+		return "powershell.exe"
+	}
+	return deviceAgentPath
+}
+
+// nssmParameters returns the NSSM parameters of the service, except the
+// account (see setServiceAccount) and the environment (see nssmEnvironment).
+//
+// Parameters:
+//   - join: Joins the elements of a path on the target system
+//   - workDir: The working directory for the service
+//   - port: The port the Device Agent listens on
+//
+// Returns:
+//   - map[string]string: The parameter values by name
+func nssmParameters(join func(elem ...string) string, workDir string, port int) map[string]string {
+	// The application gets the working directory and port, or the launcher script
+	appParams := fmt.Sprintf("--dir \"%s\" --port %d", workDir, port) + windowsArgs()
+	if credentials.Encryption == credentials.ModeDPAPI {
+		appParams = fmt.Sprintf("-NoProfile -ExecutionPolicy Bypass -File \"%s\"", join(workDir, "start-device-agent.ps1"))
+	}
+	return map[string]string{
 		"AppDirectory":                 workDir,
 		"DisplayName":                  fmt.Sprintf("FlowFuse Device Agent (%d)", port),
 		"Description":                  fmt.Sprintf("FlowFuse Device Agent Service running from %s on port %d", workDir, port),
-		"AppStdout":                    filepath.Join(workDir, "flowfuse-device-agent.log"),
-		"AppStderr":                    filepath.Join(workDir, "flowfuse-device-agent-error.log"),
+		"AppStdout":                    join(workDir, "flowfuse-device-agent.log"),
+		"AppStderr":                    join(workDir, "flowfuse-device-agent-error.log"),
 		"AppRestartDelay":              "30000",
-		"ObjectName":                   "LocalService",
 		"AppStdoutCreationDisposition": "4",
 		"AppStderrCreationDisposition": "4",
 		"AppRotateFiles":               "1",
 		"AppRotateOnline":              "1",
 		"AppRotateBytes":               "10240",
-		"AppParameters":                fmt.Sprintf("--dir=\"%s\"", workDir),
-	}
-
-	for param, value := range serviceParams {
-		if err := setNssmParam(nssmPath, serviceName, param, value); err != nil {
-			return err
-		}
+		"AppParameters":                appParams,
 	}
+}
 
-	// Configure environment variables
-	nodeOptions := "NODE_OPTIONS=--max_old_space_size=512"
-	// The AppEnvironmentExtra parameter needs multiple values, which requires a direct command
-	envValues := []string{"set", serviceName, "AppEnvironmentExtra", nodeOptions, os.Getenv("PATH")}
+// nssmEnvironment returns the values of the AppEnvironmentExtra parameter.
+//
+// Parameters:
+//   - path: The PATH of the service, with the Node.js directory first
+//   - nodePath: The directory of the extra Node-RED nodes, passed in NODE_PATH
+//   - caCertPath: The CA bundle passed in NODE_EXTRA_CA_CERTS, if any
+//
+// Returns:
+//   - []string: The environment values
+func nssmEnvironment(path, nodePath, caCertPath string) []string {
+	values := []string{"NODE_OPTIONS=--max_old_space_size=512", path, "NODE_PATH=" + nodePath}
 	if caCertPath != "" {
-		envValues = append(envValues, "NODE_EXTRA_CA_CERTS="+caCertPath)
+		values = append(values, "NODE_EXTRA_CA_CERTS="+caCertPath)
 	}
-	envCmd := exec.Command(nssmPath, envValues...)
-	logger.Debug("Set environment command: %s", envCmd.String())
-	if output, err := envCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to set environment variables: %w\nOutput: %s", err, output)
+	for _, v := range environmentVariables() {
+		values = append(values, v[0]+"="+v[1])
 	}
+	return values
+}
 
-	// Set AppParameters to include workdir and port
-	appParams := fmt.Sprintf("--dir \"%s\" --port %d", workDir, port)
-	if err := setNssmParam(nssmPath, serviceName, "AppParameters", appParams); err != nil {
-		return err
+// setServiceAccount sets the account the service runs as: LocalService, or
+// with --use-existing-account the account given with --service-user, e.g. a
+// domain user, a group managed service account (DOMAIN\name$) or a virtual
+// account (NT SERVICE\<service>). NSSM sets the account and grants it the
+// "Log on as a service" right. Accounts that need a password take it from the
+// FLOWFUSE_SERVICE_PASSWORD environment variable; it is then set through the
+// Service Control Manager rather than passed to nssm.exe, whose command line
+// other processes can read.
+//
+// Parameters:
+//   - nssmPath: The path to the NSSM executable
+//   - serviceName: The name of the service
+//
+// Returns:
+//   - error: nil on success, otherwise an error indicating the failure
+func setServiceAccount(nssmPath, serviceName string) error {
+	if !utils.UseExistingAccount {
+		return setNssmParam(nssmPath, serviceName, "ObjectName", "LocalService")
 	}
 
+	if err := setNssmParam(nssmPath, serviceName, "ObjectName", utils.ServiceUsername); err != nil {
+		return err
+	}
+	if password := os.Getenv("FLOWFUSE_SERVICE_PASSWORD"); password != "" {
+		logger.Debug("Setting the password of %s for service %s", utils.ServiceUsername, serviceName)
+		if err := setServicePassword(serviceName, utils.ServiceUsername, password); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -262,6 +351,18 @@ func IsInstalledWindows(serviceName string) bool {
 	return err == nil
 }
 
+// IsRunningWindows checks if a Windows service with the given name is running.
+//
+// Parameters:
+//   - serviceName: The name of the Windows service to check.
+//
+// Returns:
+//   - bool: true if the service state is RUNNING, false otherwise.
+func IsRunningWindows(serviceName string) bool {
+	output, err := exec.Command("sc.exe", "query", serviceName).CombinedOutput()
+	return err == nil && strings.Contains(string(output), "RUNNING")
+}
+
 // ensureNSSM ensures that the NSSM (Non-Sucking Service Manager) executable is available on the system.
 // It first tries to find an existing NSSM installation. If not found, it downloads and extracts
 // the specified version of NSSM to a directory within the application's working directory.
@@ -322,11 +423,11 @@ func ensureNSSM(workDir string) (string, error) {
 	return nssmPath, nil
 }
 
-// downloadNSSM downloads the NSSM archive to destPath. It tries each source
-// returned by nssmDownloadURLs in priority order, retrying transient failures
-// against each source before moving on to the next. The downloaded file is
-// verified against nssmZipSHA256, so a partially-written, corrupt or tampered
-// archive is rejected and treated as a failed attempt.
+// downloadNSSM downloads the NSSM archive to destPath using the shared download
+// client. It tries each source returned by nssmDownloadURLs in priority order,
+// retrying transient failures against each source before moving on to the next.
+// The downloaded file is verified against nssmZipSHA256, so a partially-written,
+// corrupt or tampered archive is rejected and treated as a failed attempt.
 //
 // Parameters:
 //   - destPath: The path the verified archive should be written to
@@ -335,76 +436,11 @@ func ensureNSSM(workDir string) (string, error) {
 //   - an error describing the last failure encountered across all sources
 //   - nil if a verified archive was downloaded successfully
 func downloadNSSM(destPath string) error {
-	var lastErr error
-	for _, url := range nssmDownloadURLs() {
-		for attempt := 1; attempt <= nssmDownloadRetries; attempt++ {
-			logger.Debug("Downloading NSSM from %s (attempt %d/%d)", url, attempt, nssmDownloadRetries)
-			if err := downloadAndVerify(url, destPath); err != nil {
-				lastErr = err
-				logger.Debug("NSSM download from %s failed: %v", url, err)
-				if attempt < nssmDownloadRetries {
-					time.Sleep(time.Duration(attempt) * 2 * time.Second)
-				}
-				continue
-			}
-			return nil
-		}
-	}
-	return fmt.Errorf("failed to download NSSM from all sources: %w", lastErr)
-}
-
-// downloadAndVerify fetches url, writes the body to destPath and verifies it
-// against nssmZipSHA256. On any failure the partial file is removed so a later
-// attempt or source starts from a clean slate.
-//
-// Parameters:
-//   - url: The URL to download the NSSM archive from
-//   - destPath: The path the archive should be written to
-//
-// Returns:
-//	 - error describing any failure encountered during the download or verification process,
-//   - nil if the archive was downloaded and verified successfully
-func downloadAndVerify(url, destPath string) error {
-	logger.Debug("Requesting NSSM archive from %s", url)
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	logger.Debug("Received response from %s: status=%s content-length=%d", url, resp.Status, resp.ContentLength)
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected response status: %s", resp.Status)
-	}
-
-	out, err := os.Create(destPath)
-	if err != nil {
-		return fmt.Errorf("failed to create download file: %w", err)
-	}
-
-	hasher := sha256.New()
-	written, err := io.Copy(io.MultiWriter(out, hasher), resp.Body)
-	if err != nil {
-		_ = out.Close()
-		_ = os.Remove(destPath)
-		return fmt.Errorf("failed to write download: %w", err)
-	}
-	if err := out.Close(); err != nil {
-		_ = os.Remove(destPath)
-		return fmt.Errorf("failed to finalize download: %w", err)
-	}
-	logger.Debug("Wrote %d bytes to %s", written, destPath)
-
-	sum := hex.EncodeToString(hasher.Sum(nil))
-	logger.Debug("Verifying NSSM checksum: computed=%s expected=%s", sum, nssmZipSHA256)
-	if !strings.EqualFold(sum, nssmZipSHA256) {
-		_ = os.Remove(destPath)
-		logger.Debug("NSSM checksum mismatch for %s (%d bytes), discarded %s", url, written, destPath)
-		return fmt.Errorf("checksum mismatch: got %s, expected %s", sum, nssmZipSHA256)
-	}
-	logger.Debug("NSSM checksum verified successfully for download from %s", url)
-
-	return nil
+	return download.File(nssmDownloadURLs(), destPath, download.Options{
+		Label:   fmt.Sprintf("NSSM %s", nssmVersion),
+		SHA256:  nssmZipSHA256,
+		Retries: nssmDownloadRetries,
+	})
 }
 
 // findNSSM searches for the NSSM (Non-Sucking Service Manager) executable in the workdir/nssm directory.
@@ -428,3 +464,25 @@ func findNSSM(workDir string) (string, error) {
 
 	return "", fmt.Errorf("NSSM not found")
 }
+
+// exportDefinitionWindows returns the NSSM configuration of serviceName as
+// the batch script printed by "nssm dump", and the credential launcher script
+// if the service uses one.
+func exportDefinitionWindows(serviceName, workDir string) (map[string][]byte, error) {
+	nssmPath, err := findNSSM(workDir)
+	if err != nil {
+		return nil, err
+	}
+	dumpCmd := exec.Command(nssmPath, "dump", serviceName)
+	output, err := dumpCmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump service configuration: %w", err)
+	}
+	files := map[string][]byte{serviceName + "-nssm.bat": output}
+
+	// In dpapi mode the service runs the launcher script, which runs the agent
+	if launcher, err := os.ReadFile(filepath.Join(workDir, "start-device-agent.ps1")); err == nil {
+		files["start-device-agent.ps1"] = launcher
+	}
+	return files, nil
+}
@@ -115,3 +115,45 @@ func Yellow(s string) string { return wrap("33", s) }
 
 // Red renders s in red. Mirrors chalk.red.
 func Red(s string) string { return wrap("31", s) }
+
+// Interactive reports whether stdout is a control-capable terminal, i.e. whether
+// in-place updates such as a progress bar (carriage return + redraw) render
+// correctly. It is false when output is piped/redirected or TERM=dumb.
+func Interactive() bool { return controlEnabled }
+
+// ProgressBar renders a fixed-width bar such as "[=======>      ]" for the
+// given fraction (0.0-1.0). Values outside that range are clamped. The filled
+// part is coloured cyan when styling is enabled.
+func ProgressBar(fraction float64, width int) string {
+	if width < 3 {
+		width = 3
+	}
+	if fraction < 0 {
+		fraction = 0
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	filled := int(fraction * float64(width))
+	bar := make([]byte, 0, width)
+	for i := 0; i < width; i++ {
+		switch {
+		case i < filled:
+			bar = append(bar, '=')
+		case i == filled && filled < width:
+			bar = append(bar, '>')
+		default:
+			bar = append(bar, ' ')
+		}
+	}
+	return "[" + Cyan(string(bar[:filled])) + string(bar[filled:]) + "]"
+}
+
+// ClearLine returns the cursor to the start of the current line and erases it,
+// so the next write replaces it. It is a no-op on non-control terminals.
+func ClearLine() {
+	if !controlEnabled {
+		return
+	}
+	fmt.Fprint(os.Stdout, "\r\x1b[2K")
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin
+
+package utils
+
+import "os/exec"
+
+// serviceAccountExists reports whether an account exists, including accounts
+// provided by LDAP or SSSD through NSS.
+//
+// Parameters:
+//   - name: the account name
+//
+// Returns:
+//   - bool: true if the account exists
+//
+// Note: this function is implemented for Unix-like systems (Linux, macOS).
+func serviceAccountExists(name string) bool {
+	return exec.Command("id", name).Run() == nil
+}
@@ -0,0 +1,25 @@
+//go:build windows
+
+package utils
+
+import "golang.org/x/sys/windows"
+
+// serviceAccountExists reports whether an account exists, including domain
+// and group managed service accounts. Virtual service accounts
+// (NT SERVICE\<name>) only exist once their service is registered, so they
+// are accepted without a lookup.
+//
+// Parameters:
+//   - name: the account name, e.g. DOMAIN\user or NT SERVICE\<service>
+//
+// Returns:
+//   - bool: true if the account exists
+//
+// Note: this function is implemented for Windows systems.
+func serviceAccountExists(name string) bool {
+	if IsVirtualServiceAccount(name) {
+		return true
+	}
+	_, _, _, err := windows.LookupSID("", name)
+	return err == nil
+}
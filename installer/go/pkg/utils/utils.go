@@ -11,8 +11,11 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/flowfuse/device-agent-installer/pkg/certs"
 	"github.com/flowfuse/device-agent-installer/pkg/logger"
 	"github.com/flowfuse/device-agent-installer/pkg/style"
 
@@ -22,19 +25,80 @@ import (
 // Global variable to store the service username
 var ServiceUsername = "flowfuse"
 
+// UseExistingAccount runs the service as an existing account
+// (--use-existing-account): ServiceUsername is validated but never created or
+// removed, e.g. an LDAP/SSSD user on Linux or a domain, managed or virtual
+// service account on Windows.
+var UseExistingAccount bool
+
+// Service account settings applied when the service user is created
+// (--service-uid, --service-gid, --service-home) and the supplementary groups
+// it is kept a member of (--service-groups). Zero or empty values select the
+// system defaults; a nil ServiceGroups leaves group membership untouched.
+var (
+	ServiceUID    int
+	ServiceGID    int
+	ServiceHome   string
+	ServiceGroups []string
+)
+
 // DefaultPort is the default TCP port for the device agent when not specified elsewhere
 // This can be overridden at runtime by the CLI flag in main.go
 var DefaultPort = 1880
 
-// DeviceConfig represents the expected structure of the device.yml configuration file
+// RootDir is prepended to the Linux system paths the installer manages: the
+// default working directory and the locations of systemd units and init
+// scripts. It is empty in normal use; the end-to-end tests point it at a
+// scratch directory so that an install never touches the host.
+var RootDir string
+
+// SystemPath returns an absolute system path below RootDir.
+//
+// Parameters:
+//   - path: The absolute path, e.g. "/etc/init.d/flowfuse-device-agent-1880"
+//
+// Returns:
+//   - string: The path below RootDir, or path itself when RootDir is empty
+func SystemPath(path string) string {
+	if RootDir == "" {
+		return path
+	}
+	return filepath.Join(RootDir, path)
+}
+
+// DeviceConfig represents the expected structure of the device.yml configuration file.
+// A registered device has deviceId, token, credentialSecret and the broker
+// credentials; a provisioning configuration instead has provisioningTeam and
+// provisioningToken, which the Device Agent exchanges for a new device on its
+// first start.
 type DeviceConfig struct {
-	DeviceID         string `yaml:"deviceId"`
-	Token            string `yaml:"token"`
-	CredentialSecret string `yaml:"credentialSecret"`
-	ForgeURL         string `yaml:"forgeURL"`
-	BrokerURL        string `yaml:"brokerURL"`
-	BrokerUsername   string `yaml:"brokerUsername"`
-	BrokerPassword   string `yaml:"brokerPassword"`
+	DeviceID          string `yaml:"deviceId,omitempty"`
+	Token             string `yaml:"token,omitempty"`
+	CredentialSecret  string `yaml:"credentialSecret,omitempty"`
+	ForgeURL          string `yaml:"forgeURL"`
+	BrokerURL         string `yaml:"brokerURL,omitempty"`
+	BrokerUsername    string `yaml:"brokerUsername,omitempty"`
+	BrokerPassword    string `yaml:"brokerPassword,omitempty"`
+	ProvisioningName  string `yaml:"provisioningName,omitempty"`
+	ProvisioningTeam  string `yaml:"provisioningTeam,omitempty"`
+	ProvisioningToken string `yaml:"provisioningToken,omitempty"`
+}
+
+// stdin buffers standard input for all prompts, so that answers piped in
+// ahead of time (e.g. printf 'y\ny\n' | installer --uninstall) are not lost
+// between prompts. It is recreated when os.Stdin is replaced.
+var (
+	stdin     *bufio.Reader
+	stdinFile *os.File
+)
+
+// stdinReader returns the shared reader of standard input.
+func stdinReader() *bufio.Reader {
+	if stdin == nil || stdinFile != os.Stdin {
+		stdin = bufio.NewReader(os.Stdin)
+		stdinFile = os.Stdin
+	}
+	return stdin
 }
 
 // PromptYesNo prompts the user with a yes/no question and returns the boolean result
@@ -46,7 +110,7 @@ type DeviceConfig struct {
 // Returns:
 //   - bool: true for yes responses (y, yes, Y, YES), false for no or invalid responses
 func PromptYesNo(question string, defaultResponse bool) bool {
-	reader := bufio.NewReader(os.Stdin)
+	reader := stdinReader()
 
 	// Mark where the prompt begins so it (and any invalid-input retries) can be
 	// collapsed once answered.
@@ -95,7 +159,7 @@ func PromptYesNo(question string, defaultResponse bool) bool {
 // Returns:
 //   - string: The trimmed user input, or defaultValue when the input is empty
 func PromptText(question, defaultValue string) string {
-	reader := bufio.NewReader(os.Stdin)
+	reader := stdinReader()
 
 	// Mark where the prompt begins so it can be collapsed once answered.
 	style.SaveCursor()
@@ -132,7 +196,7 @@ func PromptText(question, defaultValue string) string {
 //   - string: The complete multiline input (without the final empty line)
 //   - error: Any error that occurred while reading input
 func PromptMultilineInput() (string, error) {
-	reader := bufio.NewReader(os.Stdin)
+	reader := stdinReader()
 
 	var lines []string
 
@@ -161,6 +225,137 @@ func PromptMultilineInput() (string, error) {
 	return strings.Join(lines, "\n"), nil
 }
 
+// ResolveOneTimeCode returns the one-time code (OTC) from the source that
+// provides one: the --otc flag, a file (--otc-file), the first line of
+// standard input (--otc-stdin), or the FLOWFUSE_OTC environment variable.
+// Only one source may be given, so a stale FLOWFUSE_OTC is not silently
+// overridden or used instead of the intended code. The file and environment
+// variable keep the code out of the process list and shell history.
+//
+// Parameters:
+//   - flagValue: The value of --otc
+//   - filePath: The path given with --otc-file, or empty
+//   - fromStdin: Whether --otc-stdin was given
+//
+// Returns:
+//   - string: The one-time code, empty if none was provided
+//   - error: An error if more than one source is given, or the file or
+//     standard input could not be read or is empty
+func ResolveOneTimeCode(flagValue, filePath string, fromStdin bool) (string, error) {
+	var sources []string
+	if flagValue != "" {
+		sources = append(sources, "--otc")
+	}
+	if filePath != "" {
+		sources = append(sources, "--otc-file")
+	}
+	if fromStdin {
+		sources = append(sources, "--otc-stdin")
+	}
+	if strings.TrimSpace(os.Getenv("FLOWFUSE_OTC")) != "" {
+		sources = append(sources, "FLOWFUSE_OTC")
+	}
+	if len(sources) > 1 {
+		return "", fmt.Errorf("the one-time code is given with %s, use only one of them", strings.Join(sources, ", "))
+	}
+
+	switch {
+	case flagValue != "":
+		return strings.TrimSpace(flagValue), nil
+
+	case filePath != "":
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read one-time code file: %w", err)
+		}
+		if info, err := os.Stat(filePath); err == nil && runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+			logger.Info("Warning: %s is readable by other users, restrict it with chmod 600", filePath)
+		}
+		otc := strings.TrimSpace(string(content))
+		if otc == "" {
+			return "", fmt.Errorf("one-time code file %s is empty", filePath)
+		}
+		return otc, nil
+
+	case fromStdin:
+		line, err := stdinReader().ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read one-time code from standard input: %w", err)
+		}
+		otc := strings.TrimSpace(line)
+		if otc == "" {
+			return "", fmt.Errorf("no one-time code provided on standard input")
+		}
+		return otc, nil
+	}
+
+	return strings.TrimSpace(os.Getenv("FLOWFUSE_OTC")), nil
+}
+
+// ResolveProvisioningConfiguration returns the provisioning device.yml
+// content from a file (--provisioning-file) or built from the
+// --provisioning-token, --provisioning-team and --provisioning-name flags.
+// The content is validated with ValidateDeviceConfiguration.
+//
+// Parameters:
+//   - url: The FlowFuse URL written as forgeURL when the flags are used
+//   - team: The team ID the devices are registered in
+//   - token: The provisioning token
+//   - name: The provisioning name shown as the device type, or empty
+//   - filePath: The path given with --provisioning-file, or empty
+//
+// Returns:
+//   - string: The device.yml content, empty if no provisioning input was given
+//   - error: An error if the file cannot be read or the configuration is incomplete
+func ResolveProvisioningConfiguration(url, team, token, name, filePath string) (string, error) {
+	var content string
+	switch {
+	case filePath != "":
+		if token != "" || team != "" || name != "" {
+			return "", fmt.Errorf("--provisioning-file cannot be combined with --provisioning-token, --provisioning-team or --provisioning-name")
+		}
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read provisioning file: %w", err)
+		}
+		if info, err := os.Stat(filePath); err == nil && runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+			logger.Info("Warning: %s is readable by other users, restrict it with chmod 600", filePath)
+		}
+		content = string(data)
+		var config DeviceConfig
+		if err := yaml.Unmarshal(data, &config); err == nil && config.ProvisioningToken == "" {
+			return "", fmt.Errorf("provisioning file %s has no provisioningToken", filePath)
+		}
+		logger.RegisterSecret(config.ProvisioningToken)
+
+	case token != "" || team != "" || name != "":
+		if token == "" {
+			return "", fmt.Errorf("--provisioning-token is required with --provisioning-team and --provisioning-name")
+		}
+		if url == "" {
+			return "", fmt.Errorf("--url is required with --provisioning-token")
+		}
+		data, err := yaml.Marshal(DeviceConfig{
+			ForgeURL:          url,
+			ProvisioningName:  name,
+			ProvisioningTeam:  team,
+			ProvisioningToken: token,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to create provisioning configuration: %w", err)
+		}
+		content = string(data)
+
+	default:
+		return "", nil
+	}
+
+	if err := ValidateDeviceConfiguration(content); err != nil {
+		return "", fmt.Errorf("invalid provisioning configuration: %w", err)
+	}
+	return content, nil
+}
+
 // PromptOption prompts the user to select from multiple options and returns the selected index.
 // This function provides a flexible way to present multiple choices to the user with numbered options.
 //
@@ -180,7 +375,7 @@ func PromptOption(question string, options []string, defaultIndex int) (int, err
 		return -1, fmt.Errorf("invalid default index: %d", defaultIndex)
 	}
 
-	reader := bufio.NewReader(os.Stdin)
+	reader := stdinReader()
 
 	// Mark where the prompt begins so it (and any invalid-input retries) can be
 	// collapsed once answered.
@@ -325,13 +520,30 @@ func checkWindowsPermissions() error {
 //   - string: The default path to the working directory
 //   - error: nil if successful, otherwise an error describing what went wrong
 func getDefaultWorkingDirectory() (string, error) {
-	switch runtime.GOOS {
+	workDir, err := DefaultWorkingDirectoryFor(runtime.GOOS)
+	if err != nil || runtime.GOOS == "windows" {
+		return workDir, err
+	}
+	return SystemPath(workDir), nil
+}
+
+// DefaultWorkingDirectoryFor returns the default working directory on an
+// operating system, e.g. to render service definitions for another system.
+//
+// Parameters:
+//   - goos: The operating system (linux, darwin or windows)
+//
+// Returns:
+//   - string: The default path to the working directory
+//   - error: An error if the operating system is not supported
+func DefaultWorkingDirectoryFor(goos string) (string, error) {
+	switch goos {
 	case "linux", "darwin":
 		return "/opt/flowfuse-device", nil
 	case "windows":
 		return `c:\opt\flowfuse-device`, nil
 	default:
-		return "", fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+		return "", fmt.Errorf("unsupported operating system: %s", goos)
 	}
 }
 
@@ -380,9 +592,7 @@ func GetWorkingDirectory(customPath string) (string, error) {
 // Before creating directory, it creates a service user with the specified username and password.
 // On Linux systems, the function first attempts to create the directory without sudo. If that fails, it tries with sudo. After creation, it sets
 // the ownership of the directory to a service user.
-// On Windows systems, it creates the directory, then grants Modify permissions to LocalService (SID S-1-5-19) with inheritance for files and subdirectories.
-// This mirrors: icacls "path" /grant "NT AUTHORITY\LocalService":M
-// Using the SID and (OI)(CI) for inheritance; /T applies to existing children as well.
+// On Windows systems, it creates the directory, then grants Modify permissions to the service account with GrantServiceAccess.
 //
 // Parameters:
 //   - path: The file system path where the directory should be created
@@ -393,7 +603,7 @@ func GetWorkingDirectory(customPath string) (string, error) {
 //
 // Note: Currently, this function only supports Linux. Other operating systems will return an error.
 func createDirWithPermissions(path string, permissions os.FileMode) error {
-	serviceUser, err := CreateServiceUser(ServiceUsername)
+	serviceUser, err := EnsureServiceAccount(ServiceUsername)
 	if err != nil {
 		return fmt.Errorf("failed to create service user: %w", err)
 	}
@@ -426,24 +636,48 @@ func createDirWithPermissions(path string, permissions os.FileMode) error {
 			return fmt.Errorf("failed to create directory %s: %w", path, err)
 		}
 
-		logger.Debug("Granting Modify permission to LocalService on %s...", path)
-		cmd := exec.Command("icacls", path, "/grant", `*S-1-5-19:(OI)(CI)M`, "/T")
-		if output, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("failed to grant Modify to LocalService on %s: %w\nOutput: %s", path, err, output)
+		if UseExistingAccount && IsVirtualServiceAccount(ServiceUsername) {
+			logger.Debug("Access for %s is granted once its service is registered", ServiceUsername)
+			return nil
 		}
-		return nil
+		return GrantServiceAccess(path)
 
 	default:
 		return fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
 	}
 }
 
+// GrantServiceAccess grants Modify permissions on a directory to the account
+// running the service on Windows (LocalService, SID S-1-5-19, unless
+// UseExistingAccount is set) with inheritance for files and subdirectories.
+// This mirrors: icacls "path" /grant "NT AUTHORITY\LocalService":M
+// Using (OI)(CI) for inheritance; /T applies to existing children as well.
+//
+// Parameters:
+//   - path: The directory to grant access to
+//
+// Returns:
+//   - error: An error if the permissions could not be applied
+func GrantServiceAccess(path string) error {
+	account := ServiceAccountACLName()
+	logger.Debug("Granting Modify permission to %s on %s...", account, path)
+	cmd := exec.Command("icacls", path, "/grant", account+":(OI)(CI)M", "/T")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to grant Modify to %s on %s: %w\nOutput: %s", account, path, err, output)
+	}
+	return nil
+}
+
 // CreateServiceUser creates a system user with the given username if it doesn't already exist.
 // For Unix systems, it checks if the user exists by calling the "id" command.
-// If the user doesn't exist, it creates the user with a home directory and no shell.
-// On Linux, it uses "useradd" to create the user.
+// If the user doesn't exist, it creates the user with a home directory and no shell,
+// using ServiceUID, ServiceGID and ServiceHome when they are set.
+// On Linux, it uses "useradd" to create the user; with ServiceGID set, the user's
+// group is created first with that GID.
 // On macOS, it uses "sysadminctl" to create the user.
 // For Windows systems, we do not create a user.
+// An existing user is left unchanged; a UID or home directory that differs from
+// the requested one is reported as a warning.
 //
 // Parameters:
 //   - username: the name of the user to create
@@ -452,19 +686,45 @@ func createDirWithPermissions(path string, permissions os.FileMode) error {
 //   - string: the username of the created or existing service user
 //   - error: an error if the user creation failed or if the operating system is not supported
 func CreateServiceUser(username string) (string, error) {
+	home := ServiceHome
+	if home == "" {
+		home = fmt.Sprintf("/home/%s", username)
+	}
+
 	switch runtime.GOOS {
 	case "linux":
 		checkUserCmd := exec.Command("id", username)
 		if err := checkUserCmd.Run(); err == nil {
 			logger.Debug("Service user %s already exists", username)
+			warnServiceUserMismatch(username)
 		} else {
 			logger.Info("Creating service user %s...", username)
 			checkGroupCmd := exec.Command("getent", "group", username)
 			groupExists := checkGroupCmd.Run() == nil
 
+			useradd := checkBinaryExists("useradd", true)
+			if !groupExists && ServiceGID != 0 {
+				var createGroupCmd *exec.Cmd
+				if useradd {
+					createGroupCmd = exec.Command("sudo", "groupadd", "--system", "--gid", strconv.Itoa(ServiceGID), username)
+				} else {
+					createGroupCmd = exec.Command("sudo", "addgroup", "--system", "--gid", strconv.Itoa(ServiceGID), username)
+				}
+				logger.Debug("Command used to create group: %s", createGroupCmd.String())
+				if output, err := createGroupCmd.CombinedOutput(); err != nil {
+					return "", fmt.Errorf("failed to create group %s: %w\nOutput: %s", username, err, output)
+				}
+				groupExists = true
+			} else if groupExists && ServiceGID != 0 {
+				logger.Info("Warning: group %s already exists, --service-gid %d is not applied", username, ServiceGID)
+			}
+
 			var createUserCmd *exec.Cmd
-			if checkBinaryExists("useradd", true) {
-				args := []string{"sudo", "useradd", "--system", "--create-home", "--home-dir", fmt.Sprintf("/home/%s", username), "--shell", "/sbin/nologin"}
+			if useradd {
+				args := []string{"sudo", "useradd", "--system", "--create-home", "--home-dir", home, "--shell", "/sbin/nologin"}
+				if ServiceUID != 0 {
+					args = append(args, "--uid", strconv.Itoa(ServiceUID))
+				}
 				if groupExists {
 					logger.Debug("Group %s already exists, adding user to existing group", username)
 					args = append(args, "-g", username)
@@ -473,7 +733,10 @@ func CreateServiceUser(username string) (string, error) {
 				createUserCmd = exec.Command(args[0], args[1:]...)
 				logger.Debug("Command used to create user: %s", strings.Join(args, " "))
 			} else {
-				args := []string{"sudo", "adduser", "--system", "--shell", "/sbin/nologin", "--home", fmt.Sprintf("/home/%s", username)}
+				args := []string{"sudo", "adduser", "--system", "--shell", "/sbin/nologin", "--home", home}
+				if ServiceUID != 0 {
+					args = append(args, "--uid", strconv.Itoa(ServiceUID))
+				}
 				if groupExists {
 					logger.Debug("Group %s already exists, adding user to existing group", username)
 					args = append(args, "--ingroup", username)
@@ -493,19 +756,36 @@ func CreateServiceUser(username string) (string, error) {
 		checkUserCmd := exec.Command("id", username)
 		if err := checkUserCmd.Run(); err == nil {
 			logger.Debug("Service user %s already exists", username)
+			warnServiceUserMismatch(username)
 		} else {
 			// Create the user
 			logger.Info("Creating service user %s...", username)
-			createUserCmd := exec.Command("sudo", "sysadminctl", "-addUser", username, "-shell", "/usr/bin/false")
+			args := []string{"sudo", "sysadminctl", "-addUser", username, "-shell", "/usr/bin/false"}
+			if ServiceUID != 0 {
+				args = append(args, "-UID", strconv.Itoa(ServiceUID))
+			}
+			if ServiceHome != "" {
+				args = append(args, "-home", ServiceHome)
+			}
+			createUserCmd := exec.Command(args[0], args[1:]...)
 			if output, err := createUserCmd.CombinedOutput(); err != nil {
 				return "", fmt.Errorf("failed to create user: %w\nOutput: %s", err, output)
 			}
+			if ServiceGID != 0 {
+				gidCmd := exec.Command("sudo", "dscl", ".", "-create", "/Users/"+username, "PrimaryGroupID", strconv.Itoa(ServiceGID))
+				if output, err := gidCmd.CombinedOutput(); err != nil {
+					return "", fmt.Errorf("failed to set primary group of %s: %w\nOutput: %s", username, err, output)
+				}
+			}
 		}
 		logger.Debug("Service user %s created successfully", username)
 		return username, nil
 
 	case "windows":
 		logger.Debug("On Windows, we do not create a service user.")
+		if ServiceUID != 0 || ServiceGID != 0 || ServiceHome != "" || len(ServiceGroups) > 0 {
+			logger.Info("Warning: service account options are ignored on Windows")
+		}
 		return username, nil
 
 	default:
@@ -513,6 +793,208 @@ func CreateServiceUser(username string) (string, error) {
 	}
 }
 
+// EnsureServiceAccount makes sure the service account exists: it is created
+// with CreateServiceUser, or, with UseExistingAccount, validated to exist.
+//
+// Parameters:
+//   - username: the name of the service account
+//
+// Returns:
+//   - string: the name of the service account
+//   - error: an error if the account could not be created or does not exist
+func EnsureServiceAccount(username string) (string, error) {
+	if !UseExistingAccount {
+		return CreateServiceUser(username)
+	}
+	if !serviceAccountExists(username) {
+		return "", fmt.Errorf("service account %s does not exist; it must be created before installing with --use-existing-account", username)
+	}
+	logger.Debug("Using existing service account %s", username)
+	if runtime.GOOS != "windows" {
+		warnServiceUserMismatch(username)
+	}
+	return username, nil
+}
+
+// ServiceOwner returns the owner argument for chown of files belonging to the
+// service user on Linux: user and group of the same name for an account
+// created by the installer, or the user and its login group for an existing
+// account, whose primary group may be named differently.
+//
+// Returns:
+//   - string: the owner in chown's user:group form
+func ServiceOwner() string {
+	if UseExistingAccount {
+		return ServiceUsername + ":"
+	}
+	return ServiceUsername + ":" + ServiceUsername
+}
+
+// IsVirtualServiceAccount reports whether name is a Windows virtual service
+// account (NT SERVICE\<service>), which only exists once its service is registered.
+//
+// Parameters:
+//   - name: the account name
+//
+// Returns:
+//   - bool: true for a virtual service account
+func IsVirtualServiceAccount(name string) bool {
+	return strings.HasPrefix(strings.ToUpper(name), `NT SERVICE\`)
+}
+
+// ServiceAccountACLName returns the name used in icacls grants for the account
+// running the service on Windows: LocalService by default, or the existing
+// account with UseExistingAccount.
+//
+// Returns:
+//   - string: the account name or SID (prefixed with '*') for icacls
+func ServiceAccountACLName() string {
+	if UseExistingAccount {
+		return ServiceUsername
+	}
+	return "*S-1-5-19"
+}
+
+// warnServiceUserMismatch reports requested account settings that an existing
+// service user does not have. Existing accounts are never modified, as their
+// files may be owned by the current UID.
+//
+// Parameters:
+//   - username: the name of the existing service user
+func warnServiceUserMismatch(username string) {
+	if ServiceUID != 0 {
+		if output, err := exec.Command("id", "-u", username).Output(); err == nil && strings.TrimSpace(string(output)) != strconv.Itoa(ServiceUID) {
+			logger.Info("Warning: service user %s already exists with UID %s, --service-uid %d is not applied", username, strings.TrimSpace(string(output)), ServiceUID)
+		}
+	}
+	if ServiceGID != 0 {
+		if output, err := exec.Command("id", "-g", username).Output(); err == nil && strings.TrimSpace(string(output)) != strconv.Itoa(ServiceGID) {
+			logger.Info("Warning: service user %s already exists with GID %s, --service-gid %d is not applied", username, strings.TrimSpace(string(output)), ServiceGID)
+		}
+	}
+	if ServiceHome != "" {
+		if home := userHomeDir(username); home != "" && home != ServiceHome {
+			logger.Info("Warning: service user %s already exists with home directory %s, --service-home %s is not applied", username, home, ServiceHome)
+		}
+	}
+}
+
+// userHomeDir returns the home directory of a user, or an empty string if it
+// cannot be determined.
+func userHomeDir(username string) string {
+	switch runtime.GOOS {
+	case "linux":
+		output, err := exec.Command("getent", "passwd", username).Output()
+		if err != nil {
+			return ""
+		}
+		if fields := strings.Split(strings.TrimSpace(string(output)), ":"); len(fields) >= 6 {
+			return fields[5]
+		}
+	case "darwin":
+		output, err := exec.Command("dscl", ".", "-read", "/Users/"+username, "NFSHomeDirectory").Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(output)), "NFSHomeDirectory:"))
+	}
+	return ""
+}
+
+// ReconcileServiceGroups makes the service user a member of exactly the
+// requested supplementary groups (ServiceGroups), so hardware access groups
+// such as dialout or gpio can be granted and revoked by re-running the
+// installer. Only groups from previous are removed, so memberships added
+// outside the installer are kept. Groups that do not exist on the system are
+// skipped with a warning. When ServiceGroups is nil nothing is changed.
+//
+// Parameters:
+//   - username: the name of the service user
+//   - previous: the supplementary groups recorded by the previous install
+//
+// Returns:
+//   - error: an error if changing a group membership failed
+func ReconcileServiceGroups(username string, previous []string) error {
+	if ServiceGroups == nil || runtime.GOOS == "windows" {
+		return nil
+	}
+	logger.LogFunctionEntry("ReconcileServiceGroups", map[string]interface{}{
+		"username": username,
+		"groups":   ServiceGroups,
+		"previous": previous,
+	})
+
+	current := map[string]bool{}
+	if output, err := exec.Command("id", "-Gn", username).Output(); err == nil {
+		for _, group := range strings.Fields(string(output)) {
+			current[group] = true
+		}
+	}
+	wanted := map[string]bool{}
+	for _, group := range ServiceGroups {
+		wanted[group] = true
+	}
+
+	for _, group := range ServiceGroups {
+		if current[group] {
+			continue
+		}
+		if !groupExists(group) {
+			logger.Info("Warning: group %s does not exist, %s is not added to it", group, username)
+			continue
+		}
+		logger.Info("Adding service user %s to group %s...", username, group)
+		if output, err := groupMembershipCmd(username, group, true).CombinedOutput(); err != nil {
+			logger.LogFunctionExit("ReconcileServiceGroups", nil, err)
+			return fmt.Errorf("failed to add %s to group %s: %w\nOutput: %s", username, group, err, output)
+		}
+	}
+
+	for _, group := range previous {
+		if wanted[group] || !current[group] || group == username {
+			continue
+		}
+		logger.Info("Removing service user %s from group %s...", username, group)
+		if output, err := groupMembershipCmd(username, group, false).CombinedOutput(); err != nil {
+			logger.LogFunctionExit("ReconcileServiceGroups", nil, err)
+			return fmt.Errorf("failed to remove %s from group %s: %w\nOutput: %s", username, group, err, output)
+		}
+	}
+
+	logger.LogFunctionExit("ReconcileServiceGroups", "success", nil)
+	return nil
+}
+
+// groupExists reports whether a group exists on the system.
+func groupExists(group string) bool {
+	if runtime.GOOS == "darwin" {
+		return exec.Command("dscl", ".", "-read", "/Groups/"+group).Run() == nil
+	}
+	return exec.Command("getent", "group", group).Run() == nil
+}
+
+// groupMembershipCmd returns the command adding username to (add) or removing
+// it from a supplementary group, using the tools available on the system.
+func groupMembershipCmd(username, group string, add bool) *exec.Cmd {
+	if runtime.GOOS == "darwin" {
+		op := "-d"
+		if add {
+			op = "-a"
+		}
+		return exec.Command("sudo", "dseditgroup", "-o", "edit", op, username, "-t", "user", group)
+	}
+	if add {
+		if checkBinaryExists("usermod", true) {
+			return exec.Command("sudo", "usermod", "-aG", group, username)
+		}
+		return exec.Command("sudo", "adduser", username, group)
+	}
+	if checkBinaryExists("gpasswd", true) {
+		return exec.Command("sudo", "gpasswd", "-d", username, group)
+	}
+	return exec.Command("sudo", "deluser", username, group)
+}
+
 // RemoveServiceUser deletes the specified service user account from the system.
 // On Linux, it executes "userdel -r" with sudo to remove the user and their home directory.
 // It also checks for and removes the associated group if it exists.
@@ -857,7 +1339,7 @@ func ExtractTarGz(tarGzFile, destDir, version string) error {
 	// Set ownership of all files to the service user
 	var chownCmd *exec.Cmd
 	if runtime.GOOS == "linux" {
-		chownCmd = exec.Command("sudo", "chown", "-R", ServiceUsername+":"+ServiceUsername, destDir)
+		chownCmd = exec.Command("sudo", "chown", "-R", ServiceOwner(), destDir)
 	} else {
 		chownCmd = exec.Command("sudo", "chown", "-R", ServiceUsername, destDir)
 	}
@@ -1006,7 +1488,8 @@ func RemoveDirectory(dir string) error {
 }
 
 // ValidateDeviceConfiguration validates the device.yml configuration content
-// It checks for valid YAML syntax and presence of all required fields
+// It checks for valid YAML syntax and presence of all required fields, either
+// those of a registered device or those of a provisioning configuration
 //
 // Parameters:
 //   - configContent: The YAML configuration content as a string
@@ -1026,6 +1509,20 @@ func ValidateDeviceConfiguration(configContent string) error {
 	// Check for required fields
 	missingFields := []string{}
 
+	// A provisioning configuration only needs the platform, team and token
+	if config.ProvisioningToken != "" {
+		if config.ForgeURL == "" {
+			missingFields = append(missingFields, "forgeURL")
+		}
+		if config.ProvisioningTeam == "" {
+			missingFields = append(missingFields, "provisioningTeam")
+		}
+		if len(missingFields) > 0 {
+			return fmt.Errorf("missing required fields: %s", strings.Join(missingFields, ", "))
+		}
+		return nil
+	}
+
 	if config.DeviceID == "" {
 		missingFields = append(missingFields, "deviceId")
 	}
@@ -1056,7 +1553,8 @@ func ValidateDeviceConfiguration(configContent string) error {
 }
 
 // SaveDeviceConfiguration saves the device configuration content to the specified file path
-// On Unix systems, it uses sudo to write the file with proper ownership and permissions
+// On Unix systems, it uses sudo to write the file; the file is then restricted
+// to the service user with SecureDeviceConfiguration
 //
 // Parameters:
 //   - configContent: The YAML configuration content as a string
@@ -1090,7 +1588,7 @@ func SaveDeviceConfiguration(configContent, filePath string) error {
 		}
 
 	case "windows":
-		if err := os.WriteFile(filePath, []byte(configContent), 0644); err != nil {
+		if err := os.WriteFile(filePath, []byte(configContent), 0600); err != nil {
 			return fmt.Errorf("failed to write configuration file %s: %w", filePath, err)
 		}
 
@@ -1098,10 +1596,187 @@ func SaveDeviceConfiguration(configContent, filePath string) error {
 		return fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
 	}
 
+	if err := SecureDeviceConfiguration(filePath); err != nil {
+		return err
+	}
+
 	logger.Info("Device configuration saved successfully to: %s", filePath)
 	return nil
 }
 
+// SecureDeviceConfiguration restricts a device configuration file, which holds
+// the device credentials, to its owner.
+// On Linux and macOS the file is set to mode 0600 and owned by the service user.
+// On Windows inherited permissions are removed and access is granted to
+// SYSTEM, Administrators and the account running the agent only.
+//
+// Parameters:
+//   - filePath: The path of the configuration file
+//
+// Returns:
+//   - error: nil if the permissions were applied, error if the operation failed
+func SecureDeviceConfiguration(filePath string) error {
+	var cmds []*exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		cmds = append(cmds,
+			exec.Command("sudo", "chown", ServiceOwner(), filePath),
+			exec.Command("sudo", "chmod", "600", filePath))
+	case "darwin":
+		cmds = append(cmds,
+			exec.Command("sudo", "chown", ServiceUsername, filePath),
+			exec.Command("sudo", "chmod", "600", filePath))
+	case "windows":
+		// Well-known SIDs: SYSTEM and Administrators, plus the service account
+		cmds = append(cmds, exec.Command("icacls", filePath, "/inheritance:r",
+			"/grant:r", "*S-1-5-18:F", "*S-1-5-32-544:F", ServiceAccountACLName()+":M"))
+	default:
+		return fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+	}
+
+	for _, cmd := range cmds {
+		logger.Debug("Securing configuration file: %s", cmd.String())
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to restrict permissions of %s: %w\nOutput: %s", filePath, err, output)
+		}
+	}
+	return nil
+}
+
+// CheckDeviceConfigurationPermissions reports whether a device configuration
+// file is accessible to users other than its owner.
+// On Windows the ACL is not inspected and no problem is reported.
+//
+// Parameters:
+//   - filePath: The path of the configuration file
+//
+// Returns:
+//   - string: A description of the insecure permissions, empty if they are fine
+//   - error: An error if the file cannot be inspected
+func CheckDeviceConfigurationPermissions(filePath string) (string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	if runtime.GOOS == "windows" {
+		return "", nil
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Sprintf("%s has mode %04o and is readable by other users, it should be 0600", filePath, perm), nil
+	}
+	return "", nil
+}
+
+// ReadPrivilegedFile reads a file that may be readable only by root or the
+// service user, e.g. device.yml or a key file, using sudo on Linux and macOS.
+//
+// Parameters:
+//   - path: The file to read
+//
+// Returns:
+//   - []byte: The file content
+//   - error: An error if the file cannot be read
+func ReadPrivilegedFile(path string) ([]byte, error) {
+	if runtime.GOOS == "windows" {
+		return os.ReadFile(path)
+	}
+	var stderr strings.Builder
+	cmd := exec.Command("sudo", "cat", path)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// ArchiveInstallerLog moves an installer log file into dir (e.g.
+// <workDir>/logs/installer), readable only by root or the administrators, and
+// removes the oldest installer logs so that at most keep remain.
+// The logger must be closed before calling this function.
+//
+// Parameters:
+//   - logPath: The installer log file to archive
+//   - dir: The directory that keeps the installer logs
+//   - keep: The number of installer logs to keep
+//
+// Returns:
+//   - string: The path of the archived log file
+//   - error: An error if the log file could not be moved
+func ArchiveInstallerLog(logPath, dir string, keep int) (string, error) {
+	dest := filepath.Join(dir, filepath.Base(logPath))
+
+	var names []string
+	switch runtime.GOOS {
+	case "linux", "darwin":
+		for _, args := range [][]string{
+			{"mkdir", "-p", "-m", "700", dir},
+			{"mv", logPath, dest},
+			{"chmod", "600", dest},
+		} {
+			if output, err := exec.Command("sudo", args...).CombinedOutput(); err != nil {
+				return "", fmt.Errorf("failed to archive installer log: %w\nOutput: %s", err, output)
+			}
+		}
+		output, err := exec.Command("sudo", "ls", "-1", dir).Output()
+		if err != nil {
+			return dest, nil
+		}
+		names = strings.Fields(string(output))
+
+	case "windows":
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+		// The mode does not restrict access on Windows. Like the download
+		// cache, only SYSTEM and the Administrators (well-known SIDs) get
+		// access; the grant the service account gets on the working directory
+		// is not inherited, and removed if an earlier grant copied it here
+		// (the account may be gone after an uninstall).
+		restrict := exec.Command("icacls", dir, "/inheritance:r",
+			"/grant:r", "*S-1-5-18:(OI)(CI)F", "*S-1-5-32-544:(OI)(CI)F")
+		if output, err := restrict.CombinedOutput(); err != nil {
+			return "", fmt.Errorf("failed to restrict permissions of %s: %w\nOutput: %s", dir, err, output)
+		}
+		exec.Command("icacls", dir, "/remove:g", ServiceAccountACLName()).Run()
+		if err := os.Rename(logPath, dest); err != nil {
+			return "", fmt.Errorf("failed to archive installer log: %w", err)
+		}
+		// A moved file keeps the permissions of the temporary directory
+		if output, err := exec.Command("icacls", dest, "/reset").CombinedOutput(); err != nil {
+			return "", fmt.Errorf("failed to restrict permissions of %s: %w\nOutput: %s", dest, err, output)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return dest, nil
+		}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+
+	default:
+		return "", fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+	}
+
+	// Timestamped names sort chronologically
+	var logs []string
+	for _, name := range names {
+		if strings.HasPrefix(name, logger.LogFilePrefix) && strings.HasSuffix(name, ".log") {
+			logs = append(logs, name)
+		}
+	}
+	sort.Strings(logs)
+	for ; keep > 0 && len(logs) > keep; logs = logs[1:] {
+		oldest := filepath.Join(dir, logs[0])
+		if runtime.GOOS == "windows" {
+			os.Remove(oldest)
+		} else {
+			exec.Command("sudo", "rm", "-f", oldest).Run()
+		}
+	}
+	return dest, nil
+}
+
 // HasEnoughDiskSpace checks if the filesystem containing dir has at least requiredBytes available.
 //
 // Parameters:
@@ -1168,7 +1843,7 @@ func nearestExistingPath(path string) (string, error) {
 // It tailors the message based on the installation mode and includes helpful next steps.
 //
 // Parameters:
-//   - installMode: one of "otc", "manual", "install-only", or "none"
+//   - installMode: one of "otc", "manual", "install-only", "provisioning", or "none"
 //   - url: the FlowFuse platform URL to direct the user back to
 //   - workDir: the working directory where device.yml would reside (for manual mode)
 func ShowInstallSummary(installMode, url, workDir string) {
@@ -1181,6 +1856,10 @@ func ShowInstallSummary(installMode, url, workDir string) {
 		logger.Info("You can return to the FlowFuse platform and start creating Node-RED flows on your device:")
 		logger.Info("%s", url)
 		logger.Info("If you encounter any issues, check the service status or refer to the documentation.")
+	case "provisioning":
+		logger.Info("The FlowFuse Device Agent is now running in provisioning mode and will start automatically on system boot.")
+		logger.Info("It registers itself as a new device in the provisioning team on its first connection to the FlowFuse platform.")
+		logger.Info("The device appears in the team's device list once it has registered; check the service logs if it does not.")
 	case "install-only":
 		logger.Info("Installation complete! The FlowFuse Device Agent has been installed but requires configuration.")
 		logger.Info("To finish setup:")
@@ -1203,37 +1882,32 @@ func ShowInstallSummary(installMode, url, workDir string) {
 	logger.Info("")
 }
 
-// InstallCACertificate copies a CA certificate bundle into the working directory
-// and makes it readable by the service user, returning the path to the installed copy.
+// InstallCACertificate validates one or more CA certificate bundles, combines
+// them (optionally with the operating system trust store, see certs.SystemStore)
+// into one bundle in the working directory and makes it readable by the service
+// user, returning the path to the installed bundle.
 //
 // The agent and the installer's npm/OTC steps run as the unprivileged service user
 // (or LocalService on Windows), which generally cannot read a path the admin exported
-// (e.g. under /root or a home directory). Copying the bundle into the working directory
+// (e.g. under /root or a home directory). Writing the bundle into the working directory
 // and chowning it to the service user guarantees the CA is readable at both setup and
 // runtime. The returned path is what NODE_EXTRA_CA_CERTS should be set to.
 //
 // Parameters:
-//   - srcPath: The admin-provided CA bundle path (empty = no-op)
-//   - workDir: The working directory to copy the bundle into
+//   - srcPaths: The admin-provided CA bundle paths (empty and no system store = no-op)
+//   - workDir: The working directory to write the bundle into
 //
 // Returns:
-//   - string: The path to the installed CA bundle copy, or "" if srcPath was empty
-//   - error: An error if the source is missing/unreadable or the copy fails
-func InstallCACertificate(srcPath, workDir string) (string, error) {
-	if srcPath == "" {
+//   - string: The path to the installed CA bundle, or "" if there is nothing to install
+//   - error: An error if a source is missing, unreadable or not a PEM bundle, or the copy fails
+func InstallCACertificate(srcPaths []string, workDir string) (string, error) {
+	if len(srcPaths) == 0 && !certs.SystemStore {
 		return "", nil
 	}
 
-	info, err := os.Stat(srcPath)
+	data, err := certs.Build(srcPaths, certs.SystemStore)
 	if err != nil {
-		return "", fmt.Errorf("CA certificate %q is not accessible: %w", srcPath, err)
-	}
-	if !info.Mode().IsRegular() {
-		return "", fmt.Errorf("CA certificate %q is not a regular file", srcPath)
-	}
-	data, err := os.ReadFile(srcPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to read CA certificate %q: %w", srcPath, err)
+		return "", err
 	}
 
 	destPath := filepath.Join(workDir, "ca-certificates.pem")
@@ -1261,7 +1935,7 @@ func InstallCACertificate(srcPath, workDir string) (string, error) {
 			return "", fmt.Errorf("failed to set CA certificate permissions: %w\nOutput: %s", err, output)
 		}
 	case "windows":
-		// The working directory already grants LocalService Modify (see createDirWithPermissions).
+		// The working directory already grants the service account Modify (see GrantServiceAccess).
 		if err := os.WriteFile(destPath, data, 0644); err != nil {
 			return "", fmt.Errorf("failed to copy CA certificate: %w", err)
 		}
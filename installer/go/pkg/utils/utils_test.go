@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveOneTimeCode(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "otc")
+	if err := os.WriteFile(file, []byte("file-code\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		flag      string
+		file      string
+		stdin     bool
+		env       string
+		want      string
+		conflicts string
+	}{
+		{name: "none"},
+		{name: "flag", flag: " flag-code ", want: "flag-code"},
+		{name: "file", file: file, want: "file-code"},
+		{name: "environment", env: "env-code\n", want: "env-code"},
+		{name: "flag and file", flag: "flag-code", file: file, conflicts: "--otc, --otc-file"},
+		{name: "file and stdin", file: file, stdin: true, conflicts: "--otc-file, --otc-stdin"},
+		{name: "flag and environment", flag: "flag-code", env: "env-code", conflicts: "--otc, FLOWFUSE_OTC"},
+		{name: "stdin and environment", stdin: true, env: "env-code", conflicts: "--otc-stdin, FLOWFUSE_OTC"},
+		{name: "blank environment ignored", flag: "flag-code", env: " ", want: "flag-code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("FLOWFUSE_OTC", tt.env)
+			got, err := ResolveOneTimeCode(tt.flag, tt.file, tt.stdin)
+			if tt.conflicts != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.conflicts) {
+					t.Errorf("ResolveOneTimeCode = %q, %v, want an error naming %s", got, err, tt.conflicts)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("ResolveOneTimeCode = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := ResolveOneTimeCode("", filepath.Join(t.TempDir(), "missing"), false); err == nil {
+		t.Error("ResolveOneTimeCode with a missing file succeeded")
+	}
+}
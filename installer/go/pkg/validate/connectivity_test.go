@@ -0,0 +1,36 @@
+package validate
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestIsConfigurationError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"invalid url", fmt.Errorf("not a valid FlowFuse URL: %w", errInvalidURL), true},
+		{"unknown host", fmt.Errorf("could not resolve: %w", &net.DNSError{Err: "no such host", Name: "flowfuse.invalid", IsNotFound: true}), true},
+		{"dns timeout", fmt.Errorf("could not resolve: %w", &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}), false},
+		{"dns server failure", fmt.Errorf("could not resolve: %w", &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}), false},
+		{"untrusted certificate", fmt.Errorf("not trusted: %w", x509.UnknownAuthorityError{}), true},
+		{"wrong host name", fmt.Errorf("not valid for that name: %w", x509.HostnameError{Host: "example.com"}), true},
+		{"connection refused", fmt.Errorf("refused the connection: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), false},
+		{"server error", errors.New("example.com answered HTTP 502"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsConfigurationError(tt.err); got != tt.want {
+				t.Errorf("IsConfigurationError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+	if _, err := VerifyPlatform("ftp://example.com"); !IsConfigurationError(err) {
+		t.Errorf("VerifyPlatform with an invalid URL returned %v, want a configuration error", err)
+	}
+}
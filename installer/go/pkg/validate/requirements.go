@@ -0,0 +1,450 @@
+package validate
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flowfuse/device-agent-installer/pkg/download"
+	"github.com/flowfuse/device-agent-installer/pkg/logger"
+	"github.com/flowfuse/device-agent-installer/pkg/utils"
+)
+
+// Outcomes of a system requirement check
+const (
+	CheckPass = "pass"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+	CheckSkip = "skip"
+)
+
+// DefaultHeapMB is the Node.js heap limit of the service definitions
+// (--max_old_space_size in NODE_OPTIONS).
+const DefaultHeapMB = 512
+
+// memoryHeadroomMB is the memory the system needs besides the Node.js heap
+// of the Device Agent and Node-RED.
+const memoryHeadroomMB = 256
+
+// Clock skew limits; TLS certificates and one-time codes are time limited
+const (
+	clockSkewWarn = time.Minute
+	clockSkewFail = 5 * time.Minute
+)
+
+// endpointTimeout bounds each reachability check.
+const endpointTimeout = 10 * time.Second
+
+// CheckResult is the outcome of one system requirement check.
+type CheckResult struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	// Hint tells the user how to resolve a warning or failure
+	Hint string `json:"hint,omitempty"`
+}
+
+// result returns a CheckResult with a formatted message.
+func result(name, status, hint, format string, args ...interface{}) CheckResult {
+	return CheckResult{Name: name, Status: status, Message: fmt.Sprintf(format, args...), Hint: hint}
+}
+
+// CheckPrivileges checks, without prompting, that the installer can run the
+// steps that need administrator privileges.
+//
+// Returns:
+//   - CheckResult: The outcome
+func CheckPrivileges() CheckResult {
+	const name = "Privileges"
+	if runtime.GOOS == "windows" {
+		if err := utils.CheckPermissions(); err != nil {
+			return result(name, CheckFail, "Run the installer from an elevated prompt", "%v", err)
+		}
+		return result(name, CheckPass, "", "running as administrator")
+	}
+	if os.Geteuid() == 0 {
+		return result(name, CheckPass, "", "running as root")
+	}
+	if _, err := exec.LookPath("sudo"); err != nil {
+		return result(name, CheckFail, "Install sudo or run the installer as root", "sudo is not installed")
+	}
+	if err := exec.Command("sudo", "-n", "true").Run(); err != nil {
+		return result(name, CheckWarn, "Run unattended installations as root or with passwordless sudo",
+			"sudo asks for a password")
+	}
+	return result(name, CheckPass, "", "sudo is usable without a password")
+}
+
+// CheckDiskSpace wraps CheckFreeDiskSpace with the installer's minimum.
+//
+// Parameters:
+//   - customWorkDir: Optional custom working directory path. If empty, uses default path.
+//
+// Returns:
+//   - CheckResult: The outcome
+func CheckDiskSpace(customWorkDir string) CheckResult {
+	const name = "Disk space"
+	if err := CheckFreeDiskSpace(customWorkDir, MinFreeDiskBytes); err != nil {
+		return result(name, CheckFail, "Free up space or choose another location with --dir", "%v", err)
+	}
+	return result(name, CheckPass, "", "at least %d MB free", MinFreeDiskBytes/(1024*1024))
+}
+
+// CheckPort wraps CheckUnusedPort.
+//
+// Parameters:
+//   - port: The TCP port of the Device Agent
+//
+// Returns:
+//   - CheckResult: The outcome
+func CheckPort(port int) CheckResult {
+	const name = "Port"
+	if err := CheckUnusedPort(port); err != nil {
+		return result(name, CheckFail, "Stop the process using it or choose another port with --port", "%v", err)
+	}
+	return result(name, CheckPass, "", "port %d is free", port)
+}
+
+// CheckExistingInstallation reports an installation in the working
+// directory. Unlike PreInstall it does not prompt; the installation prompts
+// whether to keep or replace it.
+//
+// Parameters:
+//   - customWorkDir: Optional custom working directory path. If empty, uses default path.
+//
+// Returns:
+//   - CheckResult: The outcome
+func CheckExistingInstallation(customWorkDir string) CheckResult {
+	const name = "Existing installation"
+	workDir, err := utils.GetWorkingDirectory(customWorkDir)
+	if err != nil {
+		return result(name, CheckFail, "", "failed to get working directory: %v", err)
+	}
+	for _, file := range []string{"installer.conf", "device.yml"} {
+		if _, err := os.Stat(filepath.Join(workDir, file)); err == nil {
+			return result(name, CheckWarn, "The installation asks whether to keep the configuration; use --update-agent or --update-nodejs to update instead",
+				"%s already contains %s", workDir, file)
+		}
+	}
+	return result(name, CheckPass, "", "none in %s", workDir)
+}
+
+// CheckLibraries wraps CheckLibstdcExists.
+//
+// Returns:
+//   - CheckResult: The outcome
+func CheckLibraries() CheckResult {
+	const name = "System libraries"
+	if runtime.GOOS != "linux" {
+		return result(name, CheckSkip, "", "only checked on Linux")
+	}
+	if err := CheckLibstdcExists(); err != nil {
+		return result(name, CheckFail, "Install libstdc++ with the package manager, e.g. libstdc++6 or libstdc++", "%v", err)
+	}
+	return result(name, CheckPass, "", "libstdc++ found")
+}
+
+// glibcRequirement returns the glibc version the official Linux builds of a
+// Node.js major version need.
+func glibcRequirement(nodeMajor int) (int, int) {
+	if nodeMajor >= 18 {
+		return 2, 28
+	}
+	return 2, 17
+}
+
+// CheckCLibrary checks that the C library of the system can run the Node.js
+// build the installer downloads: the official builds need a minimum glibc
+// version, Alpine uses the unofficial musl builds.
+//
+// Parameters:
+//   - nodeVersion: The Node.js version to install
+//
+// Returns:
+//   - CheckResult: The outcome
+func CheckCLibrary(nodeVersion string) CheckResult {
+	const name = "C library"
+	if runtime.GOOS != "linux" {
+		return result(name, CheckSkip, "", "only checked on Linux")
+	}
+	nodeMajor, _ := strconv.Atoi(strings.SplitN(strings.TrimPrefix(nodeVersion, "v"), ".", 2)[0])
+
+	if utils.IsAlpine() {
+		if runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64" {
+			return result(name, CheckFail, "Use a glibc-based distribution on this architecture",
+				"musl: no unofficial Node.js %s build for %s", nodeVersion, runtime.GOARCH)
+		}
+		return result(name, CheckPass, "", "musl, using the unofficial Node.js %s musl build", nodeVersion)
+	}
+
+	output, err := exec.Command("getconf", "GNU_LIBC_VERSION").Output()
+	if err != nil {
+		return result(name, CheckWarn, "", "could not determine the glibc version: %v", err)
+	}
+	m := regexp.MustCompile(`(\d+)\.(\d+)`).FindStringSubmatch(string(output))
+	if m == nil {
+		return result(name, CheckWarn, "", "could not determine the glibc version from %q", strings.TrimSpace(string(output)))
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	wantMajor, wantMinor := glibcRequirement(nodeMajor)
+	if major < wantMajor || (major == wantMajor && minor < wantMinor) {
+		return result(name, CheckFail, "Choose an older Node.js version with --nodejs-version or upgrade the operating system",
+			"glibc %d.%d, Node.js %s needs %d.%d or newer", major, minor, nodeVersion, wantMajor, wantMinor)
+	}
+	return result(name, CheckPass, "", "glibc %d.%d (Node.js %s needs %d.%d)", major, minor, nodeVersion, wantMajor, wantMinor)
+}
+
+// HeapMB returns the Node.js heap limit set by --max_old_space_size (or
+// --max-old-space-size) in NODE_OPTIONS among environment, or DefaultHeapMB.
+//
+// Parameters:
+//   - environment: The environment variables of the service as KEY=VALUE
+//
+// Returns:
+//   - int: The heap limit in MB
+func HeapMB(environment []string) int {
+	heap := DefaultHeapMB
+	pattern := regexp.MustCompile(`--max[_-]old[_-]space[_-]size=(\d+)`)
+	for _, spec := range environment {
+		if value, ok := strings.CutPrefix(spec, "NODE_OPTIONS="); ok {
+			if m := pattern.FindStringSubmatch(value); m != nil {
+				heap, _ = strconv.Atoi(m[1])
+			}
+		}
+	}
+	return heap
+}
+
+// CheckMemory checks the memory of the system against the Node.js heap limit
+// of the service.
+//
+// Parameters:
+//   - heapMB: The heap limit in MB
+//
+// Returns:
+//   - CheckResult: The outcome
+func CheckMemory(heapMB int) CheckResult {
+	const name = "Memory"
+	total, available, err := memoryBytes()
+	if err != nil {
+		return result(name, CheckSkip, "", "%v", err)
+	}
+	totalMB, availableMB := int(total/(1024*1024)), int(available/(1024*1024))
+	describe := fmt.Sprintf("%d MB total", totalMB)
+	if available > 0 {
+		describe += fmt.Sprintf(", %d MB available", availableMB)
+	}
+	hint := "Add memory, or lower the heap with --env NODE_OPTIONS=--max_old_space_size=<MB>"
+	switch {
+	case totalMB < heapMB:
+		return result(name, CheckFail, hint, "%s, less than the %d MB Node.js heap", describe, heapMB)
+	case totalMB < heapMB+memoryHeadroomMB:
+		return result(name, CheckWarn, hint, "%s, little room besides the %d MB Node.js heap", describe, heapMB)
+	case available > 0 && availableMB < heapMB:
+		return result(name, CheckWarn, "Stop other services, or lower the heap", "%s, less available than the %d MB Node.js heap", describe, heapMB)
+	}
+	return result(name, CheckPass, "", "%s for a %d MB Node.js heap", describe, heapMB)
+}
+
+// meminfoBytes reads MemTotal and MemAvailable from /proc/meminfo.
+func meminfoBytes() (uint64, uint64, error) {
+	file, err := os.Open(utils.SystemPath("/proc/meminfo"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not read the memory size: %w", err)
+	}
+	defer file.Close()
+
+	var total, available uint64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb * 1024
+		case "MemAvailable:":
+			available = kb * 1024
+		}
+	}
+	if total == 0 {
+		return 0, 0, fmt.Errorf("no MemTotal in /proc/meminfo")
+	}
+	return total, available, nil
+}
+
+// EndpointResult is the outcome of CheckEndpoint.
+type EndpointResult struct {
+	CheckResult
+	// Skew is the difference between the local clock and the server's Date
+	// header; zero if the server was not reached or sent no date
+	Skew time.Duration
+	// HasDate is set if the server sent a Date header
+	HasDate bool
+}
+
+// CheckEndpoint checks that a URL can be reached over HTTP(S), with the proxy
+// and CA settings of the downloads. Any HTTP response counts as reachable.
+//
+// Parameters:
+//   - name: The name of the check, e.g. "npm registry"
+//   - url: The URL to request
+//
+// Returns:
+//   - EndpointResult: The outcome and the clock skew against the server
+func CheckEndpoint(name, url string) EndpointResult {
+	if download.Offline {
+		return EndpointResult{CheckResult: result(name, CheckSkip, "", "%s not checked with --offline", url)}
+	}
+	client := download.NewHTTPClient(endpointTimeout)
+	start := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		logger.Debug("Reachability check of %s failed: %v", url, err)
+		return EndpointResult{CheckResult: result(name, CheckFail,
+			"Check DNS, the firewall and the proxy settings (HTTPS_PROXY); behind a TLS-intercepting proxy pass its CA with --ca-cert",
+			"%s is not reachable: %v", url, err)}
+	}
+	resp.Body.Close()
+	elapsed := time.Since(start)
+
+	res := EndpointResult{CheckResult: result(name, CheckPass, "", "%s reachable (HTTP %d, %d ms)", url, resp.StatusCode, elapsed.Milliseconds())}
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		// The server's clock was read about halfway through the request
+		res.Skew = start.Add(elapsed / 2).Sub(date)
+		res.HasDate = true
+	}
+	return res
+}
+
+// CheckClockSkew compares the local clock with the Date header of the
+// servers reached by CheckEndpoint.
+//
+// Parameters:
+//   - endpoints: The outcomes of CheckEndpoint
+//
+// Returns:
+//   - CheckResult: The outcome
+func CheckClockSkew(endpoints []EndpointResult) CheckResult {
+	const name = "Clock"
+	for _, endpoint := range endpoints {
+		if !endpoint.HasDate {
+			continue
+		}
+		skew := endpoint.Skew.Round(time.Second)
+		abs := skew
+		if abs < 0 {
+			abs = -abs
+		}
+		direction := "ahead of"
+		if skew < 0 {
+			direction = "behind"
+		}
+		hint := "Enable time synchronisation (NTP); TLS and one-time codes fail with a wrong clock"
+		switch {
+		case abs >= clockSkewFail:
+			return result(name, CheckFail, hint, "%s %s %s", abs, direction, endpoint.Name)
+		case abs >= clockSkewWarn:
+			return result(name, CheckWarn, hint, "%s %s %s", abs, direction, endpoint.Name)
+		}
+		return result(name, CheckPass, "", "within %s of %s", clockSkewWarn, endpoint.Name)
+	}
+	return result(name, CheckSkip, "", "no server reached to compare with")
+}
+
+// CheckFilesystem checks that the file system of the working directory, or
+// of its nearest existing parent, is mounted writable and allows executing
+// programs, as the bundled Node.js runs from it.
+//
+// Parameters:
+//   - workDir: The working directory
+//
+// Returns:
+//   - []CheckResult: The outcomes of the writable and the noexec checks
+func CheckFilesystem(workDir string) []CheckResult {
+	path, err := nearestExistingDir(workDir)
+	if err != nil {
+		return []CheckResult{
+			result("Writable file system", CheckFail, "", "%v", err),
+			result("Executable file system", CheckSkip, "", "%v", err),
+		}
+	}
+	readOnly, noExec, err := mountFlags(path)
+	if err != nil {
+		return []CheckResult{
+			result("Writable file system", CheckSkip, "", "%v", err),
+			result("Executable file system", CheckSkip, "", "%v", err),
+		}
+	}
+
+	results := make([]CheckResult, 0, 2)
+	if readOnly {
+		results = append(results, result("Writable file system", CheckFail, "Choose a writable location with --dir",
+			"%s is on a read-only file system", path))
+	} else {
+		results = append(results, result("Writable file system", CheckPass, "", "%s is writable", path))
+	}
+	if noExec {
+		results = append(results, result("Executable file system", CheckFail, "Choose another location with --dir, or remount without noexec",
+			"%s is mounted noexec; the bundled Node.js cannot run from it", path))
+	} else {
+		results = append(results, result("Executable file system", CheckPass, "", "%s allows executables", path))
+	}
+	return results
+}
+
+// nearestExistingDir returns path or its nearest existing parent directory.
+func nearestExistingDir(path string) (string, error) {
+	path = filepath.Clean(path)
+	for {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			return path, nil
+		} else if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", fmt.Errorf("no existing parent directory of %s", path)
+		}
+		path = parent
+	}
+}
+
+// CheckSecurityModule reports the SELinux or AppArmor mode. An enforcing
+// SELinux policy can keep the service from running Node.js from the working
+// directory.
+//
+// Returns:
+//   - CheckResult: The outcome
+func CheckSecurityModule() CheckResult {
+	const name = "Security module"
+	if runtime.GOOS != "linux" {
+		return result(name, CheckSkip, "", "only checked on Linux")
+	}
+	if data, err := os.ReadFile(utils.SystemPath("/sys/fs/selinux/enforce")); err == nil {
+		if strings.TrimSpace(string(data)) == "1" {
+			return result(name, CheckWarn,
+				"If the service does not start, check the audit log (ausearch -m avc) and label the working directory, e.g. with semanage fcontext and restorecon",
+				"SELinux is enforcing")
+		}
+		return result(name, CheckPass, "", "SELinux is permissive")
+	}
+	if data, err := os.ReadFile(utils.SystemPath("/sys/module/apparmor/parameters/enabled")); err == nil && strings.TrimSpace(string(data)) == "Y" {
+		return result(name, CheckPass, "", "AppArmor is enabled; the installer's files are not confined by a profile")
+	}
+	return result(name, CheckPass, "", "no SELinux or AppArmor enforcement")
+}
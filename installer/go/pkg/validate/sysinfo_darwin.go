@@ -0,0 +1,34 @@
+//go:build darwin
+
+package validate
+
+import "golang.org/x/sys/unix"
+
+// mountFlags reports whether the file system containing path is mounted
+// read-only or noexec.
+//
+// Parameters:
+//   - path: An existing path on the file system
+//
+// Returns:
+//   - bool: true if the file system is read-only
+//   - bool: true if the file system is mounted noexec
+//   - error: non-nil if the file system could not be queried
+func mountFlags(path string) (bool, bool, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return false, false, err
+	}
+	flags := uint64(st.Flags)
+	return flags&unix.MNT_RDONLY != 0, flags&unix.MNT_NOEXEC != 0, nil
+}
+
+// memoryBytes returns the total memory of the system; macOS does not report
+// the available memory in a comparable way, so it is returned as zero.
+func memoryBytes() (uint64, uint64, error) {
+	total, err := unix.SysctlUint64("hw.memsize")
+	if err != nil {
+		return 0, 0, err
+	}
+	return total, 0, nil
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package validate
+
+import "golang.org/x/sys/unix"
+
+// mountFlags reports whether the file system containing path is mounted
+// read-only or noexec.
+//
+// Parameters:
+//   - path: An existing path on the file system
+//
+// Returns:
+//   - bool: true if the file system is read-only
+//   - bool: true if the file system is mounted noexec
+//   - error: non-nil if the file system could not be queried
+func mountFlags(path string) (bool, bool, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return false, false, err
+	}
+	flags := uint64(st.Flags)
+	return flags&unix.ST_RDONLY != 0, flags&unix.ST_NOEXEC != 0, nil
+}
+
+// memoryBytes returns the total and the available memory of the system.
+func memoryBytes() (uint64, uint64, error) {
+	return meminfoBytes()
+}
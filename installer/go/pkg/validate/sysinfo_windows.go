@@ -0,0 +1,15 @@
+//go:build windows
+
+package validate
+
+import "fmt"
+
+// mountFlags is not implemented on Windows, which has no noexec mounts.
+func mountFlags(path string) (bool, bool, error) {
+	return false, false, fmt.Errorf("not checked on Windows")
+}
+
+// memoryBytes is not implemented on Windows.
+func memoryBytes() (uint64, uint64, error) {
+	return 0, 0, fmt.Errorf("not checked on Windows")
+}
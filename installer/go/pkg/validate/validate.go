@@ -14,7 +14,7 @@ import (
 )
 
 // Minimum free space required for installation
-const minFreeDiskBytes uint64 = 500 * 1024 * 1024 // 500 MB
+const MinFreeDiskBytes uint64 = 500 * 1024 * 1024 // 500 MB
 
 // PreInstall performs validation steps before installation:
 // 1. Checks if the working directory exists and attempts to remove it if it does
@@ -34,13 +34,13 @@ func PreInstall(customWorkDir string, port int) error {
 		return fmt.Errorf("permission check failed: %w", err)
 	}
 
-	if err := checkFreeDiskSpace(customWorkDir, minFreeDiskBytes); err != nil {
+	if err := CheckFreeDiskSpace(customWorkDir, MinFreeDiskBytes); err != nil {
 		logger.Error("Disk space check failed: %v", err)
 		logger.LogFunctionExit("PreInstall", nil, err)
 		return fmt.Errorf("disk space check failed: %w", err)
 	}
 
-	if err := checkUnusedPort(port); err != nil {
+	if err := CheckUnusedPort(port); err != nil {
 		logger.Error("Port check failed: %v", err)
 		logger.LogFunctionExit("PreInstall", nil, err)
 		return fmt.Errorf("port check failed: %w", err)
@@ -51,7 +51,7 @@ func PreInstall(customWorkDir string, port int) error {
 		return fmt.Errorf("configuration file pre-check failed: %w", err)
 	}
 
-	if err := checkLibstdcExists(); err != nil {
+	if err := CheckLibstdcExists(); err != nil {
 		logger.Error("Library check failed: %v", err)
 		logger.LogFunctionExit("PreInstall", nil, err)
 		return fmt.Errorf("library check failed: %w", err)
@@ -106,6 +106,14 @@ func checkConfigFileExists(customWorkDir string) error {
 		perPortService := fmt.Sprintf("flowfuse-device-agent-%d", port)
 		legacyService := "flowfuse-device-agent"
 
+		// Configuration kept by "--uninstall --keep-config" has no service left;
+		// reuse it without asking
+		if cfgErr == nil && cfg.KeptByUninstall && !service.IsInstalled(perPortService) && !service.IsInstalled(legacyService) {
+			logger.Info("Reusing the device configuration kept from a previous installation")
+			logger.LogFunctionExit("checkConfigFileExists", "kept configuration", nil)
+			return nil
+		}
+
 		options := []string{
 			"Keep existing configuration and continue installation",
 			"Remove all content and do fresh installation",
@@ -170,7 +178,7 @@ func checkConfigFileExists(customWorkDir string) error {
 // Returns:
 //   - nil if libstdc++ is found in any of the checked locations
 //   - error if libstdc++ is not found in any location
-func checkLibstdcExists() error {
+func CheckLibstdcExists() error {
 	if runtime.GOOS == "linux" {
 		// Check common library directories with glob patterns
 		globPatterns := []string{
@@ -228,29 +236,29 @@ func ValidateUninstallDirectory(workDir string) error {
 	return nil
 }
 
-// checkUnusedPort validates if specified TCP port is not in use by any process.
+// CheckUnusedPort validates if specified TCP port is not in use by any process.
 //
 // Parameters
 //   - port: The TCP port to validate for availability.
 //
 // Returns:
 //   - error: nil if the port is available, otherwise an error indicating the port is in use
-func checkUnusedPort(port int) error {
-	logger.LogFunctionEntry("checkUnusedPort", map[string]interface{}{
+func CheckUnusedPort(port int) error {
+	logger.LogFunctionEntry("CheckUnusedPort", map[string]interface{}{
 		"port": port,
 	})
 	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
 	if err != nil {
-		logger.LogFunctionExit("checkUnusedPort", "error", err)
+		logger.LogFunctionExit("CheckUnusedPort", "error", err)
 		logger.Debug("Port %d is in use: %v", port, err)
 		return fmt.Errorf("port %d is in use. Please select another port and try again", port)
 	}
 	defer listener.Close()
-	logger.LogFunctionExit("checkUnusedPort", "success", nil)
+	logger.LogFunctionExit("CheckUnusedPort", "success", nil)
 	return nil
 }
 
-// checkFreeDiskSpace validates free disk space for the install directory and OS temp directory.
+// CheckFreeDiskSpace validates free disk space for the install directory and OS temp directory.
 // It requires at least requiredBytes free in each distinct location.
 // /
 // Parameters:
@@ -259,15 +267,15 @@ func checkUnusedPort(port int) error {
 //
 // Returns:
 //   - error: nil if both locations have sufficient free space, otherwise an error indicating insufficient space
-func checkFreeDiskSpace(customWorkDir string, requiredBytes uint64) error {
-	logger.LogFunctionEntry("checkFreeDiskSpace", map[string]interface{}{
+func CheckFreeDiskSpace(customWorkDir string, requiredBytes uint64) error {
+	logger.LogFunctionEntry("CheckFreeDiskSpace", map[string]interface{}{
 		"customWorkDir": customWorkDir,
 		"requiredBytes": requiredBytes,
 	})
 
 	workDir, err := utils.GetWorkingDirectory(customWorkDir)
 	if err != nil {
-		logger.LogFunctionExit("checkFreeDiskSpace", nil, err)
+		logger.LogFunctionExit("CheckFreeDiskSpace", nil, err)
 		return fmt.Errorf("failed to get working directory: %w", err)
 	}
 
@@ -285,7 +293,7 @@ func checkFreeDiskSpace(customWorkDir string, requiredBytes uint64) error {
 	for _, t := range targets {
 		ok, free, err := utils.HasEnoughDiskSpace(t.path, requiredBytes)
 		if err != nil {
-			logger.LogFunctionExit("checkFreeDiskSpace", nil, err)
+			logger.LogFunctionExit("CheckFreeDiskSpace", nil, err)
 			return fmt.Errorf("failed to check disk space for %s (%s): %w", t.label, t.path, err)
 		}
 		if !ok {
@@ -295,11 +303,11 @@ func checkFreeDiskSpace(customWorkDir string, requiredBytes uint64) error {
 			err := fmt.Errorf("insufficient disk space in %s (%s): need at least %.1f MB, available %.1f MB\n" +
 				"For information on how to handle this error, visit: http://flowfuse.com/docs/device-agent/install/device-agent-installer/#error%%3A-disk-space-check-failed",
 				t.label, t.path, requiredMB, freeMB)
-			logger.LogFunctionExit("checkFreeDiskSpace", nil, err)
+			logger.LogFunctionExit("CheckFreeDiskSpace", nil, err)
 			return err
 		}
 	}
 
-	logger.LogFunctionExit("checkFreeDiskSpace", "success", nil)
+	logger.LogFunctionExit("CheckFreeDiskSpace", "success", nil)
 	return nil
 }